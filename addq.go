@@ -0,0 +1,112 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// addQueue is a lock-free multiple producers, single consumer queue for
+// the timers waiting to be added to the wheels (see Config.AddQueue).
+// The timers are linked using their next pointer. The consumer always
+// takes the whole queue content.
+type addQueue struct {
+	head unsafe.Pointer // *TimerLnk, last added timer (atomic access)
+}
+
+// push adds a detached timer to the queue.
+func (q *addQueue) push(tl *TimerLnk) {
+	for {
+		h := atomic.LoadPointer(&q.head)
+		tl.next = (*TimerLnk)(h)
+		if atomic.CompareAndSwapPointer(&q.head, h, unsafe.Pointer(tl)) {
+			return
+		}
+	}
+}
+
+// isEmpty returns true if the queue is empty.
+func (q *addQueue) isEmpty() bool {
+	return atomic.LoadPointer(&q.head) == nil
+}
+
+// popAll empties the queue and returns its content, linked using the
+// next pointer, in the order in which the timers were added.
+// It must not be called in parallel.
+func (q *addQueue) popAll() *TimerLnk {
+	l := (*TimerLnk)(atomic.SwapPointer(&q.head, nil))
+	var r *TimerLnk
+	for l != nil {
+		n := l.next
+		l.next = r
+		r = l
+		l = n
+	}
+	return r
+}
+
+// queueAdd is the Config.AddQueue version of addTimer(): the timer is only
+// queued, without taking wt.lock() or wt.rlock(), and it will be added to
+// the wheels on the next tick (see drainAddQ()).
+func (wt *WTimer) queueAdd(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}, site uintptr,
+	chkGen bool, gen uint32) error {
+	tl.lock.Lock()
+	if chkGen && atomic.LoadUint32(&tl.gen) != gen {
+		tl.lock.Unlock()
+		return ErrStaleHandle
+	}
+	if self, err := wt.rearmSelfUnsafe(tl, d, f, p); self {
+		tl.lock.Unlock()
+		return err
+	}
+	if err := wt.addSanityChecks(tl, d, f); err != nil {
+		tl.lock.Unlock()
+		return err
+	}
+	tl.f = f
+	tl.arg = p
+	tl.intvl = d
+	tl.added = wt.Now()
+	wt.setSite(tl, site)
+	wt.stampAdd(tl)
+
+	// set fActive and clear the rest of the internal flags
+	tl.info.chgFlags(fActive, fInternalMask)
+	tl.info.setWheel(wheelAddQ, wheelNoIdx)
+	wt.addQ.push(tl)
+	// increment after push, so that a non-empty counter with an empty
+	// queue can be checked under wt.lock() (see CheckConsistency())
+	wt.activeInc(tl)
+	tl.lock.Unlock()
+	wt.wakeBefore(wt.Now().Add(wt.TicksRoundUp(d)))
+	return nil
+}
+
+// drainAddQ adds all the queued timers to the wheels, relative to now.
+// The timers deleted while queued are only marked as removed.
+// It must be called with wt.lock() held.
+func (wt *WTimer) drainAddQ(now Ticks) {
+	for t := wt.addQ.popAll(); t != nil; {
+		n := t.next
+		t.next = nil
+		t.info.setWheel(wheelNone, wheelNoIdx)
+		if t.info.flags()&fDelete != 0 {
+			// deleted while queued
+			t.info.setFlags(fRemoved)
+			wt.activeDec(t)
+		} else if wt.addUnsafe(t, now) != nil {
+			t.info.setFlags(fRemoved)
+			wt.activeDec(t)
+		} else {
+			wt.nextExpAdded(t.expire)
+		}
+		t = n
+	}
+}
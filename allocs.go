@@ -0,0 +1,48 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+)
+
+// AllocStats contains the counters of the heap allocations performed by
+// the timer wheel on the paths known to allocate (see the package
+// documentation for the steady state zero allocations guarantee). If the
+// counters do not change while the application runs, it uses only the
+// allocation free paths (they can be checked in tests, together with
+// testing.AllocsPerRun()).
+type AllocStats struct {
+	Timers     uint64 // timers allocated by NewTimer()
+	Goroutines uint64 // FgoR runners and OverloadGoR batches goroutines
+	Deadlines  uint64 // handler runs with a deadline (SetDeadline())
+	Labels     uint64 // handler runs with pprof labels (ProfLabels)
+	Watched    uint64 // handler runs watched for getting stuck
+	Options    uint64 // timers using an optional feature (SetTag() ...)
+}
+
+// AllocStats returns the allocation counters.
+func (wt *WTimer) AllocStats() AllocStats {
+	return AllocStats{
+		Timers:     atomic.LoadUint64(&wt.allocTimers),
+		Goroutines: atomic.LoadUint64(&wt.allocGoR),
+		Deadlines:  atomic.LoadUint64(&wt.allocDeadlines),
+		Labels:     atomic.LoadUint64(&wt.allocLabels),
+		Watched:    atomic.LoadUint64(&wt.allocWatched),
+		Options:    atomic.LoadUint64(&wt.allocExt),
+	}
+}
+
+// resetAllocStats resets the allocation counters.
+func (wt *WTimer) resetAllocStats() {
+	atomic.StoreUint64(&wt.allocTimers, 0)
+	atomic.StoreUint64(&wt.allocGoR, 0)
+	atomic.StoreUint64(&wt.allocDeadlines, 0)
+	atomic.StoreUint64(&wt.allocLabels, 0)
+	atomic.StoreUint64(&wt.allocWatched, 0)
+	atomic.StoreUint64(&wt.allocExt, 0)
+}
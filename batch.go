@@ -0,0 +1,129 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A BatchHandlerF receives all the timers of a run class with batch
+// delivery (RunClassCfg.BatchF) that expired on the same tick, amortizing
+// the per-timer overhead for workloads expiring a lot of timers on each
+// tick (e.g. cache eviction or session garbage collection).
+// The timers are already removed when BatchF is called (the handlers set
+// with Add*() are not run), so they can be re-added or re-initialised.
+// It is called from the class workers goroutines (or from RunTicks() in
+// simulation mode). The tls slice is re-used by the timer wheel after the
+// call, so it must not be kept (copy it if needed).
+// If all the class workers are busy and the class batch queue is full, the
+// batch is handled according to Config.RunQueuePolicy.
+type BatchHandlerF func(wt *WTimer, tls []*TimerLnk)
+
+// flushBatches passes the timers collected by processExpired() for the
+// batch delivery classes to the class workers.
+// It must be called with wt.lock() held, but it will release it while
+// passing the batches.
+func (wt *WTimer) flushBatches() {
+	for i := int(PrioNo); i < len(wt.rClasses); i++ {
+		cls := &wt.rClasses[i]
+		if len(cls.batch) == 0 {
+			continue
+		}
+		b := cls.batch
+		cls.batch = cls.newBatch()
+		wt.unlock()
+		if wt.cfg.Simulation {
+			cls.batchF(wt, b)
+			cls.freeBatch(b)
+		} else {
+			wt.sendBatch(cls, b)
+		}
+		wt.lock()
+	}
+}
+
+// sendBatch passes the batch b to the workers of the class cls. If the
+// class batch queue is full, the batch is handled according to
+// Config.RunQueuePolicy and counted in RunQueueStats (all its timers for
+// OverloadDrop and OverloadGoR).
+// It must be called without wt.lock() held.
+func (wt *WTimer) sendBatch(cls *runClass, b []*TimerLnk) {
+	select {
+	case cls.batchCh <- b:
+		return
+	default:
+	}
+	switch wt.cfg.RunQueuePolicy {
+	case OverloadDrop:
+		atomic.AddUint64(&wt.rQdropped, uint64(len(b)))
+		if f := wt.cfg.DropF; f != nil {
+			for _, t := range b {
+				f(wt, t)
+			}
+		}
+		cls.freeBatch(b)
+	case OverloadGoR:
+		atomic.AddUint64(&wt.rQspilled, uint64(len(b)))
+		atomic.AddUint64(&wt.allocGoR, 1)
+		wt.wg.Add(1)
+		go func() {
+			defer wt.wg.Done()
+			cls.batchF(wt, b)
+			cls.freeBatch(b)
+		}()
+	default:
+		atomic.AddUint64(&wt.rQblocked, 1)
+		select {
+		case cls.batchCh <- b:
+		case <-wt.cancel:
+			// shutting down => dropped (already removed)
+		}
+	}
+}
+
+// newBatch returns a free batch buffer for the class cls, or nil if none
+// is available (it will be allocated on the first append).
+func (cls *runClass) newBatch() []*TimerLnk {
+	select {
+	case b := <-cls.batchFree:
+		return b
+	default:
+		return nil
+	}
+}
+
+// freeBatch returns the batch buffer b, after its timers were delivered,
+// to the class cls free buffers.
+func (cls *runClass) freeBatch(b []*TimerLnk) {
+	for i := range b {
+		b[i] = nil // don't keep the timers alive
+	}
+	select {
+	case cls.batchFree <- b[:0]:
+	default:
+		// enough free buffers
+	}
+}
+
+// batchListen runs the batches of expired timers for the batch delivery
+// class cls (see flushBatches()), counting them in the worker stats ws.
+func (wt *WTimer) batchListen(cls *runClass, ws *workerStats) {
+	for {
+		select {
+		case <-wt.cancel:
+			return
+		case b := <-cls.batchCh:
+			atomic.AddUint64(&ws.wakeups, 1)
+			start := time.Now()
+			cls.batchF(wt, b)
+			atomic.AddUint64(&ws.handled, uint64(len(b)))
+			ws.addBusy(start)
+			cls.freeBatch(b)
+		}
+	}
+}
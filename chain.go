@@ -0,0 +1,61 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// chainLink contains the timer added when a chained timer completes
+// (see Chain()).
+type chainLink struct {
+	tl  *TimerLnk
+	d   time.Duration
+	f   TimerHandlerF
+	arg interface{}
+}
+
+// Chain links the timer next to tl: when tl completes (its handler
+// returns false), next is added with the interval d, the handler f and
+// the parameter arg, like with Add(). It allows multi-stage timeouts
+// without adding the next stage from each handler (e.g. tl -> next ->
+// another timer chained to next). If next is nil, the link is removed.
+// The link is followed only when tl handler returns false: a timer
+// removed with Del*() before expiring or re-armed does not start next.
+// If adding next fails (e.g. next was not initialised or it is already
+// active), a warning is logged.
+// Since a completed timer must be re-initialised before re-use, the
+// chains cannot contain cycles.
+// It has the same usage restrictions as Reset() for tl. A re-initialised
+// timer (InitTimer()) is not chained.
+func (wt *WTimer) Chain(tl, next *TimerLnk, d time.Duration,
+	f TimerHandlerF, arg interface{}) error {
+	if next == tl || (next != nil && f == nil) {
+		return wt.opErr("Chain", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("Chain", tl, err)
+	}
+	if next == nil {
+		if x := tl.ext(); x != nil {
+			x.chain = nil
+		}
+		return nil
+	}
+	wt.extOf(tl).chain = &chainLink{tl: next, d: d, f: f, arg: arg}
+	return nil
+}
+
+// runChain adds the timer chained to a completed timer (see Chain()).
+// ch must be read before running the completed timer handler (the timer
+// cannot be used after its handler returns false).
+func (wt *WTimer) runChain(ch *chainLink) {
+	if err := wt.Add(ch.tl, ch.d, ch.f, ch.arg); err != nil &&
+		wt.warnOn() {
+		wt.warn(ch.tl, "failed to add chained timer %p: %s\n", ch.tl, err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// chanDelivery is the handler parameter of the timers added with
+// AddChan().
+type chanDelivery struct {
+	ch    chan<- interface{}
+	token interface{}
+}
+
+// chanHandler is the handler of the timers added with AddChan(): it sends
+// the timer token (or the timer) on the timer channel.
+func chanHandler(wt *WTimer, tl *TimerLnk,
+	p interface{}) (bool, time.Duration) {
+	cd := p.(*chanDelivery)
+	v := cd.token
+	if v == nil {
+		v = tl
+	}
+	select {
+	case cd.ch <- v:
+	case <-wt.cancel:
+		// shutting down, nobody might read anymore
+	}
+	return false, 0
+}
+
+// AddChan starts a new timer that, instead of running a handler, sends
+// token on ch after the specified time.Duration (or the timer, as a
+// *TimerLnk, if token is nil), allowing reactor-style applications to
+// consume the expired timers in their own loop.
+// The send blocks the goroutine running the timer (depending on the timer
+// flags, see Reset()) until ch is read, so ch should be buffered (it
+// must be buffered in simulation mode). A blocked send is abandoned on
+// Shutdown().
+// The timer is one-shot and it is removed right after the send, so the
+// reader must wait for it (e.g. DelWait()) before re-adding it.
+func (wt *WTimer) AddChan(tl *TimerLnk, d time.Duration,
+	ch chan<- interface{}, token interface{}) error {
+	if ch == nil {
+		return wt.opErr("AddChan", tl, ErrInvalidParameters)
+	}
+	return wt.opErr("AddChan", tl,
+		wt.add(tl, d, chanHandler, &chanDelivery{ch: ch, token: token}))
+}
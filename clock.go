@@ -0,0 +1,86 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/intuitivelabs/timestamp"
+)
+
+// Clock is the time source used by the timer wheel for computing the
+// elapsed ticks (see Config.Clock). It allows using custom monotonic
+// sources (e.g. a PTP disciplined clock) or a fake clock for deterministic
+// tests. Now() is called from the timer goroutine and from the Add*()
+// functions, so it must be safe for concurrent use.
+type Clock interface {
+	Now() timestamp.TS
+}
+
+// sysClock is the default time source: the system clock.
+type sysClock struct{}
+
+// Now returns the current system time.
+func (sysClock) Now() timestamp.TS {
+	return timestamp.Now()
+}
+
+// scaledClock is a time source running at a multiple of the base time
+// source speed, starting from the creation time (see Config.TimeScale).
+type scaledClock struct {
+	base  Clock
+	start timestamp.TS // base time at creation
+	scale float64
+}
+
+// newScaledClock returns a time source running scale times faster then
+// base.
+func newScaledClock(base Clock, scale float64) *scaledClock {
+	return &scaledClock{base: base, start: base.Now(), scale: scale}
+}
+
+// Now returns the current scaled time.
+func (c *scaledClock) Now() timestamp.TS {
+	elapsed := c.base.Now().Sub(c.start)
+	return c.start.Add(time.Duration(float64(elapsed) * c.scale))
+}
+
+// realDuration converts the timer wheel time duration d to the
+// corresponding real time (for sleeping), according to Config.TimeScale.
+func (wt *WTimer) realDuration(d time.Duration) time.Duration {
+	if wt.cfg.TimeScale <= 0 || wt.cfg.TimeScale == 1 {
+		return d
+	}
+	r := time.Duration(float64(d) / wt.cfg.TimeScale)
+	if r <= 0 {
+		r = 1
+	}
+	return r
+}
+
+// timeNow returns the current time, according to the configured time
+// source, minus the time spent paused (see Pause()).
+func (wt *WTimer) timeNow() timestamp.TS {
+	if frozen := timestamp.AtomicLoad(&wt.pausedTS); !frozen.IsZero() {
+		return frozen
+	}
+	now := wt.clock.Now()
+	if off := atomic.LoadInt64(&wt.pauseOff); off != 0 {
+		now = now.Add(-time.Duration(off))
+	}
+	return now
+}
+
+// Time returns the current timer wheel time, according to the configured
+// time source (Config.Clock, Config.TimeScale or the simulation time),
+// minus the time spent paused (see Pause()).
+func (wt *WTimer) Time() time.Time {
+	// not TS.Time(): the 0 time stamp (the simulation start) would be
+	// converted to the zero time.Time
+	return time.Unix(0, int64(wt.timeNow().Duration()))
+}
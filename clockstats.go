@@ -0,0 +1,133 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ClockEvent is a time source anomaly detected by the timer goroutine
+// (see ClockStats and Config.ClockEventF).
+type ClockEvent uint8
+
+const (
+	// ClockBackward: the time went backwards (reported on the first
+	// tick, the ticks are not advanced until the time catches up or the
+	// time reference is re-initialised, see Config.ClockBackResync).
+	ClockBackward ClockEvent = iota
+	// ClockResync: the time reference was re-initialised after the time
+	// went backwards for too many ticks.
+	ClockResync
+	// ClockReanchor: the time reference was moved forward, to avoid the
+	// ticks overflow after a very long run.
+	ClockReanchor
+	// ClockSlow: the ticks fell behind the time source (ticks lost, e.g.
+	// because of a VM pause or a slow timer goroutine).
+	ClockSlow
+	// ClockFast: the ticks got ahead of the time source (e.g. the clock
+	// was slowed down).
+	ClockFast
+)
+
+// String returns the event name.
+func (ev ClockEvent) String() string {
+	switch ev {
+	case ClockBackward:
+		return "backward"
+	case ClockResync:
+		return "resync"
+	case ClockReanchor:
+		return "reanchor"
+	case ClockSlow:
+		return "slow"
+	case ClockFast:
+		return "fast"
+	}
+	return "invalid"
+}
+
+// A ClockEventHandlerF is called for each detected time source anomaly
+// (see Config.ClockEventF). d is the anomaly size: the (negative) time
+// step for ClockBackward and ClockResync, the run time before moving the
+// reference for ClockReanchor and the time by which the ticks are behind
+// or ahead for ClockSlow and ClockFast. It is called from the timer
+// goroutine.
+type ClockEventHandlerF func(wt *WTimer, ev ClockEvent, d time.Duration)
+
+// ClockStats contains the time source anomalies counters.
+type ClockStats struct {
+	Backward  uint64 // ticks with the time going backwards
+	Resyncs   uint64 // time reference re-initialised (ClockResync)
+	Reanchors uint64 // time reference moved forward (ClockReanchor)
+	Slow      uint64 // ticks fell behind the time source (ClockSlow)
+	SlowTicks uint64 // total ticks behind, when found behind
+	Fast      uint64 // ticks got ahead of the time source (ClockFast)
+	FastTicks uint64 // total ticks ahead, when found ahead
+}
+
+// clock drift states (wt.clkState), for counting only the ClockSlow and
+// ClockFast changes
+const (
+	clkInSync uint8 = iota
+	clkSlow
+	clkFast
+)
+
+// ClockStats returns the time source anomalies counters.
+func (wt *WTimer) ClockStats() ClockStats {
+	return ClockStats{
+		Backward:  atomic.LoadUint64(&wt.clkBackward),
+		Resyncs:   atomic.LoadUint64(&wt.clkResyncs),
+		Reanchors: atomic.LoadUint64(&wt.clkReanchors),
+		Slow:      atomic.LoadUint64(&wt.clkSlow),
+		SlowTicks: atomic.LoadUint64(&wt.clkSlowTicks),
+		Fast:      atomic.LoadUint64(&wt.clkFast),
+		FastTicks: atomic.LoadUint64(&wt.clkFastTicks),
+	}
+}
+
+// resetClockStats resets the time source anomalies counters.
+func (wt *WTimer) resetClockStats() {
+	atomic.StoreUint64(&wt.clkBackward, 0)
+	atomic.StoreUint64(&wt.clkResyncs, 0)
+	atomic.StoreUint64(&wt.clkReanchors, 0)
+	atomic.StoreUint64(&wt.clkSlow, 0)
+	atomic.StoreUint64(&wt.clkSlowTicks, 0)
+	atomic.StoreUint64(&wt.clkFast, 0)
+	atomic.StoreUint64(&wt.clkFastTicks, 0)
+	wt.clkState = clkInSync
+}
+
+// clockEvent reports ev to Config.ClockEventF, if set.
+func (wt *WTimer) clockEvent(ev ClockEvent, d time.Duration) {
+	if wt.cfg.ClockEventF != nil {
+		wt.cfg.ClockEventF(wt, ev, d)
+	}
+}
+
+// clockDrift records the ticks drift state: ClockSlow or ClockFast with
+// the drift in ticks or, for clkInSync, the end of the drift. Only the
+// state changes are counted and reported (the drift is found on each
+// tick until corrected).
+// It must be called only from the timer goroutine (ticker()).
+func (wt *WTimer) clockDrift(state uint8, ticks Ticks) {
+	if state == wt.clkState {
+		return
+	}
+	wt.clkState = state
+	switch state {
+	case clkSlow:
+		atomic.AddUint64(&wt.clkSlow, 1)
+		atomic.AddUint64(&wt.clkSlowTicks, ticks.Val())
+		wt.clockEvent(ClockSlow, wt.Duration(ticks))
+	case clkFast:
+		atomic.AddUint64(&wt.clkFast, 1)
+		atomic.AddUint64(&wt.clkFastTicks, ticks.Val())
+		wt.clockEvent(ClockFast, wt.Duration(ticks))
+	}
+}
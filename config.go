@@ -0,0 +1,318 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// Config contains the optional WTimer configuration parameters
+// (see InitCfg()).
+// The zero value corresponds to the default configuration.
+type Config struct {
+	// Lenient enables the "lenient" error mode: internal inconsistencies
+	// (which normally cause a panic()) are logged and returned as errors,
+	// trying to recover where possible.
+	Lenient bool
+	// NoListChecks disables the internal sanity checks done on each
+	// timer list operation (e.g. adding a timer already on a list or
+	// removing it from the wrong list), saving some loads and branches
+	// in the hottest code paths. The inconsistencies caught by these
+	// checks are not reported anymore, so it should be used only in
+	// production, for well tested code (the tests should keep the checks
+	// enabled). See also VerifyIntvl.
+	NoListChecks bool
+	// FaultF, if set, is called for each reported problem (warnings,
+	// internal errors and inconsistencies), see FaultHandlerF.
+	FaultF FaultHandlerF
+	// Log is the logger used by this WTimer instance. If nil the
+	// package generic log (Log) will be used.
+	Log Logger
+	// Name, if set, identifies this WTimer instance in the process-wide
+	// instances registry: a named instance is registered on Start() (see
+	// Instances() and AggregatedStats()).
+	Name string
+	// Clock is the time source used for computing the elapsed ticks
+	// (see Clock). If nil the system clock will be used.
+	Clock Clock
+	// TimeScale, if set, makes the timer wheel time run TimeScale times
+	// faster then the real time (e.g. 100 for running 100s of timers
+	// in 1s), for accelerated simulations and soak tests. All the
+	// timer intervals and the time related config parameters are in
+	// timer wheel (scaled) time. The scaled time starts at Init().
+	// 0 or 1 mean real time.
+	TimeScale float64
+	// Simulation enables the deterministic simulation mode, for
+	// reproducible tests: Start() does not start any goroutine, the
+	// time advances only with RunTicks() and the run queues handlers are
+	// run by RunTicks() too (after each tick, in an order depending only
+	// on SimSeed). The FgoR timers are run like Ffast timers and the
+	// run queues never block (OverloadBlock). Repeated runs with the
+	// same timers operations and seed produce identical fire sequences.
+	// Clock and TimeScale are ignored.
+	Simulation bool
+	// SimSeed is the seed used for choosing the next run queue in
+	// simulation mode.
+	SimSeed int64
+	// FaultState enables capturing a snapshot of the timer state (the timer,
+	// its list neighbours and the wheel statistics) for each internal
+	// error (FaultBug and FaultPanic). The snapshot is passed to the fault
+	// handler (Fault.State) and logged together with the fault message.
+	FaultState bool
+	// Tickless enables the tickless mode: instead of waking up every tick,
+	// the timer goroutine sleeps until the nearest timer expire (see
+	// NextExpire()) and is woken up only if an earlier timer is added.
+	// It reduces the wake ups (and the idle cpu usage) for sparse timers,
+	// at the cost of slightly higher Add*() overhead.
+	Tickless bool
+	// CascadeBudget is the maximum number of timers redistributed
+	// (cascaded) from a higher wheel while holding the internal lock.
+	// After each CascadeBudget timers the lock is released, allowing
+	// waiting Add*() or Del*() to proceed and then the redistribution
+	// continues (still in the same tick, so no timer will be delayed).
+	// It bounds the Add*() or Del*() latency for wheels with a very high
+	// number of timers in the same list. 0 means unlimited (default).
+	CascadeBudget int
+	// RunBudget is the maximum number of expired timers dispatched
+	// (run, for Ffast timers, or queued for running) on each tick. The
+	// remaining expired timers are left for the next tick, before the
+	// timers expiring on that tick. It avoids stalling the timer goroutine
+	// on huge expire bursts, at the cost of delaying some of the timers.
+	// 0 means unlimited (default).
+	RunBudget int
+	// AddQueue enables queuing the timers added with Add() or AddT(): the
+	// timers are added to a lock-free queue, without taking any internal
+	// lock and moved on the wheels by the timer goroutine on the next tick.
+	// It reduces the Add() contention, at the cost of delaying the timers
+	// by up to 1 tick. A queued timer cannot be removed immediately:
+	// Del() will return false and the timer will be removed on the next
+	// tick (like for a running timer). DelWait() drains the queue instead
+	// of waiting for the next tick.
+	AddQueue bool
+	// MaxTimers is the maximum number of pending timers (see Len()). When
+	// it is reached the Add*() functions return ErrQuotaExceeded. The
+	// re-arms of periodic timers are not limited. Note that the limit
+	// might be exceeded by the number of Add*() calls running in parallel.
+	// 0 means unlimited (default).
+	MaxTimers int
+	// RunQueues configures the number of run queues and workers for each
+	// timer priority (see Priority and SetPriority()), indexed by Priority.
+	// A zero value for a priority means the default config, sized
+	// according to GOMAXPROCS at Init() (see ResizeRunQueues()).
+	RunQueues [PrioNo]RunQueueCfg
+	// RunClasses defines named run queues classes, each with its own
+	// queues and workers, isolated from the priorities run queues and
+	// from each other (see SetRunClass()). It allows separating the
+	// timers of different subsystems, so that the slow handlers of one
+	// of them cannot delay the others.
+	RunClasses []RunClassCfg
+	// RunBatch is the maximum number of handlers run consecutively by a
+	// run queue worker from the same run queue. After RunBatch handlers
+	// the worker checks the other queues (higher priorities first) and
+	// only then continues with the rest of the queue, so that a burst
+	// on one queue cannot starve the others. 0 means unlimited (default:
+	// the worker empties the queue before checking the others).
+	RunBatch int
+	// WorkerSpin is the maximum time a run queue worker spins waiting
+	// for new work, after running the queued handlers, before blocking.
+	// While a worker spins, the newly queued handlers are picked up
+	// directly, without waking it up, cutting the handlers start latency
+	// for bursty expirations, at the cost of some CPU. The spin time is
+	// adapted: it decreases while no new work arrives during the spins
+	// and it increases up to WorkerSpin when it does. 0 disables the
+	// spinning (default).
+	WorkerSpin time.Duration
+	// RunQueueMax is the maximum number of handlers waiting in the run
+	// queues (all the classes). When it is reached, the expired timers
+	// that would be queued are handled according to RunQueuePolicy.
+	// 0 means unlimited (default). See also RunQueueStats().
+	RunQueueMax int
+	// RunQueuePolicy is the overload policy used when RunQueueMax is
+	// reached (see OverloadPolicy) or when the batch queue of a batch
+	// delivery class is full (see BatchHandlerF). The default is
+	// OverloadBlock.
+	RunQueuePolicy OverloadPolicy
+	// RunQueueSignalCap is the capacity of the channel used for signaling
+	// new work to the workers of each run class. If 0, a default of 4
+	// signals per worker serving the class is used.
+	RunQueueSignalCap int
+	// RunQueueSignal is the policy used for the new work signals when a
+	// signal channel is full (see SignalPolicy). The default is
+	// SignalDrop. See also RunQueueStats().
+	RunQueueSignal SignalPolicy
+	// RunQueueSignalWait is the maximum time the timer goroutine waits for
+	// room in a full signal channel, for SignalBlock. If 0, a default of
+	// 1 tick is used.
+	RunQueueSignalWait time.Duration
+	// DropF, if set, is called for each timer dropped by the OverloadDrop
+	// policy (batches included) or by LagDropLow. It is called from the
+	// timer goroutine, so it should be fast. The timer is already removed
+	// when DropF is called (it can be re-added).
+	DropF func(wt *WTimer, tl *TimerLnk)
+	// LagTicks is the number of lost ticks (e.g. because of scheduling
+	// delays or a blocked timer goroutine) after which the timer wheel is
+	// considered behind schedule. While catching up, the periodic timers
+	// run only once, instead of once for each missed interval, and the
+	// PrioLow timers can be dropped (LagDropLow). See LagStats().
+	// If 0, a default of 20 ticks is used. It is ignored in tickless mode.
+	LagTicks int
+	// LagDropLow enables dropping the PrioLow timers expired while the
+	// timer wheel is behind schedule (Config.DropF is called for them).
+	LagDropLow bool
+	// CatchUp selects how the timer wheel catches up after falling behind
+	// schedule by more then LagTicks (see CatchUpPolicy). The default is
+	// CatchUpReplay.
+	CatchUp CatchUpPolicy
+	// SuspendThreshold, if non-zero, enables the system suspend detection
+	// (e.g. laptop sleep or VM pause): if more then SuspendThreshold
+	// passed between two ticks, the gap is handled according to
+	// SuspendPolicy (see SuspendStats()). It should be much higher then
+	// the tick duration and then the expected scheduling latencies.
+	// It is ignored in tickless mode.
+	SuspendThreshold time.Duration
+	// SuspendPolicy selects how the timers are handled after a detected
+	// suspend (see SuspendPolicy). The default is SuspendFire.
+	SuspendPolicy SuspendPolicy
+	// SuspendF is called for deciding the policy if SuspendPolicy is
+	// SuspendAsk.
+	SuspendF SuspendHandlerF
+	// ClockStepF, if set, is called for each detected system clock step
+	// (e.g. the clock re-synchronised), so that the application can
+	// adjust its own timers (see ClockStepHandlerF). The backward steps
+	// are always detected, the forward ones only if ClockStepThreshold
+	// is set and not in tickless mode. It is called from the timer
+	// goroutine.
+	ClockStepF ClockStepHandlerF
+	// ClockStepThreshold is the minimum clock step reported to
+	// ClockStepF. For the forward steps the normal tick duration is not
+	// included.
+	ClockStepThreshold time.Duration
+	// ClockBackResync is the number of consecutive ticks with the time
+	// going backwards after which the timer wheel time reference is
+	// re-initialised (until then no tick is advanced). If 0, a default
+	// of 10 is used.
+	ClockBackResync int
+	// ClockEventF, if set, is called for each detected time source
+	// anomaly: time going backwards, time reference re-initialised or
+	// moved and ticks falling behind or getting ahead of the time source
+	// (see ClockEvent and ClockStats()). It allows correlating the timers
+	// misbehaviour with NTP steps or VM pauses. It is called from the
+	// timer goroutine.
+	ClockEventF ClockEventHandlerF
+	// FIFO enables the ordering guarantee for the timers expiring on the
+	// same tick: they are dispatched in the order in which they were
+	// added (or re-armed), or in the order set with SetSeq(). Without it
+	// the order is arbitrary (e.g. changed by the cascading from the
+	// higher wheels). It also forces a single run queue per class (the
+	// RunQueues and RunClasses Queues are ignored), so that the handlers
+	// of the same class are run one at a time, in order. There is no
+	// order between different classes or priorities and the FgoR
+	// handlers are only started in order.
+	// It makes processing the expired timers slower (sorting).
+	FIFO bool
+	// CoarseTick is the resolution of the coarse timers (see
+	// SetResolution()). It should be a multiple of the tick duration.
+	// If 0, a default of 1s is used.
+	CoarseTick time.Duration
+	// PreciseTicks is the maximum interval, in ticks, of the precise
+	// timers (see SetPrecise()) run by runtime timers. The longer
+	// precise timers are handled like the normal ones. If 0, a default
+	// of 4 ticks is used.
+	PreciseTicks int
+	// SingleLeg disables the support for intervals longer then
+	// MaxDuration(): the Add*() functions return ErrTicksTooHigh for
+	// them (see TicksTooHighError), instead of re-adding the timer
+	// internally on expire, until the whole interval elapses.
+	SingleLeg bool
+	// ProfLabels enables running the timer handlers with pprof labels
+	// (see runtime/pprof.Do()), so that the CPU profiles attribute the
+	// time to specific handlers: "wtimer" (Name), "handler" (the handler
+	// name, see RegisterHandler()) and "class" (the run class or
+	// priority name). It makes running the handlers slower.
+	ProfLabels bool
+	// StuckThreshold, if non-zero, enables the stuck handlers watchdog:
+	// the handlers running for more then StuckThreshold are reported
+	// to StuckF (or logged as warnings if StuckF is not set). A stuck
+	// Ffast handler delays all the other timers. The check is done
+	// every StuckThreshold/2 and it makes running the handlers slower.
+	StuckThreshold time.Duration
+	// StuckF, if set, is called for each stuck handler, once per run
+	// (see StuckHandlerF and StuckThreshold).
+	StuckF StuckHandlerF
+	// TrackAddSite enables recording the Add*() caller for each timer,
+	// reported by FindLeaks() and in the errors returned for timers
+	// already active (e.g. added twice, see TimerError.AddSite). It
+	// makes Add*() slower.
+	TrackAddSite bool
+	// LeakScanIntvl, if non-zero, enables the leaked timers scanner: every
+	// LeakScanIntvl a goroutine started by Start() calls FindLeaks() with
+	// LeakAge and LeakIntvlMult and reports each found timer through the
+	// fault handler (as FaultWarn).
+	LeakScanIntvl time.Duration
+	// LeakAge is the age after which an active timer is considered leaked
+	// (see FindLeaks()).
+	LeakAge time.Duration
+	// LeakIntvlMult is the multiple of the timer interval after which
+	// an active timer is considered leaked (see FindLeaks()).
+	LeakIntvlMult uint
+	// VerifyIntvl, if non-zero, enables the background consistency checks
+	// (debugging mode): every VerifyIntvl a goroutine started by Start()
+	// checks the next VerifyLists timer lists (round-robin, see
+	// CheckConsistency()) and reports each problem found through the
+	// fault handler (as FaultBug).
+	VerifyIntvl time.Duration
+	// VerifyLists is the number of lists checked every VerifyIntvl.
+	// If 0, a default of 64 lists is used.
+	VerifyLists int
+	// PortableTicker disables the OS specific tick sources, used by
+	// default for more precise ticks:
+	//   - on Linux a timerfd (see timerfd_create(2)) is used instead of
+	//     time.Ticker: its ticks use absolute CLOCK_MONOTONIC expires,
+	//     so they do not drift, and they have lower jitter.
+	//   - on Windows, for ticks shorter then the default system timer
+	//     resolution (~15.6ms), the 1ms resolution is requested
+	//     (timeBeginPeriod()) while the timer wheel is running. Note that
+	//     it affects the whole system (timer interrupts frequency).
+	// On the other OSes, or if timerfd is not available, a runtime timer
+	// re-armed for the absolute time of each tick is always used.
+	PortableTicker bool
+	// LockOSThread pins the timer goroutine to an OS thread (see
+	// runtime.LockOSThread()), reducing the tick jitter caused by the
+	// scheduler moving it between threads. It does not apply to the
+	// timer wheels driven by a SharedTicker.
+	LockOSThread bool
+	// TickerNice, if non-zero, sets the scheduling priority (nice value)
+	// of the timer goroutine OS thread (it implies LockOSThread), e.g.
+	// -10 for reducing the tick delays under load. It is supported only
+	// on Linux and raising the priority (negative values) requires the
+	// CAP_SYS_NICE capability. On failure a warning is logged and the
+	// default priority is used. The thread is terminated when the timer
+	// goroutine exits (Shutdown()).
+	TickerNice int
+	// CPUAffinity, if set, restricts the timer goroutine OS thread to the
+	// listed CPUs (it implies LockOSThread), e.g. a core dedicated to
+	// the timer wheel, for BusyPoll. It is supported only on Linux. On
+	// failure a warning is logged.
+	CPUAffinity []int
+	// BusyPoll enables the ultra-low latency mode, for deployments with a
+	// dedicated core: instead of sleeping between ticks, the timer
+	// goroutine spins on the monotonic clock, minimising the ticks delay
+	// and jitter, at the cost of using a whole CPU all the time. It
+	// implies LockOSThread and it should be used together with
+	// CPUAffinity. It is ignored in tickless mode and for the timer
+	// wheels driven by the application or by a SharedTicker.
+	BusyPoll bool
+	// Drain selects which pending timers are run on Shutdown() (see
+	// DrainPolicy). By default none (DrainCancel).
+	Drain DrainPolicy
+	// Saturation configures the saturation alerts: callbacks called when
+	// the run queues depth, the expired timers backlog or the late
+	// handlers rate cross a threshold and when they recover (see
+	// SaturationCfg), allowing automated mitigation (e.g. shedding low
+	// priority work).
+	Saturation SaturationCfg
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Inconsistency describes a problem found by CheckConsistency().
+type Inconsistency struct {
+	T     *TimerLnk // timer, nil for list head problems
+	Wheel uint8     // wheel number of the list containing the problem
+	Idx   uint16    // list index inside the wheel
+	Msg   string    // problem description
+}
+
+// String returns a short description of the problem.
+func (i *Inconsistency) String() string {
+	if i.T != nil {
+		return fmt.Sprintf("list %d/%d: timer %p: %s",
+			i.Wheel, i.Idx, i.T, i.Msg)
+	}
+	return fmt.Sprintf("list %d/%d: %s", i.Wheel, i.Idx, i.Msg)
+}
+
+// ConsistencyReport is the result of CheckConsistency().
+type ConsistencyReport struct {
+	Now      Ticks           // wt time when the check was performed
+	Lists    int             // number of checked lists
+	Timers   int             // number of checked timers
+	Deleted  int             // timers marked by DelLazy(), not yet removed
+	Problems []Inconsistency // found problems, empty if everything is ok
+}
+
+// OK returns true if no problems were found.
+func (r *ConsistencyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a human readable version of the report.
+func (r *ConsistencyReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "now %s: %d lists, %d timers checked, %d problems\n",
+		r.Now, r.Lists, r.Timers, len(r.Problems))
+	for i := range r.Problems {
+		sb.WriteString(r.Problems[i].String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// add records a new problem for timer tl (can be nil) on lst.
+func (r *ConsistencyReport) add(lst *timerLst, tl *TimerLnk,
+	f string, a ...interface{}) {
+	r.Problems = append(r.Problems, Inconsistency{
+		T:     tl,
+		Wheel: lst.wheelNo,
+		Idx:   lst.wheelIdx,
+		Msg:   fmt.Sprintf(f, a...),
+	})
+}
+
+// wheelPos returns the index in wheel w corresponding to t.
+func wheelPos(w uint8, t uint64) uint16 {
+	switch w {
+	case 0:
+		return uint16(wheel0Pos(t))
+	case 1:
+		return uint16(wheel1Pos(t))
+	case 2:
+		return uint16(wheel2Pos(t))
+	}
+	return uint16(wheel3Pos(t))
+}
+
+// wheelSpan returns the maximum expire delta (in ticks) for the timers
+// on wheel w.
+func wheelSpan(w uint8) uint64 {
+	switch w {
+	case 0:
+		return W0Entries
+	case 1:
+		return W0Entries * W1Entries
+	case 2:
+		return W0Entries * W1Entries * W2Entries
+	}
+	return maxLegTicks + 2
+}
+
+// CheckConsistency verifies the internal timer structures: it walks all the
+// wheels, the expired list and the run queues and checks the lists
+// integrity, the timers flags and wheel position, that each timer
+// expire corresponds to the list it is on and the pending timers
+// counter (see Len()).
+// It returns a report with all the problems found.
+// It holds the internal locks for the whole check, so it might delay the
+// timers (use it only for debugging).
+func (wt *WTimer) CheckConsistency() *ConsistencyReport {
+	r := &ConsistencyReport{}
+	wt.lock()
+	r.Now = wt.Now()
+	for w := range wt.wheels {
+		for i := range wt.wheels[w].lsts {
+			wt.checkLst(r, &wt.wheels[w].lsts[i], r.Now)
+		}
+	}
+	wt.checkLst(r, &wt.expired, r.Now)
+	if wt.carry.wheelNo != wheelNone {
+		// chunked redistribution in progress
+		wt.checkLst(r, &wt.carry, r.Now)
+	}
+	for i := range wt.rQs {
+		wt.rQs[i].lock.Lock()
+		wt.checkLst(r, &wt.rQs[i].lst, r.Now)
+		wt.rQs[i].lock.Unlock()
+	}
+	// the queued timers (Config.AddQueue) are counted only after being
+	// queued, so the counter can be checked only if the queue is empty
+	n := wt.Len()
+	if found := r.Timers - r.Deleted; n != found && wt.addQ.isEmpty() {
+		r.Problems = append(r.Problems, Inconsistency{
+			Wheel: wheelNone,
+			Idx:   wheelNoIdx,
+			Msg: fmt.Sprintf("pending timers counter %d != %d timers found",
+				n, found),
+		})
+	}
+	wt.unlock()
+	return r
+}
+
+// checkLst checks lst and all its timers, adding the problems found to r.
+// It must be called with the locks protecting lst held.
+// On a broken link it stops checking the rest of the list.
+func (wt *WTimer) checkLst(r *ConsistencyReport, lst *timerLst, now Ticks) {
+	r.Lists++
+	h := &lst.head
+	if h.next == nil || h.prev == nil {
+		r.add(lst, nil, "list head not initialised (n: %p p: %p)",
+			h.next, h.prev)
+		return
+	}
+	if f, w, idx := h.info.getAll(); f&fHead == 0 ||
+		w != lst.wheelNo || idx != lst.wheelIdx {
+		r.add(lst, nil, "invalid list head flags 0x%02x wheel %d/%d",
+			f, w, idx)
+	}
+	prev := h
+	for v := h.next; v != h; prev, v = v, v.next {
+		if v == nil {
+			r.add(lst, prev, "nil next link")
+			return
+		}
+		if v.prev != prev {
+			r.add(lst, v, "broken prev link: %p instead of %p", v.prev, prev)
+			return
+		}
+		r.Timers++
+		wt.checkTimer(r, lst, v, now)
+	}
+	if h.prev != prev {
+		r.add(lst, nil, "broken list head prev link: %p instead of %p",
+			h.prev, prev)
+	}
+}
+
+// checkTimer checks a timer on lst (flags, wheel position and expire).
+func (wt *WTimer) checkTimer(r *ConsistencyReport, lst *timerLst,
+	tl *TimerLnk, now Ticks) {
+	f, w, idx := tl.info.getAll()
+	if w != lst.wheelNo || idx != lst.wheelIdx {
+		r.add(lst, tl, "wheel position %d/%d does not match the list", w, idx)
+	}
+	if f&(fActive|fHead|fRunning|fRemoved) != fActive ||
+		(f&fDelete != 0 && lst.wheelNo == wheelRQ) {
+		r.add(lst, tl, "invalid flags 0x%02x", f)
+	} else if f&fDelete != 0 {
+		// marked by DelLazy(), waiting to be removed
+		r.Deleted++
+	}
+	switch {
+	case lst.wheelNo < WheelsNo:
+		if pos := wheelPos(lst.wheelNo, tl.expire.Val()); pos != lst.wheelIdx {
+			r.add(lst, tl, "expire %s belongs to idx %d", tl.expire, pos)
+		}
+		if tl.expire.LT(now) {
+			r.add(lst, tl, "expire %s in the past (now %s)", tl.expire, now)
+		} else if d := tl.expire.Sub(now).Val(); d >= wheelSpan(lst.wheelNo) {
+			r.add(lst, tl, "expire %s too high for the wheel (now %s)",
+				tl.expire, now)
+		}
+	case lst.wheelNo == wheelExp:
+		if tl.expire.GT(now) {
+			r.add(lst, tl, "not expired: expire %s now %s", tl.expire, now)
+		}
+	}
+}
+
+const defaultVerifyLists = 64 // lists checked each Config.VerifyIntvl
+
+// totalLists returns the total number of timer lists: wheels, expired &
+// run queues.
+func (wt *WTimer) totalLists() int {
+	return wTotalEntries + 1 + len(wt.rQs)
+}
+
+// verifyLists checks n timer lists, starting with the one at position pos
+// (all the lists are numbered in the order: wheels, expired, run queues)
+// and reports the problems found.
+// It returns the position of the next list that should be checked.
+func (wt *WTimer) verifyLists(pos, n int) int {
+	for i := 0; i < n; i++ {
+		var r ConsistencyReport
+		wt.lock()
+		now := wt.Now()
+		switch {
+		case pos < wTotalEntries:
+			wt.checkLst(&r, &wt.wlists[pos], now)
+		case pos == wTotalEntries:
+			wt.checkLst(&r, &wt.expired, now)
+		default:
+			q := pos - wTotalEntries - 1
+			wt.rQs[q].lock.Lock()
+			wt.checkLst(&r, &wt.rQs[q].lst, now)
+			wt.rQs[q].lock.Unlock()
+		}
+		wt.unlock()
+		for j := range r.Problems {
+			p := &r.Problems[j]
+			wt.report(FaultBug, 1, nil, p.T, "consistency check: %s\n", p)
+		}
+		pos = (pos + 1) % wt.totalLists()
+	}
+	return pos
+}
+
+// verifyLoop periodically checks the timer lists, in the background,
+// until Shutdown() is called (see Config.VerifyIntvl).
+func (wt *WTimer) verifyLoop() {
+	n := wt.cfg.VerifyLists
+	if n <= 0 {
+		n = defaultVerifyLists
+	}
+	pos := 0
+	ticker := time.NewTicker(wt.cfg.VerifyIntvl)
+loop:
+	for {
+		select {
+		case <-wt.cancel:
+			break loop
+		case <-ticker.C:
+			pos = wt.verifyLists(pos, n)
+		}
+	}
+	ticker.Stop()
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DeadlineStats contains the handlers execution deadline counters
+// (see SetDeadline()).
+type DeadlineStats struct {
+	Overruns uint64        // handler runs that exceeded their deadline
+	Overrun  time.Duration // total time spent running past the deadlines
+}
+
+// DeadlineStats returns the handlers execution deadline counters.
+func (wt *WTimer) DeadlineStats() DeadlineStats {
+	return DeadlineStats{
+		Overruns: atomic.LoadUint64(&wt.overruns),
+		Overrun:  time.Duration(atomic.LoadInt64(&wt.overrunT)),
+	}
+}
+
+// resetDeadlineStats resets the handlers execution deadline counters.
+func (wt *WTimer) resetDeadlineStats() {
+	atomic.StoreUint64(&wt.overruns, 0)
+	atomic.StoreInt64(&wt.overrunT, 0)
+}
+
+// SetDeadline sets the maximum execution duration for the timer handler
+// (0 disables it). The handler can get a context cancelled when the
+// deadline passes with HandlerContext() and each run exceeding it is
+// counted in DeadlineStats(). The handler is not interrupted: it is up
+// to it to check the context and abort.
+// It has the same usage restrictions as Reset() (the new deadline is used
+// starting with the next run). A re-initialised timer (InitTimer()) has
+// no deadline.
+func (wt *WTimer) SetDeadline(tl *TimerLnk, d time.Duration) error {
+	if d < 0 {
+		return wt.opErr("SetDeadline", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetDeadline", tl, err)
+	}
+	wt.extOf(tl).dline = d
+	return nil
+}
+
+// setHandlerCtx sets the context returned by HandlerContext() for the
+// next run of t handler (nil for the default one).
+func (wt *WTimer) setHandlerCtx(t *TimerLnk, ctx context.Context) {
+	if ctx != nil {
+		wt.extOf(t).hctx = ctx
+	} else if x := t.ext(); x != nil {
+		x.hctx = nil
+	}
+}
+
+// HandlerContext returns the context for the running handler of tl. It is
+// cancelled when the timer wheel is stopped (see Context()) or when the
+// handler deadline passes (see SetDeadline()) and, if Config.ProfLabels
+// is set, it carries the handler pprof labels.
+// It must be called only from the timer own handler.
+func (wt *WTimer) HandlerContext(tl *TimerLnk) context.Context {
+	ctx := tl.extView().hctx
+	if ctx == nil {
+		return wt.Context()
+	}
+	return ctx
+}
+
+// deadlineEnd records a possible deadline overrun for a handler with the
+// deadline dline, started at start, and releases its context.
+// It must not access the timer (it might have been freed by its handler).
+func (wt *WTimer) deadlineEnd(start time.Time, dline time.Duration,
+	cancel context.CancelFunc) {
+	cancel()
+	if over := time.Since(start) - dline; over > 0 {
+		atomic.AddUint64(&wt.overruns, 1)
+		atomic.AddInt64(&wt.overrunT, int64(over))
+	}
+}
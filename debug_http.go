@@ -0,0 +1,94 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const httpDefaultLimit = 100 // default number of pending timers shown
+
+// DebugHandler returns an http.Handler that renders the current timer
+// wheel state as text: statistics, wheel lists occupancy and the pending
+// timers, sorted by expire (similar to Dump()).
+// It can be registered like the net/http/pprof handlers, e.g.:
+//
+//	http.Handle("/debug/wtimer", wt.DebugHandler())
+//
+// Supported query parameters:
+//
+//	lists=0       - don't show the wheel lists occupancy
+//	wheel=N       - show only the pending timers on wheel N
+//	min=D, max=D  - show only the timers expiring in more then min
+//	                and less then max (time.Duration format, e.g. 1s)
+//	limit=N       - maximum number of pending timers shown (default 100)
+//
+// Like Dump(), each request walks all the active timers under lock, so
+// it should be used only for debugging.
+func (wt *WTimer) DebugHandler() http.Handler {
+	return http.HandlerFunc(wt.serveDebug)
+}
+
+// serveDebug implements the DebugHandler() http handler.
+func (wt *WTimer) serveDebug(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lists := q.Get("lists") != "0"
+	wheel := -1
+	var minD, maxD time.Duration
+	limit := httpDefaultLimit
+	var err error
+	if s := q.Get("wheel"); s != "" {
+		if wheel, err = strconv.Atoi(s); err != nil ||
+			wheel < 0 || wheel >= WheelsNo {
+			http.Error(w, "invalid wheel: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("min"); s != "" {
+		if minD, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid min: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("max"); s != "" {
+		if maxD, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid max: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, "invalid limit: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	d := dumpInfo{nearestMax: limit}
+	d.filter = func(tl *TimerLnk, delta Ticks) bool {
+		if wheel >= 0 {
+			if w, _ := tl.info.wheelPos(); int(w) != wheel {
+				return false
+			}
+		}
+		in := wt.Duration(delta)
+		return in >= minD && (maxD == 0 || in < maxD)
+	}
+	wt.snapshot(&d)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	wt.writeDump(bw, &d, lists)
+	fmt.Fprintf(bw, "pending timers (first %d):\n", limit)
+	for i := range d.nearest {
+		wt.dumpTimer(bw, d.now, &d.nearest[i])
+	}
+	bw.Flush()
+}
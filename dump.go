@@ -0,0 +1,246 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dumpNearestNo = 10  // number of nearest expirations in a dump
+	dumpExpiredNo = 100 // maximum number of expired timers in a dump
+	dumpSitesNo   = 10  // number of add sites in a dump
+)
+
+// dumpTimer contains information about a timer, used by Dump().
+type dumpTimer struct {
+	t      *TimerLnk
+	flags  uint8
+	wheel  uint8
+	idx    uint16
+	expire Ticks
+	intvl  time.Duration
+	f      TimerHandlerF
+	name   string
+	site   uintptr // Add*() caller, if Config.TrackAddSite
+}
+
+// dumpBucket contains the number of timers in a wheel list.
+type dumpBucket struct {
+	idx uint16
+	n   int
+}
+
+// dumpInfo is a snapshot of the timer wheel contents, used by Dump().
+type dumpInfo struct {
+	now         Ticks
+	wheelTimers [WheelsNo]int
+	buckets     [WheelsNo][]dumpBucket // non-empty lists
+	expiredNo   int
+	expired     []dumpTimer // first dumpExpiredNo expired timers
+	rQsNo       []int
+	rQhead      []uint32 // for each run class
+	rQtail      []uint32
+	running     *TimerLnk // fast timer handler running
+	rQrunning   []*TimerLnk
+	nearest     []dumpTimer // sorted by expire
+	// number of timers for each add site (only if Config.TrackAddSite)
+	sites map[uintptr]int
+
+	nearestMax int // maximum number of nearest timers collected
+	// filter for the nearest timers (if non nil only the timers for
+	// which it returns true are collected)
+	filter func(tl *TimerLnk, delta Ticks) bool
+}
+
+// newDumpTimer returns the dump information for tl.
+// It must be called with the lock protecting tl held.
+func newDumpTimer(tl *TimerLnk) dumpTimer {
+	f, w, idx := tl.info.getAll()
+	x := tl.extView()
+	return dumpTimer{t: tl, flags: f, wheel: w, idx: idx,
+		expire: tl.expire, intvl: tl.intvl, f: tl.f, name: x.name,
+		site: x.site}
+}
+
+// addNearest adds tl to the sorted list of the nearest expiring timers,
+// if it passes the filter and it expires before the ones already in it.
+func (d *dumpInfo) addNearest(tl *TimerLnk) {
+	delta := tl.expire.Sub(d.now)
+	if d.filter != nil && !d.filter(tl, delta) {
+		return
+	}
+	dv := delta.Val()
+	n := len(d.nearest)
+	if n == d.nearestMax && dv >= d.nearest[n-1].expire.Sub(d.now).Val() {
+		return
+	}
+	if n < d.nearestMax {
+		d.nearest = append(d.nearest, dumpTimer{})
+	} else {
+		n--
+	}
+	// insertion sort, n is the position of the last free element
+	for ; n > 0 && d.nearest[n-1].expire.Sub(d.now).Val() > dv; n-- {
+		d.nearest[n] = d.nearest[n-1]
+	}
+	d.nearest[n] = newDumpTimer(tl)
+}
+
+// snapshot fills d with the current wheel contents.
+// d.nearestMax and d.filter must be set before calling it.
+func (wt *WTimer) snapshot(d *dumpInfo) {
+	wt.lock()
+	d.now = wt.Now()
+	for w := range wt.wheels {
+		for i := range wt.wheels[w].lsts {
+			lst := &wt.wheels[w].lsts[i]
+			n := 0
+			lst.forEach(func(e *TimerLnk) bool {
+				n++
+				d.addNearest(e)
+				if d.sites != nil {
+					if site := e.extView().site; site != 0 {
+						d.sites[site]++
+					}
+				}
+				return true
+			})
+			if n != 0 {
+				d.buckets[w] = append(d.buckets[w],
+					dumpBucket{idx: uint16(i), n: n})
+				d.wheelTimers[w] += n
+			}
+		}
+	}
+	wt.expired.forEach(func(e *TimerLnk) bool {
+		if d.expiredNo < dumpExpiredNo {
+			d.expired = append(d.expired, newDumpTimer(e))
+		}
+		d.expiredNo++
+		return true
+	})
+	d.running = wt.running
+	d.rQsNo = make([]int, len(wt.rQs))
+	d.rQrunning = make([]*TimerLnk, len(wt.rQs))
+	for i := range wt.rQs {
+		wt.rQs[i].lock.Lock()
+		wt.rQs[i].lst.forEach(func(e *TimerLnk) bool {
+			d.rQsNo[i]++
+			return true
+		})
+		d.rQrunning[i] = wt.rQs[i].running
+		wt.rQs[i].lock.Unlock()
+	}
+	wt.unlock()
+	d.rQhead = make([]uint32, len(wt.rClasses))
+	d.rQtail = make([]uint32, len(wt.rClasses))
+	for c := range wt.rClasses {
+		d.rQhead[c] = atomic.LoadUint32(&wt.rClasses[c].rQhead)
+		d.rQtail[c] = atomic.LoadUint32(&wt.rClasses[c].rQtail)
+	}
+}
+
+// Dump writes a description of the timer wheel contents to w: the number
+// of timers in each non-empty wheel list, the expired list, the run queues,
+// the currently running timer handlers and the nearest expiring timers.
+// The wheel contents are copied under lock and written afterwards, so a
+// slow w will not delay the timers. Note however that the copy walks all
+// the active timers (use it only for debugging).
+// The running handlers are only those executed in the timer context (Ffast)
+// or by the run queues workers (FgoR timers are not tracked).
+// If Config.TrackAddSite is set, the Add*() caller is included for each
+// timer, together with the callers that added most of the timers.
+func (wt *WTimer) Dump(w io.Writer) error {
+	d := dumpInfo{nearestMax: dumpNearestNo}
+	if wt.cfg.TrackAddSite {
+		d.sites = make(map[uintptr]int)
+	}
+	wt.snapshot(&d)
+
+	bw := bufio.NewWriter(w)
+	wt.writeDump(bw, &d, true)
+	fmt.Fprintf(bw, "nearest expirations:\n")
+	for i := range d.nearest {
+		wt.dumpTimer(bw, d.now, &d.nearest[i])
+	}
+	if d.sites != nil {
+		fmt.Fprintf(bw, "add sites (%d):\n", len(d.sites))
+		for _, s := range siteCounts(d.sites, dumpSitesNo) {
+			fmt.Fprintf(bw, "    %d: %s\n", s.Timers, s.Site)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeDump writes the wheel contents from d to w, without the nearest
+// expirations. If buckets is false, the non-empty lists are not written.
+func (wt *WTimer) writeDump(bw io.Writer, d *dumpInfo, buckets bool) {
+	fmt.Fprintf(bw, "wtimer dump: now %s ticks, tick %s\n",
+		d.now, wt.tickDuration)
+	for i := range d.buckets {
+		fmt.Fprintf(bw, "wheel %d: %d timers in %d lists\n",
+			i, d.wheelTimers[i], len(d.buckets[i]))
+		if !buckets {
+			continue
+		}
+		for _, b := range d.buckets[i] {
+			fmt.Fprintf(bw, "    %5d: %d\n", b.idx, b.n)
+		}
+	}
+	fmt.Fprintf(bw, "expired: %d timers\n", d.expiredNo)
+	for i := range d.expired {
+		wt.dumpTimer(bw, d.now, &d.expired[i])
+	}
+	if d.expiredNo > len(d.expired) {
+		fmt.Fprintf(bw, "    ... (%d more)\n", d.expiredNo-len(d.expired))
+	}
+	for c := 0; c < len(wt.rClasses) && c < len(d.rQhead); c++ {
+		cls := &wt.rClasses[c]
+		fmt.Fprintf(bw, "run queues %s: head %d tail %d\n",
+			cls.name, d.rQhead[c], d.rQtail[c])
+		for i := cls.first; i < cls.first+cls.n && i < len(d.rQsNo); i++ {
+			fmt.Fprintf(bw, "    %d: %d timers\n", i, d.rQsNo[i])
+		}
+	}
+	fmt.Fprintf(bw, "running:\n")
+	if d.running != nil {
+		fmt.Fprintf(bw, "    fast: %p flags 0x%02x\n",
+			d.running, d.running.info.flags())
+	}
+	for i, r := range d.rQrunning {
+		if r != nil {
+			fmt.Fprintf(bw, "    runq %d: %p flags 0x%02x\n",
+				i, r, r.info.flags())
+		}
+	}
+}
+
+// dumpTimer writes the information about timer t to w.
+func (wt *WTimer) dumpTimer(w io.Writer, now Ticks, t *dumpTimer) {
+	var in time.Duration
+	if t.expire.GT(now) {
+		in = wt.Duration(t.expire.Sub(now))
+	} else {
+		in = -wt.Duration(now.Sub(t.expire))
+	}
+	fmt.Fprintf(w, "    %p: expire %s (in %s) intvl %s wheel %d/%d"+
+		" flags 0x%02x handler %s",
+		t.t, t.expire, in, t.intvl, t.wheel, t.idx, t.flags,
+		handlerStr(t.f))
+	if t.name != "" {
+		fmt.Fprintf(w, " name %q", t.name)
+	}
+	if t.site != 0 {
+		fmt.Fprintf(w, " added from %s", siteStr(t.site))
+	}
+	fmt.Fprintln(w)
+}
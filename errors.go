@@ -8,6 +8,8 @@ package wtimer
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var ErrInactiveTimer = errors.New("called on inactive timer")
@@ -19,4 +21,85 @@ var ErrAlreadyRemovedTimer = errors.New("called on already removed timer")
 var ErrInvalidTimer = errors.New("called on invalid timer handler")
 var ErrTicksTooHigh = errors.New("ticks delta too high")
 var ErrDurationTooSmall = errors.New("duration smaller then tick")
+var ErrNotTickMultiple = errors.New("duration not a multiple of the tick")
 var ErrInvalidParameters = errors.New("invalid parameters")
+var ErrSelfWait = errors.New("wait called from the timer own handler")
+var ErrStaleHandle = errors.New("called with stale timer generation")
+var ErrQuotaExceeded = errors.New("active timers quota exceeded")
+var ErrRateExceeded = errors.New("timers add rate exceeded")
+var ErrHandlerExists = errors.New("handler name already registered")
+var ErrUnknownHandler = errors.New("unknown handler name")
+var ErrAlreadyStarted = errors.New("timer wheel already started")
+
+// TicksTooHighError is the error returned when an interval does not fit
+// on the timer wheels and Config.SingleLeg is set (see MaxDuration()).
+// It matches ErrTicksTooHigh (errors.Is()).
+type TicksTooHighError struct {
+	Requested time.Duration // requested interval (rounded to ticks)
+	Max       time.Duration // maximum interval (MaxDuration())
+}
+
+// Error returns the error message, including the requested and maximum
+// intervals.
+func (e *TicksTooHighError) Error() string {
+	return fmt.Sprintf("%s: %s > max %s", ErrTicksTooHigh, e.Requested, e.Max)
+}
+
+// Is returns true for ErrTicksTooHigh.
+func (e *TicksTooHighError) Is(target error) bool {
+	return target == ErrTicksTooHigh
+}
+
+// TimerError is the error type returned by the public timer operations.
+// It wraps one of the above Err* errors (use errors.Is() to check for them)
+// and contains a snapshot of the timer state at the time the error was
+// returned.
+type TimerError struct {
+	Op     string    // failed operation (e.g. "Add", "Del")
+	Err    error     // underlying error
+	T      *TimerLnk // timer
+	Flags  uint8     // timer flags
+	Wheel  uint8     // timer wheel number
+	Idx    uint16    // timer index inside the wheel
+	Expire Ticks     // timer expire value
+	// AddSite is the caller of the Add*() that armed the timer, for
+	// ErrActiveTimer (e.g. a timer added twice). It is set only if
+	// Config.TrackAddSite is enabled.
+	AddSite string
+}
+
+// Error returns the error message, including the timer state.
+func (e *TimerError) Error() string {
+	s := fmt.Sprintf("%s: %s (timer %p flags 0x%02x wheel %d/%d expire %s)",
+		e.Op, e.Err, e.T, e.Flags, e.Wheel, e.Idx, e.Expire)
+	if e.AddSite != "" {
+		s += " added from " + e.AddSite
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *TimerError) Unwrap() error {
+	return e.Err
+}
+
+// opErr returns err wrapped in a TimerError for operation op on timer tl.
+// If err is nil it returns nil.
+func (wt *WTimer) opErr(op string, tl *TimerLnk, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &TimerError{Op: op, Err: err, T: tl}
+	if tl != nil {
+		var site uintptr
+		wt.lockTimer(tl)
+		e.Flags, e.Wheel, e.Idx = tl.info.getAll()
+		e.Expire = tl.expire
+		if err == ErrActiveTimer {
+			site = tl.extView().site
+		}
+		wt.unlockTimer(tl)
+		e.AddSite = siteStr(site) // resolved without holding the locks
+	}
+	return e
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+)
+
+// timerRef is a reference to a timer "incarnation" (see TimerLnk.Gen()).
+type timerRef struct {
+	tl  *TimerLnk
+	gen uint32
+}
+
+// SetParent makes tl a child of parent: when parent is removed with Del*()
+// or when it expires (before its handler is run), tl is removed too, like
+// with DelGen() (so a re-initialised tl is never touched). The children
+// of a removed child are removed too, so a whole hierarchy (e.g. a call
+// and all its transactions timers) can be cleared by removing its root.
+// A nil parent removes tl from its current parent.
+// A periodic parent removes its children on each run, so only the
+// children set after the last run are removed.
+// It has the same usage restrictions as Reset() for tl, while parent can
+// be active. A re-initialised parent (InitTimer()) forgets its children.
+func (wt *WTimer) SetParent(tl, parent *TimerLnk) error {
+	if tl == parent {
+		return wt.opErr("SetParent", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetParent", tl, err)
+	}
+	x := tl.ext()
+	if x == nil && parent == nil {
+		return nil
+	}
+	if x == nil {
+		x = wt.extOf(tl)
+	}
+	if old := x.parent; old != nil {
+		ox := old.ext() // allocated when tl was added to its kids
+		old.lock.Lock()
+		for i := range ox.kids {
+			if ox.kids[i].tl == tl {
+				last := len(ox.kids) - 1
+				ox.kids[i] = ox.kids[last]
+				ox.kids[last] = timerRef{}
+				ox.kids = ox.kids[:last]
+				break
+			}
+		}
+		old.lock.Unlock()
+	}
+	x.parent = parent
+	if parent == nil {
+		return nil
+	}
+	ref := timerRef{tl: tl, gen: atomic.LoadUint32(&tl.gen)}
+	px := wt.extOf(parent)
+	parent.lock.Lock()
+	if len(px.kids) == cap(px.kids) {
+		// before growing, drop the children that are not used anymore
+		px.kids = pruneKids(px.kids)
+	}
+	px.kids = append(px.kids, ref)
+	parent.lock.Unlock()
+	return nil
+}
+
+// pruneKids removes the removed or re-initialised children from kids.
+func pruneKids(kids []timerRef) []timerRef {
+	n := 0
+	for _, k := range kids {
+		if atomic.LoadUint32(&k.tl.gen) == k.gen &&
+			k.tl.info.flags()&fRemoved == 0 {
+			kids[n] = k
+			n++
+		}
+	}
+	for i := n; i < len(kids); i++ {
+		kids[i] = timerRef{}
+	}
+	return kids[:n]
+}
+
+// delKids removes all the children of tl (see SetParent()).
+// It must be called without any lock held.
+func (wt *WTimer) delKids(tl *TimerLnk) {
+	x := tl.ext()
+	if x == nil {
+		return // no children
+	}
+	tl.lock.Lock()
+	kids := x.kids
+	x.kids = nil
+	tl.lock.Unlock()
+	for _, k := range kids {
+		// errors ignored: already removed, finished or re-initialised
+		wt.del(k.tl, fDelGen|fDelAlreadyOk, k.gen)
+	}
+}
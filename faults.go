@@ -0,0 +1,243 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intuitivelabs/slog"
+)
+
+// FaultLevel is the severity of a reported fault.
+type FaultLevel uint8
+
+const (
+	FaultWarn  FaultLevel = iota // suspicious condition (WARN)
+	FaultBug                     // internal error, recovered (BUG)
+	FaultPanic                   // internal inconsistency (panic in strict mode)
+)
+
+// String returns the fault level name.
+func (l FaultLevel) String() string {
+	switch l {
+	case FaultWarn:
+		return "WARN"
+	case FaultBug:
+		return "BUG"
+	case FaultPanic:
+		return "PANIC"
+	}
+	return "invalid"
+}
+
+// FaultAction is returned by a FaultHandlerF and decides what happens
+// after a fault is reported.
+type FaultAction uint8
+
+const (
+	// FaultDefault: log the fault and for FaultPanic panic() in strict mode
+	// or return an error in lenient mode (see Config.Lenient).
+	FaultDefault FaultAction = iota
+	// FaultContinue: the fault was handled, don't log it and try to
+	// recover (like in lenient mode, even for FaultPanic).
+	FaultContinue
+	// FaultAbort: log the fault and panic(), whatever the level.
+	FaultAbort
+)
+
+// Fault contains information about a reported problem.
+// The timer related fields (Flags, Wheel, Idx) are a snapshot taken when
+// the fault was detected and are valid only if T is not nil.
+type Fault struct {
+	Level FaultLevel
+	Err   error     // error returned to the caller, if any
+	Msg   string    // problem description
+	T     *TimerLnk // timer, nil if not timer related
+	Flags uint8     // timer flags
+	Wheel uint8     // timer wheel number
+	Idx   uint16    // timer index inside the wheel
+	// State is a snapshot of the timer and wheel state, filled only for
+	// FaultBug and FaultPanic if Config.FaultState is set.
+	State *FaultState
+}
+
+// String returns a short description of the fault.
+func (f *Fault) String() string {
+	if f.T != nil {
+		return fmt.Sprintf("%s: timer %p flags 0x%02x wheel %d/%d: %s",
+			f.Level, f.T, f.Flags, f.Wheel, f.Idx, f.Msg)
+	}
+	return fmt.Sprintf("%s: %s", f.Level, f.Msg)
+}
+
+// A FaultHandlerF is a callback called for each detected problem:
+// internal inconsistencies (FaultPanic), recovered internal errors (FaultBug)
+// or suspicious conditions (FaultWarn). Its return value decides what
+// happens next (see FaultAction).
+// It might be called with internal locks held, so it should not call any
+// WTimer function.
+type FaultHandlerF func(wt *WTimer, f *Fault) FaultAction
+
+// warnOn returns true if warnings should be reported (either they
+// are logged or a fault handler is installed).
+func (wt *WTimer) warnOn() bool {
+	return wt.log.L(slog.LWARN) || wt.cfg.FaultF != nil
+}
+
+// report handles a fault: it calls the fault handler, if installed,
+// logs the message (callDepth is used for the log location) and
+// panics if needed.
+// It returns err.
+func (wt *WTimer) report(lvl FaultLevel, callDepth int, err error,
+	tl *TimerLnk, f string, a ...interface{}) error {
+	act := FaultDefault
+	msg := fmt.Sprintf(f, a...)
+	var st *FaultState
+	if wt.cfg.FaultState && lvl != FaultWarn {
+		st = wt.faultState(tl)
+	}
+	if wt.cfg.FaultF != nil {
+		flt := Fault{Level: lvl, Err: err, Msg: msg, T: tl, State: st}
+		if tl != nil {
+			flt.Flags, flt.Wheel, flt.Idx = tl.info.getAll()
+		}
+		act = wt.cfg.FaultF(wt, &flt)
+	}
+	if act == FaultContinue {
+		return err
+	}
+	if act == FaultAbort || (lvl == FaultPanic && !wt.cfg.Lenient) {
+		s := pPANIC + msg
+		if st != nil {
+			wt.log.LLog(slog.LBUG, callDepth+1, "", "%s%s", s, st)
+		} else {
+			wt.log.LLog(slog.LBUG, callDepth+1, "", "%s", s)
+		}
+		panic(s)
+	}
+	switch {
+	case lvl == FaultWarn:
+		wt.log.LLog(slog.LWARN, callDepth+1, pWARN, "%s", msg)
+	case st != nil:
+		wt.log.LLog(slog.LBUG, callDepth+1, pBUG, "%s%s", msg, st)
+	default:
+		wt.log.LLog(slog.LBUG, callDepth+1, pBUG, "%s", msg)
+	}
+	return err
+}
+
+// fault reports an internal inconsistency, related to timer tl (can be nil).
+// In strict mode (default) it will log and panic, in lenient mode it will
+// log a BUG message and return err (unless the installed fault handler
+// decides otherwise).
+func (wt *WTimer) fault(err error, tl *TimerLnk,
+	f string, a ...interface{}) error {
+	return wt.report(FaultPanic, 1, err, tl, f, a...)
+}
+
+// bug reports a recoverable internal error, related to timer tl (can be nil).
+func (wt *WTimer) bug(tl *TimerLnk, f string, a ...interface{}) {
+	wt.report(FaultBug, 1, nil, tl, f, a...)
+}
+
+// warn reports a suspicious condition, related to timer tl (can be nil).
+func (wt *WTimer) warn(tl *TimerLnk, f string, a ...interface{}) {
+	wt.report(FaultWarn, 1, nil, tl, f, a...)
+}
+
+// TimerSnapshot contains a copy of a timer internal state.
+type TimerSnapshot struct {
+	T      *TimerLnk // timer, if nil the rest of the fields are not valid
+	Flags  uint8
+	Wheel  uint8
+	Idx    uint16
+	Expire Ticks
+	Intvl  time.Duration
+	Next   *TimerLnk // next timer in the list
+	Prev   *TimerLnk // previous timer in the list
+}
+
+// String returns a short description of the timer state.
+func (s *TimerSnapshot) String() string {
+	if s.T == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%p flags 0x%02x wheel %d/%d expire %s intvl %s"+
+		" n: %p p: %p", s.T, s.Flags, s.Wheel, s.Idx, s.Expire, s.Intvl,
+		s.Next, s.Prev)
+}
+
+// FaultState is a snapshot of the state of a faulty timer and of the wheel,
+// captured when an internal error is reported (see Config.FaultState).
+// Since faults can be reported with or without the internal locks held,
+// the state is read without locking and is only a best-effort
+// approximation (e.g. the list counters stop on the first broken link).
+type FaultState struct {
+	Now         Ticks
+	Timer       TimerSnapshot // timer that caused the fault, if any
+	Next        TimerSnapshot // timer list neighbours
+	Prev        TimerSnapshot
+	WheelTimers [WheelsNo]int // timers on each wheel
+	Expired     int           // timers on the expired list
+	RunQueues   int           // timers on the run queues
+}
+
+// String returns a multi-line description of the state.
+func (s *FaultState) String() string {
+	return fmt.Sprintf("\n    now %s\n    timer: %s\n    next: %s\n"+
+		"    prev: %s\n    timers on wheels %v expired %d runq %d\n",
+		s.Now, &s.Timer, &s.Next, &s.Prev, s.WheelTimers, s.Expired,
+		s.RunQueues)
+}
+
+// faultStateMaxLst is the maximum number of timers counted on a list by
+// faultState(), to avoid looping on a corrupted list.
+const faultStateMaxLst = 1 << 24
+
+// snapshotTimer returns a copy of tl internal state (tl can be nil).
+func snapshotTimer(tl *TimerLnk) TimerSnapshot {
+	if tl == nil {
+		return TimerSnapshot{}
+	}
+	s := TimerSnapshot{T: tl, Expire: tl.expire, Intvl: tl.intvl,
+		Next: tl.next, Prev: tl.prev}
+	s.Flags, s.Wheel, s.Idx = tl.info.getAll()
+	return s
+}
+
+// lstLenUnsafe returns the number of elements of lst, counting only up
+// to the first broken link, without any locking.
+func lstLenUnsafe(lst *timerLst) int {
+	n := 0
+	prev := &lst.head
+	for v := lst.head.next; v != nil && v != &lst.head && v.prev == prev &&
+		n < faultStateMaxLst; prev, v = v, v.next {
+		n++
+	}
+	return n
+}
+
+// faultState returns a best-effort snapshot of tl (can be nil) and the
+// wheel state. It does not use any locks.
+func (wt *WTimer) faultState(tl *TimerLnk) *FaultState {
+	s := &FaultState{Now: wt.Now(), Timer: snapshotTimer(tl)}
+	if tl != nil {
+		s.Next = snapshotTimer(s.Timer.Next)
+		s.Prev = snapshotTimer(s.Timer.Prev)
+	}
+	for w := range wt.wheels {
+		for i := range wt.wheels[w].lsts {
+			s.WheelTimers[w] += lstLenUnsafe(&wt.wheels[w].lsts[i])
+		}
+	}
+	s.Expired = lstLenUnsafe(&wt.expired)
+	for i := range wt.rQs {
+		s.RunQueues += lstLenUnsafe(&wt.rQs[i].lst)
+	}
+	return s
+}
@@ -0,0 +1,380 @@
+package wtimer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/intuitivelabs/slog"
+)
+
+func TestLenientMode(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var faults int
+	var lastErr error
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		if f.Level == FaultPanic {
+			faults++
+			lastErr = f.Err
+		}
+		return FaultDefault
+	}
+
+	cfg := Config{Lenient: true, FaultF: faultF}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// corrupt the timer: mark it as detached while still on a list
+	w, idx := tl.info.wheelPos()
+	n, p := tl.next, tl.prev
+	tl.next, tl.prev = &tl, &tl
+	ok, err := wt.Del(&tl)
+	if !ok || !errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("unexpected Del result on corrupted timer: %v %v\n", ok, err)
+	}
+	if faults != 1 || !errors.Is(lastErr, ErrInvalidTimer) {
+		t.Errorf("fault handler not called: %d %v\n", faults, lastErr)
+	}
+	// fix it and remove it
+	tl.next, tl.prev = n, p
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Errorf("unexpected Del result on fixed timer: %v %v\n", ok, err)
+	}
+	if !wt.wheels[w].lsts[idx].isEmpty() {
+		t.Errorf("timer not removed from the list\n")
+	}
+
+	// same thing in strict mode should panic
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	tl.next, tl.prev = &tl, &tl
+	panicked := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+			}
+		}()
+		wt.Del(&tl)
+	}()
+	if !panicked {
+		t.Errorf("no panic in strict mode\n")
+	}
+	if faults != 1 {
+		t.Errorf("fault handler called in strict mode: %d\n", faults)
+	}
+}
+
+func TestFaultHandler(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var faults [FaultPanic + 1]int
+	var last Fault
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		faults[f.Level]++
+		last = *f
+		// handle everything, even in strict mode
+		return FaultContinue
+	}
+
+	cfg := Config{FaultF: faultF}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	w, idx := tl.info.wheelPos()
+	n, p := tl.next, tl.prev
+	tl.next, tl.prev = &tl, &tl
+	// should not panic
+	if ok, err := wt.Del(&tl); !ok || !errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("unexpected Del result on corrupted timer: %v %v\n", ok, err)
+	}
+	if faults[FaultPanic] != 1 || last.T != &tl || last.Wheel != w ||
+		last.Idx != idx || last.Flags&fActive == 0 {
+		t.Errorf("wrong fault info: %d %s\n", faults[FaultPanic], &last)
+	}
+	tl.next, tl.prev = n, p
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Errorf("unexpected Del result on fixed timer: %v %v\n", ok, err)
+	}
+	// Del on already removed timer => warning
+	if ok, err := wt.Del(&tl); !ok || !errors.Is(err, ErrAlreadyRemovedTimer) {
+		t.Errorf("unexpected Del result on removed timer: %v %v\n", ok, err)
+	}
+	if faults[FaultWarn] != 1 || last.Level != FaultWarn {
+		t.Errorf("warning not reported: %d %s\n", faults[FaultWarn], &last)
+	}
+}
+
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) L(lev slog.LogLevel) bool {
+	return lev <= slog.LWARN
+}
+
+func (l *testLogger) LLog(lev slog.LogLevel, callersSkip int, prefix string,
+	f string, args ...interface{}) {
+	if l.L(lev) {
+		l.msgs = append(l.msgs, prefix+fmt.Sprintf(f, args...))
+	}
+}
+
+func TestInstanceLogger(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var log testLogger
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.InitCfg(time.Millisecond, &Config{Log: &log}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Errorf("unexpected Del result: %v %v\n", ok, err)
+	}
+	if len(log.msgs) != 0 {
+		t.Errorf("unexpected log messages: %q\n", log.msgs)
+	}
+	// Del on already removed timer => warning
+	wt.Del(&tl)
+	if len(log.msgs) != 1 || !strings.HasPrefix(log.msgs[0], pWARN) {
+		t.Errorf("warning not logged: %q\n", log.msgs)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{10, W0Entries + 5,
+		W0Entries*W1Entries + 7, W0Entries * W1Entries * W2Entries * 3}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if w, _ := tls[i].info.wheelPos(); w != uint8(i) {
+			t.Fatalf("timer %d added on wrong wheel %d\n", i, w)
+		}
+	}
+	r := wt.CheckConsistency()
+	if !r.OK() || r.Timers != len(tls) ||
+		r.Lists != wt.totalLists() {
+		t.Errorf("unexpected report: %s\n", r)
+	}
+	wt.advanceTimeTo(wt.Now().AddUint64(W0Entries))
+	if r = wt.CheckConsistency(); !r.OK() || r.Timers != len(tls)-1 {
+		t.Errorf("unexpected report after advancing time: %s\n", r)
+	}
+
+	// wrong expire for the bucket
+	tl := &tls[3]
+	exp := tl.expire
+	tl.expire = exp.AddUint64(W0Entries * W1Entries * W2Entries)
+	r = wt.CheckConsistency()
+	if len(r.Problems) != 1 || r.Problems[0].T != tl {
+		t.Errorf("wrong expire not detected: %s\n", r)
+	}
+	tl.expire = exp
+	// broken link
+	p := tl.prev
+	tl.prev = tl
+	r = wt.CheckConsistency()
+	// (the timers counter check will also fail, since the list walk stops)
+	if len(r.Problems) != 2 || r.Problems[0].T != tl || r.Problems[0].Wheel != 3 {
+		t.Errorf("broken link not detected: %s\n", r)
+	}
+	tl.prev = p
+	if r = wt.CheckConsistency(); !r.OK() {
+		t.Errorf("unexpected report after fixing the timer: %s\n", r)
+	}
+}
+
+func TestVerifyMode(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var bugs uint32
+	var bugT atomic.Value
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		if f.Level == FaultBug {
+			bugT.Store(f.T)
+			atomic.AddUint32(&bugs, 1)
+		}
+		return FaultContinue
+	}
+
+	// check all the lists (with the default run queues) at once
+	lists := wTotalEntries + 1
+	for _, c := range defaultRunQueues() {
+		lists += c.Queues
+	}
+	cfg := Config{FaultF: faultF, VerifyIntvl: time.Millisecond,
+		VerifyLists: lists}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, time.Hour, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadUint32(&bugs); n != 0 {
+		t.Fatalf("unexpected problems reported: %d\n", n)
+	}
+	// corrupt the timer expire
+	wt.lock()
+	exp := tl.expire
+	tl.expire = exp.AddUint64(W0Entries * W1Entries * W2Entries)
+	wt.unlock()
+	for i := 0; i < 100 && atomic.LoadUint32(&bugs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	wt.lock()
+	tl.expire = exp
+	wt.unlock()
+	if atomic.LoadUint32(&bugs) == 0 ||
+		bugT.Load().(*TimerLnk) != &tl {
+		t.Errorf("corrupted timer not detected: %d %v\n",
+			atomic.LoadUint32(&bugs), bugT.Load())
+	}
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Errorf("unexpected Del result: %v %v\n", ok, err)
+	}
+}
+
+func TestFaultState(t *testing.T) {
+	var wt WTimer
+	var tl, tl1 TimerLnk
+	var last Fault
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		last = *f
+		return FaultContinue
+	}
+
+	cfg := Config{FaultF: faultF, FaultState: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.InitTimer(&tl1, Ffast)
+	err := wt.AddExpire(&tl1, wt.Now().AddUint64(W0Entries+10), f, nil)
+	if err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	w, idx := tl.info.wheelPos()
+	n, p := tl.next, tl.prev
+	tl.next, tl.prev = &tl, &tl
+	if ok, err := wt.Del(&tl); !ok || !errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("unexpected Del result on corrupted timer: %v %v\n", ok, err)
+	}
+	st := last.State
+	if last.Level != FaultPanic || st == nil {
+		t.Fatalf("fault state not captured: %s\n", &last)
+	}
+	if st.Timer.T != &tl || st.Timer.Wheel != w || st.Timer.Idx != idx ||
+		st.Timer.Next != &tl || st.Next.T != &tl {
+		t.Errorf("wrong timer state: %s\n", st)
+	}
+	if st.WheelTimers[0] != 0 || st.WheelTimers[1] != 1 {
+		t.Errorf("wrong wheel statistics: %s\n", st)
+	}
+	tl.next, tl.prev = n, p
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Errorf("unexpected Del result on fixed timer: %v %v\n", ok, err)
+	}
+}
+
+func TestNoListChecks(t *testing.T) {
+	var wt WTimer
+	var faults int
+
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		if f.Level == FaultPanic {
+			faults++
+		}
+		return FaultDefault
+	}
+
+	for _, nochk := range []bool{false, true} {
+		var lst1, lst2 timerLst
+		var tl TimerLnk
+
+		faults = 0
+		cfg := Config{Lenient: true, FaultF: faultF, NoListChecks: nochk}
+		if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		lst1.init(0, 1)
+		lst2.init(0, 2)
+		wt.InitTimer(&tl, Ffast)
+		if err := lst1.append(&wt, &tl); err != nil {
+			t.Fatalf("append failed: %s\n", err)
+		}
+		// remove it using the wrong list
+		err := lst2.rm(&wt, &tl)
+		if nochk && (err != nil || faults != 0) {
+			t.Errorf("unexpected rm result without checks: %v %d\n",
+				err, faults)
+		} else if !nochk && (!errors.Is(err, ErrInvalidTimer) || faults != 1) {
+			t.Errorf("unexpected rm result with checks: %v %d\n",
+				err, faults)
+		}
+		if !lst1.isEmpty() || !tl.Detached() {
+			t.Errorf("timer not removed from the list (checks off: %v)\n",
+				nochk)
+		}
+	}
+}
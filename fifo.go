@@ -0,0 +1,74 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// stampAdd records the add order of tl (Config.FIFO).
+// It must be called with tl.lock held.
+func (wt *WTimer) stampAdd(tl *TimerLnk) {
+	if wt.cfg.FIFO {
+		wt.extOf(tl).aseq = atomic.AddUint64(&wt.addSeq, 1)
+	}
+}
+
+// SetSeq sets the timer sequence number, used for ordering the timers
+// expiring on the same tick when Config.FIFO is set: they are dispatched
+// in increasing sequence number order and, for equal sequence numbers,
+// in add order. The timers without a sequence number (0) are dispatched
+// first. It makes the execution order independent of the add order (e.g.
+// for replays and tests, where the timers might be added from different
+// goroutines).
+// It has the same usage restrictions as Reset(). A re-initialised timer
+// (InitTimer()) has no sequence number.
+func (wt *WTimer) SetSeq(tl *TimerLnk, seq uint64) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetSeq", tl, err)
+	}
+	wt.extOf(tl).useq = seq
+	return nil
+}
+
+// sortExpired sorts the expired list by expire, sequence number (see
+// SetSeq()) and add order (Config.FIFO).
+// It must be called with wt.lock() held.
+func (wt *WTimer) sortExpired() {
+	lst := &wt.expired
+	if lst.isEmpty() || lst.head.next.next == &lst.head {
+		return // 0 or 1 element
+	}
+	ts := wt.fifoBuf[:0]
+	for !lst.isEmpty() {
+		t := lst.head.next
+		if lst.rm(wt, t) != nil {
+			// lenient mode: corrupted list, drop its content
+			lst.forceEmpty()
+			break
+		}
+		ts = append(ts, t)
+	}
+	sort.SliceStable(ts, func(i, j int) bool {
+		if ts[i].expire.NE(ts[j].expire) {
+			return ts[i].expire.LT(ts[j].expire)
+		}
+		xi, xj := ts[i].extView(), ts[j].extView()
+		if xi.useq != xj.useq {
+			return xi.useq < xj.useq
+		}
+		return xi.aseq < xj.aseq
+	})
+	for i, t := range ts {
+		t.next = nil
+		t.prev = nil
+		lst.append(wt, t)
+		ts[i] = nil // don't keep references to the timers
+	}
+	wt.fifoBuf = ts[:0]
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"runtime"
+	"sync"
+)
+
+// goIDBufs contains the buffers used by goID() (a local buffer would escape
+// to the heap, causing an allocation on each call).
+var goIDBufs = sync.Pool{
+	New: func() interface{} { return new([64]byte) },
+}
+
+// goID returns the current goroutine id.
+// It is slow (it parses the runtime.Stack() output, without allocating),
+// so the callers cache its result: it is called once per worker or FgoR
+// runner start, at most once per tick when running fast handlers (see
+// processExpired()), once per precise timer fire (see preciseFire()) and
+// by DelWait() only if the timer is running (see selfRunning()).
+// On failure it returns 0.
+func goID() uint64 {
+	b := goIDBufs.Get().(*[64]byte)
+	defer goIDBufs.Put(b)
+	buf := b[:]
+	n := runtime.Stack(buf, false)
+	// expected format: "goroutine 123 [running]: ..."
+	const prefix = "goroutine "
+	if n <= len(prefix) || string(buf[:len(prefix)]) != prefix {
+		return 0
+	}
+	var id uint64
+	for _, c := range buf[len(prefix):n] {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + uint64(c-'0')
+	}
+	return id
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Group is a set of timers sharing the same quotas and accounting
+// (e.g. all the timers belonging to a tenant), see NewGroup() and
+// SetGroup(). A Group can be used with more then one WTimer instance.
+type Group struct {
+	name      string
+	maxTimers int // maximum pending timers, 0 for unlimited
+	maxRate   int // maximum Add*()s per second, 0 for unlimited
+
+	timers   int64  // pending timers (atomic access)
+	adds     uint64 // Add*()s allowed (atomic access)
+	rejected uint64 // Add*()s refused because of the quotas (atomic access)
+
+	lock     sync.Mutex // protects the rate window
+	winStart time.Time  // start of the current 1s rate window
+	winAdds  int        // Add*()s in the current rate window
+}
+
+// GroupStats contains a group counters (see Group.Stats()).
+type GroupStats struct {
+	Name     string
+	Timers   int    // pending timers (see WTimer.Len())
+	Adds     uint64 // Add*()s allowed
+	Rejected uint64 // Add*()s refused because of the quotas
+}
+
+// NewGroup returns a new timer group, allowing at most maxTimers pending
+// timers and at most maxRate Add*()s per second (0 means unlimited).
+// When a limit is reached, the Add*() functions return ErrQuotaExceeded
+// or ErrRateExceeded for the group timers. The re-arms of periodic timers
+// are not limited.
+func NewGroup(name string, maxTimers, maxRate int) *Group {
+	return &Group{name: name, maxTimers: maxTimers, maxRate: maxRate}
+}
+
+// Name returns the group name.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Len returns the number of pending timers in the group.
+func (g *Group) Len() int {
+	return int(atomic.LoadInt64(&g.timers))
+}
+
+// Stats returns the group counters.
+func (g *Group) Stats() GroupStats {
+	return GroupStats{
+		Name:     g.name,
+		Timers:   g.Len(),
+		Adds:     atomic.LoadUint64(&g.adds),
+		Rejected: atomic.LoadUint64(&g.rejected),
+	}
+}
+
+// allowAdd checks the group quotas for a new timer. On success the add
+// is counted in the rate limit.
+func (g *Group) allowAdd() error {
+	if g.maxTimers > 0 && g.Len() >= g.maxTimers {
+		atomic.AddUint64(&g.rejected, 1)
+		return ErrQuotaExceeded
+	}
+	if g.maxRate > 0 {
+		g.lock.Lock()
+		now := time.Now()
+		if now.Sub(g.winStart) >= time.Second {
+			g.winStart = now
+			g.winAdds = 0
+		}
+		if g.winAdds >= g.maxRate {
+			g.lock.Unlock()
+			atomic.AddUint64(&g.rejected, 1)
+			return ErrRateExceeded
+		}
+		g.winAdds++
+		g.lock.Unlock()
+	}
+	atomic.AddUint64(&g.adds, 1)
+	return nil
+}
+
+// SetGroup sets the timer group (nil removes the timer from its group).
+// It has the same usage restrictions as Reset(): it must be called before
+// adding the timer or from the timer own handler. A re-initialised timer
+// (InitTimer()) does not belong to any group.
+func (wt *WTimer) SetGroup(tl *TimerLnk, g *Group) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetGroup", tl, err)
+	}
+	wt.extOf(tl).group = g
+	return nil
+}
+
+// activeInc increments the pending timers counters (of wt and of the tl
+// group).
+func (wt *WTimer) activeInc(tl *TimerLnk) {
+	atomic.AddInt64(&wt.active, 1)
+	if g := tl.extView().group; g != nil {
+		atomic.AddInt64(&g.timers, 1)
+	}
+}
+
+// activeDec decrements the pending timers counters (of wt and of the tl
+// group).
+func (wt *WTimer) activeDec(tl *TimerLnk) {
+	atomic.AddInt64(&wt.active, -1)
+	if g := tl.extView().group; g != nil {
+		atomic.AddInt64(&g.timers, -1)
+	}
+}
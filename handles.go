@@ -0,0 +1,208 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimerHandle is an opaque timer handle, returned by TimerHandles.Add().
+// It encodes a slot index and the slot generation, so it can be safely
+// used even after the timer finished (operations on it will return
+// ErrStaleHandle). The 0 value is never a valid handle.
+type TimerHandle uint64
+
+// idx returns the slot index encoded in the handle.
+func (h TimerHandle) idx() uint32 {
+	return uint32(h >> 32)
+}
+
+// gen returns the slot generation encoded in the handle.
+func (h TimerHandle) gen() uint32 {
+	return uint32(h)
+}
+
+// A HandleTimerF is the callback type for timers added using TimerHandles.
+// The parameters and the return values have the same meaning as for
+// TimerHandlerF. Returning false will also free the handle.
+type HandleTimerF func(wt *WTimer, h TimerHandle, arg interface{}) (bool, time.Duration)
+
+const hChunkSz = 1024 // number of slots allocated at once
+
+// hSlot contains a timer used by TimerHandles.
+type hSlot struct {
+	tl  TimerLnk
+	ht  *TimerHandles
+	idx uint32
+	h   TimerHandle // current handle, valid while the timer is active
+
+	f   HandleTimerF
+	arg interface{}
+
+	lock      sync.Mutex // protects inHandler & delReq
+	inHandler bool       // f executing
+	delReq    bool       // deleted while f was executing
+}
+
+// TimerHandles provides an alternative timer API on top of a WTimer, using
+// opaque handles (TimerHandle) instead of the TimerLnk pointers.
+// It protects against common misuses (adding an already active timer,
+// deleting a finished or re-used timer), at the cost of an internal
+// lookup table and one lock for each Add() and timer end.
+type TimerHandles struct {
+	wt     *WTimer
+	lock   sync.Mutex
+	chunks []*[hChunkSz]hSlot
+	free   []uint32 // free slots indexes
+}
+
+// Init initialises the handle table for use with wt.
+func (ht *TimerHandles) Init(wt *WTimer) {
+	ht.wt = wt
+	ht.chunks = nil
+	ht.free = nil
+}
+
+// alloc returns a new free slot.
+func (ht *TimerHandles) alloc() *hSlot {
+	ht.lock.Lock()
+	if len(ht.free) == 0 {
+		c := &[hChunkSz]hSlot{}
+		start := uint32(len(ht.chunks) * hChunkSz)
+		for i := len(c) - 1; i >= 0; i-- {
+			c[i].ht = ht
+			c[i].idx = start + uint32(i)
+			ht.free = append(ht.free, c[i].idx)
+		}
+		ht.chunks = append(ht.chunks, c)
+	}
+	idx := ht.free[len(ht.free)-1]
+	ht.free = ht.free[:len(ht.free)-1]
+	s := &ht.chunks[idx/hChunkSz][idx%hChunkSz]
+	ht.lock.Unlock()
+	return s
+}
+
+// release frees the slot s if its generation is still gen.
+func (ht *TimerHandles) release(s *hSlot, gen uint32) {
+	ht.lock.Lock()
+	if s.tl.Gen() == gen {
+		// increase the generation so that any use of the old handle
+		// will be detected even before the slot is re-used
+		atomic.AddUint32(&s.tl.gen, 1)
+		s.f = nil
+		s.arg = nil
+		ht.free = append(ht.free, s.idx)
+	}
+	ht.lock.Unlock()
+}
+
+// get returns the slot corresponding to h.
+func (ht *TimerHandles) get(h TimerHandle) (*hSlot, error) {
+	idx := h.idx()
+	ht.lock.Lock()
+	if int(idx/hChunkSz) >= len(ht.chunks) || h.gen() == 0 {
+		ht.lock.Unlock()
+		return nil, ErrInvalidTimer
+	}
+	s := &ht.chunks[idx/hChunkSz][idx%hChunkSz]
+	ht.lock.Unlock()
+	return s, nil
+}
+
+// hTimerHandler is the TimerLnk handler for all the handle based timers.
+func hTimerHandler(wt *WTimer, tl *TimerLnk, arg interface{}) (bool, time.Duration) {
+	s := arg.(*hSlot)
+	h := s.h
+	s.lock.Lock()
+	s.inHandler = true
+	s.lock.Unlock()
+
+	rearm, d := s.f(wt, h, s.arg)
+
+	s.lock.Lock()
+	s.inHandler = false
+	if !rearm || s.delReq {
+		s.lock.Unlock()
+		s.ht.release(s, h.gen())
+		return false, 0
+	}
+	s.lock.Unlock()
+	return true, d
+}
+
+// Add starts a new timer that will run f(wt, handle, arg) after d.
+// For the possible flags values see WTimer.Reset().
+// It returns the new timer handle on success or an error.
+func (ht *TimerHandles) Add(d time.Duration, flags uint8,
+	f HandleTimerF, arg interface{}) (TimerHandle, error) {
+	if f == nil {
+		return 0, ErrInvalidParameters
+	}
+	s := ht.alloc()
+	if err := ht.wt.InitTimer(&s.tl, flags); err != nil {
+		ht.release(s, s.tl.Gen())
+		return 0, err
+	}
+	gen := s.tl.Gen()
+	s.h = TimerHandle(uint64(s.idx)<<32 | uint64(gen))
+	s.f = f
+	s.arg = arg
+	s.inHandler = false
+	s.delReq = false
+	if err := ht.wt.Add(&s.tl, d, hTimerHandler, s); err != nil {
+		ht.release(s, gen)
+		return 0, err
+	}
+	return s.h, nil
+}
+
+// Del removes the timer corresponding to h.
+// It returns true on success and false if the timer handler is running
+// (in which case the timer will be removed when the handler returns).
+// On an invalid or finished timer handle it returns true and
+// ErrStaleHandle or ErrInvalidTimer.
+func (ht *TimerHandles) Del(h TimerHandle) (bool, error) {
+	s, err := ht.get(h)
+	if err != nil {
+		return true, err
+	}
+	s.lock.Lock()
+	ok, err := ht.wt.DelGen(&s.tl, h.gen())
+	if errors.Is(err, ErrStaleHandle) {
+		s.lock.Unlock()
+		return true, err
+	}
+	if !ok && err == nil && s.inHandler {
+		// running, the slot will be freed when the handler returns
+		s.delReq = true
+		s.lock.Unlock()
+		return false, nil
+	}
+	s.lock.Unlock()
+	if !ok && err == nil {
+		// the handler returned and asked for re-arming, but the timer
+		// was not yet re-added => wait for the timer code to finish with
+		// it, the timer is marked for delete and will not be re-added.
+		for {
+			ok, err = ht.wt.DelWaitGen(&s.tl, h.gen())
+			if ok || err != nil {
+				break
+			}
+			// FgoR timers cannot be waited for => retry
+			runtime.Gosched()
+		}
+	}
+	if ok {
+		ht.release(s, h.gen())
+	}
+	return ok, err
+}
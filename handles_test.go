@@ -0,0 +1,81 @@
+package wtimer
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerHandles(t *testing.T) {
+	var wt WTimer
+	var ht TimerHandles
+	var runs uint64
+
+	f := func(wt *WTimer, h TimerHandle, p interface{}) (bool, time.Duration) {
+		n := atomic.AddUint64(&runs, 1)
+		if p.(int) == 1 {
+			// delete itself
+			if ok, err := ht.Del(h); ok || err != nil {
+				t.Errorf("Del from handler: unexpected %v %v\n", ok, err)
+			}
+			return true, Periodic
+		}
+		return n < 3, Periodic
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	ht.Init(&wt)
+	wt.Start()
+	defer wt.Shutdown()
+
+	// one shot-timer
+	h1, err := ht.Add(5*time.Millisecond, 0, f, 0)
+	if err != nil || h1 == 0 {
+		t.Fatalf("Add failed: %v (%x)\n", err, h1)
+	}
+	// timer deleted before expire
+	h2, err := ht.Add(time.Second, 0, f, 0)
+	if err != nil {
+		t.Fatalf("Add failed: %v\n", err)
+	}
+	if h2 == h1 {
+		t.Fatalf("same handle returned for 2 active timers: %x\n", h1)
+	}
+	if ok, err := ht.Del(h2); !ok || err != nil {
+		t.Errorf("Del failed: %v %v\n", ok, err)
+	}
+	if ok, err := ht.Del(h2); !ok || !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("Del on deleted handle: unexpected %v %v\n", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadUint64(&runs); n != 3 {
+		t.Errorf("unexpected timer runs %d\n", n)
+	}
+	// finished timer
+	if ok, err := ht.Del(h1); !ok || !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("Del on finished timer: unexpected %v %v\n", ok, err)
+	}
+	// timer deleting itself from the handler
+	atomic.StoreUint64(&runs, 0)
+	h3, err := ht.Add(5*time.Millisecond, 0, f, 1)
+	if err != nil {
+		t.Fatalf("Add failed: %v\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadUint64(&runs); n != 1 {
+		t.Errorf("unexpected self-deleted timer runs %d\n", n)
+	}
+	if ok, err := ht.Del(h3); !ok || !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("Del on self-deleted timer: unexpected %v %v\n", ok, err)
+	}
+	if len(ht.free) != hChunkSz {
+		t.Errorf("slots leaked: %d free from %d\n", len(ht.free), hChunkSz)
+	}
+	if ok, err := ht.Del(TimerHandle(uint64(hChunkSz) << 32)); !ok ||
+		!errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("Del on invalid handle: unexpected %v %v\n", ok, err)
+	}
+}
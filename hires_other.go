@@ -0,0 +1,19 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build !windows
+
+package wtimer
+
+import (
+	"time"
+)
+
+// beginHiResTicks does nothing: the default timer resolution is high
+// enough on the other OSes (see hires_windows.go).
+func beginHiResTicks(d time.Duration) (func(), error) {
+	return func() {}, nil
+}
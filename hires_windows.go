@@ -0,0 +1,43 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build windows
+
+package wtimer
+
+import (
+	"syscall"
+	"time"
+)
+
+// default Windows timer resolution: the time.Ticker and time.Timer
+// expires are rounded to it, unless a higher resolution is requested
+const winDefaultRes = 15600 * time.Microsecond
+
+var (
+	winmm           = syscall.NewLazyDLL("winmm.dll")
+	timeBeginPeriod = winmm.NewProc("timeBeginPeriod")
+	timeEndPeriod   = winmm.NewProc("timeEndPeriod")
+)
+
+// beginHiResTicks requests the 1ms system timer resolution if the tick
+// duration d is lower then the default Windows timer resolution (~15.6ms),
+// so that the ticks are not delayed to the next default timer interrupt.
+// It returns a function that must be called for restoring the previous
+// resolution, when the ticks are not needed anymore.
+func beginHiResTicks(d time.Duration) (func(), error) {
+	if d >= winDefaultRes {
+		return func() {}, nil
+	}
+	if err := timeBeginPeriod.Find(); err != nil {
+		return func() {}, err
+	}
+	if r, _, _ := timeBeginPeriod.Call(1); r != 0 {
+		// TIMERR_NOCANDO
+		return func() {}, syscall.Errno(r)
+	}
+	return func() { timeEndPeriod.Call(1) }, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sort"
+	"sync"
+)
+
+// instances contains the started named WTimer instances (see
+// Config.Name).
+var instances struct {
+	lock sync.Mutex
+	lst  []*WTimer
+}
+
+// InstanceStats contains the statistics of a WTimer instance (see
+// WTimer.Stats()) or aggregated for several instances (AggregatedStats()).
+type InstanceStats struct {
+	Name      string
+	Instances int // number of aggregated instances
+	Timers    int // pending timers (see WTimer.Len())
+	RunQueues RunQueueStats
+	Lag       LagStats
+	Suspend   SuspendStats
+	Clock     ClockStats
+	Ticks     TickStats
+	Allocs    AllocStats
+	// Workers contains the run queues workers utilization (the workers of
+	// all the instances, when aggregated)
+	Workers []WorkerStats
+	// Queues contains the depth of each run queue (the queues of all the
+	// instances, when aggregated)
+	Queues []RunQueueDepth
+}
+
+// add adds s to the aggregated statistics in a.
+func (a *InstanceStats) add(s *InstanceStats) {
+	a.Instances += s.Instances
+	a.Timers += s.Timers
+	a.RunQueues.Depth += s.RunQueues.Depth
+	if s.RunQueues.MaxDepth > a.RunQueues.MaxDepth {
+		a.RunQueues.MaxDepth = s.RunQueues.MaxDepth
+	}
+	a.RunQueues.Blocked += s.RunQueues.Blocked
+	a.RunQueues.Dropped += s.RunQueues.Dropped
+	a.RunQueues.Spilled += s.RunQueues.Spilled
+	a.RunQueues.SigDrops += s.RunQueues.SigDrops
+	a.Lag.Events += s.Lag.Events
+	a.Lag.LostTicks += s.Lag.LostTicks
+	a.Lag.Coalesced += s.Lag.Coalesced
+	a.Lag.Dropped += s.Lag.Dropped
+	a.Suspend.Suspends += s.Suspend.Suspends
+	a.Suspend.Shifted += s.Suspend.Shifted
+	a.Suspend.Gap += s.Suspend.Gap
+	a.Clock.Backward += s.Clock.Backward
+	a.Clock.Resyncs += s.Clock.Resyncs
+	a.Clock.Reanchors += s.Clock.Reanchors
+	a.Clock.Slow += s.Clock.Slow
+	a.Clock.SlowTicks += s.Clock.SlowTicks
+	a.Clock.Fast += s.Clock.Fast
+	a.Clock.FastTicks += s.Clock.FastTicks
+	a.Ticks.Proc.add(&s.Ticks.Proc)
+	a.Ticks.Jitter.add(&s.Ticks.Jitter)
+	a.Allocs.Timers += s.Allocs.Timers
+	a.Allocs.Goroutines += s.Allocs.Goroutines
+	a.Allocs.Deadlines += s.Allocs.Deadlines
+	a.Allocs.Labels += s.Allocs.Labels
+	a.Allocs.Watched += s.Allocs.Watched
+	a.Allocs.Options += s.Allocs.Options
+	a.Workers = append(a.Workers, s.Workers...)
+	a.Queues = append(a.Queues, s.Queues...)
+}
+
+// Name returns the instance name (Config.Name).
+func (wt *WTimer) Name() string {
+	return wt.cfg.Name
+}
+
+// Stats returns the instance statistics.
+func (wt *WTimer) Stats() InstanceStats {
+	return InstanceStats{
+		Name:      wt.cfg.Name,
+		Instances: 1,
+		Timers:    wt.Len(),
+		RunQueues: wt.RunQueueStats(),
+		Lag:       wt.LagStats(),
+		Suspend:   wt.SuspendStats(),
+		Clock:     wt.ClockStats(),
+		Ticks:     wt.TickStats(),
+		Allocs:    wt.AllocStats(),
+		Workers:   wt.WorkerStats(),
+		Queues:    wt.RunQueueDepths(),
+	}
+}
+
+// register adds wt to the instances registry, if named.
+func (wt *WTimer) register() {
+	if wt.cfg.Name == "" {
+		return
+	}
+	instances.lock.Lock()
+	for _, i := range instances.lst {
+		if i == wt {
+			instances.lock.Unlock()
+			return
+		}
+	}
+	instances.lst = append(instances.lst, wt)
+	instances.lock.Unlock()
+}
+
+// unregister removes wt from the instances registry.
+func (wt *WTimer) unregister() {
+	instances.lock.Lock()
+	for i, v := range instances.lst {
+		if v == wt {
+			last := len(instances.lst) - 1
+			instances.lst[i] = instances.lst[last]
+			instances.lst[last] = nil
+			instances.lst = instances.lst[:last]
+			break
+		}
+	}
+	instances.lock.Unlock()
+}
+
+// Instances returns the started named WTimer instances (see Config.Name),
+// sorted by name. An instance is registered by Start() and removed by
+// Shutdown().
+func Instances() []*WTimer {
+	instances.lock.Lock()
+	lst := make([]*WTimer, len(instances.lst))
+	copy(lst, instances.lst)
+	instances.lock.Unlock()
+	sort.SliceStable(lst, func(i, j int) bool {
+		return lst[i].Name() < lst[j].Name()
+	})
+	return lst
+}
+
+// AggregatedStats returns the statistics of all the registered instances
+// (see Instances()) summed up (the run queues MaxDepth is the maximum)
+// and the statistics of each instance.
+func AggregatedStats() (InstanceStats, []InstanceStats) {
+	var total InstanceStats
+	lst := Instances()
+	each := make([]InstanceStats, len(lst))
+	for i, wt := range lst {
+		each[i] = wt.Stats()
+		total.add(&each[i])
+	}
+	return total, each
+}
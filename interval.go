@@ -0,0 +1,31 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// SetInterval changes the interval of an active periodic timer, without
+// removing and re-adding it: the new interval is used starting with the
+// next re-arm of the timer (when its handler returns Periodic), the
+// current expire is not changed. If the handler returns a different
+// interval or calls Add*(), the new interval is ignored.
+// It can be called at any time on an active timer, from any goroutine.
+func (wt *WTimer) SetInterval(tl *TimerLnk, d time.Duration) error {
+	if d <= 0 || d == Periodic {
+		return wt.opErr("SetInterval", tl, ErrInvalidParameters)
+	}
+	wt.lockTimer(tl)
+	if tl.info.flags()&(fActive|fDelete|fRemoved) != fActive {
+		wt.unlockTimer(tl)
+		return wt.opErr("SetInterval", tl, ErrInactiveTimer)
+	}
+	wt.extOf(tl).newIv = d
+	wt.unlockTimer(tl)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ArmedTimer contains a copy of the state of a timer waiting on the wheels
+// (see ForEachTimer()).
+type ArmedTimer struct {
+	T      *TimerLnk
+	Gen    uint32        // timer generation, see TimerLnk.Gen() and DelGen()
+	Expire Ticks         // expire time (of the current leg, for long timers)
+	Left   time.Duration // time left until the timer expires
+	Intvl  time.Duration // timer interval
+	Tag    interface{}   // timer tag, see SetTag()
+}
+
+// ForEachTimer calls fn for each timer waiting on the wheels, until fn
+// returns false. The running or expired timers are not included.
+// The wheel lists are copied one by one, each under its list lock, so the
+// timer operations on other lists are not blocked (only the timer
+// goroutine waits for the copy of the current list when processing a
+// tick). fn is called without holding any lock and it can use the timer
+// operations, but since the timers can change in parallel, the state
+// passed to fn might be stale (e.g. use DelGen() with ArmedTimer.Gen for
+// removing a timer). A timer moved between lists during the iteration
+// might be reported twice or not at all. a is valid only until fn returns.
+func (wt *WTimer) ForEachTimer(fn func(a *ArmedTimer) bool) {
+	var buf []ArmedTimer
+	for i := range wt.wlists {
+		lst := &wt.wlists[i]
+		buf = buf[:0]
+		wt.rlock()
+		wt.lstLock(lst).Lock()
+		now := wt.Now()
+		lst.forEach(func(e *TimerLnk) bool {
+			if e.info.flags()&fDelete != 0 {
+				return true // DelLazy()-ed
+			}
+			left := e.extView().left
+			if e.expire.GT(now) {
+				left += e.expire.Sub(now).Val()
+			}
+			buf = append(buf, ArmedTimer{
+				T:      e,
+				Gen:    atomic.LoadUint32(&e.gen),
+				Expire: e.expire,
+				Left:   time.Duration(left) * wt.tickDuration,
+				Intvl:  e.intvl,
+				Tag:    e.extView().tag,
+			})
+			return true
+		})
+		wt.lstLock(lst).Unlock()
+		wt.runlock()
+		for j := range buf {
+			if !fn(&buf[j]) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON encodes the ticks value as a JSON number.
+func (t Ticks) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.v)
+}
+
+// UnmarshalJSON decodes a ticks value encoded by MarshalJSON().
+func (t *Ticks) UnmarshalJSON(b []byte) error {
+	var v uint64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*t = NewTicks(v)
+	return nil
+}
+
+// jsonRunQueues is the JSON encoding of RunQueueStats.
+type jsonRunQueues struct {
+	Depth    int    `json:"depth"`
+	MaxDepth int    `json:"max_depth"`
+	Blocked  uint64 `json:"blocked"`
+	Dropped  uint64 `json:"dropped"`
+	Spilled  uint64 `json:"spilled"`
+	SigDrops uint64 `json:"sig_drops"`
+}
+
+// jsonLag is the JSON encoding of LagStats.
+type jsonLag struct {
+	Events    uint64 `json:"events"`
+	LostTicks uint64 `json:"lost_ticks"`
+	Coalesced uint64 `json:"coalesced"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// jsonSuspend is the JSON encoding of SuspendStats.
+type jsonSuspend struct {
+	Suspends uint64 `json:"suspends"`
+	Shifted  uint64 `json:"shifted"`
+	GapNs    int64  `json:"gap_ns"`
+}
+
+// jsonClock is the JSON encoding of ClockStats.
+type jsonClock struct {
+	Backward  uint64 `json:"backward"`
+	Resyncs   uint64 `json:"resyncs"`
+	Reanchors uint64 `json:"reanchors"`
+	Slow      uint64 `json:"slow"`
+	SlowTicks uint64 `json:"slow_ticks"`
+	Fast      uint64 `json:"fast"`
+	FastTicks uint64 `json:"fast_ticks"`
+}
+
+// jsonTickHist is the JSON encoding of TickHist (the buckets bounds are
+// implicit, see TickHistBound()).
+type jsonTickHist struct {
+	Counts []uint64 `json:"counts"`
+	SumNs  int64    `json:"sum_ns"`
+	MaxNs  int64    `json:"max_ns"`
+}
+
+// jsonTicks is the JSON encoding of TickStats.
+type jsonTicks struct {
+	Proc   jsonTickHist `json:"proc"`
+	Jitter jsonTickHist `json:"jitter"`
+}
+
+// jsonAllocs is the JSON encoding of AllocStats.
+type jsonAllocs struct {
+	Timers     uint64 `json:"timers"`
+	Goroutines uint64 `json:"goroutines"`
+	Deadlines  uint64 `json:"deadlines"`
+	Labels     uint64 `json:"labels"`
+	Watched    uint64 `json:"watched"`
+	Options    uint64 `json:"options"`
+}
+
+// jsonWorker is the JSON encoding of WorkerStats.
+type jsonWorker struct {
+	Class   string `json:"class"`
+	BusyNs  int64  `json:"busy_ns"`
+	Handled uint64 `json:"handled"`
+	Wakeups uint64 `json:"wakeups"`
+	Idle    uint64 `json:"idle"`
+}
+
+// jsonQueue is the JSON encoding of RunQueueDepth.
+type jsonQueue struct {
+	Class    string `json:"class"`
+	Queue    int    `json:"queue"`
+	Depth    int    `json:"depth"`
+	MaxDepth int    `json:"max_depth"`
+}
+
+// newJSONTickHist returns the JSON encoding of h.
+func newJSONTickHist(h *TickHist) jsonTickHist {
+	return jsonTickHist{
+		Counts: h.Counts[:],
+		SumNs:  int64(h.Sum),
+		MaxNs:  int64(h.Max),
+	}
+}
+
+// MarshalJSON encodes the statistics as a JSON object with lower case
+// keys (the durations are encoded in ns, with a _ns key suffix).
+func (s InstanceStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name      string        `json:"name"`
+		Instances int           `json:"instances"`
+		Timers    int           `json:"timers"`
+		RunQueues jsonRunQueues `json:"run_queues"`
+		Lag       jsonLag       `json:"lag"`
+		Suspend   jsonSuspend   `json:"suspend"`
+		Clock     jsonClock     `json:"clock"`
+		Ticks     jsonTicks     `json:"ticks"`
+		Allocs    jsonAllocs    `json:"allocs"`
+		Workers   []jsonWorker  `json:"workers"`
+		Queues    []jsonQueue   `json:"queues"`
+	}{
+		Name:      s.Name,
+		Instances: s.Instances,
+		Timers:    s.Timers,
+		RunQueues: jsonRunQueues(s.RunQueues),
+		Lag:       jsonLag(s.Lag),
+		Suspend: jsonSuspend{
+			Suspends: s.Suspend.Suspends,
+			Shifted:  s.Suspend.Shifted,
+			GapNs:    int64(s.Suspend.Gap),
+		},
+		Clock: jsonClock(s.Clock),
+		Ticks: jsonTicks{
+			Proc:   newJSONTickHist(&s.Ticks.Proc),
+			Jitter: newJSONTickHist(&s.Ticks.Jitter),
+		},
+		Allocs:  jsonAllocs(s.Allocs),
+		Workers: newJSONWorkers(s.Workers),
+		Queues:  newJSONQueues(s.Queues),
+	})
+}
+
+// newJSONWorkers returns the JSON encoding of the workers stats w.
+func newJSONWorkers(w []WorkerStats) []jsonWorker {
+	r := make([]jsonWorker, len(w))
+	for i := range w {
+		r[i] = jsonWorker{
+			Class:   w[i].Class,
+			BusyNs:  int64(w[i].Busy),
+			Handled: w[i].Handled,
+			Wakeups: w[i].Wakeups,
+			Idle:    w[i].Idle,
+		}
+	}
+	return r
+}
+
+// newJSONQueues returns the JSON encoding of the run queues depths q.
+func newJSONQueues(q []RunQueueDepth) []jsonQueue {
+	r := make([]jsonQueue, len(q))
+	for i := range q {
+		r[i] = jsonQueue(q[i])
+	}
+	return r
+}
+
+// jsonPtr returns the JSON representation of a timer pointer (a string
+// with its address, since it is used only for identifying the timer).
+func jsonPtr(tl *TimerLnk) string {
+	if tl == nil {
+		return ""
+	}
+	return fmt.Sprintf("%p", tl)
+}
+
+// MarshalJSON encodes the timer snapshot as a JSON object (see
+// InstanceStats.MarshalJSON() for the format conventions). The timers are
+// encoded as strings containing their addresses.
+func (s TimerSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		T       string `json:"timer"`
+		Flags   uint8  `json:"flags"`
+		Wheel   uint8  `json:"wheel"`
+		Idx     uint16 `json:"idx"`
+		Expire  Ticks  `json:"expire"`
+		IntvlNs int64  `json:"intvl_ns"`
+		Next    string `json:"next"`
+		Prev    string `json:"prev"`
+	}{
+		T:       jsonPtr(s.T),
+		Flags:   s.Flags,
+		Wheel:   s.Wheel,
+		Idx:     s.Idx,
+		Expire:  s.Expire,
+		IntvlNs: int64(s.Intvl),
+		Next:    jsonPtr(s.Next),
+		Prev:    jsonPtr(s.Prev),
+	})
+}
+
+// MarshalJSON encodes the timer debug information (the same as
+// TimerLnk.GoString()) as a JSON object. Like for String(), the timer is
+// not locked, so for an active timer the result is only a best-effort
+// approximation.
+func (tl *TimerLnk) MarshalJSON() ([]byte, error) {
+	if tl == nil {
+		return []byte("null"), nil
+	}
+	f, w, idx := tl.info.getAll()
+	return json.Marshal(struct {
+		T       string `json:"timer"`
+		Name    string `json:"name,omitempty"`
+		Gen     uint32 `json:"gen"`
+		Flags   uint8  `json:"flags"`
+		State   string `json:"state"`
+		Wheel   uint8  `json:"wheel"`
+		Idx     uint16 `json:"idx"`
+		Expire  Ticks  `json:"expire"`
+		IntvlNs int64  `json:"intvl_ns"`
+		Handler string `json:"handler"`
+	}{
+		T:       jsonPtr(tl),
+		Name:    tl.extView().name,
+		Gen:     tl.Gen(),
+		Flags:   f,
+		State:   tl.State().String(),
+		Wheel:   w,
+		Idx:     idx,
+		Expire:  tl.expire,
+		IntvlNs: int64(tl.intvl),
+		Handler: handlerStr(tl.f),
+	})
+}
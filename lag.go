@@ -0,0 +1,174 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+)
+
+// default number of lost ticks after which the timer wheel is considered
+// behind schedule (see Config.LagTicks)
+const defaultLagTicks = 20
+
+// CatchUpPolicy selects how the timer wheel catches up after falling
+// behind schedule (see Config.CatchUp and Config.LagTicks).
+type CatchUpPolicy uint8
+
+const (
+	// CatchUpReplay advances the time one tick at a time, running the
+	// expired timers after each tick (default).
+	CatchUpReplay CatchUpPolicy = iota
+	// CatchUpFastForward advances the time directly to the current
+	// tick and then runs all the expired timers, in a single pass.
+	CatchUpFastForward
+	// CatchUpSkipPeriodic is like CatchUpReplay, but the periodic timers
+	// re-armed while catching up are always re-armed relative to the
+	// catch-up end, so they never run more then once while catching up.
+	// The timers re-armed with an explicit interval (or with Add*() from
+	// the handler) are not affected.
+	CatchUpSkipPeriodic
+)
+
+// String returns the policy name.
+func (p CatchUpPolicy) String() string {
+	switch p {
+	case CatchUpReplay:
+		return "replay"
+	case CatchUpFastForward:
+		return "fast-forward"
+	case CatchUpSkipPeriodic:
+		return "skip-periodic"
+	}
+	return "invalid"
+}
+
+// LagStats contains the counters for the lost ticks handling (see
+// Config.LagTicks).
+type LagStats struct {
+	Events    uint64 // times the timer wheel was found behind schedule
+	LostTicks uint64 // total ticks caught up after falling behind
+	// periodic timers fires skipped: when falling behind, a periodic
+	// timer runs only once and it is re-armed relative to the current
+	// time, instead of running for each missed interval
+	Coalesced uint64
+	Dropped   uint64 // PrioLow timers dropped (Config.LagDropLow)
+}
+
+// LagStats returns the lost ticks handling counters.
+func (wt *WTimer) LagStats() LagStats {
+	return LagStats{
+		Events:    atomic.LoadUint64(&wt.lagEvents),
+		LostTicks: atomic.LoadUint64(&wt.lagTicks),
+		Coalesced: atomic.LoadUint64(&wt.lagCoalesced),
+		Dropped:   atomic.LoadUint64(&wt.lagDropped),
+	}
+}
+
+// resetLagStats resets the lost ticks handling counters.
+func (wt *WTimer) resetLagStats() {
+	atomic.StoreUint32(&wt.catchingUp, 0)
+	atomic.StoreUint64(&wt.catchUp, 0)
+	atomic.StoreUint64(&wt.lagEvents, 0)
+	atomic.StoreUint64(&wt.lagTicks, 0)
+	atomic.StoreUint64(&wt.lagCoalesced, 0)
+	atomic.StoreUint64(&wt.lagDropped, 0)
+}
+
+// catchUpTo advances the time to target (like advanceTimeTo()), handling
+// the case in which the timer wheel is behind schedule (more then
+// Config.LagTicks ticks to advance).
+func (wt *WTimer) catchUpTo(target Ticks) {
+	lag := wt.cfg.LagTicks
+	if lag <= 0 {
+		lag = defaultLagTicks
+	}
+	lost := target.Sub(wt.Now()).Val()
+	if lost <= uint64(lag) {
+		wt.advanceTimeTo(target)
+		return
+	}
+	atomic.AddUint64(&wt.lagEvents, 1)
+	atomic.AddUint64(&wt.lagTicks, lost)
+	if wt.warnOn() {
+		wt.warn(nil, "timer wheel behind schedule: %d ticks (%s) lost\n",
+			lost, wt.Duration(target.Sub(wt.Now())))
+	}
+	// the target is set before marking the catch-up start, so that
+	// catchUpTarget() never sees an old target
+	atomic.StoreUint64(&wt.catchUp, target.Val())
+	atomic.StoreUint32(&wt.catchingUp, 1)
+	if wt.cfg.CatchUp == CatchUpFastForward {
+		wt.fastForwardTo(target)
+	} else {
+		wt.advanceTimeTo(target)
+	}
+	atomic.StoreUint32(&wt.catchingUp, 0)
+}
+
+// fastForwardTo advances the time to target (like advanceTimeTo()), but
+// in a single pass: first all the timers expiring up to target are moved
+// to the expired list (tick by tick, cascading them from the higher wheels
+// as needed) and only then they are run.
+// It must never be called in parallel.
+func (wt *WTimer) fastForwardTo(target Ticks) {
+	wt.lock()
+	wt.drainAddQ(wt.Now())
+	for wt.Now().LT(target) {
+		wt.incTime()
+		wt.redistTimers(wt.Now())
+	}
+	now := wt.Now()
+	wt.processExpired(now)
+	if next, ok := wt.cachedNextExp(); ok && !next.GT(now) {
+		wt.setNextExp(Ticks{}, false) // expired, re-compute on the next use
+	}
+	wt.unlock()
+}
+
+// skipCatchUp returns the base time for re-arming a periodic timer
+// and true if it should be re-armed relative to the catch-up end
+// (CatchUpSkipPeriodic).
+func (wt *WTimer) skipCatchUp() (Ticks, bool) {
+	if wt.cfg.CatchUp != CatchUpSkipPeriodic {
+		return Ticks{}, false
+	}
+	return wt.catchUpTarget()
+}
+
+// catchUpTarget returns the time to which the timer wheel is catching up
+// and true, or false if not behind schedule.
+func (wt *WTimer) catchUpTarget() (Ticks, bool) {
+	if atomic.LoadUint32(&wt.catchingUp) == 0 {
+		return Ticks{}, false
+	}
+	return NewTicks(atomic.LoadUint64(&wt.catchUp)), true
+}
+
+// countCoalesced counts the fires skipped by the periodic timer t re-armed
+// while catching up (see LagStats.Coalesced).
+func (wt *WTimer) countCoalesced(t *TimerLnk) {
+	target, ok := wt.catchUpTarget()
+	if !ok {
+		return
+	}
+	now := wt.Now()
+	iv := wt.TicksRoundUp(t.intvl)
+	if t.expire.GT(target) && target.GT(now) && iv.Val() != 0 {
+		atomic.AddUint64(&wt.lagCoalesced, target.Sub(now).Val()/iv.Val())
+	}
+}
+
+// lagDrop returns true if the expired timer t should be dropped because
+// the timer wheel is behind schedule (Config.LagDropLow).
+func (wt *WTimer) lagDrop(t *TimerLnk, flags uint8) bool {
+	if !wt.cfg.LagDropLow || flags&(Ffast|FgoR) != 0 ||
+		t.extView().class != uint8(PrioLow) {
+		return false
+	}
+	_, behind := wt.catchUpTarget()
+	return behind
+}
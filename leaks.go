@@ -0,0 +1,187 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// LeakInfo contains information about a possibly leaked timer
+// (see FindLeaks()).
+type LeakInfo struct {
+	T     *TimerLnk
+	Age   time.Duration // time since the timer was added
+	Intvl time.Duration // current timer interval
+	Site  string        // Add*() caller, empty if not Config.TrackAddSite
+}
+
+// String returns a short description of the leaked timer.
+func (l *LeakInfo) String() string {
+	s := fmt.Sprintf("timer %p active for %s (interval %s)",
+		l.T, l.Age, l.Intvl)
+	if l.Site != "" {
+		s += " added from " + l.Site
+	}
+	return s
+}
+
+// addSite returns the pc of the public Add*() function caller, if
+// Config.TrackAddSite is set and 0 otherwise.
+// It must be called directly from the internal add*() functions.
+func (wt *WTimer) addSite() uintptr {
+	if !wt.cfg.TrackAddSite {
+		return 0
+	}
+	var pc [1]uintptr
+	// skip runtime.Callers, addSite, add*() and Add*()
+	if runtime.Callers(4, pc[:]) == 0 {
+		return 0
+	}
+	return pc[0]
+}
+
+// setSite records the add site of tl, returned by addSite().
+// It must be called with tl.lock held.
+func (wt *WTimer) setSite(tl *TimerLnk, site uintptr) {
+	if site != 0 {
+		wt.extOf(tl).site = site
+	} else if x := tl.ext(); x != nil {
+		x.site = 0
+	}
+}
+
+// siteStr returns a file:line function description for an add site pc.
+func siteStr(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	frames := runtime.CallersFrames([]uintptr{pc})
+	fr, _ := frames.Next()
+	return fmt.Sprintf("%s:%d %s", fr.File, fr.Line, fr.Function)
+}
+
+// FindLeaks returns the timers that are waiting on the wheels and were
+// added more then age ago or more then mult times their interval ago
+// (a 0 value disables the corresponding check).
+// A timer is considered added by the Add*() functions, the periodic re-arms
+// do not change its age, so it can be used for finding timers that are
+// never stopped (e.g. belonging to leaked sessions). The add site is
+// reported only if Config.TrackAddSite is set.
+// The running or expired timers are not checked.
+// It walks all the timers, taking the internal lock for each wheel list.
+func (wt *WTimer) FindLeaks(age time.Duration, mult uint) []LeakInfo {
+	var leaks []LeakInfo
+	var sites []uintptr // resolved after the lock is released
+	if age == 0 && mult == 0 {
+		return nil
+	}
+	for i := range wt.wlists {
+		lst := &wt.wlists[i]
+		wt.lock()
+		now := wt.Now()
+		lst.forEach(func(e *TimerLnk) bool {
+			if e.info.flags()&fDelete != 0 {
+				return true // DelLazy()-ed
+			}
+			a := wt.Duration(now.Sub(e.added))
+			if (age != 0 && a > age) ||
+				(mult != 0 && a > time.Duration(mult)*e.intvl) {
+				leaks = append(leaks, LeakInfo{T: e, Age: a, Intvl: e.intvl})
+				sites = append(sites, e.extView().site)
+			}
+			return true
+		})
+		wt.unlock()
+	}
+	for i := range leaks {
+		leaks[i].Site = siteStr(sites[i])
+	}
+	return leaks
+}
+
+// SiteCount contains the number of waiting timers added from the same
+// place (see AddSites()).
+type SiteCount struct {
+	Site   string // Add*() caller
+	Timers int    // number of timers
+}
+
+// AddSites returns the number of timers waiting on the wheels for each
+// Add*() caller, sorted by the number of timers (highest first), so
+// that the code that keeps adding timers that are never stopped can be
+// easily found. It returns nil if Config.TrackAddSite is not set.
+// It walks all the timers, taking the internal lock for each wheel list.
+func (wt *WTimer) AddSites() []SiteCount {
+	if !wt.cfg.TrackAddSite {
+		return nil
+	}
+	sites := make(map[uintptr]int)
+	for i := range wt.wlists {
+		lst := &wt.wlists[i]
+		wt.lock()
+		lst.forEach(func(e *TimerLnk) bool {
+			site := e.extView().site
+			if e.info.flags()&fDelete == 0 && site != 0 {
+				sites[site]++ // not DelLazy()-ed
+			}
+			return true
+		})
+		wt.unlock()
+	}
+	return siteCounts(sites, 0)
+}
+
+// siteCounts returns the top n (0 for all) elements of the add site pc
+// to timers number map sites, sorted by the number of timers.
+func siteCounts(sites map[uintptr]int, n int) []SiteCount {
+	if len(sites) == 0 {
+		return nil
+	}
+	pcs := make([]uintptr, 0, len(sites))
+	for pc := range sites {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if sites[pcs[i]] != sites[pcs[j]] {
+			return sites[pcs[i]] > sites[pcs[j]]
+		}
+		return pcs[i] < pcs[j]
+	})
+	if n > 0 && len(pcs) > n {
+		pcs = pcs[:n]
+	}
+	res := make([]SiteCount, len(pcs))
+	for i, pc := range pcs {
+		res[i] = SiteCount{Site: siteStr(pc), Timers: sites[pc]}
+	}
+	return res
+}
+
+// leakScanLoop periodically looks for leaked timers, until Shutdown() is
+// called (see Config.LeakScanIntvl).
+func (wt *WTimer) leakScanLoop() {
+	ticker := time.NewTicker(wt.cfg.LeakScanIntvl)
+loop:
+	for {
+		select {
+		case <-wt.cancel:
+			break loop
+		case <-ticker.C:
+			if !wt.warnOn() {
+				continue
+			}
+			leaks := wt.FindLeaks(wt.cfg.LeakAge, wt.cfg.LeakIntvlMult)
+			for i := range leaks {
+				wt.warn(leaks[i].T, "leaked timer: %s\n", &leaks[i])
+			}
+		}
+	}
+	ticker.Stop()
+}
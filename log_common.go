@@ -27,6 +27,18 @@ const (
 var Log slog.Log = slog.New(slog.LDBG, slog.LbackTraceS|slog.LlocInfoS,
 	slog.LStdErr)
 
+// Logger is the interface used for per WTimer instance logging
+// (see Config.Log). It is implemented by slog.Log.
+type Logger interface {
+	// L returns true if logging at level lev is enabled.
+	L(lev slog.LogLevel) bool
+	// LLog logs a message at level lev. callersSkip has the same meaning
+	// as for slog.Log.LLog() (stack frames to skip when adding the
+	// location information).
+	LLog(lev slog.LogLevel, callersSkip int, prefix string,
+		f string, args ...interface{})
+}
+
 // WARNon() is a shorthand for checking if logging at LWARN level is enabled
 func WARNon() bool {
 	return Log.WARNon()
@@ -58,3 +70,14 @@ func PANIC(f string, a ...interface{}) {
 	Log.LLog(slog.LBUG, 1, "", "%s", s)
 	panic(s)
 }
+
+// errOn is a shorthand for checking if logging at LERR level is enabled
+// for wt.
+func (wt *WTimer) errOn() bool {
+	return wt.log.L(slog.LERR)
+}
+
+// err is a shorthand for logging an error message using wt logger.
+func (wt *WTimer) err(f string, a ...interface{}) {
+	wt.log.LLog(slog.LERR, 1, pERR, f, a...)
+}
@@ -27,3 +27,13 @@ func DBGon() bool {
 func DBG(f string, a ...interface{}) {
 	Log.LLog(slog.LDBG, 1, pDBG, f, a...)
 }
+
+// dbgOn is a shorthand for checking if debug logging is enabled for wt.
+func (wt *WTimer) dbgOn() bool {
+	return wt.log.L(slog.LDBG)
+}
+
+// dbg is a shorthand for logging a debug message using wt logger.
+func (wt *WTimer) dbg(f string, a ...interface{}) {
+	wt.log.LLog(slog.LDBG, 1, pDBG, f, a...)
+}
@@ -24,3 +24,12 @@ func DBGon() bool {
 // DBG is a shorthand for logging a debug message.
 func DBG(f string, a ...interface{}) {
 }
+
+// dbgOn is a shorthand for checking if debug logging is enabled for wt.
+func (wt *WTimer) dbgOn() bool {
+	return false
+}
+
+// dbg is a shorthand for logging a debug message using wt logger.
+func (wt *WTimer) dbg(f string, a ...interface{}) {
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// Migrate moves all the armed timers from wt to dst, keeping their
+// remaining time (the expire is re-computed using the dst ticks), e.g. for
+// changing the tick duration without dropping timers.
+// The move is atomic: both timer wheels are locked while moving and the
+// timers expire in dst even if they were about to expire in wt.
+// The timers already queued for running or running (e.g. periodic timers
+// that will be re-armed after running) are not moved and remain in wt.
+// After Migrate() all the operations on the moved timers must use dst.
+// It returns the number of moved timers.
+// Two Migrate() calls between the same instances must not run in parallel
+// in opposite directions.
+func (wt *WTimer) Migrate(dst *WTimer) (int, error) {
+	if dst == nil || dst == wt {
+		return 0, ErrInvalidParameters
+	}
+	wt.lock()
+	dst.lock()
+	now := wt.Now()
+	dstNow := dst.Now()
+	wt.drainAddQ(now)
+	n := 0
+	var err error
+	mv := func(lst *timerLst, t *TimerLnk) bool {
+		if err = lst.rm(wt, t); err != nil {
+			return false
+		}
+		t.next = nil
+		t.prev = nil
+		if t.info.flags()&fDelete != 0 {
+			// marked by DelLazy() (already not counted)
+			t.info.setFlags(fRemoved)
+			return true
+		}
+		wt.activeDec(t)
+		if err = dst.migrateTimer(t, wt, now, dstNow); err != nil {
+			t.info.setFlags(fRemoved)
+			return false
+		}
+		n++
+		return true
+	}
+wheels:
+	for w := range wt.wheels {
+		for i := range wt.wheels[w].lsts {
+			wt.wheels[w].lsts[i].forEachSafeRm(mv)
+			if err != nil {
+				break wheels
+			}
+		}
+	}
+	if err == nil {
+		wt.expired.forEachSafeRm(mv)
+	}
+	wt.setNextExp(Ticks{}, false) // re-compute on the next use
+	dst.unlock()
+	wt.unlock()
+	return n, err
+}
+
+// migrateTimer adds the timer t, removed from src, keeping its remaining
+// time (see Migrate()).
+// It must be called with both wt.lock() and src.lock() held.
+func (wt *WTimer) migrateTimer(t *TimerLnk, src *WTimer,
+	srcNow, now Ticks) error {
+	// src ticks left, including the not yet started legs (long intervals)
+	x := t.extView()
+	left := x.left
+	if t.expire.GT(srcNow) {
+		left += t.expire.Sub(srcNow).Val()
+	}
+	var ahead uint64
+	if left != 0 {
+		ahead = wt.roundTicks(time.Duration(left)*src.tickDuration, x.round)
+	}
+	age, _ := wt.Ticks(src.Duration(srcNow.Sub(t.added)))
+	if err := wt.setExpire(t, now, ahead); err != nil {
+		return err
+	}
+	t.added = now.Sub(age)
+	w, idx := getWheelPos(t.expire, now)
+	if err := wt.appendTimer(t, w, idx); err != nil {
+		return err
+	}
+	wt.activeInc(t)
+	wt.nextExpAdded(t.expire)
+	return nil
+}
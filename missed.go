@@ -0,0 +1,134 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+// MissPolicy decides how a periodic timer handles the periods missed
+// because the timer wheel stalled or fell behind schedule, or because its
+// handler was delayed (see SetMissPolicy()).
+// It applies only to the timers whose handler returns Periodic (and does
+// not call Add*()).
+type MissPolicy uint8
+
+const (
+	// MissDefault: the timer is re-armed relative to the end of its
+	// handler, the missed periods are handled according to
+	// Config.CatchUp (default).
+	MissDefault MissPolicy = iota
+	// MissRealign: the handler runs once and the timer is re-armed
+	// relative to the current time (the timer period phase changes).
+	MissRealign
+	// MissBurst: the handler runs once for each missed period, the runs
+	// for the missed periods follow each other as fast as possible (one
+	// per tick) and then the timer keeps its original period phase.
+	MissBurst
+	// MissReport: the handler runs once and it can get the number of
+	// missed periods with MissedPeriods(). The timer keeps its original
+	// period phase.
+	MissReport
+)
+
+// String returns the policy name.
+func (p MissPolicy) String() string {
+	switch p {
+	case MissDefault:
+		return "default"
+	case MissRealign:
+		return "realign"
+	case MissBurst:
+		return "burst"
+	case MissReport:
+		return "report"
+	}
+	return "invalid"
+}
+
+// SetMissPolicy sets how the periods missed by a periodic timer are
+// handled (see MissPolicy). With a policy other then MissDefault the
+// timer periods are counted from its first expire, not from the end of
+// each handler run, so a periodic timer with a non-default policy will
+// not drift.
+// It has the same usage restrictions as Reset() (the new policy is used
+// starting with the next re-arm). A re-initialised timer (InitTimer())
+// has the MissDefault policy.
+func (wt *WTimer) SetMissPolicy(tl *TimerLnk, p MissPolicy) error {
+	if p > MissReport {
+		return wt.opErr("SetMissPolicy", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetMissPolicy", tl, err)
+	}
+	wt.extOf(tl).miss = p
+	return nil
+}
+
+// MissedPeriods returns the number of whole periods that passed between
+// the time at which the current run of the timer was due and the time at
+// which its handler was started: the missed periods for MissRealign and
+// MissReport and the still pending runs for MissBurst. It returns 0 for
+// MissDefault timers.
+// It must be called only from the timer own handler.
+func (wt *WTimer) MissedPeriods(tl *TimerLnk) uint64 {
+	x := tl.extView()
+	if x.miss == MissDefault {
+		return 0
+	}
+	return x.nmiss
+}
+
+// missRef returns the current time for the missed periods computation:
+// the time up to which the timer wheel is catching up, if behind schedule,
+// or the timer wheel time.
+func (wt *WTimer) missRef() Ticks {
+	if target, ok := wt.catchUpTarget(); ok {
+		return target
+	}
+	return wt.Now()
+}
+
+// missedPeriods returns the number of periods of t that passed since the
+// current run was due (see MissedPeriods()) and the due time.
+func (wt *WTimer) missedPeriods(t *TimerLnk) (uint64, Ticks) {
+	x := t.extView()
+	due := t.expire.SubUint64(x.late)
+	ref := wt.missRef()
+	if !ref.GT(due) {
+		return 0, due
+	}
+	return ref.Sub(due).Val() / wt.roundTicks(t.intvl, x.round), due
+}
+
+// rearmMissedUnsafe re-adds the periodic timer t, after its handler ran,
+// according to its MissPolicy.
+// It must be called with the same locks as addUnsafe().
+func (wt *WTimer) rearmMissedUnsafe(t *TimerLnk) error {
+	x := wt.extOf(t) // allocated by SetMissPolicy()
+	iv := wt.roundTicks(t.intvl, x.round)
+	n, due := wt.missedPeriods(t)
+	var next Ticks
+	switch x.miss {
+	case MissRealign:
+		next = wt.missRef().AddUint64(iv)
+	case MissBurst:
+		next = due.AddUint64(iv)
+	default:
+		next = due.AddUint64((n + 1) * iv)
+	}
+	now := wt.Now()
+	ahead := uint64(1) // late => as soon as possible
+	if next.GT(now) {
+		ahead = next.Sub(now).Val()
+	}
+	if err := wt.setExpire(t, now, ahead); err != nil {
+		return err
+	}
+	if t.expire.GT(next) {
+		// remember the due time (MissBurst)
+		x.late = t.expire.Sub(next).Val()
+	}
+	w, idx := getWheelPos(t.expire, now)
+	return wt.appendTimer(t, w, idx)
+}
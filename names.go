@@ -0,0 +1,84 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetName sets the timer name, used for identifying the timer in the log
+// messages and dumps (see TimerLnk.String()), e.g. by purpose
+// ("keepalive", "reg-refresh").
+// It has the same usage restrictions as Reset(). A re-initialised timer
+// (InitTimer()) has no name.
+func (wt *WTimer) SetName(tl *TimerLnk, name string) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetName", tl, err)
+	}
+	wt.extOf(tl).name = name
+	return nil
+}
+
+// Name returns the timer name (see SetName()).
+func (tl *TimerLnk) Name() string {
+	return tl.extView().name
+}
+
+// String returns a short description of the timer: name, state, flags,
+// wheel position and expire.
+// The timer is not locked, so for an active timer the result is only
+// a best-effort approximation.
+func (tl *TimerLnk) String() string {
+	if tl == nil {
+		return "timer <nil>"
+	}
+	f, w, idx := tl.info.getAll()
+	name := tl.extView().name
+	if name == "" {
+		name = "-"
+	}
+	return fmt.Sprintf("timer %q %p [%s] flags 0x%02x wheel %d/%d"+
+		" expire %s", name, tl, tl.State(), f, w, idx, tl.expire)
+}
+
+// GoString returns a Go-syntax like representation of the timer, used by
+// the %#v format.
+func (tl *TimerLnk) GoString() string {
+	if tl == nil {
+		return "(*wtimer.TimerLnk)(nil)"
+	}
+	f, w, idx := tl.info.getAll()
+	return fmt.Sprintf("&wtimer.TimerLnk{name: %q, flags: 0x%02x,"+
+		" wheel: %d, idx: %d, expire: %s, intvl: %s, handler: %q}"+
+		" /* %p */", tl.extView().name, f, w, idx, tl.expire, tl.intvl,
+		handlerStr(tl.f), tl)
+}
+
+// String returns the names of the states set in s (e.g. "active,armed").
+func (s TimerState) String() string {
+	var b strings.Builder
+	add := func(set bool, name string) {
+		if !set {
+			return
+		}
+		if b.Len() != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+	}
+	add(s.Flags&Ffast != 0, "fast")
+	add(s.Flags&FgoR != 0, "goR")
+	add(s.Active, "active")
+	add(!s.Active, "inactive")
+	add(s.Armed, "armed")
+	add(s.Expired, "expired")
+	add(s.Running, "running")
+	add(s.Removed, "removed")
+	add(s.DelPending, "del-pending")
+	return b.String()
+}
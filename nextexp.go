@@ -0,0 +1,172 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// nextExpNone marks an invalid cached nearest expire (wt.nextExp).
+// It is never a valid Ticks value with the default TicksBits. With the
+// ticks64 build tag all the values are valid Ticks, so a nearest expire
+// equal to it is not cached (it will be re-computed on each use).
+const nextExpNone = ^uint64(0)
+
+// cachedNextExp returns the cached nearest expire and whether it is valid.
+func (wt *WTimer) cachedNextExp() (Ticks, bool) {
+	v := atomic.LoadUint64(&wt.nextExp)
+	return NewTicks(v), v != nextExpNone
+}
+
+// setNextExp sets the cached nearest expire.
+// It must be called with wt.lock() held.
+func (wt *WTimer) setNextExp(next Ticks, ok bool) {
+	v := nextExpNone
+	if ok {
+		v = next.Val()
+	}
+	atomic.StoreUint64(&wt.nextExp, v)
+}
+
+// nextExpAdded updates the cached nearest expire after adding a timer
+// expiring at expire. In tickless mode it also wakes up the sleeping
+// timer goroutine if the new timer expires before the wake up time.
+// It must be called with wt.lock() or wt.rlock() held.
+func (wt *WTimer) nextExpAdded(expire Ticks) {
+	for {
+		v := atomic.LoadUint64(&wt.nextExp)
+		if v == nextExpNone || !expire.LT(NewTicks(v)) ||
+			atomic.CompareAndSwapUint64(&wt.nextExp, v, expire.Val()) {
+			break
+		}
+	}
+	wt.wakeBefore(expire)
+}
+
+// wakeBefore wakes up the timer goroutine, if sleeping in tickless mode
+// and it should wake up after expire.
+func (wt *WTimer) wakeBefore(expire Ticks) {
+	if atomic.LoadUint32(&wt.sleeping) != 0 && expire.LT(wt.wakeAt) &&
+		atomic.CompareAndSwapUint32(&wt.sleeping, 1, 0) {
+		select {
+		case wt.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextExpRemoved updates the cached nearest expire after removing a timer
+// expiring at expire.
+// It must be called with wt.lock() or wt.rlock() held.
+func (wt *WTimer) nextExpRemoved(expire Ticks) {
+	v := atomic.LoadUint64(&wt.nextExp)
+	if v != nextExpNone && expire.EQ(NewTicks(v)) {
+		// might be the last one, re-compute
+		atomic.CompareAndSwapUint64(&wt.nextExp, v, nextExpNone)
+	}
+}
+
+// lstMinExpire returns the minimum expire of the timers in lst, relative
+// to now.
+// It must be called with the lock protecting lst held, on a non-empty list.
+func lstMinExpire(lst *timerLst, now Ticks) Ticks {
+	min := lst.head.next.expire
+	lst.forEach(func(e *TimerLnk) bool {
+		if e.expire.Sub(now).Val() < min.Sub(now).Val() {
+			min = e.expire
+		}
+		return true
+	})
+	return min
+}
+
+// computeNextExp returns the expire of the nearest timer on the wheels
+// and true, or false if there are no timers on the wheels.
+// It must be called with wt.lock() held.
+func (wt *WTimer) computeNextExp(now Ticks) (Ticks, bool) {
+	var next Ticks
+	found := false
+	// wheel 0 timers expire exactly at the list position
+	// (the current position might contain timers not yet run)
+	for d := uint64(0); d < W0Entries; d++ {
+		if !wt.wheels[0].lsts[wheel0Pos(now.Val()+d)].isEmpty() {
+			next = now.AddUint64(d)
+			found = true
+			break
+		}
+	}
+	// for the higher wheels each list contains timers expiring in the
+	// corresponding wheel "slot", the lists are checked in time order,
+	// starting with the next slot (the current position contains only
+	// timers for the next wheel rotation)
+	for w := uint8(1); w < WheelsNo; w++ {
+		lsts := wt.wheels[w].lsts
+		crt := int(wheelPos(w, now.Val()))
+		for i := 1; i <= len(lsts); i++ {
+			lst := &lsts[(crt+i)%len(lsts)]
+			if lst.isEmpty() {
+				continue
+			}
+			e := lstMinExpire(lst, now)
+			if !found || e.Sub(now).Val() < next.Sub(now).Val() {
+				next = e
+				found = true
+			}
+			break
+		}
+	}
+	return next, found
+}
+
+// NextExpire returns the expire of the nearest pending timer, the
+// duration until it expires and true. If there are no pending timers it
+// returns false.
+// If there are expired timers waiting to be run or timers waiting to be
+// added (see Config.AddQueue), it returns the current time (wt.Now())
+// and 0.
+// The nearest expire is cached and re-computed (by walking the wheels)
+// only if the nearest timer was removed or has expired.
+// It can be used for integrating the timers into an external event loop
+// (e.g. sleep until the next expire and then advance the time).
+func (wt *WTimer) NextExpire() (Ticks, time.Duration, bool) {
+	wt.lock()
+	next, d, ok := wt.nextExpireUnsafe()
+	wt.unlock()
+	return next, d, ok
+}
+
+// nextExpireUnsafe is the internal version of NextExpire().
+// It must be called with wt.lock() held.
+func (wt *WTimer) nextExpireUnsafe() (Ticks, time.Duration, bool) {
+	now := wt.Now()
+	pending := !wt.expired.isEmpty() || !wt.addQ.isEmpty()
+	for i := 0; i < len(wt.rQs) && !pending; i++ {
+		wt.rQs[i].lock.Lock()
+		pending = !wt.rQs[i].lst.isEmpty()
+		wt.rQs[i].lock.Unlock()
+	}
+	if pending {
+		return now, 0, true
+	}
+	if wt.Len() == 0 {
+		return Ticks{}, 0, false
+	}
+	next, ok := wt.cachedNextExp()
+	if !ok || !next.GT(now) {
+		next, ok = wt.computeNextExp(now)
+		wt.setNextExp(next, ok)
+	}
+	if !ok {
+		return Ticks{}, 0, false
+	}
+	var d time.Duration
+	if next.GT(now) {
+		d = wt.Duration(next.Sub(now))
+	}
+	return next, d, true
+}
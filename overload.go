@@ -0,0 +1,179 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+)
+
+// OverloadPolicy decides what happens with an expired timer that should be
+// queued for running when the run queues are full (see Config.RunQueueMax).
+type OverloadPolicy uint8
+
+const (
+	// OverloadBlock: the timer goroutine waits until the run queues
+	// workers make room (delaying all the other timers).
+	OverloadBlock OverloadPolicy = iota
+	// OverloadDrop: the timer is removed without running its handler and
+	// Config.DropF is called.
+	OverloadDrop
+	// OverloadGoR: the timer handler is run like for a FgoR timer, in a
+	// separate goroutine.
+	OverloadGoR
+)
+
+// String returns the policy name.
+func (p OverloadPolicy) String() string {
+	switch p {
+	case OverloadBlock:
+		return "block"
+	case OverloadDrop:
+		return "drop"
+	case OverloadGoR:
+		return "goR"
+	}
+	return "invalid"
+}
+
+// RunQueueStats contains the run queues depth and saturation statistics
+// (see Config.RunQueueMax).
+type RunQueueStats struct {
+	Depth    int    // handlers waiting in the run queues
+	MaxDepth int    // maximum depth reached
+	Blocked  uint64 // times the timer goroutine waited (OverloadBlock)
+	Dropped  uint64 // timers dropped (OverloadDrop)
+	Spilled  uint64 // timers run in separate goroutines (OverloadGoR)
+	// SigDrops counts the work signals dropped because the signal
+	// channel was full (see Config.RunQueueSignal).
+	SigDrops uint64
+}
+
+// RunQueueStats returns the run queues depth and saturation counters.
+func (wt *WTimer) RunQueueStats() RunQueueStats {
+	return RunQueueStats{
+		Depth:    int(atomic.LoadInt64(&wt.rQdepth)),
+		MaxDepth: int(atomic.LoadInt64(&wt.rQmaxDepth)),
+		Blocked:  atomic.LoadUint64(&wt.rQblocked),
+		Dropped:  atomic.LoadUint64(&wt.rQdropped),
+		Spilled:  atomic.LoadUint64(&wt.rQspilled),
+		SigDrops: atomic.LoadUint64(&wt.rQsigDrops),
+	}
+}
+
+// RunQueueDepth contains the depth of a run queue.
+type RunQueueDepth struct {
+	Class    string // run class name
+	Queue    int    // queue index in the run class
+	Depth    int    // handlers waiting in the run queue
+	MaxDepth int    // maximum depth reached
+}
+
+// RunQueueDepths returns the current and maximum depth of each run queue,
+// in the run classes order (priorities first, see Config.RunClasses).
+// A queue with a high depth while the others are empty points to slow
+// handlers blocking it (see Config.RunBatch).
+func (wt *WTimer) RunQueueDepths() []RunQueueDepth {
+	var d []RunQueueDepth
+	for c := range wt.rClasses {
+		cls := &wt.rClasses[c]
+		for i := 0; i < cls.n; i++ {
+			rq := &wt.rQs[cls.first+i]
+			d = append(d, RunQueueDepth{
+				Class:    cls.name,
+				Queue:    i,
+				Depth:    int(atomic.LoadInt64(&rq.depth)),
+				MaxDepth: int(atomic.LoadInt64(&rq.maxDepth)),
+			})
+		}
+	}
+	return d
+}
+
+// resetRQStats resets the run queues depth and saturation counters.
+func (wt *WTimer) resetRQStats() {
+	atomic.StoreInt64(&wt.rQdepth, 0)
+	atomic.StoreInt64(&wt.rQmaxDepth, 0)
+	atomic.StoreUint64(&wt.rQblocked, 0)
+	atomic.StoreUint64(&wt.rQdropped, 0)
+	atomic.StoreUint64(&wt.rQspilled, 0)
+	atomic.StoreUint64(&wt.rQsigDrops, 0)
+}
+
+// rqFull returns true if the run queues depth reached Config.RunQueueMax.
+func (wt *WTimer) rqFull() bool {
+	max := wt.cfg.RunQueueMax
+	return max > 0 && atomic.LoadInt64(&wt.rQdepth) >= int64(max)
+}
+
+// rqQueued updates the run queues depth after a timer was queued on the
+// run queue idx. It must be called with wt.rQs[idx].lock held.
+func (wt *WTimer) rqQueued(idx int) {
+	rq := &wt.rQs[idx]
+	if d := atomic.AddInt64(&rq.depth, 1); d > rq.maxDepth {
+		atomic.StoreInt64(&rq.maxDepth, d)
+	}
+	d := atomic.AddInt64(&wt.rQdepth, 1)
+	for {
+		m := atomic.LoadInt64(&wt.rQmaxDepth)
+		if d <= m || atomic.CompareAndSwapInt64(&wt.rQmaxDepth, m, d) {
+			return
+		}
+	}
+}
+
+// rqDequeued updates the run queues depth after n timers were removed from
+// the run queue idx and wakes up the timer goroutine if waiting for room
+// (OverloadBlock). It must be called with wt.rQs[idx].lock held (or after
+// the workers were stopped).
+func (wt *WTimer) rqDequeued(idx int, n int64) {
+	atomic.AddInt64(&wt.rQs[idx].depth, -n)
+	d := atomic.AddInt64(&wt.rQdepth, -n)
+	if max := int64(wt.cfg.RunQueueMax); max > 0 && d < max && d+n >= max {
+		select {
+		case wt.rQfree <- struct{}{}:
+		default:
+			// already signaled
+		}
+	}
+}
+
+// waitRQFree waits until the run queues are not full anymore.
+// It must be called with wt.lock() held, but it will release it while
+// waiting. It returns false, without waiting, if Shutdown() was called.
+func (wt *WTimer) waitRQFree() bool {
+	select {
+	case <-wt.cancel:
+		return false
+	default:
+	}
+	atomic.AddUint64(&wt.rQblocked, 1)
+	wt.unlock()
+	ok := true
+	select {
+	case <-wt.rQfree:
+	case <-wt.cancel:
+		ok = false
+	}
+	wt.lock()
+	return ok
+}
+
+// dropExpired removes the expired timer t, without running it
+// (e.g. OverloadDrop), increments the cnt drop counter and calls
+// Config.DropF.
+// It must be called with wt.lock() held, but it will release it while
+// calling DropF.
+func (wt *WTimer) dropExpired(t *TimerLnk, cnt *uint64) {
+	t.info.setFlags(fRemoved)
+	wt.activeDec(t)
+	atomic.AddUint64(cnt, 1)
+	if f := wt.cfg.DropF; f != nil {
+		wt.unlock()
+		f(wt, t)
+		wt.lock()
+	}
+}
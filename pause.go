@@ -0,0 +1,104 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/intuitivelabs/timestamp"
+)
+
+// Pause freezes the timer wheel time: the ticks stop advancing and no
+// timer expires until Resume() is called. The timers can still be added
+// or deleted while paused (the new timers expire relative to the frozen
+// time). It cannot be used in simulation mode (see RunTicks()).
+// It returns false if already paused (or in simulation mode).
+func (wt *WTimer) Pause() bool {
+	wt.pauseLock.Lock()
+	defer wt.pauseLock.Unlock()
+	if wt.Paused() || wt.cfg.Simulation {
+		return false
+	}
+	now := wt.timeNow()
+	if now.IsZero() {
+		// zero means not paused, use the closest value
+		now = now.Add(1)
+	}
+	timestamp.AtomicStore(&wt.pausedTS, now)
+	return true
+}
+
+// Resume restarts the timer wheel time after Pause(), from the value
+// it had when paused, so that all the pending timers keep their
+// remaining time. It returns the pause duration, or 0 and false if not
+// paused.
+func (wt *WTimer) Resume() (time.Duration, bool) {
+	wt.pauseLock.Lock()
+	defer wt.pauseLock.Unlock()
+	frozen := timestamp.AtomicLoad(&wt.pausedTS)
+	if frozen.IsZero() {
+		return 0, false
+	}
+	off := time.Duration(atomic.LoadInt64(&wt.pauseOff))
+	// time.Now() - new offset must be equal to the frozen time
+	newOff := wt.clock.Now().Sub(frozen)
+	atomic.StoreInt64(&wt.pauseOff, int64(newOff))
+	timestamp.AtomicStore(&wt.pausedTS, timestamp.TS(0))
+	return newOff - off, true
+}
+
+// resetPause resets the Pause() and SuspendDispatch() state.
+func (wt *WTimer) resetPause() {
+	timestamp.AtomicStore(&wt.pausedTS, timestamp.TS(0))
+	atomic.StoreInt64(&wt.pauseOff, 0)
+	atomic.StoreUint32(&wt.held, 0)
+}
+
+// SuspendDispatch stops running the timers handlers, while the time still
+// advances and the timers can still be added or deleted (e.g. for
+// maintenance windows). The expired timers accumulate and their handlers
+// are run after ResumeDispatch(). The handlers already running are not
+// affected.
+// It returns false if already suspended.
+func (wt *WTimer) SuspendDispatch() bool {
+	return atomic.CompareAndSwapUint32(&wt.held, 0, 1)
+}
+
+// ResumeDispatch resumes running the timers handlers after
+// SuspendDispatch(): the timers that expired meanwhile are run starting
+// with the next tick. It returns false if not suspended.
+func (wt *WTimer) ResumeDispatch() bool {
+	if atomic.LoadUint32(&wt.held) == 0 {
+		return false
+	}
+	// re-dispatch the timers left on the run queues
+	wt.requeueRQs()
+	if !atomic.CompareAndSwapUint32(&wt.held, 1, 0) {
+		return false
+	}
+	wt.wakeBefore(wt.Now())
+	return true
+}
+
+// DispatchSuspended returns true if running the handlers is suspended (see
+// SuspendDispatch()).
+func (wt *WTimer) DispatchSuspended() bool {
+	return atomic.LoadUint32(&wt.held) != 0
+}
+
+// dispatchStopped returns true if no new handlers should be run from the
+// run queues (SuspendDispatch() or ShutdownContext()).
+func (wt *WTimer) dispatchStopped() bool {
+	return atomic.LoadUint32(&wt.held) != 0 ||
+		atomic.LoadUint32(&wt.stopRun) != 0
+}
+
+// Paused returns true if the timer wheel time is frozen (see Pause()).
+func (wt *WTimer) Paused() bool {
+	return !timestamp.AtomicLoad(&wt.pausedTS).IsZero()
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// runHandler runs the handler of the timer t, on the path p. If
+// Config.ProfLabels is set, the handler runs with pprof labels identifying
+// it (see profLabels()). If Config.StuckThreshold is set, the handler is
+// watched by the stuck handlers watchdog. If t has a deadline (see
+// SetDeadline()), the handler context is cancelled when it passes. If t is
+// chained (see Chain()) and it completes, the next timer is added. The
+// children of t (see SetParent()) are removed before running the handler.
+func (wt *WTimer) runHandler(t *TimerLnk,
+	p HandlerPath) (rearm bool, delta time.Duration) {
+	wt.delKids(t)
+	x := t.extView()
+	if ch := x.chain; ch != nil {
+		defer func() {
+			if !rearm {
+				wt.runChain(ch)
+			}
+		}()
+	}
+	if wt.cfg.StuckThreshold > 0 {
+		atomic.AddUint64(&wt.allocWatched, 1)
+		wt.watchStart(t, p)
+		defer wt.watchEnd(t)
+	}
+	if x.miss != MissDefault {
+		x.nmiss, _ = wt.missedPeriods(t) // x allocated by SetMissPolicy()
+	}
+	wt.lateStart(t)
+	// t must not be used after the handler returns (it might be freed),
+	// so its context is only set before each run
+	var ctx context.Context
+	if x.dline > 0 {
+		var cancel context.CancelFunc
+		atomic.AddUint64(&wt.allocDeadlines, 1)
+		start := time.Now()
+		ctx, cancel = context.WithDeadline(wt.Context(), start.Add(x.dline))
+		defer wt.deadlineEnd(start, x.dline, cancel)
+	}
+	// t.arg can be changed in parallel (see SetArg())
+	t.lock.Lock()
+	arg := t.arg
+	t.lock.Unlock()
+	if !wt.cfg.ProfLabels {
+		wt.setHandlerCtx(t, ctx)
+		return t.f(wt, t, arg)
+	}
+	if ctx == nil {
+		ctx = wt.Context()
+	}
+	atomic.AddUint64(&wt.allocLabels, 1)
+	pprof.Do(ctx, wt.profLabels(t),
+		func(ctx context.Context) {
+			wt.setHandlerCtx(t, ctx)
+			rearm, delta = t.f(wt, t, arg)
+		})
+	return rearm, delta
+}
+
+// profLabels returns the pprof labels for running the handler of t:
+// "wtimer" (the instance name, see Config.Name), "handler" (the handler
+// name, see RegisterHandler()) and "class" (the run class or priority).
+func (wt *WTimer) profLabels(t *TimerLnk) pprof.LabelSet {
+	name := wt.cfg.Name
+	if name == "" {
+		name = "-"
+	}
+	class := PrioNormal.String()
+	if c := t.extView().class; int(c) < len(wt.rClasses) {
+		class = wt.rClasses[c].name
+	}
+	return pprof.Labels("wtimer", name, "handler", handlerStr(t.f),
+		"class", class)
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// default maximum interval, in ticks, of the precise timers handled with
+// runtime timers (see Config.PreciseTicks)
+const defaultPreciseTicks = 4
+
+// SetPrecise enables (or disables) the sub-tick precision for the timer:
+// if its interval is shorter then Config.PreciseTicks ticks, the timer is
+// run by a runtime timer (time.AfterFunc()) at the exact interval,
+// instead of at a tick boundary. It allows mixing a handful of high
+// precision timers with bulk timers using a coarse tick.
+// The handler of a precise timer is run from the runtime timer goroutine
+// (like for a FgoR timer, even if Ffast is set). The timer stays on the
+// timer wheel, 1 tick after its interval, as a backstop (e.g. while
+// paused).
+// It has the same usage restrictions as Reset(). A re-initialised timer
+// (InitTimer()) is not precise. It has no effect in simulation mode.
+func (wt *WTimer) SetPrecise(tl *TimerLnk, on bool) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetPrecise", tl, err)
+	}
+	wt.extOf(tl).prec = on
+	return nil
+}
+
+// isPrecise returns true if tl should be handled by a runtime timer (see
+// SetPrecise()).
+func (wt *WTimer) isPrecise(tl *TimerLnk) bool {
+	if !tl.extView().prec || wt.cfg.Simulation {
+		return false
+	}
+	max := wt.cfg.PreciseTicks
+	if max <= 0 {
+		max = defaultPreciseTicks
+	}
+	return tl.intvl < time.Duration(max)*wt.tickDuration
+}
+
+// armPrecise starts the runtime timer for the precise timer tl, just
+// added on the wheel.
+// It must be called with the same locks as addUnsafe().
+func (wt *WTimer) armPrecise(tl *TimerLnk) {
+	x := wt.extOf(tl) // allocated by SetPrecise()
+	x.pseq++
+	seq := x.pseq
+	time.AfterFunc(wt.realDuration(tl.intvl), func() {
+		wt.preciseFire(tl, seq)
+	})
+}
+
+// preciseFire is called by the runtime timer armed by armPrecise(): it
+// removes tl from the wheel and runs its handler, if still on the wheel
+// for the same add (seq).
+func (wt *WTimer) preciseFire(tl *TimerLnk, seq uint32) {
+	wt.lock()
+	flags, w, idx := tl.info.getAll()
+	x := tl.extView()
+	if !x.prec || x.pseq != seq || flags&(fActive|fDelete) != fActive ||
+		w >= WheelsNo || wt.dispatchStopped() || wt.Paused() {
+		// already expired on the wheel, deleted or re-added
+		// (or not allowed to run now => it will expire on the wheel)
+		wt.unlock()
+		return
+	}
+	lst := &wt.wheels[w].lsts[idx]
+	wt.lstLock(lst).Lock()
+	err := lst.rm(wt, tl)
+	wt.lstLock(lst).Unlock()
+	if err != nil {
+		wt.unlock()
+		return
+	}
+	tl.next = nil
+	tl.prev = nil
+	wt.nextExpRemoved(tl.expire)
+	// not queued anymore (will run now)
+	wt.activeDec(tl)
+	atomic.StoreUint64(&tl.rgid, goID())
+	tl.info.setFlags(fRunning)
+	tl.rctx.setWheel(wheelNone, wheelNoIdx)
+	wt.unlock()
+
+	atomic.AddInt64(&wt.goRactive, 1)
+	rearm, delta := wt.runHandler(tl, HandlerGoR)
+	atomic.AddInt64(&wt.goRactive, -1)
+	// if rearm == false tl cannot be used anymore (see goRunner())
+	if !rearm {
+		tl = nil
+	}
+	wt.afterRun(tl, rearm, delta)
+}
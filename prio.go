@@ -0,0 +1,287 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+)
+
+// Priority is the dispatch priority of a timer handler run by the run
+// queues workers (timers without Ffast or FgoR), see SetPriority().
+// Each priority has its own run queues. When the run queues back up, the
+// queued handlers with a higher priority are run first.
+type Priority uint8
+
+const (
+	PrioNormal Priority = iota // default priority
+	PrioHigh                   // critical timers, run before the others
+	PrioLow                    // bulk timers, run after all the others
+	PrioNo                     // number of priorities
+)
+
+// prioOrder contains the priorities in dispatch order.
+var prioOrder = [PrioNo]Priority{PrioHigh, PrioNormal, PrioLow}
+
+// String returns the priority name.
+func (p Priority) String() string {
+	switch p {
+	case PrioNormal:
+		return "normal"
+	case PrioHigh:
+		return "high"
+	case PrioLow:
+		return "low"
+	}
+	return "invalid"
+}
+
+// RunQueueCfg configures the run queues used for a timer priority
+// (see Config.RunQueues).
+type RunQueueCfg struct {
+	// Queues is the number of run queues (more queues mean less lock
+	// contention between the workers).
+	Queues int
+	// Workers is the number of goroutines started for running the
+	// handlers. Besides its own priority queues, a worker runs also the
+	// handlers queued with a higher priority, so 0 is allowed for
+	// PrioHigh and PrioNormal (the handlers will be run only by the lower
+	// priority workers).
+	Workers int
+}
+
+// limits for the default run queues config (see defaultRunQueues())
+const (
+	minAutoQueues = 2
+	maxAutoQueues = 256
+)
+
+// defaultRunQueues returns the run queues config used for the priorities
+// with a zero Config.RunQueues value, sized according to the current
+// GOMAXPROCS: a run queue and a worker for each P for PrioNormal and a
+// quarter of them for PrioHigh and PrioLow (at least 2 and at most 256
+// for each priority).
+func defaultRunQueues() [PrioNo]RunQueueCfg {
+	procs := runtime.GOMAXPROCS(0)
+	size := func(n int) RunQueueCfg {
+		if n < minAutoQueues {
+			n = minAutoQueues
+		} else if n > maxAutoQueues {
+			n = maxAutoQueues
+		}
+		return RunQueueCfg{Queues: n, Workers: n}
+	}
+	return [PrioNo]RunQueueCfg{
+		PrioNormal: size(procs),
+		PrioHigh:   size(procs / 4),
+		PrioLow:    size(procs / 4),
+	}
+}
+
+// RunClassCfg configures a named run queues class (see Config.RunClasses
+// and SetRunClass()).
+type RunClassCfg struct {
+	Name    string // class name, must be unique
+	Queues  int    // number of run queues
+	Workers int    // number of goroutines running the class handlers
+	// BatchF, if set, enables the batch delivery for the class: all the
+	// class timers expired on the same tick are passed to a single BatchF
+	// call, instead of running their handlers (see BatchHandlerF).
+	BatchF BatchHandlerF
+}
+
+// maxRunClasses is the maximum number of run classes (priorities
+// included), limited by timerExt.class.
+const maxRunClasses = 256
+
+// runClass contains the run queues state for a priority or for a named
+// run class.
+type runClass struct {
+	// runq pos (idx) for consuming, atomic access, always ++ & <=rQhead
+	// (each runq "worker" will consume from rQs[first+(rQtail++)%n])
+	rQtail uint32
+	// runq pos  for producing, atomic access, always increasing
+	rQhead uint32
+
+	name    string
+	first   int // first run queue (index in wt.rQs)
+	n       int // number of run queues
+	workers int // started workers
+	served  int // workers running the class handlers (own or lower prio)
+	added   int // timers queued by processExpired() (under wt.lock())
+
+	// workers spinning for new work, that don't need to be signaled
+	// (atomic access, see spinForWork())
+	spinning int32
+	// pending wake tokens, for SignalToken (atomic access, see
+	// takeToken())
+	tokens int64
+	// batch delivery (RunClassCfg.BatchF): timers collected on the current
+	// tick (under wt.lock()), the channel for passing them to the class
+	// workers and the free batch buffers (re-used)
+	batchF    BatchHandlerF
+	batch     []*TimerLnk
+	batchCh   chan []*TimerLnk
+	batchFree chan []*TimerLnk
+	// channel for signaling the runq workers, a message means new work
+	ch chan struct{}
+}
+
+// initRunQueues creates the run queues and the run classes (priorities
+// first, indexed by Priority, followed by the named classes), according
+// to the config.
+func (wt *WTimer) initRunQueues() error {
+	var cfg [PrioNo]RunQueueCfg
+	defaults := defaultRunQueues()
+	total := 0
+	for p := range cfg {
+		cfg[p] = wt.cfg.RunQueues[p]
+		if cfg[p] == (RunQueueCfg{}) {
+			cfg[p] = defaults[p]
+		}
+		if cfg[p].Queues <= 0 || cfg[p].Workers < 0 {
+			return errors.New("wtimer.Init: invalid run queues config")
+		}
+		if wt.cfg.FIFO {
+			// a single queue is run by a single worker at a time
+			cfg[p].Queues = 1
+		}
+		total += cfg[p].Queues
+	}
+	if wt.cfg.RunQueueSignalCap < 0 || wt.cfg.RunQueueSignal > SignalToken {
+		return errors.New("wtimer.Init: invalid run queues signal config")
+	}
+	if cfg[PrioLow].Workers == 0 {
+		// nobody would run the low priority handlers
+		return errors.New("wtimer.Init: no low priority run queues workers")
+	}
+	named := wt.cfg.RunClasses
+	if int(PrioNo)+len(named) > maxRunClasses {
+		return errors.New("wtimer.Init: too many run classes")
+	}
+	for i := range named {
+		if named[i].Name == "" || named[i].Queues <= 0 ||
+			named[i].Workers <= 0 {
+			return errors.New("wtimer.Init: invalid run class config")
+		}
+		for j := 0; j < i; j++ {
+			if named[j].Name == named[i].Name {
+				return errors.New("wtimer.Init: duplicate run class " +
+					named[i].Name)
+			}
+		}
+		if wt.cfg.FIFO {
+			total++
+		} else {
+			total += named[i].Queues
+		}
+	}
+	if total > int(wheelNoIdx) {
+		return errors.New("wtimer.Init: too many run queues")
+	}
+	wt.rQs = make([]runQueue, total)
+	for i := 0; i < len(wt.rQs); i++ {
+		wt.rQs[i].lst.init(wheelRQ, uint16(i))
+	}
+	wt.rClasses = make([]runClass, int(PrioNo)+len(named))
+	first, served := 0, 0
+	for _, p := range prioOrder {
+		c := &wt.rClasses[p]
+		c.name = p.String()
+		c.first = first
+		c.n = cfg[p].Queues
+		c.workers = cfg[p].Workers
+		first += c.n
+	}
+	// the workers of a priority serve also the higher priorities
+	for i := len(prioOrder) - 1; i >= 0; i-- {
+		c := &wt.rClasses[prioOrder[i]]
+		served += c.workers
+		c.served = served
+		c.ch = make(chan struct{}, wt.signalCap(c.served))
+	}
+	// the named classes are isolated: only their own workers serve them
+	for i := range named {
+		c := &wt.rClasses[int(PrioNo)+i]
+		c.name = named[i].Name
+		c.first = first
+		c.n = named[i].Queues
+		if wt.cfg.FIFO {
+			c.n = 1
+		}
+		c.workers = named[i].Workers
+		c.served = c.workers
+		c.ch = make(chan struct{}, wt.signalCap(c.served))
+		if c.batchF = named[i].BatchF; c.batchF != nil {
+			c.batchCh = make(chan []*TimerLnk, c.workers)
+			// queued, running and collecting buffers
+			c.batchFree = make(chan []*TimerLnk, 2*c.workers+1)
+		}
+		first += c.n
+	}
+	wt.initWorkers()
+	return nil
+}
+
+// SetPriority sets the priority used when running the timer handler from
+// the run queues (it has no effect on Ffast or FgoR timers). It replaces
+// a run class set with SetRunClass().
+// Like Reset(), it must be called before adding the timer or from the
+// timer own handler (in which case the new priority is used starting
+// with the next run). A re-initialised timer (InitTimer()) has the
+// PrioNormal priority.
+func (wt *WTimer) SetPriority(tl *TimerLnk, p Priority) error {
+	if p >= PrioNo {
+		return wt.opErr("SetPriority", tl, ErrInvalidParameters)
+	}
+	return wt.opErr("SetPriority", tl, wt.setRunClass(tl, uint8(p)))
+}
+
+// ResizeRunQueues re-evaluates the default run queues config (see
+// Config.RunQueues) using the current GOMAXPROCS, e.g. after changing it
+// with runtime.GOMAXPROCS(). The priorities with an explicit config and
+// the named run classes are not changed. The timers waiting in the run
+// queues are dispatched again after Start().
+// It can be called only while the timer wheel is not running (before
+// Start() or after Shutdown()), otherwise it returns ErrAlreadyStarted.
+func (wt *WTimer) ResizeRunQueues() error {
+	if atomic.LoadUint32(&wt.runState) == rsRunning {
+		return ErrAlreadyStarted
+	}
+	wt.requeueRQs()
+	wt.lock()
+	err := wt.initRunQueues()
+	wt.simOrder = nil // see simRunQueues()
+	wt.simPend = nil
+	wt.unlock()
+	return err
+}
+
+// SetRunClass assigns the timer to the named run class (see
+// Config.RunClasses): its handler will be run only by the class own
+// workers, so that it cannot be delayed by the handlers of other classes
+// or priorities (and the other way around).
+// It has no effect on Ffast or FgoR timers and it has the same usage
+// restrictions as SetPriority().
+func (wt *WTimer) SetRunClass(tl *TimerLnk, name string) error {
+	for i := int(PrioNo); i < len(wt.rClasses); i++ {
+		if wt.rClasses[i].name == name {
+			return wt.opErr("SetRunClass", tl, wt.setRunClass(tl, uint8(i)))
+		}
+	}
+	return wt.opErr("SetRunClass", tl, ErrInvalidParameters)
+}
+
+// setRunClass sets the timer run class (index in wt.rClasses).
+func (wt *WTimer) setRunClass(tl *TimerLnk, c uint8) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return err
+	}
+	wt.extOf(tl).class = c
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// handlerRegistry maps names to timer handlers (see RegisterHandler()).
+type handlerRegistry struct {
+	lock   sync.RWMutex
+	byName map[string]TimerHandlerF
+	names  map[uintptr]string // handler code pointer -> name
+}
+
+// handlers is the package handlers registry.
+var handlers = handlerRegistry{
+	byName: map[string]TimerHandlerF{},
+	names:  map[uintptr]string{},
+}
+
+// handlerPC returns the code pointer of the handler f.
+func handlerPC(f TimerHandlerF) uintptr {
+	return reflect.ValueOf(f).Pointer()
+}
+
+// RegisterHandler registers the timer handler f under name, so that it can
+// be used with AddNamed() and AddExpireNamed() and it is referenced by
+// name in the dumps (and by any code that needs to persist the timers,
+// see HandlerName() and LookupHandler()).
+// It returns ErrHandlerExists if name is already registered with a
+// different handler.
+// Note that all the closures created from the same function literal have
+// the same code and so they are reported with the name of the first
+// registered one.
+func RegisterHandler(name string, f TimerHandlerF) error {
+	if name == "" || f == nil {
+		return ErrInvalidParameters
+	}
+	pc := handlerPC(f)
+	handlers.lock.Lock()
+	defer handlers.lock.Unlock()
+	if old, ok := handlers.byName[name]; ok {
+		if handlerPC(old) != pc {
+			return ErrHandlerExists
+		}
+	}
+	handlers.byName[name] = f
+	if _, ok := handlers.names[pc]; !ok {
+		handlers.names[pc] = name
+	}
+	return nil
+}
+
+// LookupHandler returns the timer handler registered under name and true,
+// or false if no handler was registered with this name.
+func LookupHandler(name string) (TimerHandlerF, bool) {
+	handlers.lock.RLock()
+	f, ok := handlers.byName[name]
+	handlers.lock.RUnlock()
+	return f, ok
+}
+
+// HandlerName returns the name under which the timer handler f was
+// registered and true, or false if f was not registered.
+func HandlerName(f TimerHandlerF) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	handlers.lock.RLock()
+	name, ok := handlers.names[handlerPC(f)]
+	handlers.lock.RUnlock()
+	return name, ok
+}
+
+// handlerStr returns a description of the handler f, for dumps: its
+// registered name or, if not registered, the function name.
+func handlerStr(f TimerHandlerF) string {
+	if f == nil {
+		return "-"
+	}
+	if name, ok := HandlerName(f); ok {
+		return name
+	}
+	if fn := runtime.FuncForPC(handlerPC(f)); fn != nil {
+		return fn.Name() + "()"
+	}
+	return "?"
+}
+
+// AddNamed is similar to Add(), but uses the handler registered under name
+// (see RegisterHandler()). It returns ErrUnknownHandler if no handler was
+// registered with this name.
+func (wt *WTimer) AddNamed(tl *TimerLnk, d time.Duration,
+	name string, p interface{}) error {
+	f, ok := LookupHandler(name)
+	if !ok {
+		return wt.opErr("AddNamed", tl, ErrUnknownHandler)
+	}
+	return wt.opErr("AddNamed", tl, wt.add(tl, d, f, p))
+}
+
+// AddExpireNamed is similar to AddExpire(), but uses the handler registered
+// under name (see RegisterHandler()). It returns ErrUnknownHandler if no
+// handler was registered with this name.
+func (wt *WTimer) AddExpireNamed(tl *TimerLnk, expire Ticks,
+	name string, p interface{}) error {
+	f, ok := LookupHandler(name)
+	if !ok {
+		return wt.opErr("AddExpireNamed", tl, ErrUnknownHandler)
+	}
+	return wt.opErr("AddExpireNamed", tl, wt.addExpire(tl, expire, f, p))
+}
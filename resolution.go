@@ -0,0 +1,82 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// default coarse resolution (see Config.CoarseTick)
+const defaultCoarseTick = time.Second
+
+// Resolution is the timer resolution class (see SetResolution()).
+type Resolution uint8
+
+const (
+	// ResFine: the timer expires on the tick following its interval
+	// (default).
+	ResFine Resolution = iota
+	// ResCoarse: the timer expires only on Config.CoarseTick boundaries
+	// (the interval is rounded up to the next boundary), e.g. for session
+	// expiry timers, which do not need the tick precision.
+	ResCoarse
+)
+
+// String returns the resolution name.
+func (r Resolution) String() string {
+	switch r {
+	case ResFine:
+		return "fine"
+	case ResCoarse:
+		return "coarse"
+	}
+	return "invalid"
+}
+
+// SetResolution sets the timer resolution class, allowing a single
+// WTimer to serve both timers needing the tick precision (e.g.
+// retransmissions) and a high number of long, imprecise timers (e.g.
+// session expiry). The coarse timers expire only on the coarse tick
+// boundaries, so all the coarse timers expiring in the same coarse tick
+// share the same wheel lists: they are cascaded and expired together, in
+// bulk, and they do not touch the lists used by the fine timers in
+// between (a coarse geometry over the same wheels).
+// It has the same usage restrictions as Reset(). A re-initialised timer
+// (InitTimer()) uses ResFine. It has no effect on precise timers (see
+// SetPrecise()).
+func (wt *WTimer) SetResolution(tl *TimerLnk, r Resolution) error {
+	if r > ResCoarse {
+		return wt.opErr("SetResolution", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetResolution", tl, err)
+	}
+	wt.extOf(tl).res = r
+	return nil
+}
+
+// coarseTicks returns the coarse tick size in ticks.
+func (wt *WTimer) coarseTicks() uint64 {
+	c := wt.cfg.CoarseTick
+	if c <= 0 {
+		c = defaultCoarseTick
+	}
+	if n := uint64(c / wt.tickDuration); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// coarseAlign returns ahead increased so that now + ahead is on a coarse
+// tick boundary.
+func (wt *WTimer) coarseAlign(now Ticks, ahead uint64) uint64 {
+	c := wt.coarseTicks()
+	if r := (now.Val() + ahead) % c; r != 0 {
+		ahead += c - r
+	}
+	return ahead
+}
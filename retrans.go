@@ -0,0 +1,137 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// RetransmitF is called for each retransmission of a request (see
+// StartRetrans()). n is the retransmission number (starting from 1) and
+// arg the parameter passed to StartRetrans(). Returning false stops the
+// retransmissions (e.g. on a send error), without calling RetransCfg.Fail.
+type RetransmitF func(wt *WTimer, r *Retrans, n int, arg interface{}) bool
+
+// RetransFailF is called when a request was not answered in time (see
+// RetransCfg.Timeout and RetransCfg.MaxRetrans).
+type RetransFailF func(wt *WTimer, r *Retrans, arg interface{})
+
+// RetransCfg contains the retransmission schedule parameters, shared by
+// all the requests using it (see StartRetrans()). It must not be changed
+// while in use.
+type RetransCfg struct {
+	// RTO is the initial retransmission timeout (e.g. SIP T1). It is
+	// doubled after each retransmission.
+	RTO time.Duration
+	// MaxRTO caps the retransmission timeout (e.g. SIP T2). 0 means no
+	// limit.
+	MaxRTO time.Duration
+	// Timeout is the time after which the request fails, counted from
+	// StartRetrans() (e.g. SIP Timer B, 64*T1). 0 means no limit.
+	Timeout time.Duration
+	// MaxRetrans is the maximum number of retransmissions: the request
+	// fails one RTO after the last one (e.g. for DNS). 0 means no limit.
+	// At least one of Timeout and MaxRetrans must be set.
+	MaxRetrans int
+	// Flags are the timer flags (see Reset()).
+	Flags uint8
+	// Retransmit is called for each retransmission.
+	Retransmit RetransmitF
+	// Fail, if set, is called when the request fails.
+	Fail RetransFailF
+}
+
+// Retrans manages the retransmissions of a request sent over an
+// unreliable transport (e.g. SIP or DNS over UDP): it calls
+// RetransCfg.Retransmit after each retransmission timeout, doubling the
+// timeout up to RetransCfg.MaxRTO, and RetransCfg.Fail if no answer
+// arrives in time (see StartRetrans()).
+// Like TimerLnk, it is meant to be part of the request structure and it
+// must not be copied or re-used while started.
+type Retrans struct {
+	tl      TimerLnk
+	cfg     *RetransCfg
+	arg     interface{}
+	rto     time.Duration // current retransmission timeout
+	elapsed time.Duration // time since start, at the current expire
+	n       int           // retransmissions so far
+}
+
+// retransHandler is the timer handler of the Retrans timers.
+func retransHandler(wt *WTimer, tl *TimerLnk,
+	p interface{}) (bool, time.Duration) {
+	r := p.(*Retrans)
+	cfg := r.cfg
+	r.elapsed += r.rto
+	if (cfg.MaxRetrans > 0 && r.n >= cfg.MaxRetrans) ||
+		(cfg.Timeout > 0 && r.elapsed >= cfg.Timeout) {
+		if cfg.Fail != nil {
+			cfg.Fail(wt, r, r.arg)
+		}
+		return false, 0
+	}
+	r.n++
+	if !cfg.Retransmit(wt, r, r.n, r.arg) {
+		return false, 0
+	}
+	next := 2 * r.rto
+	if cfg.MaxRTO > 0 && next > cfg.MaxRTO {
+		next = cfg.MaxRTO
+	}
+	if cfg.Timeout > 0 && r.elapsed+next > cfg.Timeout {
+		// fail exactly at the timeout
+		next = cfg.Timeout - r.elapsed
+	}
+	r.rto = next
+	return true, next
+}
+
+// StartRetrans starts the retransmissions schedule for a request that was
+// just sent, using the parameters in cfg: the first retransmission
+// happens after cfg.RTO. arg is passed to the cfg callbacks.
+// Once the request is answered, the retransmissions must be stopped with
+// StopRetrans(). After the request fails or the retransmissions are
+// stopped, r can be re-used.
+// It does not allocate, so it can be used for very high numbers of
+// parallel requests.
+func (wt *WTimer) StartRetrans(r *Retrans, cfg *RetransCfg,
+	arg interface{}) error {
+	if cfg == nil || cfg.RTO <= 0 || cfg.Retransmit == nil ||
+		(cfg.MaxRTO > 0 && cfg.MaxRTO < cfg.RTO) ||
+		cfg.Timeout < 0 || cfg.MaxRetrans < 0 ||
+		(cfg.Timeout == 0 && cfg.MaxRetrans == 0) {
+		return wt.opErr("StartRetrans", &r.tl, ErrInvalidParameters)
+	}
+	if err := wt.InitTimer(&r.tl, cfg.Flags); err != nil {
+		return err
+	}
+	r.cfg = cfg
+	r.arg = arg
+	r.rto = cfg.RTO
+	if cfg.Timeout > 0 && r.rto > cfg.Timeout {
+		r.rto = cfg.Timeout
+	}
+	r.elapsed = 0
+	r.n = 0
+	return wt.opErr("StartRetrans", &r.tl,
+		wt.add(&r.tl, r.rto, retransHandler, r))
+}
+
+// StopRetrans stops the retransmissions of an answered request, like
+// Del(). It returns false if a callback is running (it will be the last
+// one), in which case r can be re-used only after the callback returns.
+func (wt *WTimer) StopRetrans(r *Retrans) (bool, error) {
+	ok, err := wt.del(&r.tl, 0, 0)
+	return ok, wt.opErr("StopRetrans", &r.tl, err)
+}
+
+// Retransmissions returns the number of retransmissions so far. It must
+// be called only from the RetransCfg callbacks or after the request
+// failed or was stopped.
+func (r *Retrans) Retransmissions() int {
+	return r.n
+}
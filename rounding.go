@@ -0,0 +1,88 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// Rounding selects how a timer interval that is not a multiple of the tick
+// duration is converted to ticks (see SetRounding()).
+type Rounding uint8
+
+const (
+	// RoundNearest rounds to the nearest tick (half a tick or more is
+	// rounded up) and to at least 1 tick, like TicksRoundUp() (default).
+	RoundNearest Rounding = iota
+	// RoundUp always rounds up to the next tick: the timer never expires
+	// before its interval (e.g. for timeouts).
+	RoundUp
+	// RoundDown always rounds down, but to at least 1 tick: the timer
+	// never expires after its interval, except for intervals shorter
+	// then 1 tick (e.g. for rate-limiting).
+	RoundDown
+	// RoundExact refuses the intervals that are not a multiple of the
+	// tick duration: the Add*() functions return ErrNotTickMultiple.
+	RoundExact
+)
+
+// String returns the rounding name.
+func (r Rounding) String() string {
+	switch r {
+	case RoundNearest:
+		return "nearest"
+	case RoundUp:
+		return "up"
+	case RoundDown:
+		return "down"
+	case RoundExact:
+		return "exact"
+	}
+	return "invalid"
+}
+
+// SetRounding sets how the timer intervals are converted to ticks.
+// It has the same usage restrictions as Reset(): it must be called before
+// adding the timer or from the timer own handler. A re-initialised timer
+// (InitTimer()) uses RoundNearest.
+func (wt *WTimer) SetRounding(tl *TimerLnk, r Rounding) error {
+	if r > RoundExact {
+		return wt.opErr("SetRounding", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetRounding", tl, err)
+	}
+	wt.extOf(tl).round = r
+	return nil
+}
+
+// roundTicks converts d to ticks using the rounding r. The result is
+// at least 1 tick (even for negative durations) and it is not limited to
+// TicksBits.
+func (wt *WTimer) roundTicks(d time.Duration, r Rounding) uint64 {
+	if d < 0 {
+		// uint64(d) would wrap to a huge value
+		return 1
+	}
+	t := uint64(d / wt.tickDuration)
+	rest := d % wt.tickDuration
+	switch r {
+	case RoundUp:
+		if rest != 0 {
+			t++
+		}
+	case RoundDown:
+	default:
+		if rest >= 50*wt.tickDuration/100 {
+			t++
+		}
+	}
+	if t == 0 {
+		t = 1
+	}
+	return t
+}
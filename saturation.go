@@ -0,0 +1,167 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SaturationAlert identifies a saturation condition (see SaturationCfg).
+type SaturationAlert uint8
+
+const (
+	// SatRunQueues: the run queues depth (all the queues) reached
+	// SaturationCfg.RunQueueDepth (the workers cannot keep up).
+	SatRunQueues SaturationAlert = iota
+	// SatExpired: the expired timers waiting to be dispatched reached
+	// SaturationCfg.ExpiredBacklog (e.g. because of Config.RunBudget or
+	// OverloadBlock).
+	SatExpired
+	// SatLateFires: the handlers started late (see SaturationCfg.LateFire)
+	// in the last SaturationCfg.Interval reached SaturationCfg.LateRate.
+	SatLateFires
+)
+
+// String returns the alert name.
+func (a SaturationAlert) String() string {
+	switch a {
+	case SatRunQueues:
+		return "run_queues"
+	case SatExpired:
+		return "expired"
+	case SatLateFires:
+		return "late_fires"
+	}
+	return "invalid"
+}
+
+// A SaturationHandlerF is called when the saturation condition a starts
+// (on true) and when it recovers (on false), see SaturationCfg. v is the
+// current value: the run queues depth, the expired timers backlog
+// (counted only up to its threshold) or the late handlers in the last
+// interval. It is called from the timer goroutine, so it should be fast
+// (e.g. it could enable shedding the low priority work).
+type SaturationHandlerF func(wt *WTimer, a SaturationAlert, on bool, v int)
+
+// SaturationCfg contains the saturation alerts thresholds (see
+// Config.Saturation). An alert starts when its value reaches the
+// threshold and it recovers when the value drops under half of the
+// threshold (hysteresis, to avoid flapping alerts). The values are
+// checked on each tick. A 0 threshold disables the alert.
+type SaturationCfg struct {
+	// RunQueueDepth is the run queues depth threshold (SatRunQueues).
+	RunQueueDepth int
+	// ExpiredBacklog is the expired timers backlog threshold (SatExpired),
+	// the timers left for the next tick after dispatching.
+	ExpiredBacklog int
+	// LateFire is the delay after which a starting handler is counted as
+	// late, for SatLateFires (rounded down to ticks, at least 1 tick).
+	LateFire time.Duration
+	// LateRate is the late handlers threshold (SatLateFires), counted in
+	// each Interval. It is used only if LateFire is set.
+	LateRate int
+	// Interval is the late handlers counting interval. If 0, a default
+	// of 1s is used.
+	Interval time.Duration
+	// F is called for each alert start and recovery. The alerts are
+	// disabled if nil.
+	F SaturationHandlerF
+}
+
+// defaultSatInterval is the default late handlers counting interval (see
+// SaturationCfg.Interval).
+const defaultSatInterval = time.Second
+
+// initSaturation initialises the saturation alerts state, according to
+// Config.Saturation.
+func (wt *WTimer) initSaturation() {
+	cfg := &wt.cfg.Saturation
+	atomic.StoreUint32(&wt.satOn, 0)
+	atomic.StoreUint64(&wt.satLate, 0)
+	wt.satLateTicks = 0
+	wt.satStart = wt.Now()
+	if cfg.F == nil || cfg.LateFire <= 0 || cfg.LateRate <= 0 {
+		return
+	}
+	late, _ := wt.Ticks(cfg.LateFire)
+	if wt.satLateTicks = late.Val(); wt.satLateTicks == 0 {
+		wt.satLateTicks = 1
+	}
+	intvl := cfg.Interval
+	if intvl <= 0 {
+		intvl = defaultSatInterval
+	}
+	wt.satIntvl = wt.TicksRoundUp(intvl).Val()
+}
+
+// Saturated returns true if the saturation alert a is active (see
+// SaturationCfg).
+func (wt *WTimer) Saturated(a SaturationAlert) bool {
+	return atomic.LoadUint32(&wt.satOn)&(1<<a) != 0
+}
+
+// lateStart counts the handler of t as late, if started more then
+// SaturationCfg.LateFire after its expire.
+func (wt *WTimer) lateStart(t *TimerLnk) {
+	if wt.satLateTicks != 0 &&
+		wt.Now().GT(t.expire.AddUint64(wt.satLateTicks)) {
+		atomic.AddUint64(&wt.satLate, 1)
+	}
+}
+
+// expiredBacklog returns the number of timers left on the expired list,
+// counted only up to SaturationCfg.ExpiredBacklog (0 if disabled).
+// It must be called with wt.lock() held.
+func (wt *WTimer) expiredBacklog() int {
+	max := wt.cfg.Saturation.ExpiredBacklog
+	if wt.cfg.Saturation.F == nil || max <= 0 {
+		return 0
+	}
+	n := 0
+	wt.expired.forEach(func(e *TimerLnk) bool {
+		n++
+		return n < max
+	})
+	return n
+}
+
+// checkSaturation checks the saturation thresholds at the tick now and
+// calls SaturationCfg.F for the alerts that start or recover. backlog is
+// the expired timers backlog (see expiredBacklog()).
+// It must be called only from the timer goroutine (or RunTicks()).
+func (wt *WTimer) checkSaturation(now Ticks, backlog int) {
+	cfg := &wt.cfg.Saturation
+	wt.satCheck(SatRunQueues, cfg.RunQueueDepth,
+		int(atomic.LoadInt64(&wt.rQdepth)))
+	wt.satCheck(SatExpired, cfg.ExpiredBacklog, backlog)
+	if wt.satLateTicks != 0 && now.Sub(wt.satStart).Val() >= wt.satIntvl {
+		wt.satStart = now
+		late := atomic.SwapUint64(&wt.satLate, 0)
+		wt.satCheck(SatLateFires, cfg.LateRate, int(late))
+	}
+}
+
+// satCheck compares the value v of the alert a with its threshold and
+// calls SaturationCfg.F if the alert starts or recovers.
+func (wt *WTimer) satCheck(a SaturationAlert, threshold, v int) {
+	if threshold <= 0 {
+		return
+	}
+	// written only by the timer goroutine => no CAS needed
+	bits := atomic.LoadUint32(&wt.satOn)
+	on := bits&(1<<a) != 0
+	switch {
+	case !on && v >= threshold:
+		atomic.StoreUint32(&wt.satOn, bits|1<<a)
+	case on && v < (threshold+1)/2:
+		atomic.StoreUint32(&wt.satOn, bits&^(1<<a))
+	default:
+		return
+	}
+	wt.cfg.Saturation.F(wt, a, !on, v)
+}
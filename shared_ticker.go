@@ -0,0 +1,118 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// SharedTicker drives the ticks of several WTimer instances from a single
+// goroutine and OS ticker (see StartShared()), reducing the wake ups in
+// processes using more then one timer wheel (e.g. a 1ms and a 100ms one).
+// The instances tick durations must be multiples of the shared ticker base
+// duration.
+type SharedTicker struct {
+	base time.Duration
+
+	lock  sync.Mutex // protects wts & every, held while ticking
+	wts   []*WTimer
+	every []uint64 // base ticks between two ticks, for each instance
+
+	cancel chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewSharedTicker returns a new shared ticker, ticking each base duration.
+// It must be started with Start().
+func NewSharedTicker(base time.Duration) (*SharedTicker, error) {
+	if base < time.Microsecond {
+		return nil, errors.New("wtimer.NewSharedTicker: base too small")
+	}
+	return &SharedTicker{base: base}, nil
+}
+
+// Start starts the shared ticker goroutine.
+func (st *SharedTicker) Start() {
+	st.cancel = make(chan struct{})
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		st.loop()
+	}()
+}
+
+// Stop stops the shared ticker goroutine. The attached WTimer instances
+// will not advance their time anymore (they should be stopped first, see
+// WTimer.Shutdown()).
+func (st *SharedTicker) Stop() {
+	if st.cancel != nil {
+		close(st.cancel)
+	}
+	st.wg.Wait()
+}
+
+// loop is the shared ticker goroutine main loop.
+func (st *SharedTicker) loop() {
+	ticker := time.NewTicker(st.base)
+	defer ticker.Stop()
+	var n uint64
+	for {
+		select {
+		case <-st.cancel:
+			return
+		case <-ticker.C:
+			n++
+			st.lock.Lock()
+			for i, wt := range st.wts {
+				if n%st.every[i] == 0 {
+					wt.ticker()
+				}
+			}
+			st.lock.Unlock()
+		}
+	}
+}
+
+// attach adds wt to the instances driven by the shared ticker.
+func (st *SharedTicker) attach(wt *WTimer) {
+	st.lock.Lock()
+	st.wts = append(st.wts, wt)
+	st.every = append(st.every, uint64(wt.tickDuration/st.base))
+	st.lock.Unlock()
+}
+
+// detach removes wt from the instances driven by the shared ticker. It
+// waits for the current tick to finish.
+func (st *SharedTicker) detach(wt *WTimer) {
+	st.lock.Lock()
+	for i, v := range st.wts {
+		if v == wt {
+			st.wts = append(st.wts[:i], st.wts[i+1:]...)
+			st.every = append(st.every[:i], st.every[i+1:]...)
+			break
+		}
+	}
+	st.lock.Unlock()
+}
+
+// StartShared is similar to Start(), but the ticks are driven by the
+// shared ticker st, together with the ticks of other WTimer instances.
+// The tick duration must be a multiple of the st base duration.
+// Since all the instances ticks are run from the same goroutine, a
+// Ffast timer handler must never call Shutdown() on an instance using the
+// same shared ticker.
+// It cannot be used in tickless or simulation mode (Config.Tickless and
+// Config.Simulation).
+func (wt *WTimer) StartShared(st *SharedTicker) error {
+	if st == nil || wt.cfg.Tickless || wt.cfg.Simulation ||
+		wt.tickDuration%st.base != 0 {
+		return ErrInvalidParameters
+	}
+	return wt.start(nil, st)
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// DrainPolicy decides what happens with the pending timers on Shutdown()
+// (see Config.Drain).
+type DrainPolicy uint8
+
+const (
+	// DrainCancel: the pending timers are not run anymore (default).
+	DrainCancel DrainPolicy = iota
+	// DrainFireAll: all the pending timers are run immediately on
+	// shutdown (e.g. for flush-on-exit semantics).
+	DrainFireAll
+	// DrainMustRun: only the pending timers marked with SetMustRun() are
+	// run immediately on shutdown.
+	DrainMustRun
+)
+
+// String returns the policy name.
+func (p DrainPolicy) String() string {
+	switch p {
+	case DrainCancel:
+		return "cancel"
+	case DrainFireAll:
+		return "fire-all"
+	case DrainMustRun:
+		return "must-run"
+	}
+	return "invalid"
+}
+
+// SetMustRun marks the timer as "must-run": with the DrainMustRun policy
+// (Config.Drain) its handler is run on Shutdown() if still pending.
+// It has the same usage restrictions as Reset(): it must be called before
+// adding the timer or from the timer own handler. A re-initialised timer
+// (InitTimer()) is not marked.
+func (wt *WTimer) SetMustRun(tl *TimerLnk, must bool) error {
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetMustRun", tl, err)
+	}
+	wt.extOf(tl).must = must
+	return nil
+}
+
+// drain runs the pending timers selected by Config.Drain, from the
+// current goroutine, in expire order. The re-arm requests of the drained
+// timers are ignored.
+// It must be called after all the timer wheel goroutines were stopped.
+func (wt *WTimer) drain() {
+	pol := wt.cfg.Drain
+	if pol != DrainFireAll && pol != DrainMustRun {
+		return
+	}
+	var lst []*TimerLnk
+	collect := func(l *timerLst, t *TimerLnk) bool {
+		if t.info.flags()&fDelete != 0 ||
+			(pol == DrainMustRun && !t.extView().must) {
+			return true
+		}
+		if l.rm(wt, t) != nil {
+			return false
+		}
+		t.next = nil
+		t.prev = nil
+		wt.activeDec(t)
+		lst = append(lst, t)
+		return true
+	}
+	wt.lock()
+	wt.drainAddQ(wt.Now())
+	for w := range wt.wheels {
+		for i := range wt.wheels[w].lsts {
+			wt.wheels[w].lsts[i].forEachSafeRm(collect)
+		}
+	}
+	wt.expired.forEachSafeRm(collect)
+	for i := range wt.rQs {
+		n := len(lst)
+		wt.rQs[i].lst.forEachSafeRm(collect)
+		wt.rqDequeued(i, int64(len(lst)-n))
+	}
+	wt.setNextExp(Ticks{}, false)
+	sort.SliceStable(lst, func(i, j int) bool {
+		return lst[i].expire.LT(lst[j].expire)
+	})
+	gid := goID()
+	for _, t := range lst {
+		wt.running = t
+		atomic.StoreUint64(&t.rgid, gid)
+		t.rctx.setWheel(wheelExp, wheelNoIdx)
+		t.info.setFlags(fRunning)
+		wt.unlock()
+		rearm, _ := wt.runHandler(t, HandlerFast)
+		wt.lock()
+		if rearm {
+			// not re-armed on shutdown
+			t.info.chgFlags(fRemoved, fRunning|fRearm)
+		}
+		wt.running = nil
+	}
+	wt.unlock()
+}
+
+// ShutdownReport contains the handlers abandoned by ShutdownContext().
+type ShutdownReport struct {
+	// handlers still running at the deadline (run from the timer
+	// goroutine or from the run queues)
+	Running []*TimerLnk
+	// FgoR handlers still running at the deadline
+	RunningGoR int
+	// expired timers left in the run queues, whose handlers were not run
+	Queued int
+}
+
+// Context returns a context that is cancelled when the timer wheel is
+// stopped: at the end of Shutdown() or, for ShutdownContext(), when its
+// deadline is reached. Long running handlers can use it for aborting.
+func (wt *WTimer) Context() context.Context {
+	if wt.ctx == nil {
+		return context.Background()
+	}
+	return wt.ctx
+}
+
+// ShutdownContext is similar to Shutdown(), but it waits for the running
+// handlers only until ctx is done. Unlike Shutdown(), the handlers queued
+// in the run queues and not started yet are not run anymore.
+// If ctx is done before all the handlers finish, the remaining handlers
+// are signaled using the timer wheel context (see Context()) and a report
+// of what was abandoned is returned, together with the ctx error. The
+// abandoned handlers might still run after it returns and a new Start()
+// will wait for them to finish.
+func (wt *WTimer) ShutdownContext(ctx context.Context) (ShutdownReport,
+	error) {
+	var rep ShutdownReport
+	if atomic.LoadUint32(&wt.runState) == rsStopped {
+		return rep, nil
+	}
+	atomic.StoreUint32(&wt.stopRun, 1)
+	if !wt.stop() {
+		return rep, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		wt.wg.Wait()
+		close(done)
+	}()
+	wt.shutWait = done
+	var err error
+	select {
+	case <-done:
+		wt.drain()
+	case <-ctx.Done():
+		err = ctx.Err()
+		rep.Running = wt.runningHandlers()
+		rep.RunningGoR = int(atomic.LoadInt64(&wt.goRactive))
+	}
+	wt.stopped()
+	rep.Queued = int(atomic.LoadInt64(&wt.rQdepth))
+	return rep, err
+}
+
+// runningHandlers returns the timers whose handlers are currently run from
+// the timer goroutine or from the run queues.
+func (wt *WTimer) runningHandlers() []*TimerLnk {
+	var lst []*TimerLnk
+	wt.lock()
+	if wt.running != nil {
+		lst = append(lst, wt.running)
+	}
+	wt.unlock()
+	for i := range wt.rQs {
+		wt.rQs[i].lock.Lock()
+		if r := wt.rQs[i].running; r != nil {
+			lst = append(lst, r)
+		}
+		wt.rQs[i].lock.Unlock()
+	}
+	return lst
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SignalPolicy decides what happens with a new work signal for the run
+// queues workers when the run class signal channel is full (see
+// Config.RunQueueSignalCap).
+type SignalPolicy uint8
+
+const (
+	// SignalDrop: the signal is dropped, relying on the already queued
+	// signals for waking up the workers (default).
+	SignalDrop SignalPolicy = iota
+	// SignalBlock: the timer goroutine waits for room in the channel for
+	// up to Config.RunQueueSignalWait and then the signal is dropped.
+	SignalBlock
+	// SignalToken: each signal is also counted as a wake token and the
+	// workers take the pending tokens before blocking, so that no signal
+	// is lost even if the channel is full.
+	SignalToken
+)
+
+// String returns the policy name.
+func (p SignalPolicy) String() string {
+	switch p {
+	case SignalDrop:
+		return "drop"
+	case SignalBlock:
+		return "block"
+	case SignalToken:
+		return "token"
+	}
+	return "invalid"
+}
+
+// defaultSignalsPerWorker is the default run class signal channel
+// capacity, per served worker (see Config.RunQueueSignalCap).
+const defaultSignalsPerWorker = 4
+
+// signalCap returns the signal channel capacity for a run class served
+// by the given number of workers.
+func (wt *WTimer) signalCap(served int) int {
+	if wt.cfg.RunQueueSignalCap > 0 {
+		return wt.cfg.RunQueueSignalCap
+	}
+	return served * defaultSignalsPerWorker
+}
+
+// waitSignal waits for room in the signal channel of cls, for up to
+// Config.RunQueueSignalWait (SignalBlock), and sends a signal. It returns
+// false on timeout or on Shutdown().
+// It must be called only from the timer goroutine (it uses wt.sigTimer).
+func (wt *WTimer) waitSignal(cls *runClass) bool {
+	d := wt.cfg.RunQueueSignalWait
+	if d <= 0 {
+		d = wt.tickDuration
+	}
+	d = wt.realDuration(d)
+	if wt.sigTimer == nil {
+		wt.sigTimer = time.NewTimer(d)
+	} else {
+		wt.sigTimer.Reset(d)
+	}
+	ok := false
+	select {
+	case cls.ch <- struct{}{}:
+		ok = true
+	case <-wt.sigTimer.C:
+		return false
+	case <-wt.cancel:
+	}
+	if !wt.sigTimer.Stop() {
+		select {
+		case <-wt.sigTimer.C:
+		default:
+		}
+	}
+	return ok
+}
+
+// takeToken takes a wake token (SignalToken) from the first run class in
+// cls that has one. It returns false if there is none or if the tokens
+// are not used.
+func (wt *WTimer) takeToken(cls *[PrioNo]*runClass) bool {
+	if wt.cfg.RunQueueSignal != SignalToken {
+		return false
+	}
+	for i := 0; i < len(cls) && cls[i] != nil; i++ {
+		for {
+			n := atomic.LoadInt64(&cls[i].tokens)
+			if n <= 0 {
+				break
+			}
+			if atomic.CompareAndSwapInt64(&cls[i].tokens, n, n-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"math/rand"
+
+	"github.com/intuitivelabs/timestamp"
+)
+
+// simClock is the time source used in simulation mode: the time advances
+// only with the timer wheel ticks (see RunTicks()).
+type simClock struct {
+	wt *WTimer
+}
+
+// Now returns the time corresponding to the current timer wheel ticks.
+func (c simClock) Now() timestamp.TS {
+	wt := c.wt
+	return wt.refTS.Add(wt.Duration(wt.Now().Sub(wt.refTicks)))
+}
+
+// initSim initialises the simulation mode (see Config.Simulation).
+func (wt *WTimer) initSim() {
+	wt.clock = simClock{wt}
+	wt.refTS = timestamp.Unix(0, 0)
+	wt.refTicks = wt.Now()
+	wt.lastTickT = wt.refTS
+	wt.simRand = rand.New(rand.NewSource(wt.cfg.SimSeed))
+	wt.simOrder = nil // the run classes might change, see simRunQueues()
+	wt.simPend = nil
+}
+
+// RunTicks advances the timer wheel time with n ticks, running all the
+// timers that expire. In simulation mode (Config.Simulation) all the
+// handlers are run before returning, from the calling goroutine.
+// It can be used only in simulation mode or if the timer wheel was not
+// started (Start()) and it must never be called in parallel.
+func (wt *WTimer) RunTicks(n uint64) {
+	for i := uint64(0); i < n; i++ {
+		wt.advanceTimeTo(wt.Now().AddUint64(1))
+		if wt.cfg.Simulation {
+			wt.simRunQueues()
+		}
+	}
+}
+
+// simRunQueues runs all the handlers queued on the run queues, emulating
+// the run queues workers in simulation mode: the classes are served in
+// dispatch order (priorities first), while the order of the queues inside
+// a class is chosen pseudo-randomly, based on Config.SimSeed.
+func (wt *WTimer) simRunQueues() {
+	gid := goID()
+	if wt.simOrder == nil {
+		wt.simOrder = wt.simClassOrder()
+		wt.simPend = make([]int, 0, len(wt.rQs))
+	}
+	order := wt.simOrder
+	pending := wt.simPend
+	for !wt.dispatchStopped() {
+		pending = pending[:0]
+		for _, c := range order {
+			cls := &wt.rClasses[c]
+			for i := cls.first; i < cls.first+cls.n; i++ {
+				wt.rQs[i].lock.Lock()
+				if !wt.rQs[i].lst.isEmpty() {
+					pending = append(pending, i)
+				}
+				wt.rQs[i].lock.Unlock()
+			}
+			if len(pending) != 0 {
+				break
+			}
+		}
+		if len(pending) == 0 {
+			return
+		}
+		wt.runQ(pending[wt.simRand.Intn(len(pending))], gid, nil)
+	}
+}
+
+// simClassOrder returns the run classes indexes in dispatch order.
+func (wt *WTimer) simClassOrder() []int {
+	order := make([]int, 0, len(wt.rClasses))
+	for _, p := range prioOrder {
+		order = append(order, int(p))
+	}
+	for c := int(PrioNo); c < len(wt.rClasses); c++ {
+		order = append(order, c)
+	}
+	return order
+}
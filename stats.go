@@ -0,0 +1,146 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// WheelStats contains occupancy statistics for one wheel.
+type WheelStats struct {
+	Timers   int    // timers on the wheel
+	Lists    int    // non-empty lists
+	MaxList  int    // maximum number of timers in one list
+	Cascaded uint64 // timers redistributed (cascaded) from this wheel
+	// Buckets contains the number of timers in each wheel list (filled
+	// only if requested)
+	Buckets []int
+}
+
+// OccupancyStats contains the timers distribution (see Occupancy()).
+type OccupancyStats struct {
+	Wheels    [WheelsNo]WheelStats
+	Expired   int // timers on the expired list
+	RunQueues int // timers on the run queues
+}
+
+// Occupancy returns the current timers distribution on the wheels, the
+// expired list and the run queues. If buckets is true the number of timers
+// in each wheel list is also returned (WheelStats.Buckets).
+// The Cascaded counters can be used to see how many timers are
+// re-distributed from the higher wheels (which might help choosing a
+// better tick duration).
+// It walks all the timers, taking the internal lock for each list, so the
+// result is only approximate if timers are added or removed in the
+// meantime.
+func (wt *WTimer) Occupancy(buckets bool) *OccupancyStats {
+	s := &OccupancyStats{}
+	for w := range wt.wheels {
+		ws := &s.Wheels[w]
+		if buckets {
+			ws.Buckets = make([]int, len(wt.wheels[w].lsts))
+		}
+		for i := range wt.wheels[w].lsts {
+			wt.lock()
+			n := lstLen(&wt.wheels[w].lsts[i])
+			wt.unlock()
+			if n == 0 {
+				continue
+			}
+			ws.Timers += n
+			ws.Lists++
+			if n > ws.MaxList {
+				ws.MaxList = n
+			}
+			if buckets {
+				ws.Buckets[i] = n
+			}
+		}
+	}
+	wt.lock()
+	for w := range wt.cascaded {
+		s.Wheels[w].Cascaded = wt.cascaded[w]
+	}
+	s.Expired = lstLen(&wt.expired)
+	wt.unlock()
+	for i := range wt.rQs {
+		wt.rQs[i].lock.Lock()
+		s.RunQueues += lstLen(&wt.rQs[i].lst)
+		wt.rQs[i].lock.Unlock()
+	}
+	return s
+}
+
+// lstLen returns the number of timers in lst.
+// It must be called with the lock protecting lst held.
+func lstLen(lst *timerLst) int {
+	n := 0
+	lst.forEach(func(e *TimerLnk) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// HotBucket contains the state of a wheel list (bucket), see HotBuckets().
+type HotBucket struct {
+	Idx     int           // list index inside the wheel
+	Timers  int           // timers in the list
+	Nearest Ticks         // nearest expire of the list timers
+	In      time.Duration // time until Nearest
+}
+
+// HotBuckets returns, for each wheel, the n most populated lists, sorted
+// by the number of timers (descending), together with their nearest
+// expire. A list with a lot of timers on wheel 0 means a lot of timers
+// expiring on the same tick (e.g. synchronized timeouts), which can cause
+// latency spikes when they expire.
+// It walks all the timers, taking the internal lock for each list, so the
+// result is only approximate if timers are added or removed in the
+// meantime.
+func (wt *WTimer) HotBuckets(n int) [WheelsNo][]HotBucket {
+	var hot [WheelsNo][]HotBucket
+	if n <= 0 {
+		return hot
+	}
+	for w := range wt.wheels {
+		top := make([]HotBucket, 0, n+1)
+		for i := range wt.wheels[w].lsts {
+			b := HotBucket{Idx: i}
+			wt.lock()
+			now := wt.Now()
+			wt.wheels[w].lsts[i].forEach(func(e *TimerLnk) bool {
+				if b.Timers == 0 || e.expire.LT(b.Nearest) {
+					b.Nearest = e.expire
+				}
+				b.Timers++
+				return true
+			})
+			wt.unlock()
+			if b.Timers == 0 ||
+				(len(top) == n && b.Timers <= top[n-1].Timers) {
+				continue
+			}
+			if b.Nearest.GT(now) {
+				b.In = wt.Duration(b.Nearest.Sub(now))
+			}
+			// insert sorted, keeping at most n
+			pos := len(top)
+			for pos > 0 && top[pos-1].Timers < b.Timers {
+				pos--
+			}
+			top = append(top, HotBucket{})
+			copy(top[pos+1:], top[pos:])
+			top[pos] = b
+			if len(top) > n {
+				top = top[:n]
+			}
+		}
+		hot[w] = top
+	}
+	return hot
+}
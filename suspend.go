@@ -0,0 +1,107 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/intuitivelabs/timestamp"
+)
+
+// SuspendPolicy decides how the pending timers are handled after a system
+// suspend (e.g. laptop sleep or VM pause), see Config.SuspendThreshold.
+type SuspendPolicy uint8
+
+const (
+	// SuspendFire: all the timers that expired during the suspend are
+	// run immediately (default).
+	SuspendFire SuspendPolicy = iota
+	// SuspendShift: all the pending timers expire times are shifted with
+	// the suspend duration (the timer wheel time is stopped during the
+	// suspend).
+	SuspendShift
+	// SuspendAsk: Config.SuspendF is called to decide (SuspendFire if
+	// not set).
+	SuspendAsk
+)
+
+// String returns the policy name.
+func (p SuspendPolicy) String() string {
+	switch p {
+	case SuspendFire:
+		return "fire"
+	case SuspendShift:
+		return "shift"
+	case SuspendAsk:
+		return "ask"
+	}
+	return "invalid"
+}
+
+// A SuspendHandlerF is called after a detected suspend of duration gap and
+// returns the policy that should be used for it (SuspendFire or
+// SuspendShift). It is called from the timer goroutine.
+type SuspendHandlerF func(wt *WTimer, gap time.Duration) SuspendPolicy
+
+// SuspendStats contains the suspend detection counters.
+type SuspendStats struct {
+	Suspends uint64        // detected suspends
+	Shifted  uint64        // suspends handled by shifting the timers
+	Gap      time.Duration // total suspend time
+}
+
+// SuspendStats returns the suspend detection counters.
+func (wt *WTimer) SuspendStats() SuspendStats {
+	return SuspendStats{
+		Suspends: atomic.LoadUint64(&wt.suspends),
+		Shifted:  atomic.LoadUint64(&wt.suspShifted),
+		Gap:      time.Duration(atomic.LoadInt64(&wt.suspGap)),
+	}
+}
+
+// resetSuspendStats resets the suspend detection counters.
+func (wt *WTimer) resetSuspendStats() {
+	atomic.StoreUint64(&wt.suspends, 0)
+	atomic.StoreUint64(&wt.suspShifted, 0)
+	atomic.StoreInt64(&wt.suspGap, 0)
+}
+
+// checkSuspend checks if the time elapsed since the last tick (at now)
+// indicates a system suspend and handles it according to
+// Config.SuspendPolicy.
+// It must be called only from the timer goroutine (ticker()).
+func (wt *WTimer) checkSuspend(now timestamp.TS) {
+	if wt.cfg.SuspendThreshold <= 0 || wt.cfg.Tickless {
+		return
+	}
+	diff := now.Sub(wt.lastTickT)
+	if diff <= wt.cfg.SuspendThreshold {
+		return
+	}
+	// all the time since the last tick, minus the normal tick
+	gap := diff - wt.tickDuration
+	atomic.AddUint64(&wt.suspends, 1)
+	atomic.AddInt64(&wt.suspGap, int64(gap))
+	pol := wt.cfg.SuspendPolicy
+	if pol == SuspendAsk {
+		pol = SuspendFire
+		if wt.cfg.SuspendF != nil {
+			pol = wt.cfg.SuspendF(wt, gap)
+		}
+	}
+	if wt.warnOn() {
+		wt.warn(nil, "suspend detected: %s since the last tick,"+
+			" policy %s\n", diff, pol)
+	}
+	if pol == SuspendShift {
+		// stop the timer wheel time during the suspend
+		wt.setRef(wt.refTS.Add(gap), wt.refTicks)
+		wt.lastTickT = wt.lastTickT.Add(gap)
+		atomic.AddUint64(&wt.suspShifted, 1)
+	}
+}
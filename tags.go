@@ -0,0 +1,92 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// SetTag sets the timer tag, used for finding the armed timers with
+// FindByTag(), CountByTag() or CancelByTag() (e.g. the timer kind, like
+// "reg-refresh", or an application id). The tag must be comparable,
+// typically a string or an integer, nil removes it.
+// It has the same usage restrictions as Reset(). A re-initialised timer
+// (InitTimer()) has no tag.
+func (wt *WTimer) SetTag(tl *TimerLnk, tag interface{}) error {
+	if tag != nil && !reflect.TypeOf(tag).Comparable() {
+		return wt.opErr("SetTag", tl, ErrInvalidParameters)
+	}
+	if err := wt.inactiveOrSelf(tl); err != nil {
+		return wt.opErr("SetTag", tl, err)
+	}
+	wt.extOf(tl).tag = tag
+	return nil
+}
+
+// Tag returns the timer tag (see SetTag()).
+func (tl *TimerLnk) Tag() interface{} {
+	return tl.extView().tag
+}
+
+// forEachTagged calls f for each timer with the tag tag waiting on the
+// wheels, with wt.lock() held (it must not block).
+func (wt *WTimer) forEachTagged(tag interface{}, f func(*TimerLnk)) {
+	if tag == nil {
+		return
+	}
+	for i := range wt.wlists {
+		lst := &wt.wlists[i]
+		wt.lock()
+		lst.forEach(func(e *TimerLnk) bool {
+			if e.info.flags()&fDelete == 0 && e.extView().tag == tag {
+				f(e) // not DelLazy()-ed
+			}
+			return true
+		})
+		wt.unlock()
+	}
+}
+
+// FindByTag returns the timers with the tag tag that are waiting on the
+// wheels (the running or expired timers are not included).
+// It walks all the timers, taking the internal lock for each wheel list,
+// so the result might not be a consistent snapshot.
+func (wt *WTimer) FindByTag(tag interface{}) []*TimerLnk {
+	var found []*TimerLnk
+	wt.forEachTagged(tag, func(tl *TimerLnk) {
+		found = append(found, tl)
+	})
+	return found
+}
+
+// CountByTag returns the number of timers with the tag tag that are
+// waiting on the wheels (see FindByTag()).
+func (wt *WTimer) CountByTag(tag interface{}) int {
+	n := 0
+	wt.forEachTagged(tag, func(tl *TimerLnk) {
+		n++
+	})
+	return n
+}
+
+// CancelByTag removes all the timers with the tag tag that are waiting on
+// the wheels (see FindByTag()), like DelGen(). It returns the number of
+// removed timers. The timers re-initialised in parallel are not touched.
+func (wt *WTimer) CancelByTag(tag interface{}) int {
+	var refs []timerRef
+	wt.forEachTagged(tag, func(tl *TimerLnk) {
+		refs = append(refs, timerRef{tl, atomic.LoadUint32(&tl.gen)})
+	})
+	n := 0
+	for _, r := range refs {
+		if ok, err := wt.del(r.tl, fDelGen, r.gen); ok && err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"runtime"
+)
+
+// lockTimerThread pins the calling goroutine (the timer goroutine) to its
+// OS thread and sets the thread scheduling priority and CPU affinity,
+// according to Config.LockOSThread, Config.TickerNice and
+// Config.CPUAffinity. It returns a function that must be called when the
+// goroutine exits.
+func (wt *WTimer) lockTimerThread() func() {
+	if !wt.cfg.LockOSThread && !wt.cfg.BusyPoll && wt.cfg.TickerNice == 0 &&
+		len(wt.cfg.CPUAffinity) == 0 {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	changed := false // thread attributes changed
+	if wt.cfg.TickerNice != 0 {
+		if err := setThreadNice(wt.cfg.TickerNice); err != nil {
+			if wt.warnOn() {
+				wt.warn(nil, "failed to set the timer thread priority to"+
+					" %d: %s\n", wt.cfg.TickerNice, err)
+			}
+		} else {
+			changed = true
+		}
+	}
+	if len(wt.cfg.CPUAffinity) != 0 {
+		if err := setThreadAffinity(wt.cfg.CPUAffinity); err != nil {
+			if wt.warnOn() {
+				wt.warn(nil, "failed to set the timer thread CPU affinity"+
+					" to %v: %s\n", wt.cfg.CPUAffinity, err)
+			}
+		} else {
+			changed = true
+		}
+	}
+	if changed {
+		// never unlock the thread, so that it will be terminated when the
+		// goroutine exits (instead of being re-used for other goroutines)
+		return func() {}
+	}
+	return runtime.UnlockOSThread
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build linux
+
+package wtimer
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setThreadAffinity restricts the current OS thread to the CPUs cpus.
+func setThreadAffinity(cpus []int) error {
+	var mask [16]uint64 // cpu_set_t, 1024 CPUs
+	for _, c := range cpus {
+		if c < 0 || c >= len(mask)*64 {
+			return ErrInvalidParameters
+		}
+		mask[c/64] |= 1 << uint(c%64)
+	}
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// setThreadNice sets the nice value of the current OS thread (on Linux the
+// priority of a single thread can be changed using its thread id).
+func setThreadNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice)
+}
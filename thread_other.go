@@ -0,0 +1,25 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build !linux
+
+package wtimer
+
+import (
+	"errors"
+)
+
+// setThreadAffinity is not supported: the CPU affinity can be set only on
+// Linux.
+func setThreadAffinity(cpus []int) error {
+	return errors.New("thread CPU affinity not supported on this OS")
+}
+
+// setThreadNice is not supported: changing the priority of a single thread
+// is supported only on Linux.
+func setThreadNice(nice int) error {
+	return errors.New("thread priority not supported on this OS")
+}
@@ -10,9 +10,10 @@ import (
 	"strconv"
 )
 
+// TicksBits is defined in ticks_bits*.go, depending on the build tags
+// (48 bits by default, 64 bits with the ticks64 tag).
+
 const (
-	//TicksBits    = 48
-	TicksBits    = W0Bits + W1Bits + W2Bits + W3Bits
 	MaxTicksDiff = 1 << (TicksBits - 1)
 	TicksMask    = (MaxTicksDiff - 1) | MaxTicksDiff
 	// special value, when returned from a timer handler the timer will be
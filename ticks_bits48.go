@@ -0,0 +1,12 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build !ticks64
+
+package wtimer
+
+// TicksBits is the Ticks size in bits, equal to the total wheels bits.
+const TicksBits = W0Bits + W1Bits + W2Bits + W3Bits
@@ -0,0 +1,20 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build ticks64
+
+package wtimer
+
+// TicksBits is the Ticks size in bits: 64 bits Ticks, for tiny ticks and
+// very long running instances (the Ticks practically never wrap around
+// and can be compared over any interval).
+// The wheels still cover only 2^(W0Bits+W1Bits+W2Bits+W3Bits) ticks, the
+// longer intervals are split in legs (see MaxDuration()).
+const TicksBits = 64
+
+func init() {
+	BuildTags = append(BuildTags, "ticks64")
+}
@@ -26,12 +26,12 @@ func TestTicksConst(t *testing.T) {
 		t.Fatalf("bad TicksBits constant, too small\n")
 	}
 	if MaxTicksDiff == 0 || (MaxTicksDiff&(MaxTicksDiff-1) != 0) {
-		t.Fatalf("wrong MaxTicksDiff 0x%x, should be 2^k\n", MaxTicksDiff)
+		t.Fatalf("wrong MaxTicksDiff 0x%x, should be 2^k\n", uint64(MaxTicksDiff))
 	}
 	if ((TicksMask+1)&TicksMask) != 0 ||
 		(MaxTicksDiff-1)&TicksMask != (MaxTicksDiff-1) ||
 		MaxTicksDiff&TicksMask != MaxTicksDiff {
-		t.Fatalf("wrong TicksMask 0x%x\n", TicksMask)
+		t.Fatalf("wrong TicksMask 0x%x\n", uint64(TicksMask))
 	}
 }
 
@@ -41,11 +41,11 @@ func tstOp(t *testing.T, p string, v1, v2 uint64) {
 
 	if !((t1.Val() == v1) == (v1 <= TicksMask)) {
 		t.Errorf(p+"Val for 0x%x (mask 0x%x) => 0x%x failed\n",
-			v1, TicksMask, t1.Val())
+			v1, uint64(TicksMask), t1.Val())
 	}
 	if !((t2.Val() == v2) == (v2 <= TicksMask)) {
 		t.Errorf(p+"Val for 0x%x (mask 0x%x) => 0x%x failed\n",
-			v2, TicksMask, t2.Val())
+			v2, uint64(TicksMask), t2.Val())
 	}
 
 	if t1.EQ(t2) != ((v1 & TicksMask) == (v2 & TicksMask)) {
@@ -78,7 +78,7 @@ func tstOp(t *testing.T, p string, v1, v2 uint64) {
 		if t1.GE(t2) != (v1 >= v2) {
 			t.Errorf(p+"GE for 0x%x <> 0x%x failed (0x%x, 0x%x) v1 GE v2 %v diff 0x%x (%d) t1 - t2 = 0x%x  mask = 0x%x\n",
 				t1.Val(), t2.Val(), v1, v2,
-				v1 >= v2, v1-v2, v1-v2, t1.Val()-t2.Val(), TicksMask)
+				v1 >= v2, v1-v2, v1-v2, t1.Val()-t2.Val(), uint64(TicksMask))
 		}
 		if t1.Add(t2).NE(NewTicks(v1 + v2)) {
 			t.Errorf(p+"Add for 0x%x <> 0x%x failed (0x%x, 0x%x)\n",
@@ -113,7 +113,7 @@ func TestTicksOps(t *testing.T) {
 
 	for i := 0; i < iterations; i++ {
 		v1 := uint64(rand.Int63())
-		diff := uint64(rand.Int63n(MaxTicksDiff))
+		diff := rand.Uint64() % MaxTicksDiff
 		tstOp(t, "rand+: ", v1, v1+diff)
 		tstOp(t, "rand-: ", v1, v1-diff)
 	}
@@ -0,0 +1,177 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// TickHistBuckets is the number of buckets of a TickHist: bucket 0
+// counts the values under 1us, bucket i the values in [2^(i-1)us, 2^i us)
+// and the last bucket all the values over 2^(TickHistBuckets-2)us (~262ms).
+const TickHistBuckets = 20
+
+// TickHistBound returns the upper bound of the TickHist bucket i (0 for
+// the last bucket, which has no upper bound).
+func TickHistBound(i int) time.Duration {
+	if i < 0 || i >= TickHistBuckets-1 {
+		return 0
+	}
+	return time.Microsecond << uint(i)
+}
+
+// TickHist is a log2 histogram of durations (see TickStats).
+type TickHist struct {
+	Counts [TickHistBuckets]uint64 // values in each bucket
+	Sum    time.Duration           // sum of all the values
+	Max    time.Duration           // maximum value
+}
+
+// N returns the number of values in the histogram.
+func (h *TickHist) N() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Mean returns the average value (0 if empty).
+func (h *TickHist) Mean() time.Duration {
+	n := h.N()
+	if n == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(n)
+}
+
+// Quantile returns an upper bound for the q quantile (0 <= q <= 1) of the
+// values: the upper bound of the bucket containing it, or Max for the
+// last bucket (e.g. Quantile(0.99) for the 99th percentile).
+func (h *TickHist) Quantile(q float64) time.Duration {
+	n := h.N()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var cnt uint64
+	for i, c := range h.Counts {
+		cnt += c
+		if cnt >= rank {
+			if b := TickHistBound(i); b != 0 && b < h.Max {
+				return b
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+// add adds the values in o to h (aggregation).
+func (h *TickHist) add(o *TickHist) {
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Sum += o.Sum
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+}
+
+// TickStats contains the timer goroutine self-measurements, for finding
+// capacity problems (e.g. ticks taking 30ms because of cascades or slow
+// Ffast handlers) without external profiling.
+type TickStats struct {
+	// Proc contains the processing duration of each tick: advancing the
+	// time, cascading the timers and dispatching the expired ones
+	// (including running the Ffast handlers).
+	Proc TickHist
+	// Jitter contains the difference between the time elapsed between
+	// two consecutive ticks and the tick duration (absolute value). It is
+	// not measured in tickless mode (Config.Tickless).
+	Jitter TickHist
+}
+
+// tickHist is the internal TickHist, updated by the timer goroutine
+// (atomic access).
+type tickHist struct {
+	counts [TickHistBuckets]uint64
+	sum    int64
+	max    int64
+}
+
+// record adds d to the histogram.
+// It must be called only from the timer goroutine (the only writer).
+func (h *tickHist) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= TickHistBuckets {
+		i = TickHistBuckets - 1
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	if int64(d) > atomic.LoadInt64(&h.max) {
+		atomic.StoreInt64(&h.max, int64(d))
+	}
+}
+
+// get returns a copy of the histogram.
+func (h *tickHist) get() TickHist {
+	var r TickHist
+	for i := range h.counts {
+		r.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	r.Sum = time.Duration(atomic.LoadInt64(&h.sum))
+	r.Max = time.Duration(atomic.LoadInt64(&h.max))
+	return r
+}
+
+// reset clears the histogram.
+func (h *tickHist) reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// TickStats returns the tick processing duration and jitter histograms.
+func (wt *WTimer) TickStats() TickStats {
+	return TickStats{
+		Proc:   wt.tickProc.get(),
+		Jitter: wt.tickJitter.get(),
+	}
+}
+
+// resetTickStats resets the tick processing duration and jitter
+// histograms.
+func (wt *WTimer) resetTickStats() {
+	wt.tickProc.reset()
+	wt.tickJitter.reset()
+	wt.tickWall = time.Time{}
+}
+
+// tickStart records the jitter of a tick starting at the real time start
+// (see TickStats).
+// It must be called only from the timer goroutine (ticker()).
+func (wt *WTimer) tickStart(start time.Time) {
+	if !wt.tickWall.IsZero() && !wt.cfg.Tickless {
+		jitter := start.Sub(wt.tickWall) - wt.realDuration(wt.tickDuration)
+		if jitter < 0 {
+			jitter = -jitter
+		}
+		wt.tickJitter.record(jitter)
+	}
+	wt.tickWall = start
+}
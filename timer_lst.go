@@ -6,8 +6,10 @@
 
 package wtimer
 
-import ()
-
+// A timerLst is a timer list. There is one for each wheel slot, so it
+// must be kept small: the errors are reported using the WTimer passed to
+// the list operations and, when modified under wt.rlock(), the list is
+// protected by one of the WTimer list locks (see WTimer.lstLock()).
 type timerLst struct {
 	head     TimerLnk // used only as list head (only next & prev)
 	wheelNo  uint8    // mostly for debugging
@@ -36,14 +38,26 @@ func (lst *timerLst) isEmpty() bool {
 
 // insert adds a new TimerLnk entry to the list.
 // There's no internal locking.
-func (lst *timerLst) insert(e *TimerLnk) {
+// It returns nil on success or an error if e is invalid (only in
+// lenient mode, see Config.Lenient), reported using wt.
+func (lst *timerLst) insert(wt *WTimer, e *TimerLnk) error {
 	// DBG checks:
-	if !isDetached(e) {
+	if !wt.cfg.NoListChecks {
+		if !isDetached(e) {
+			w, idx := e.info.wheelPos()
+			return wt.fault(ErrInvalidTimer, e,
+				"timerLst insert called on an entry not detached: "+
+					" t wheel %d idx %d , lst wheel %d idx %d next %p prev %p\n",
+				w, idx, lst.wheelNo, lst.wheelIdx,
+				e.next, e.prev)
+		}
 		w, idx := e.info.wheelPos()
-		PANIC("timerLst insert called on an entry not detached: "+
-			" t wheel %d idx %d , lst wheel %d idx %d next %p prev %p\n",
-			w, idx, lst.wheelNo, lst.wheelIdx,
-			e.next, e.prev)
+		if w != wheelNone || idx != wheelNoIdx {
+			return wt.fault(ErrInvalidTimer, e,
+				"timerLst insert called on an entry already on a diff. list: "+
+					" t wheel %d idx %d , lst wheel %d idx %d\n",
+				w, idx, lst.wheelNo, lst.wheelIdx)
+		}
 	}
 
 	e.prev = &lst.head
@@ -51,26 +65,32 @@ func (lst *timerLst) insert(e *TimerLnk) {
 	e.next.prev = e
 	lst.head.next = e
 
-	// DBG checks:
-	w, idx := e.info.wheelPos()
-	if w != wheelNone || idx != wheelNoIdx {
-		PANIC("timerLst insert called on an entry already on a diff. list: "+
-			" t wheel %d idx %d , lst wheel %d idx %d\n",
-			w, idx, lst.wheelNo, lst.wheelIdx)
-	}
 	e.info.setWheel(lst.wheelNo, lst.wheelIdx)
+	return nil
 }
 
 // appends adds a TimerLnk entry at the end of the list
 // There's no internal locking.
-func (lst *timerLst) append(e *TimerLnk) {
+// It returns nil on success or an error if e is invalid (only in
+// lenient mode, see Config.Lenient), reported using wt.
+func (lst *timerLst) append(wt *WTimer, e *TimerLnk) error {
 	// DBG checks:
-	if !isDetached(e) {
+	if !wt.cfg.NoListChecks {
+		if !isDetached(e) {
+			w, idx := e.info.wheelPos()
+			return wt.fault(ErrInvalidTimer, e,
+				"timerLst append called on an entry not detached: "+
+					" t wheel %d idx %d , lst wheel %d idx %d next %p prev %p\n",
+				w, idx, lst.wheelNo, lst.wheelIdx,
+				e.next, e.prev)
+		}
 		w, idx := e.info.wheelPos()
-		PANIC("timerLst append called on an entry not detached: "+
-			" t wheel %d idx %d , lst wheel %d idx %d next %p prev %p\n",
-			w, idx, lst.wheelNo, lst.wheelIdx,
-			e.next, e.prev)
+		if w != wheelNone || idx != wheelNoIdx {
+			return wt.fault(ErrInvalidTimer, e,
+				"timerLst append called on an entry already on a diff. list: "+
+					" t wheel %d idx %d , lst wheel %d idx %d\n",
+				w, idx, lst.wheelNo, lst.wheelIdx)
+		}
 	}
 
 	e.prev = lst.head.prev
@@ -78,30 +98,29 @@ func (lst *timerLst) append(e *TimerLnk) {
 	e.prev.next = e
 	lst.head.prev = e
 
-	// DBG checks:
-	w, idx := e.info.wheelPos()
-	if w != wheelNone || idx != wheelNoIdx {
-		PANIC("timerLst insert called on an entry already on a diff. list: "+
-			" t wheel %d idx %d , lst wheel %d idx %d\n",
-			w, idx, lst.wheelNo, lst.wheelIdx)
-	}
 	e.info.setWheel(lst.wheelNo, lst.wheelIdx)
+	return nil
 }
 
 // rm removes a TimerLnk entry from the list.
 // There's no internal locking.
-func (lst *timerLst) rm(e *TimerLnk) {
+// It returns nil on success or an error if e is invalid (only in
+// lenient mode, see Config.Lenient), reported using wt. Note that on
+// error e might be still linked in the list.
+func (lst *timerLst) rm(wt *WTimer, e *TimerLnk) error {
 	if e == nil || e.next == nil || e.prev == nil {
-		PANIC("called with nil-detached element %p\n", e)
+		return wt.fault(ErrInvalidTimer, e,
+			"called with nil-detached element %p\n", e)
 	}
 	if e.next == e || e.prev == e {
 		if e == &lst.head {
-			PANIC("trying to rm list head  %p\n", e)
-		} else {
-			PANIC("called with detached element %p:"+
-				" expire %s intvl %s %s\n",
-				e, e.expire, e.intvl, e.info)
+			return wt.fault(ErrInvalidTimer, e,
+				"trying to rm list head  %p\n", e)
 		}
+		return wt.fault(ErrInvalidTimer, e,
+			"called with detached element %p:"+
+				" expire %s intvl %s %s\n",
+			e, e.expire, e.intvl, e.info)
 	}
 	e.prev.next = e.next
 	e.next.prev = e.prev
@@ -109,14 +128,16 @@ func (lst *timerLst) rm(e *TimerLnk) {
 	e.next = e
 	e.prev = e
 
-	// DBG checks:
 	w, idx := e.info.wheelPos()
-	if w != lst.wheelNo || idx != lst.wheelIdx {
-		PANIC("timerLst rm called on an entry from a different list: "+
-			" t wheel %d idx %d , lst wheel %d idx %d\n",
+	e.info.setWheel(wheelNone, wheelNoIdx)
+	// DBG checks:
+	if !wt.cfg.NoListChecks && (w != lst.wheelNo || idx != lst.wheelIdx) {
+		return wt.fault(ErrInvalidTimer, e,
+			"timerLst rm called on an entry from a different list: "+
+				" t wheel %d idx %d , lst wheel %d idx %d\n",
 			w, idx, lst.wheelNo, lst.wheelIdx)
 	}
-	e.info.setWheel(wheelNone, wheelNoIdx)
+	return nil
 }
 
 // rmSubList removes a sub list defined by all the elements between
@@ -125,24 +146,34 @@ func (lst *timerLst) rm(e *TimerLnk) {
 // is empty.
 // Note: s & e must be different from lst (from the list head address).
 // Examples:
-//   - detach the entire list:  l := lst.rmSubList(lst.next, lst.prev)
-//   - detach from start to e:  l := lst.rmSubList(lst.next, e)
-//   - detach from e to end:    l := lst.rmSubList(e, lst.prev)
-func (lst *timerLst) rmSubList(s, e *TimerLnk) *TimerLnk {
+//   - detach the entire list:  l := lst.rmSubList(wt, lst.next, lst.prev)
+//   - detach from start to e:  l := lst.rmSubList(wt, lst.next, e)
+//   - detach from e to end:    l := lst.rmSubList(wt, e, lst.prev)
+// On error (invalid s or e in lenient mode, see Config.Lenient) it
+// returns nil.
+func (lst *timerLst) rmSubList(wt *WTimer, s, e *TimerLnk) *TimerLnk {
 	if e == nil || e.next == nil || e.prev == nil {
-		PANIC("called with nil-detached element %p\n", e)
+		wt.fault(ErrInvalidTimer, e,
+			"called with nil-detached element %p\n", e)
+		return nil
 	}
 	if e.next == e || e.prev == e {
 		if e != &lst.head {
-			PANIC("called with detached element %p\n", e)
+			wt.fault(ErrInvalidTimer, e,
+				"called with detached element %p\n", e)
+			return nil
 		}
 	}
 	if s == nil || s.next == nil || s.prev == nil {
-		PANIC("called with nil-detached element %p\n", e)
+		wt.fault(ErrInvalidTimer, s,
+			"called with nil-detached element %p\n", s)
+		return nil
 	}
 	if s.next == s || s.prev == s {
 		if s != &lst.head {
-			PANIC("called with detached element %p\n", s)
+			wt.fault(ErrInvalidTimer, s,
+				"called with detached element %p\n", s)
+			return nil
 		}
 	}
 
@@ -201,10 +232,10 @@ func (lst *timerLst) appendSubList(s, e *TimerLnk) {
 
 // mv moves all the elements of the current lst to the end of dst.
 // Returns true if any elements where moved
-func (lst *timerLst) mv(dst *timerLst) bool {
+func (lst *timerLst) mv(wt *WTimer, dst *timerLst) bool {
 	s := lst.head.next
 	e := lst.head.prev
-	if lst.rmSubList(s, e) == nil {
+	if lst.rmSubList(wt, s, e) == nil {
 		return false
 	}
 	dst.appendSubList(s, e)
@@ -0,0 +1,45 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+// timerFDLoop is the timer goroutine main loop when the ticks are driven
+// by a timerfd (see newTimerFD()). It returns nil when Shutdown() is called
+// and the error on a timerfd read error (the timerfd is closed).
+func (wt *WTimer) timerFDLoop(tfd *timerFD) error {
+	done := make(chan struct{})
+	wt.wg.Add(1) // Shutdown() must not return before it exits
+	go func() {
+		defer wt.wg.Done()
+		// closing the timerfd interrupts the blocked wait()
+		select {
+		case <-wt.cancel:
+		case <-done:
+		}
+		tfd.close()
+	}()
+	var err error
+	for {
+		if _, err = tfd.wait(); err != nil {
+			break
+		}
+		select {
+		case <-wt.cancel:
+			// wait() might have returned before close()
+		default:
+			wt.ticker()
+			continue
+		}
+		break
+	}
+	close(done)
+	select {
+	case <-wt.cancel:
+		return nil // shut down (the timerfd closed by Shutdown())
+	default:
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build linux
+
+package wtimer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	clockMonotonic  = 1 // CLOCK_MONOTONIC
+	tfdTimerAbstime = 1 // TFD_TIMER_ABSTIME
+)
+
+// itimerspec is the timerfd_settime() parameter.
+type itimerspec struct {
+	interval syscall.Timespec
+	value    syscall.Timespec
+}
+
+// timerFD is a periodic tick source based on a Linux timerfd, expiring on
+// absolute CLOCK_MONOTONIC times, multiple of the tick duration from its
+// creation. Compared to time.Ticker it has lower jitter and it does not
+// drift. The timerfd is non-blocking and it is waited on using the runtime
+// network poller (epoll).
+type timerFD struct {
+	f   *os.File
+	buf [8]byte // expirations counter read buffer (avoids allocations)
+}
+
+// newTimerFD returns a new timerfd tick source, firing every d, starting
+// d after the call. It should be created right after setting the timer
+// wheel reference time, so that the expires are in phase with the timer
+// wheel ticks (otherwise the ticks would be seen late by up to 1 tick).
+func newTimerFD(d time.Duration) (*timerFD, error) {
+	if d <= 0 {
+		return nil, ErrInvalidParameters
+	}
+	fd, _, e := syscall.Syscall(syscall.SYS_TIMERFD_CREATE, clockMonotonic,
+		syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if e != 0 {
+		return nil, e
+	}
+	var now syscall.Timespec
+	_, _, e = syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic,
+		uintptr(unsafe.Pointer(&now)), 0)
+	if e != 0 {
+		syscall.Close(int(fd))
+		return nil, e
+	}
+	// absolute expires, multiple of d from now => no drift
+	first := now.Nano() + int64(d)
+	spec := itimerspec{
+		interval: syscall.NsecToTimespec(int64(d)),
+		value:    syscall.NsecToTimespec(first),
+	}
+	_, _, e = syscall.Syscall6(syscall.SYS_TIMERFD_SETTIME, fd,
+		tfdTimerAbstime, uintptr(unsafe.Pointer(&spec)), 0, 0, 0)
+	if e != 0 {
+		syscall.Close(int(fd))
+		return nil, e
+	}
+	// non-blocking fd => os.NewFile() uses the runtime poller
+	return &timerFD{f: os.NewFile(fd, "wtimer-timerfd")}, nil
+}
+
+// wait blocks until the next expire and returns the number of expires
+// since the previous wait() (more then 1 if the reader was delayed).
+func (t *timerFD) wait() (uint64, error) {
+	n, err := t.f.Read(t.buf[:])
+	if err != nil {
+		return 0, err
+	}
+	if n != len(t.buf) {
+		return 0, errors.New("timerfd: short read")
+	}
+	// host byte order
+	return *(*uint64)(unsafe.Pointer(&t.buf[0])), nil
+}
+
+// close closes the timerfd, interrupting a blocked wait().
+func (t *timerFD) close() error {
+	return t.f.Close()
+}
@@ -0,0 +1,31 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+//+build !linux
+
+package wtimer
+
+import (
+	"errors"
+	"time"
+)
+
+// timerFD is a timerfd tick source, supported only on Linux.
+type timerFD struct{}
+
+// newTimerFD always fails: timerfd is supported only on Linux (the
+// portable loop is used instead, see absTickLoop()).
+func newTimerFD(d time.Duration) (*timerFD, error) {
+	return nil, errors.New("timerfd not supported on this OS")
+}
+
+func (t *timerFD) wait() (uint64, error) {
+	return 0, errors.New("timerfd not supported on this OS")
+}
+
+func (t *timerFD) close() error {
+	return nil
+}
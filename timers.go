@@ -7,7 +7,11 @@
 package wtimer
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 const Periodic time.Duration = time.Duration(^int64(0))
@@ -25,51 +29,148 @@ const Periodic time.Duration = time.Duration(^int64(0))
 // of Ticks (use wt.Duration(NewTicks(1)) too see the configured
 // tick interval) and it should be always at least 1 tick.
 //
-// Inside the timer callback the only timer operation allowed on
-// the timer handler ( *TimerLnk) is wt.Del(). All the other operations cannot
-// be used inside the timer callback: wt.Add() and wt.Reset() will fail
-// harmlessly, wt.DelTry() will always return false and wt.DelWait() will
-// deadlock (waiting for the callback running it to finish...).
+// Inside the timer callback the timer operations allowed on
+// the timer handler ( *TimerLnk) are wt.Del(), wt.Add*() and wt.Reset().
+// wt.Add*() called from the callback will record a re-arm request: if the
+// callback returns true the timer will be re-added using the interval,
+// handler and parameter passed to wt.Add*() (ignoring the returned interval).
+// If the callback returns false the re-arm request is ignored (returning false
+// means the timer code will not touch the timer handler anymore).
+// wt.Reset() called from the callback changes the timer flags for the
+// next runs.
+// wt.DelTry() will always return false and wt.DelWait() will
+// return false and ErrSelfWait (instead of deadlocking waiting for the
+// callback running it to finish), marking the timer for removal like
+// wt.Del().
 // wt.Del() is not 100% equivalent to returning false. Returning false
 // means that the timer handler can be freed inside the callback, the
 // timer code will not touch it. Running wt.Del() and returning
 // true will still terminate the timer, but the timer code will access first
 // the handler, so if you use wt.Del() inside the callback instead of returning
 // false, then the timer handler must still exist after the callback ends.
+//
+// The runs of the same timer never overlap, whatever the way in which it is
+// run (Ffast, FgoR or run queues): a timer is re-armed only after its
+// handler returns, so the next interval starts only then, and it cannot be
+// re-added from outside while its handler is running (see DelWait()).
+// A slow periodic handler delays its own next runs instead of running in
+// parallel with them.
 type TimerHandlerF func(wt *WTimer, h *TimerLnk, arg interface{}) (bool, time.Duration)
 
 const (
 	wheelNone  uint8  = 255   // sentinel value for no wheel
 	wheelExp   uint8  = 254   //  no wheel, expired list
 	wheelRQ    uint8  = 253   // no wheel, runq
+	wheelAddQ  uint8  = 252   // no wheel, add queue (Config.AddQueue)
 	wheelNoIdx uint16 = 65535 // sentinel debug value for no index
 )
 
-// flags for timers
+// flags for timers (all the bits are used, the application can use the
+// separate user flags, see TimerLnk.UserFlags())
 const (
-	fHead    = 1  // this is the list head (debugging)
-	fActive  = 2  // timer is active (added)
-	fDelete  = 4  // the timer was deleted
-	fRunning = 8  // timer handler is executing
-	fRemoved = 16 // timer is removed
-	Ffast    = 32 // "fast" timer, run in the main timer go routine
-	FgoR     = 64 //  run timer handle in its own temp. go routine
+	fHead    = 1   // this is the list head (debugging)
+	fActive  = 2   // timer is active (added)
+	fDelete  = 4   // the timer was deleted
+	fRunning = 8   // timer handler is executing
+	fRemoved = 16  // timer is removed
+	Ffast    = 32  // "fast" timer, run in the main timer go routine
+	FgoR     = 64  //  run timer handle in a separate (pooled) go routine
+	fRearm   = 128 // re-arm requested by Add*() from the running handler
 	// internal flags mask (flags for internal use only)
-	fInternalMask = fHead | fActive | fDelete | fRunning | fRemoved
+	fInternalMask = fHead | fActive | fDelete | fRunning | fRemoved | fRearm
 )
 
 // A TimerLnk is the internal structure used for registering timers.
+// While active, a TimerLnk is referenced from the timer wheel, so it (and
+// the structure containing it) cannot be garbage collected. It must not
+// be copied or re-used before it is removed.
 type TimerLnk struct {
 	next   *TimerLnk
 	prev   *TimerLnk
 	expire Ticks // absolute expire "time" in ticks
+	added  Ticks // when the timer was added (not updated on re-arm)
 	//deltaExp0 Ticks // initial timeout offset (duration till expire)
-	info  tInfo         // internal information (wheel no, idx, flags ...)
-	rctx  tInfo         // running "context" info, needed for DelWait()
+	info tInfo      // internal information (wheel no, idx, flags ...)
+	rctx tInfo      // running "context" info, needed for DelWait()
+	gen  uint32     // generation, increased on each InitTimer() (atomic)
+	ufl  uint32     // user flags (atomic), see TimerLnk.UserFlags()
+	rgid uint64     // id of the goroutine running the handler (atomic)
+	lock sync.Mutex // serializes the operations on the timer
+
+	f     TimerHandlerF // callback function
+	arg   interface{}   // callback function parameter
 	intvl time.Duration // initial expire interval in ns
 
-	f   TimerHandlerF // callback function
-	arg interface{}   // callback function parameter
+	// optional state (*timerExt), allocated on first use, see ext()
+	x unsafe.Pointer
+}
+
+// A timerExt contains the timer state used only by the optional features.
+// It is allocated the first time one of them is used on the timer (see
+// WTimer.extOf()) and it is kept, cleared, when the timer is
+// re-initialised, so a timer re-used with the same features does not
+// allocate again.
+type timerExt struct {
+	aseq  uint64          // add sequence number (Config.FIFO)
+	useq  uint64          // same tick dispatch order, see SetSeq()
+	group *Group          // quotas & accounting group, see SetGroup()
+	newIv time.Duration   // next periodic re-arm interval, see SetInterval()
+	site  uintptr         // Add*() caller pc, if Config.TrackAddSite
+	left  uint64          // ticks left after expire (very long intervals)
+	dline time.Duration   // handler execution deadline, see SetDeadline()
+	nmiss uint64          // periods missed by the run, see MissedPeriods()
+	late  uint64          // ticks since the current run was due (MissBurst)
+	chain *chainLink      // added when the timer completes, see Chain()
+	hctx  context.Context // running handler context, see HandlerContext()
+	tag   interface{}     // timer tag, see SetTag()
+	name  string          // timer name, see SetName()
+
+	// parent and children timers (kids protected by lock), see SetParent()
+	parent *TimerLnk
+	kids   []timerRef
+
+	pseq  uint32     // precise timer adds, see armPrecise()
+	class uint8      // run class (wt.rClasses idx), see SetPriority()
+	must  bool       // run on shutdown (DrainMustRun), see SetMustRun()
+	round Rounding   // intervals to ticks conversion, see SetRounding()
+	prec  bool       // sub-tick precision, see SetPrecise()
+	res   Resolution // resolution class, see SetResolution()
+	miss  MissPolicy // missed periods handling, see SetMissPolicy()
+}
+
+// noExt is the optional state of the timers that never used an optional
+// feature. It is never changed.
+var noExt timerExt
+
+// ext returns the optional state of tl or nil if it was never allocated.
+func (tl *TimerLnk) ext() *timerExt {
+	return (*timerExt)(atomic.LoadPointer(&tl.x))
+}
+
+// extView returns the optional state of tl for reading: if it was never
+// allocated, it returns the default values (noExt, which must not be
+// changed).
+func (tl *TimerLnk) extView() *timerExt {
+	if x := tl.ext(); x != nil {
+		return x
+	}
+	return &noExt
+}
+
+// extOf returns the optional state of tl, allocating it on first use.
+// It must be called under the same conditions as the code changing the
+// returned fields (e.g. from the setters, with tl inactive or from its own
+// handler, or from the add path with tl.lock held).
+func (wt *WTimer) extOf(tl *TimerLnk) *timerExt {
+	if x := tl.ext(); x != nil {
+		return x
+	}
+	x := &timerExt{}
+	if !atomic.CompareAndSwapPointer(&tl.x, nil, unsafe.Pointer(x)) {
+		return tl.ext()
+	}
+	atomic.AddUint64(&wt.allocExt, 1)
+	return x
 }
 
 // Detached checks if the TimerLnk entry is part of a list and returns true
@@ -87,3 +188,93 @@ func (tl *TimerLnk) Exp() Ticks {
 func (tl *TimerLnk) Intvl() time.Duration {
 	return tl.intvl
 }
+
+// Arg returns the timer handler parameter (see SetArg()).
+func (tl *TimerLnk) Arg() interface{} {
+	tl.lock.Lock()
+	arg := tl.arg
+	tl.lock.Unlock()
+	return arg
+}
+
+// SetArg changes the timer handler parameter. It can be used at any time,
+// even on an armed timer, without removing and re-adding it: the handler
+// runs started after SetArg() returns get the new value, while a run
+// already started keeps the old one. It must not be used on the timers
+// added with AddChan() or on the TimerHandles timers (their handler
+// parameter is internal).
+func (tl *TimerLnk) SetArg(arg interface{}) {
+	tl.lock.Lock()
+	tl.arg = arg
+	tl.lock.Unlock()
+}
+
+// Gen returns the timer generation number. The generation is increased each
+// time the timer is re-initialised (wt.InitTimer()) and can be used with
+// the wt.Del*Gen() functions to avoid operating on a newer "incarnation"
+// of the timer.
+func (tl *TimerLnk) Gen() uint32 {
+	return atomic.LoadUint32(&tl.gen)
+}
+
+// TimerState is a snapshot of a timer state (see TimerLnk.State()).
+type TimerState struct {
+	Flags      uint8  // public flags (Ffast, FgoR)
+	Active     bool   // added and not removed (might be finished)
+	Armed      bool   // waiting on a wheel, not yet expired
+	Expired    bool   // expired, waiting to be run (expired list or runq)
+	Running    bool   // handler executing or finished (returned false)
+	Removed    bool   // removed by Del*() or failed re-arm
+	DelPending bool   // marked for delete, waiting for the handler to end
+	Wheel      uint8  // wheel number, valid only if Armed
+	Idx        uint16 // index inside the wheel, valid only if Armed
+}
+
+// CanReset returns true if Reset() can be used on a timer in this state.
+// Note that a timer that finished (its handler returned false) cannot be
+// distinguished from a running one and must always be re-initialised.
+func (s TimerState) CanReset() bool {
+	return !s.Active || s.Removed
+}
+
+// State returns a snapshot of the timer state.
+// The flags and the wheel position are read atomically, so the returned
+// state is coherent, but it might change immediately after State() returns.
+func (tl *TimerLnk) State() TimerState {
+	f, w, idx := tl.info.getAll()
+	s := TimerState{
+		Flags:      f & ^uint8(fInternalMask),
+		Active:     f&fActive != 0,
+		Running:    f&fRunning != 0,
+		Removed:    f&fRemoved != 0,
+		DelPending: f&(fDelete|fRemoved) == fDelete,
+	}
+	switch {
+	case w < WheelsNo:
+		s.Armed = true
+		s.Wheel = w
+		s.Idx = idx
+	case w == wheelExp || w == wheelRQ:
+		s.Expired = !s.Running
+	case w == wheelAddQ:
+		// queued for adding on the next tick (Config.AddQueue)
+		s.Armed = true
+		s.Wheel = w
+		s.Idx = idx
+	}
+	return s
+}
+
+// IsActive returns true if the timer was added and not removed yet
+// (it is either waiting to expire, expired or running).
+func (tl *TimerLnk) IsActive() bool {
+	f := tl.info.flags()
+	return f&(fActive|fRemoved) == fActive
+}
+
+// IsRunning returns true if the timer handler is executing.
+// Note that it will also return true for a timer that finished by
+// returning false from its handler.
+func (tl *TimerLnk) IsRunning() bool {
+	return tl.info.flags()&fRunning != 0
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+)
+
+// The user flags are 32 flag bits reserved for the application (e.g. for
+// storing small per-timer state without wrapping the TimerLnk): the timer
+// wheel never interprets or changes them, with the exception of
+// InitTimer(), which clears them. They are separate from the timer flags
+// (Ffast, FgoR and the internal ones), so all the bits can be used.
+// They are accessed atomically and can be changed at any time, even on
+// active or running timers.
+
+// UserFlags returns the timer user flags.
+func (tl *TimerLnk) UserFlags() uint32 {
+	return atomic.LoadUint32(&tl.ufl)
+}
+
+// SetUserFlags sets the user flags bits in mask and returns the previous
+// user flags.
+func (tl *TimerLnk) SetUserFlags(mask uint32) uint32 {
+	return tl.ChgUserFlags(mask, 0)
+}
+
+// ResetUserFlags resets the user flags bits in mask and returns the
+// previous user flags.
+func (tl *TimerLnk) ResetUserFlags(mask uint32) uint32 {
+	return tl.ChgUserFlags(0, mask)
+}
+
+// ChgUserFlags atomically resets the user flags bits in resetMask and sets
+// the bits in setMask. It returns the previous user flags.
+func (tl *TimerLnk) ChgUserFlags(setMask, resetMask uint32) uint32 {
+	for {
+		crt := atomic.LoadUint32(&tl.ufl)
+		if atomic.CompareAndSwapUint32(&tl.ufl, crt,
+			(crt&^resetMask)|setMask) {
+			return crt
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"time"
+)
+
+// HandlerPath identifies the way in which a timer handler is run
+// (see StuckHandlerF).
+type HandlerPath uint8
+
+const (
+	// HandlerFast: run directly from the timer goroutine (Ffast timers,
+	// all the timers in simulation mode and the Shutdown() drain), while
+	// it runs no other timer can expire.
+	HandlerFast HandlerPath = iota
+	// HandlerRunQ: run by a run queue worker.
+	HandlerRunQ
+	// HandlerGoR: run in a separate goroutine (FgoR or precise timers).
+	HandlerGoR
+)
+
+// String returns the handler path name.
+func (p HandlerPath) String() string {
+	switch p {
+	case HandlerFast:
+		return "fast"
+	case HandlerRunQ:
+		return "runq"
+	case HandlerGoR:
+		return "goR"
+	}
+	return "invalid"
+}
+
+// A StuckHandlerF is called once for each timer handler found running
+// for more then Config.StuckThreshold. tl is the timer, path the way in
+// which its handler is run and elapsed the time since the handler was
+// started. It is called from the watchdog goroutine, while the handler
+// is still running, so tl must be used only for identifying the timer
+// (e.g. comparing it), not for accessing or changing it.
+type StuckHandlerF func(wt *WTimer, tl *TimerLnk, path HandlerPath,
+	elapsed time.Duration)
+
+// stuckRun contains the state of a handler watched by the watchdog.
+type stuckRun struct {
+	start    time.Time
+	f        TimerHandlerF // handler, for the warning messages
+	path     HandlerPath
+	reported bool
+}
+
+// watchStart registers the handler of t, about to be run on the path p,
+// with the stuck handlers watchdog.
+func (wt *WTimer) watchStart(t *TimerLnk, p HandlerPath) {
+	wt.stuckLock.Lock()
+	if wt.stuckRuns == nil {
+		wt.stuckRuns = make(map[*TimerLnk]*stuckRun)
+	}
+	wt.stuckRuns[t] = &stuckRun{start: time.Now(), f: t.f, path: p}
+	wt.stuckLock.Unlock()
+}
+
+// watchEnd removes the handler of t from the watched handlers, after it
+// returned.
+func (wt *WTimer) watchEnd(t *TimerLnk) {
+	wt.stuckLock.Lock()
+	delete(wt.stuckRuns, t)
+	wt.stuckLock.Unlock()
+}
+
+// stuckInfo contains a stuck handler report, collected under
+// wt.stuckLock.
+type stuckInfo struct {
+	t       *TimerLnk
+	f       TimerHandlerF
+	path    HandlerPath
+	elapsed time.Duration
+}
+
+// checkStuck reports the handlers running for more then
+// Config.StuckThreshold that were not already reported.
+func (wt *WTimer) checkStuck() {
+	var stuck []stuckInfo
+	now := time.Now()
+	wt.stuckLock.Lock()
+	for t, r := range wt.stuckRuns {
+		if r.reported {
+			continue
+		}
+		if e := now.Sub(r.start); e > wt.cfg.StuckThreshold {
+			r.reported = true
+			stuck = append(stuck, stuckInfo{t, r.f, r.path, e})
+		}
+	}
+	wt.stuckLock.Unlock()
+	for _, s := range stuck {
+		if f := wt.cfg.StuckF; f != nil {
+			f(wt, s.t, s.path, s.elapsed)
+		} else if wt.warnOn() {
+			wt.warn(nil, "stuck timer handler %p (%s) on the %s path:"+
+				" running for %s\n", s.t, handlerStr(s.f), s.path,
+				s.elapsed)
+		}
+	}
+}
+
+// watchdogLoop periodically looks for stuck handlers, until Shutdown() is
+// called (see Config.StuckThreshold).
+func (wt *WTimer) watchdogLoop() {
+	ticker := time.NewTicker(wt.cfg.StuckThreshold / 2)
+loop:
+	for {
+		select {
+		case <-wt.cancel:
+			break loop
+		case <-ticker.C:
+			wt.checkStuck()
+		}
+	}
+	ticker.Stop()
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtimer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WorkerStats contains the utilization counters of a run queues worker
+// (see Config.RunQueues and Config.RunClasses). They can be used for
+// deciding if more workers are needed (Busy close to the run time) or if
+// the handlers of a class are monopolizing the workers.
+type WorkerStats struct {
+	// Class is the name of the worker run class. A priority worker runs
+	// also the handlers of the higher priorities.
+	Class   string
+	Busy    time.Duration // time spent running handlers
+	Handled uint64        // handlers run (timers, for a batch class)
+	Wakeups uint64        // wake-ups on a new work signal
+	Idle    uint64        // wake-ups that found no work
+}
+
+// workerStats contains the internal utilization counters of a run queues
+// worker (atomic access, written only by the worker).
+type workerStats struct {
+	class   int // run class index (constant)
+	busy    int64
+	handled uint64
+	wakeups uint64
+	idle    uint64
+}
+
+// initWorkers creates the workers utilization counters, in the
+// wt.rClasses order. It must be called after creating the run classes.
+func (wt *WTimer) initWorkers() {
+	n := 0
+	for c := range wt.rClasses {
+		n += wt.rClasses[c].workers
+	}
+	wt.workers = make([]workerStats, 0, n)
+	for c := range wt.rClasses {
+		for i := 0; i < wt.rClasses[c].workers; i++ {
+			wt.workers = append(wt.workers, workerStats{class: c})
+		}
+	}
+}
+
+// WorkerStats returns the utilization counters of each run queues worker,
+// in the run classes order (priorities first, see Config.RunClasses).
+// There are no workers in simulation mode.
+func (wt *WTimer) WorkerStats() []WorkerStats {
+	if wt.cfg.Simulation {
+		return nil
+	}
+	s := make([]WorkerStats, len(wt.workers))
+	for i := range wt.workers {
+		w := &wt.workers[i]
+		s[i] = WorkerStats{
+			Class:   wt.rClasses[w.class].name,
+			Busy:    time.Duration(atomic.LoadInt64(&w.busy)),
+			Handled: atomic.LoadUint64(&w.handled),
+			Wakeups: atomic.LoadUint64(&w.wakeups),
+			Idle:    atomic.LoadUint64(&w.idle),
+		}
+	}
+	return s
+}
+
+// addBusy records a run queues worker busy period that started at start.
+func (ws *workerStats) addBusy(start time.Time) {
+	atomic.AddInt64(&ws.busy, int64(time.Since(start)))
+}
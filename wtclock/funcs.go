@@ -0,0 +1,50 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtclock
+
+import (
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+)
+
+// TimeFuncs is a set of functions bound to a timer wheel, with the same
+// signatures as the corresponding time package functions, for injecting
+// into code that accepts such hooks (e.g. an
+// "After func(time.Duration) <-chan time.Time" field), without writing
+// an adapter for each of them.
+// The time.Timer and time.Ticker types cannot be backed by the timer
+// wheel, so AfterFunc, NewTimer and NewTicker return the Timer and Ticker
+// types of this package (they have the same fields and methods).
+type TimeFuncs struct {
+	Now       func() time.Time
+	Since     func(t time.Time) time.Duration
+	Until     func(t time.Time) time.Duration
+	Sleep     func(d time.Duration)
+	After     func(d time.Duration) <-chan time.Time
+	Tick      func(d time.Duration) <-chan time.Time
+	AfterFunc func(d time.Duration, f func()) *Timer
+	NewTimer  func(d time.Duration) *Timer
+	NewTicker func(d time.Duration) *Ticker
+}
+
+// Funcs returns the TimeFuncs for the timer wheel wt, that must be
+// initialised (see New()). The functions are safe for concurrent use.
+func Funcs(wt *wtimer.WTimer) TimeFuncs {
+	c := &wheelClock{wt: wt}
+	return TimeFuncs{
+		Now:       c.Now,
+		Since:     c.Since,
+		Until:     c.Until,
+		Sleep:     c.Sleep,
+		After:     c.After,
+		Tick:      c.Tick,
+		AfterFunc: c.AfterFunc,
+		NewTimer:  c.Timer,
+		NewTicker: c.Ticker,
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+package wtclock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+)
+
+// closedChan is the Done() channel of the contexts cancelled before
+// Done() was called.
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// TimeoutPool creates timeout contexts backed by a timer wheel, recycling
+// each context together with its timer when it is cancelled. It is meant
+// for creating very high numbers of short lived per-request timeouts
+// (e.g. proxies), where context.WithTimeout() would allocate a runtime
+// timer, a context and a cancel function for each request.
+//
+// A recycled context allocates only its cancel function, unless its
+// Done() channel is used (allocated only on request, like for the
+// standard contexts) or its parent can be cancelled (a goroutine waits
+// for the parent cancellation, the parents that are never cancelled, like
+// context.Background(), do not need it).
+//
+// The contexts have one restriction compared to the standard ones: the
+// context must not be used after calling its cancel function (it might be
+// already re-used for another request). The cancel function can be
+// called several times, like for the standard contexts, the calls after
+// the first one do nothing. The Done() channels obtained before
+// cancelling are closed, so the goroutines waiting on them are not
+// affected.
+type TimeoutPool struct {
+	wt   *wtimer.WTimer
+	pool sync.Pool
+}
+
+// NewTimeoutPool returns a TimeoutPool using the timer wheel wt, that
+// must be initialised. The contexts will time out only after wt is
+// started.
+func NewTimeoutPool(wt *wtimer.WTimer) *TimeoutPool {
+	p := &TimeoutPool{wt: wt}
+	p.pool.New = func() interface{} {
+		return &timeoutCtx{pool: p, quit: make(chan struct{})}
+	}
+	return p
+}
+
+// WithTimeout returns a copy of parent that is cancelled after d, like
+// context.WithTimeout(), and its cancel function (see TimeoutPool).
+func (p *TimeoutPool) WithTimeout(parent context.Context,
+	d time.Duration) (context.Context, context.CancelFunc) {
+	return p.WithDeadline(parent, p.wt.Time().Add(d))
+}
+
+// WithDeadline returns a copy of parent that is cancelled when the timer
+// wheel time reaches d, like context.WithDeadline(), and its cancel
+// function (see TimeoutPool). If the timer wheel cannot add the context
+// timer, it returns a standard context (context.WithTimeout()) instead.
+func (p *TimeoutPool) WithDeadline(parent context.Context,
+	d time.Time) (context.Context, context.CancelFunc) {
+	c := p.pool.Get().(*timeoutCtx)
+	c.mu.Lock()
+	c.parent = parent
+	gen := c.gen
+	c.mu.Unlock()
+	// bound to the current use: stale or repeated calls are ignored
+	cancel := func() { c.release(gen) }
+	c.deadline = d
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) {
+		c.deadline = cur // the parent one will expire first
+	}
+	if pdone := parent.Done(); pdone != nil {
+		select {
+		case <-pdone:
+			c.cancel(parent.Err())
+			return c, cancel
+		default:
+		}
+		c.watching = true
+		go c.watch(parent, pdone)
+	}
+	left := d.Sub(p.wt.Time())
+	if left <= 0 {
+		c.cancel(context.DeadlineExceeded)
+		return c, cancel
+	}
+	err := p.wt.InitTimer(&c.tl, wtimer.Ffast)
+	if err == nil {
+		err = p.wt.Add(&c.tl, left, timeoutHandler, c)
+	}
+	if err != nil {
+		// the wheel cannot add the timer (e.g. Config.MaxTimers reached)
+		// => fall back to a standard context, that will still time out
+		c.release(gen)
+		return context.WithTimeout(parent, left)
+	}
+	return c, cancel
+}
+
+// timeoutCtx is the context returned by TimeoutPool.
+type timeoutCtx struct {
+	deadline time.Time
+	pool     *TimeoutPool
+	tl       wtimer.TimerLnk
+	quit     chan struct{} // stops watch() (not closed, re-used)
+	watching bool          // watch() started
+
+	mu     sync.Mutex
+	parent context.Context
+	done   chan struct{} // created on Done() or closedChan
+	err    error
+	gen    uint64 // current use, incremented on release()
+}
+
+// timeoutHandler cancels a timeoutCtx when its deadline is reached.
+func timeoutHandler(wt *wtimer.WTimer, tl *wtimer.TimerLnk,
+	p interface{}) (bool, time.Duration) {
+	p.(*timeoutCtx).cancel(context.DeadlineExceeded)
+	return false, 0
+}
+
+// watch cancels the context when its parent is cancelled. It exits only
+// after receiving on c.quit (sent by release()), so that the context is
+// not recycled while it is still running.
+func (c *timeoutCtx) watch(parent context.Context, pdone <-chan struct{}) {
+	select {
+	case <-pdone:
+		c.cancel(parent.Err())
+		<-c.quit
+	case <-c.quit:
+	}
+}
+
+// cancel sets the context error (if not already cancelled) and closes
+// the Done() channel.
+func (c *timeoutCtx) cancel(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		if c.done == nil {
+			c.done = closedChan
+		} else {
+			close(c.done)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// release is the context cancel function for the use gen: it cancels the
+// context, stops its timer and puts it back into the pool. It does nothing
+// if the use gen was already released.
+func (c *timeoutCtx) release(gen uint64) {
+	c.mu.Lock()
+	if c.gen != gen {
+		c.mu.Unlock()
+		return
+	}
+	c.gen++
+	c.mu.Unlock()
+	c.cancel(context.Canceled)
+	// wait for a running handler (it uses c), errors ignored: the timer
+	// might have already expired or it might have been never added
+	c.pool.wt.DelWait(&c.tl)
+	if c.watching {
+		c.quit <- struct{}{}
+		c.watching = false
+	}
+	c.mu.Lock()
+	c.parent = nil
+	c.done = nil
+	c.err = nil
+	c.mu.Unlock()
+	c.pool.pool.Put(c)
+}
+
+// Deadline returns the context deadline.
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// Done returns a channel that is closed when the context is cancelled.
+func (c *timeoutCtx) Done() <-chan struct{} {
+	c.mu.Lock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	d := c.done
+	c.mu.Unlock()
+	return d
+}
+
+// Err returns nil if the context is not yet cancelled,
+// context.DeadlineExceeded if it timed out and context.Canceled or the
+// parent error otherwise.
+func (c *timeoutCtx) Err() error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	return err
+}
+
+// Value returns the parent value for key (nil after cancelling).
+func (c *timeoutCtx) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	parent := c.parent
+	c.mu.Unlock()
+	if parent == nil {
+		return nil
+	}
+	return parent.Value(key)
+}
+
+// String returns a description of the context (for debugging).
+func (c *timeoutCtx) String() string {
+	return "wtclock.TimeoutPool.WithDeadline(" + c.deadline.String() + ")"
+}
@@ -0,0 +1,413 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+// Package wtclock exposes a wtimer timer wheel through the method set of
+// the clock.Clock interface from github.com/benbjohnson/clock (Timer,
+// Ticker, After, AfterFunc, Sleep ...), so that code written against that
+// interface can run its timers on the wheel.
+//
+// clock.Clock returns the concrete *clock.Timer and *clock.Ticker types,
+// that cannot be created outside their package, so the wheel cannot be
+// plugged directly into it. This package mirrors the interface (Clock)
+// with its own Timer and Ticker types, having the same fields and
+// methods: the code using clock.Clock needs only to switch the import (or
+// to be built against Clock).
+//
+// All the times are timer wheel times (see wtimer.WTimer.Time()) and the
+// durations are rounded to the wheel ticks. The timers are Ffast wheel
+// timers (the AfterFunc() functions are run in their own goroutine, like
+// for time.AfterFunc()).
+package wtclock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+)
+
+// Clock has the same methods as the clock.Clock interface (see the
+// package description).
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) *Timer
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	Tick(d time.Duration) <-chan time.Time
+	Ticker(d time.Duration) *Ticker
+	Timer(d time.Duration) *Timer
+	WithDeadline(parent context.Context, d time.Time) (context.Context,
+		context.CancelFunc)
+	WithTimeout(parent context.Context, t time.Duration) (context.Context,
+		context.CancelFunc)
+}
+
+// wheelClock is the Clock implementation using a timer wheel.
+type wheelClock struct {
+	wt *wtimer.WTimer
+}
+
+// New returns a Clock using the timer wheel wt, that must be initialised.
+// The timers will run only after wt is started.
+func New(wt *wtimer.WTimer) Clock {
+	return &wheelClock{wt: wt}
+}
+
+// Now returns the current timer wheel time.
+func (c *wheelClock) Now() time.Time {
+	return c.wt.Time()
+}
+
+// Since returns the timer wheel time elapsed since t.
+func (c *wheelClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until returns the timer wheel time left until t.
+func (c *wheelClock) Until(t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// Sleep blocks the calling goroutine for d.
+func (c *wheelClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// After waits for d and then sends the current time on the returned
+// channel (like time.After()).
+func (c *wheelClock) After(d time.Duration) <-chan time.Time {
+	return c.Timer(d).C
+}
+
+// Timer returns a new Timer that will send the current time on its
+// channel after d (like time.NewTimer()).
+func (c *wheelClock) Timer(d time.Duration) *Timer {
+	ch := make(chan time.Time, 1)
+	t := &Timer{C: ch, c: ch, wt: c.wt}
+	t.mu.Lock()
+	t.start(d)
+	t.mu.Unlock()
+	return t
+}
+
+// AfterFunc waits for d and then calls f in its own goroutine (like
+// time.AfterFunc()). The returned Timer can be used to cancel the call.
+func (c *wheelClock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{f: f, wt: c.wt}
+	t.mu.Lock()
+	t.start(d)
+	t.mu.Unlock()
+	return t
+}
+
+// Tick returns the channel of a new Ticker (like time.Tick()). It returns
+// nil if d <= 0.
+func (c *wheelClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return c.Ticker(d).C
+}
+
+// Ticker returns a new Ticker that sends the current time on its channel
+// every d (like time.NewTicker()). It panics if d <= 0.
+func (c *wheelClock) Ticker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic(errors.New("non-positive interval for wtclock Ticker"))
+	}
+	ch := make(chan time.Time, 1)
+	t := &Ticker{C: ch, c: ch, wt: c.wt}
+	t.mu.Lock()
+	t.start(d)
+	t.mu.Unlock()
+	return t
+}
+
+// WithDeadline returns a copy of parent that is cancelled when the timer
+// wheel time reaches d (like context.WithDeadline()).
+func (c *wheelClock) WithDeadline(parent context.Context,
+	d time.Time) (context.Context, context.CancelFunc) {
+	if cur, ok := parent.Deadline(); ok && !cur.After(d) {
+		// the parent deadline is earlier
+		return context.WithCancel(parent)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	dc := &deadlineCtx{Context: ctx, deadline: d}
+	left := c.Until(d)
+	if left <= 0 {
+		dc.expire(cancel)
+		return dc, cancel
+	}
+	t := c.AfterFunc(left, func() { dc.expire(cancel) })
+	return dc, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// WithTimeout returns a copy of parent that is cancelled after t (like
+// context.WithTimeout()).
+func (c *wheelClock) WithTimeout(parent context.Context,
+	t time.Duration) (context.Context, context.CancelFunc) {
+	return c.WithDeadline(parent, c.Now().Add(t))
+}
+
+// Timer is the Clock equivalent of time.Timer.
+type Timer struct {
+	C <-chan time.Time
+
+	c      chan time.Time // C, writable
+	f      func()         // AfterFunc() function
+	active int32          // 1 until fired or stopped (atomic)
+	wt     *wtimer.WTimer
+	tl     wtimer.TimerLnk
+	mu     sync.Mutex  // serializes Stop() and Reset()
+	rt     *time.Timer // used if the wheel Add() failed, protected by mu
+	seq    uint32      // increased on each start(), protected by mu
+}
+
+// timerHandler sends the current time on the timer channel (without
+// blocking, the channel is buffered) or starts the AfterFunc() function,
+// unless the timer was stopped in the meantime.
+func timerHandler(wt *wtimer.WTimer, tl *wtimer.TimerLnk,
+	p interface{}) (bool, time.Duration) {
+	p.(*Timer).fire()
+	return false, 0
+}
+
+// fire sends the current time on the timer channel or starts the
+// AfterFunc() function, if the timer was not stopped in the meantime.
+func (t *Timer) fire() {
+	if !atomic.CompareAndSwapInt32(&t.active, 1, 0) {
+		return // stopped while expiring
+	}
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- t.wt.Time():
+	default:
+	}
+}
+
+// start initialises the wheel timer and adds it with the interval d.
+// If d <= 0 the timer fires immediately (like time.Timer). If the wheel
+// cannot add the timer (e.g. Config.MaxTimers reached), a runtime timer is
+// used instead, so that the timer still fires.
+// It must be called with t.mu held, only on new timers or on timers that
+// are not active.
+func (t *Timer) start(d time.Duration) {
+	t.seq++
+	atomic.StoreInt32(&t.active, 1)
+	if d <= 0 {
+		t.fire()
+		return
+	}
+	err := t.wt.InitTimer(&t.tl, wtimer.Ffast)
+	if err == nil {
+		err = t.wt.Add(&t.tl, d, timerHandler, t)
+	}
+	if err != nil {
+		seq := t.seq
+		t.rt = time.AfterFunc(d, func() {
+			t.mu.Lock()
+			if t.seq == seq { // not re-started in the meantime
+				t.fire()
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// stopRT stops the runtime timer used instead of the wheel timer, if any,
+// and returns whether it was used.
+// It must be called with t.mu held.
+func (t *Timer) stopRT() bool {
+	if t.rt == nil {
+		return false
+	}
+	t.rt.Stop()
+	t.rt = nil
+	return true
+}
+
+// Stop prevents the Timer from firing. It returns true if the timer was
+// stopped and false if it already expired or was stopped.
+// The wheel timer state cannot be used for this (an expired timer is not
+// touched anymore after its handler returns), so the timer keeps its own.
+func (t *Timer) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !atomic.CompareAndSwapInt32(&t.active, 1, 0) {
+		return false
+	}
+	if !t.stopRT() {
+		t.wt.Del(&t.tl)
+	}
+	return true
+}
+
+// Reset changes the timer to expire after d. It returns true if the timer
+// was active and false if it already expired or was stopped. Like for
+// time.Timer, if the timer was not stopped or if its channel was not
+// drained, a stale value can be received after Reset().
+func (t *Timer) Reset(d time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := atomic.CompareAndSwapInt32(&t.active, 1, 0)
+	if !t.stopRT() {
+		// wait for a running handler, the timer can be re-initialised
+		// only after it returns
+		t.wt.DelWait(&t.tl)
+	}
+	t.start(d)
+	return active
+}
+
+// Ticker is the Clock equivalent of time.Ticker.
+type Ticker struct {
+	C <-chan time.Time
+
+	c      chan time.Time // C, writable
+	active int32          // 1 until stopped (atomic)
+	wt     *wtimer.WTimer
+	tl     wtimer.TimerLnk
+	mu     sync.Mutex  // serializes Stop() and Reset()
+	rt     *time.Timer // used if the wheel Add() failed, protected by mu
+	seq    uint32      // increased on each start(), protected by mu
+}
+
+// tickerHandler sends the current time on the ticker channel, dropping
+// the ticks that are not read in time (like time.Ticker).
+func tickerHandler(wt *wtimer.WTimer, tl *wtimer.TimerLnk,
+	p interface{}) (bool, time.Duration) {
+	t := p.(*Ticker)
+	if atomic.LoadInt32(&t.active) == 0 {
+		return false, 0 // stopped while expiring
+	}
+	t.send()
+	return true, wtimer.Periodic
+}
+
+// send sends the current time on the ticker channel, without blocking.
+func (t *Ticker) send() {
+	select {
+	case t.c <- t.wt.Time():
+	default:
+	}
+}
+
+// start initialises the wheel timer and adds it with the period d.
+// If the wheel cannot add the timer (e.g. Config.MaxTimers reached), a
+// runtime timer, re-armed after each tick, is used instead.
+// It must be called with t.mu held, only on new tickers or on tickers
+// that are not active.
+func (t *Ticker) start(d time.Duration) {
+	t.seq++
+	atomic.StoreInt32(&t.active, 1)
+	err := t.wt.InitTimer(&t.tl, wtimer.Ffast)
+	if err == nil {
+		err = t.wt.Add(&t.tl, d, tickerHandler, t)
+	}
+	if err != nil {
+		seq := t.seq
+		t.rt = time.AfterFunc(d, func() {
+			t.mu.Lock()
+			if t.seq == seq && atomic.LoadInt32(&t.active) != 0 {
+				t.send()
+				t.rt.Reset(d)
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// stopRT stops the runtime timer used instead of the wheel timer, if any,
+// and returns whether it was used.
+// It must be called with t.mu held.
+func (t *Ticker) stopRT() bool {
+	if t.rt == nil {
+		return false
+	}
+	t.rt.Stop()
+	t.rt = nil
+	return true
+}
+
+// Stop turns off the ticker. The channel is not closed.
+func (t *Ticker) Stop() {
+	t.mu.Lock()
+	atomic.StoreInt32(&t.active, 0)
+	if !t.stopRT() {
+		t.wt.Del(&t.tl)
+	}
+	t.mu.Unlock()
+}
+
+// Reset stops the ticker and restarts it with the period d. It panics if
+// d <= 0.
+func (t *Ticker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic(errors.New("non-positive interval for wtclock Ticker"))
+	}
+	t.mu.Lock()
+	atomic.StoreInt32(&t.active, 0)
+	if !t.stopRT() {
+		t.wt.DelWait(&t.tl)
+	}
+	t.start(d)
+	t.mu.Unlock()
+}
+
+// deadlineCtx is the context returned by WithDeadline(): a cancel context
+// that reports its deadline and context.DeadlineExceeded once expired.
+type deadlineCtx struct {
+	context.Context // the cancel context
+
+	deadline time.Time
+	mu       sync.Mutex
+	expired  bool
+}
+
+// Deadline returns the context deadline.
+func (c *deadlineCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// Err returns context.DeadlineExceeded if the deadline was reached before
+// the context was cancelled in some other way and the cancel context
+// error otherwise.
+func (c *deadlineCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.Context.Err()
+	if err != nil && c.expired {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// expire marks the deadline as reached (if not already cancelled) and
+// cancels the context.
+func (c *deadlineCtx) expire(cancel context.CancelFunc) {
+	c.mu.Lock()
+	if c.Context.Err() == nil {
+		c.expired = true
+	}
+	c.mu.Unlock()
+	cancel()
+}
+
+// String returns a description of the context (for debugging).
+func (c *deadlineCtx) String() string {
+	return "wtclock.WithDeadline(" + c.deadline.String() + ")"
+}
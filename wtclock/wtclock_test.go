@@ -0,0 +1,534 @@
+package wtclock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+)
+
+// received returns whether a value can be read from ch without blocking.
+func received(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+	return false
+}
+
+func TestWTClock(t *testing.T) {
+	var wt wtimer.WTimer
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &wtimer.Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	c := New(&wt)
+
+	start := c.Now()
+	wt.RunTicks(10)
+	if d := c.Since(start); d != 10*tick {
+		t.Errorf("unexpected Since(): %s instead of %s\n", d, 10*tick)
+	}
+
+	// Timer, After
+	tm := c.Timer(5 * tick)
+	after := c.After(3 * tick)
+	wt.RunTicks(4)
+	if !received(after) || received(tm.C) {
+		t.Fatalf("After/Timer fired at the wrong time\n")
+	}
+	wt.RunTicks(1)
+	if !received(tm.C) {
+		t.Fatalf("Timer did not fire\n")
+	}
+	if tm.Stop() {
+		t.Errorf("Stop() returned true for an expired timer\n")
+	}
+	if tm.Reset(2 * tick) {
+		t.Errorf("Reset() returned true for an expired timer\n")
+	}
+	if !tm.Reset(4 * tick) {
+		t.Errorf("Reset() returned false for an active timer\n")
+	}
+	wt.RunTicks(3)
+	if received(tm.C) {
+		t.Fatalf("Timer fired before the Reset() interval\n")
+	}
+	if !tm.Stop() {
+		t.Errorf("Stop() returned false for an active timer\n")
+	}
+	wt.RunTicks(5)
+	if received(tm.C) {
+		t.Fatalf("stopped Timer fired\n")
+	}
+
+	// AfterFunc
+	done := make(chan struct{})
+	c.AfterFunc(2*tick, func() { close(done) })
+	wt.RunTicks(2)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AfterFunc function not called\n")
+	}
+
+	// Ticker
+	tk := c.Ticker(2 * tick)
+	for i := 0; i < 3; i++ {
+		wt.RunTicks(2)
+		if !received(tk.C) {
+			t.Fatalf("Ticker did not fire on period %d\n", i)
+		}
+	}
+	tk.Reset(5 * tick)
+	wt.RunTicks(4)
+	if received(tk.C) {
+		t.Fatalf("Ticker fired before the Reset() period\n")
+	}
+	wt.RunTicks(1)
+	if !received(tk.C) {
+		t.Fatalf("Ticker did not fire after Reset()\n")
+	}
+	tk.Stop()
+	wt.RunTicks(10)
+	if received(tk.C) {
+		t.Fatalf("stopped Ticker fired\n")
+	}
+	if c.Tick(0) != nil {
+		t.Errorf("Tick(0) returned a channel\n")
+	}
+
+	// WithTimeout, WithDeadline
+	ctx, cancel := c.WithTimeout(context.Background(), 3*tick)
+	defer cancel()
+	if dl, ok := ctx.Deadline(); !ok || !dl.Equal(c.Now().Add(3*tick)) {
+		t.Errorf("unexpected deadline %s (%v)\n", dl, ok)
+	}
+	wt.RunTicks(2)
+	if ctx.Err() != nil {
+		t.Fatalf("context expired too early: %s\n", ctx.Err())
+	}
+	wt.RunTicks(1)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled on timeout\n")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("unexpected context error %v\n", ctx.Err())
+	}
+	ctx2, cancel2 := c.WithDeadline(context.Background(),
+		c.Now().Add(10*tick))
+	cancel2()
+	wt.RunTicks(10)
+	if ctx2.Err() != context.Canceled {
+		t.Errorf("unexpected context error %v\n", ctx2.Err())
+	}
+	ctx3, cancel3 := c.WithDeadline(context.Background(), start)
+	defer cancel3()
+	if ctx3.Err() != context.DeadlineExceeded {
+		t.Errorf("past deadline not expired: %v\n", ctx3.Err())
+	}
+}
+
+func TestWTClockExpired(t *testing.T) {
+	var wt wtimer.WTimer
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &wtimer.Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	c := New(&wt)
+
+	// no RunTicks(): the timers with d <= 0 must fire right away
+	if !received(c.After(-time.Second)) {
+		t.Errorf("After() with a negative duration did not fire\n")
+	}
+	c.Sleep(0)
+	done := make(chan struct{})
+	c.AfterFunc(-tick, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AfterFunc function not called for a negative duration\n")
+	}
+	tm := c.Timer(10 * tick)
+	if !tm.Reset(0) {
+		t.Errorf("Reset() returned false for an active timer\n")
+	}
+	if !received(tm.C) {
+		t.Errorf("Timer not fired after Reset(0)\n")
+	}
+	if tm.Stop() {
+		t.Errorf("Stop() returned true for an expired timer\n")
+	}
+}
+
+func TestWTClockAddFailure(t *testing.T) {
+	var wt wtimer.WTimer
+	var tl wtimer.TimerLnk
+
+	tick := time.Millisecond
+	cfg := wtimer.Config{Simulation: true, MaxTimers: 1}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	c := New(&wt)
+
+	f := func(wt *wtimer.WTimer, h *wtimer.TimerLnk,
+		p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, time.Hour, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// the wheel is full and it does not tick (simulation): the timers
+	// must still fire, using runtime timers
+	select {
+	case <-c.After(tick):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("After() did not fire with a full wheel\n")
+	}
+	tm := c.Timer(time.Hour)
+	if !tm.Stop() {
+		t.Errorf("Stop() returned false for an active timer\n")
+	}
+	tk := c.Ticker(tick)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-tk.C:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Ticker did not fire with a full wheel (%d)\n", i)
+		}
+	}
+	tk.Stop()
+	time.Sleep(10 * tick)
+	received(tk.C) // drop a tick sent before Stop()
+	time.Sleep(10 * tick)
+	if received(tk.C) {
+		t.Errorf("stopped Ticker fired\n")
+	}
+	if wt.Len() != 1 {
+		t.Errorf("unexpected wheel timers: %d\n", wt.Len())
+	}
+}
+
+func TestWTClockFuncs(t *testing.T) {
+	var wt wtimer.WTimer
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &wtimer.Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	f := Funcs(&wt)
+
+	// hooks with the time package signatures
+	now, since, after := time.Now, time.Since, time.After
+	now, since, after = f.Now, f.Since, f.After
+
+	start := now()
+	ch := after(2 * tick)
+	tm := f.NewTimer(3 * tick)
+	done := make(chan struct{})
+	f.AfterFunc(3*tick, func() { close(done) })
+	wt.RunTicks(2)
+	if !received(ch) || received(tm.C) {
+		t.Fatalf("After/NewTimer fired at the wrong time\n")
+	}
+	wt.RunTicks(1)
+	if !received(tm.C) {
+		t.Fatalf("NewTimer timer did not fire\n")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AfterFunc function not called\n")
+	}
+	if d := since(start); d != 3*tick {
+		t.Errorf("unexpected Since(): %s instead of %s\n", d, 3*tick)
+	}
+	tk := f.NewTicker(tick)
+	wt.RunTicks(1)
+	if !received(tk.C) {
+		t.Fatalf("NewTicker ticker did not fire\n")
+	}
+	tk.Stop()
+}
+
+func TestWTTimeoutPool(t *testing.T) {
+	var wt wtimer.WTimer
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &wtimer.Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	p := NewTimeoutPool(&wt)
+
+	type key struct{}
+	vctx := context.WithValue(context.Background(), key{}, "v")
+	for i := 0; i < 10; i++ {
+		// timeout (re-using the recycled contexts)
+		ctx, cancel := p.WithTimeout(vctx, 3*tick)
+		if dl, ok := ctx.Deadline(); !ok || !dl.Equal(wt.Time().Add(3*tick)) {
+			t.Errorf("unexpected deadline %s (%v)\n", dl, ok)
+		}
+		if ctx.Value(key{}) != "v" {
+			t.Errorf("parent value not found\n")
+		}
+		done := ctx.Done()
+		wt.RunTicks(2)
+		if ctx.Err() != nil {
+			t.Fatalf("context expired too early: %s\n", ctx.Err())
+		}
+		wt.RunTicks(1)
+		select {
+		case <-done:
+		default:
+			t.Fatalf("context not cancelled on timeout\n")
+		}
+		if ctx.Err() != context.DeadlineExceeded {
+			t.Errorf("unexpected context error %v\n", ctx.Err())
+		}
+		cancel()
+		if wt.Len() != 0 {
+			t.Errorf("timers left after cancel: %d\n", wt.Len())
+		}
+
+		// cancelled before the timeout
+		ctx, cancel = p.WithTimeout(context.Background(), 3*tick)
+		if ctx.Err() != nil {
+			t.Fatalf("re-used context already cancelled: %s\n", ctx.Err())
+		}
+		done = ctx.Done()
+		cancel()
+		select {
+		case <-done:
+		default:
+			t.Fatalf("Done() not closed on cancel\n")
+		}
+		if wt.Len() != 0 {
+			t.Errorf("timers left after cancel: %d\n", wt.Len())
+		}
+	}
+
+	// parent cancellation
+	parent, pcancel := context.WithCancel(context.Background())
+	ctx, cancel := p.WithTimeout(parent, 3*tick)
+	pcancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled with its parent\n")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("unexpected context error %v\n", ctx.Err())
+	}
+	cancel()
+	ctx, cancel = p.WithTimeout(parent, 3*tick)
+	if ctx.Err() != context.Canceled {
+		t.Errorf("cancelled parent not inherited: %v\n", ctx.Err())
+	}
+	cancel()
+
+	// already expired
+	ctx, cancel = p.WithDeadline(context.Background(), wt.Time())
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("past deadline not expired: %v\n", ctx.Err())
+	}
+	cancel()
+
+	// double cancel (e.g. an early cancel() and a deferred one)
+	ctx, cancel = p.WithTimeout(vctx, 3*tick)
+	cancel()
+	cancel()
+	if ctx.Value(key{}) != nil {
+		t.Errorf("parent value found after cancel\n")
+	}
+	ctx1, cancel1 := p.WithTimeout(context.Background(), 3*tick)
+	ctx2, cancel2 := p.WithTimeout(context.Background(), 5*tick)
+	defer cancel2()
+	if ctx1 == ctx2 {
+		t.Fatalf("context recycled twice\n")
+	}
+	cancel() // stale, must not affect ctx1 (possibly the same context)
+	if ctx1.Err() != nil || ctx2.Err() != nil {
+		t.Fatalf("stale cancel cancelled a new context: %v, %v\n",
+			ctx1.Err(), ctx2.Err())
+	}
+	if wt.Len() != 2 {
+		t.Errorf("unexpected timers %d after a stale cancel\n", wt.Len())
+	}
+	wt.RunTicks(3)
+	if ctx1.Err() != context.DeadlineExceeded || ctx2.Err() != nil {
+		t.Errorf("unexpected context errors %v, %v\n", ctx1.Err(), ctx2.Err())
+	}
+	cancel1()
+}
+
+func TestWTTimeoutPoolAddFailure(t *testing.T) {
+	var wt wtimer.WTimer
+	var tl wtimer.TimerLnk
+
+	tick := time.Millisecond
+	cfg := wtimer.Config{Simulation: true, MaxTimers: 1}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	p := NewTimeoutPool(&wt)
+
+	f := func(wt *wtimer.WTimer, h *wtimer.TimerLnk,
+		p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, time.Hour, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// the wheel is full and it does not tick (simulation): the context
+	// must still time out
+	ctx, cancel := p.WithTimeout(context.Background(), 5*tick)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not cancelled on timeout with a full wheel\n")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("unexpected context error %v\n", ctx.Err())
+	}
+	if wt.Len() != 1 {
+		t.Errorf("unexpected wheel timers: %d\n", wt.Len())
+	}
+}
+
+func TestWTTimeoutPoolParallel(t *testing.T) {
+	var wt wtimer.WTimer
+	var wg sync.WaitGroup
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	p := NewTimeoutPool(&wt)
+
+	parent, pcancel := context.WithCancel(context.Background())
+	defer pcancel()
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				pctx := context.Background()
+				if i%2 == 0 {
+					pctx = parent
+				}
+				ctx, cancel := p.WithTimeout(pctx,
+					time.Duration(i%3)*time.Millisecond)
+				if i%5 == 0 {
+					<-ctx.Done()
+					if ctx.Err() != context.DeadlineExceeded {
+						t.Errorf("unexpected context error %v\n",
+							ctx.Err())
+					}
+				}
+				cancel()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if wt.Len() != 0 {
+		t.Errorf("timers left: %d\n", wt.Len())
+	}
+}
+
+// BenchmarkWTTimeoutPool measures creating and cancelling a pooled
+// timeout context (1 allocation, the cancel function), see
+// BenchmarkWTStdTimeout.
+func BenchmarkWTTimeoutPool(b *testing.B) {
+	var wt wtimer.WTimer
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		b.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	p := NewTimeoutPool(&wt)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, cancel := p.WithTimeout(context.Background(), time.Second)
+			cancel()
+		}
+	})
+	b.StopTimer()
+	wt.Shutdown()
+}
+
+// BenchmarkWTStdTimeout measures creating and cancelling a
+// context.WithTimeout() context, for comparison with
+// BenchmarkWTTimeoutPool.
+func BenchmarkWTStdTimeout(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, cancel := context.WithTimeout(context.Background(),
+				time.Second)
+			cancel()
+		}
+	})
+}
+
+// BenchmarkWTTimeoutPoolDone is like BenchmarkWTTimeoutPool, but the
+// Done() channel of each context is used, see BenchmarkWTStdTimeoutDone.
+func BenchmarkWTTimeoutPoolDone(b *testing.B) {
+	var wt wtimer.WTimer
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		b.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	p := NewTimeoutPool(&wt)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ctx, cancel := p.WithTimeout(context.Background(), time.Second)
+			done := ctx.Done()
+			cancel()
+			<-done
+		}
+	})
+	b.StopTimer()
+	wt.Shutdown()
+}
+
+// BenchmarkWTStdTimeoutDone is like BenchmarkWTStdTimeout, but the
+// Done() channel of each context is used.
+func BenchmarkWTStdTimeoutDone(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				time.Second)
+			done := ctx.Done()
+			cancel()
+			<-done
+		}
+	})
+}
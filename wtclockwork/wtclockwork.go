@@ -0,0 +1,201 @@
+// Copyright 2021 Intuitive Labs GmbH. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE.txt file in the root of the source
+// tree.
+
+// Package wtclockwork provides wtimer backed implementations of the
+// interfaces from github.com/jonboulle/clockwork (Clock, FakeClock, Timer
+// and Ticker): a clock using a running timer wheel (NewClock()) and a fake
+// clock using a private timer wheel in simulation mode, driven by
+// Advance() (NewFakeClock()).
+//
+// The interfaces are mirrored with the same names and methods (the
+// clockwork ones cannot be implemented without importing the package, the
+// methods return the clockwork Timer and Ticker interfaces), so the code
+// and the test suites using clockwork need only to switch the import.
+// It is built on the wtclock package, see it for the timers behaviour.
+package wtclockwork
+
+import (
+	"sync"
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+	"github.com/intuitivelabs/wtimer/wtclock"
+)
+
+// DefaultFakeTick is the timer wheel tick used by NewFakeClock().
+const DefaultFakeTick = time.Millisecond
+
+// blockUntilPoll is the interval at which BlockUntil() checks the number
+// of waiting timers.
+const blockUntilPoll = 100 * time.Microsecond
+
+// Clock has the same methods as clockwork.Clock.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// FakeClock has the same methods as clockwork.FakeClock.
+type FakeClock interface {
+	Clock
+	// Advance advances the fake clock time with d, running all the
+	// timers that expire.
+	Advance(d time.Duration)
+	// BlockUntil blocks until exactly n timers, tickers or sleepers are
+	// waiting on the fake clock.
+	BlockUntil(n int)
+}
+
+// Timer has the same methods as clockwork.Timer.
+type Timer interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Ticker has the same methods as clockwork.Ticker.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// timer adds Chan() to a wtclock.Timer.
+type timer struct {
+	*wtclock.Timer
+}
+
+// Chan returns the timer channel (nil for AfterFunc() timers).
+func (t timer) Chan() <-chan time.Time {
+	return t.C
+}
+
+// ticker adds Chan() to a wtclock.Ticker.
+type ticker struct {
+	*wtclock.Ticker
+}
+
+// Chan returns the ticker channel.
+func (t ticker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// wheelClock is the Clock implementation using a timer wheel.
+type wheelClock struct {
+	c wtclock.Clock
+}
+
+// NewClock returns a Clock using the timer wheel wt, that must be
+// initialised. The timers will run only after wt is started.
+func NewClock(wt *wtimer.WTimer) Clock {
+	return &wheelClock{c: wtclock.New(wt)}
+}
+
+// After waits for d and then sends the current time on the returned
+// channel.
+func (c *wheelClock) After(d time.Duration) <-chan time.Time {
+	return c.c.After(d)
+}
+
+// Sleep blocks the calling goroutine for d.
+func (c *wheelClock) Sleep(d time.Duration) {
+	c.c.Sleep(d)
+}
+
+// Now returns the current timer wheel time.
+func (c *wheelClock) Now() time.Time {
+	return c.c.Now()
+}
+
+// Since returns the timer wheel time elapsed since t.
+func (c *wheelClock) Since(t time.Time) time.Duration {
+	return c.c.Since(t)
+}
+
+// NewTicker returns a new Ticker that sends the current time on its
+// channel every d. It panics if d <= 0.
+func (c *wheelClock) NewTicker(d time.Duration) Ticker {
+	return ticker{c.c.Ticker(d)}
+}
+
+// NewTimer returns a new Timer that will send the current time on its
+// channel after d.
+func (c *wheelClock) NewTimer(d time.Duration) Timer {
+	return timer{c.c.Timer(d)}
+}
+
+// AfterFunc waits for d and then calls f in its own goroutine.
+func (c *wheelClock) AfterFunc(d time.Duration, f func()) Timer {
+	return timer{c.c.AfterFunc(d, f)}
+}
+
+// fakeClock is the FakeClock implementation, using a private timer wheel
+// in simulation mode.
+type fakeClock struct {
+	wheelClock
+
+	wt   *wtimer.WTimer
+	tick time.Duration
+	mu   sync.Mutex    // serializes Advance() (see WTimer.RunTicks())
+	rest time.Duration // advanced time not yet run (less then a tick)
+}
+
+// NewFakeClock returns a new FakeClock with a DefaultFakeTick resolution.
+func NewFakeClock() FakeClock {
+	c, err := NewFakeClockTick(DefaultFakeTick)
+	if err != nil {
+		panic(err) // should never happen, DefaultFakeTick is valid
+	}
+	return c
+}
+
+// NewFakeClockTick returns a new FakeClock using a timer wheel with the
+// tick duration tick: all the timers intervals are rounded to tick and
+// the time advances in tick steps (Advance() keeps the remainder for the
+// next call). A smaller tick gives more precise timers, at the cost of
+// running more ticks on each Advance().
+// The fake clock time starts at the Unix epoch.
+func NewFakeClockTick(tick time.Duration) (FakeClock, error) {
+	wt := &wtimer.WTimer{}
+	cfg := wtimer.Config{Simulation: true}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		return nil, err
+	}
+	wt.Start() // no goroutine is started in simulation mode
+	c := &fakeClock{wt: wt, tick: tick}
+	c.c = wtclock.New(wt)
+	return c, nil
+}
+
+// Advance advances the fake clock time with d, running all the timers
+// that expire, before returning (the AfterFunc() functions are started,
+// in their own goroutines). It can be called in parallel with the other
+// operations.
+func (c *fakeClock) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	d += c.rest
+	n := d / c.tick
+	c.rest = d - n*c.tick
+	c.wt.RunTicks(uint64(n))
+	c.mu.Unlock()
+}
+
+// BlockUntil blocks until exactly n timers, tickers or sleepers are waiting
+// on the fake clock (the timers that were not stopped and did not expire
+// yet, including the ones used by After(), Sleep() and AfterFunc()).
+func (c *fakeClock) BlockUntil(n int) {
+	for c.wt.Len() != n {
+		time.Sleep(blockUntilPoll)
+	}
+}
@@ -0,0 +1,120 @@
+package wtclockwork
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intuitivelabs/wtimer"
+)
+
+// received returns whether a value can be read from ch without blocking.
+func received(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+	return false
+}
+
+func TestWTFakeClock(t *testing.T) {
+	c := NewFakeClock()
+	start := c.Now()
+
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Second)
+		close(done)
+	}()
+	c.BlockUntil(1)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Sleep returned too early\n")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sleep did not return after Advance\n")
+	}
+	if d := c.Since(start); d != time.Second {
+		t.Errorf("unexpected Since(): %s\n", d)
+	}
+
+	// sub-tick advances are accumulated
+	tm := c.NewTimer(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		c.Advance(300 * time.Microsecond)
+	}
+	if received(tm.Chan()) {
+		t.Fatalf("Timer fired too early\n")
+	}
+	c.Advance(100 * time.Microsecond)
+	if !received(tm.Chan()) {
+		t.Fatalf("Timer did not fire\n")
+	}
+	if tm.Stop() || tm.Reset(10*time.Millisecond) {
+		t.Errorf("Stop() or Reset() returned true for an expired timer\n")
+	}
+	c.BlockUntil(1)
+	if !tm.Stop() {
+		t.Errorf("Stop() returned false for an active timer\n")
+	}
+	c.BlockUntil(0)
+
+	tk := c.NewTicker(10 * time.Millisecond)
+	fired := make(chan struct{})
+	c.AfterFunc(25*time.Millisecond, func() { close(fired) })
+	c.BlockUntil(2)
+	for i := 0; i < 2; i++ {
+		c.Advance(10 * time.Millisecond)
+		if !received(tk.Chan()) {
+			t.Fatalf("Ticker did not fire on period %d\n", i)
+		}
+	}
+	c.Advance(5 * time.Millisecond)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AfterFunc function not called\n")
+	}
+	tk.Stop()
+	c.BlockUntil(0)
+
+	if _, err := NewFakeClockTick(0); err == nil {
+		t.Errorf("NewFakeClockTick accepted a 0 tick\n")
+	}
+}
+
+func TestWTClockwork(t *testing.T) {
+	var wt wtimer.WTimer
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	c := NewClock(&wt)
+
+	start := c.Now()
+	tm := c.NewTimer(10 * time.Millisecond)
+	select {
+	case <-tm.Chan():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timer did not fire\n")
+	}
+	if d := c.Since(start); d < 10*time.Millisecond {
+		t.Errorf("Timer fired too early, after %s\n", d)
+	}
+	tk := c.NewTicker(2 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-tk.Chan():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Ticker did not fire on period %d\n", i)
+		}
+	}
+	tk.Stop()
+}
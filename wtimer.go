@@ -7,10 +7,26 @@
 // Package wtimer provides a high performance hierarchical timer wheel
 // timers implementation, optimised for high number of timers (100k+)
 // with relatively lower precision requirement.
+//
+// Allocations: once the timer wheel is started, the steady state timer
+// operations (InitTimer(), Add*(), Del*(), Reset(), running the handlers
+// and re-arming the periodic timers, for all the handler kinds) do not
+// perform any heap allocation, as long as the TimerLnk structures are
+// provided by the caller (not NewTimer()) and the handler parameters do
+// not need boxing (e.g. pointers). The exceptions are the logging (if
+// enabled), starting new FgoR goroutines when all the existing ones are
+// busy and the optional features that must keep extra state: pprof
+// labels (Config.ProfLabels), handler deadlines (SetDeadline()), the
+// stuck handlers watchdog (Config.StuckThreshold) and the debugging and
+// statistics functions that return copies of the timers state. The
+// allocating handler run paths are counted (see AllocStats()).
 package wtimer
 
 import (
+	"context"
 	"errors"
+	"math"
+	"math/rand"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -26,6 +42,7 @@ var BuildTags []string
 const (
 	WheelsNo = 4
 	// note that the sums of all wheel bits must be equal with TicksBits
+	// (or less, for the ticks64 build tag)
 	// also no wheel can have more the 2^15 entries (max. 15 bits)
 	W0Bits = 14
 	W1Bits = 14
@@ -49,6 +66,9 @@ const (
 	W3Mask = (1 << W3Bits) - 1
 
 	wTotalEntries = W0Entries + W1Entries + W2Entries + W3Entries
+
+	// ticks covered by all the wheels
+	wheelsSpan = W0Entries * W1Entries * W2Entries * W3Entries
 )
 
 // wheel sizes array
@@ -113,43 +133,170 @@ func (w *wheel) init(n uint8, lists []timerLst) {
 	}
 }
 
-const (
-	runQueuesNo        = 8 // run queues used to avoid lock contention
-	runQueuesWorkersNo = 8 // workers for the runQueues
-)
+// lstLocksNo is the number of list locks (see lstLock()).
+const lstLocksNo = 64
+
+// runQueue is a run queue, together with its lock and the currently
+// running timer.
+type runQueue struct {
+	lock    sync.Mutex
+	running *TimerLnk // current running handler
+	lst     timerLst
+	// queued handlers and maximum reached (atomic access, modified under
+	// lock), see RunQueueDepths()
+	depth    int64
+	maxDepth int64
+}
 
 // WTimer implements a hierarchical timer wheel.
 type WTimer struct {
-	opLock sync.Mutex // operations lock
+	// operations lock: held exclusively (wt.lock()) by the timer goroutine
+	// while advancing the time and shared (wt.rlock()) by the timer
+	// operations (Add*(), Del*()), which use also the per-timer and
+	// list locks (see rlock())
+	opLock sync.RWMutex
 	wheels [WheelsNo]wheel
 	wlists [wTotalEntries]timerLst // each wheel gets its own slice of wlists
+	// protect the lists changed under wt.rlock(), see lstLock()
+	lstLocks [lstLocksNo]sync.Mutex
 
 	expired timerLst
+	// temporary list used for chunked redistribution (Config.CascadeBudget)
+	carry timerLst
+	// timers waiting to be added on the next tick (Config.AddQueue)
+	addQ addQueue
 
 	// ready to run entries are distributed in run queues
-	// runq pos (idx) for consuming, atomic access, always ++ & <=rQhead
-	// (each runq "worker" will consume from rQs[(qQtail++)%runQueusNo])
-	rQtail uint32
-	// runq pos  for producing, atomic access, always increasing
-	rQhead  uint32
-	rQs     [runQueuesNo]timerLst   // run queues
-	rQlocks [runQueuesNo]sync.Mutex // extra lock for the expired list
-	// channel for signaling runq workers, msg: queue index with messages
-	rQch chan struct{}
-
-	running   *TimerLnk              // current running handler in "main"
-	rQrunning [runQueuesNo]*TimerLnk // current running handler
+	// run queues classes (see runClass): the priorities, indexed by
+	// Priority, followed by the named classes (Config.RunClasses)
+	rClasses []runClass
+	rQs      []runQueue // run queues, for all the priorities
+	// run queues workers utilization counters (see WorkerStats())
+	workers []workerStats
+	// channel for passing FgoR timers to the idle runners (see goRunner())
+	goRch chan *TimerLnk
+
+	running *TimerLnk // current running handler in "main"
 
 	tickDuration time.Duration
 	nowTicks     uint64 // current ticks as uint64 (atomic access)
+	// number of timers on the wheels, expired list or run queues
+	// (atomic access)
+	active int64
+	// run queues depth and saturation counters (atomic access), see
+	// RunQueueStats()
+	rQdepth    int64
+	rQmaxDepth int64
+	rQblocked  uint64
+	rQdropped  uint64
+	rQspilled  uint64
+	rQsigDrops uint64
+	// lost ticks handling: catch-up target (valid only if catchingUp is
+	// set) and counters (atomic access), see LagStats()
+	catchUp      uint64
+	lagEvents    uint64
+	lagTicks     uint64
+	lagCoalesced uint64
+	lagDropped   uint64
+	catchingUp   uint32
+	// suspend detection counters (atomic access), see SuspendStats()
+	suspends    uint64
+	suspShifted uint64
+	suspGap     int64
+	// time source anomalies counters (atomic access), see ClockStats()
+	clkBackward  uint64
+	clkResyncs   uint64
+	clkReanchors uint64
+	clkSlow      uint64
+	clkSlowTicks uint64
+	clkFast      uint64
+	clkFastTicks uint64
+	// tick processing duration and jitter (atomic access), see
+	// TickStats()
+	tickProc   tickHist
+	tickJitter tickHist
+	// handlers deadline overruns counters (atomic access), see
+	// DeadlineStats()
+	overruns uint64
+	overrunT int64
+	// allocation counters (atomic access), see AllocStats()
+	allocTimers    uint64
+	allocGoR       uint64
+	allocDeadlines uint64
+	allocLabels    uint64
+	allocWatched   uint64
+	allocExt       uint64
+	// saturation alerts (see Config.Saturation): active alerts bitmap and
+	// late handlers in the current interval (atomic access), late handler
+	// delay and interval in ticks and the interval start (timer goroutine)
+	satOn        uint32
+	satLate      uint64
+	satLateTicks uint64
+	satIntvl     uint64
+	satStart     Ticks
+	// signaled when the run queues depth drops under Config.RunQueueMax
+	rQfree chan struct{}
+	// timer for waiting for room in a signal channel (see waitSignal())
+	sigTimer *time.Timer
+	// number of timers redistributed from each wheel (protected by opLock)
+	cascaded [WheelsNo]uint64
+	// cached expire of the nearest timer on the wheels (nextExpNone if
+	// not valid), atomic access, see NextExpire()
+	nextExp uint64
+
+	// tickless mode: the timer goroutine sleeps until wakeAt, if a timer
+	// expiring before it is added it will be woken up using wakeCh
+	// (wakeAt written under wt.lock(), sleeping atomic access)
+	wakeAt   Ticks
+	sleeping uint32
+	wakeCh   chan struct{}
 
 	lastTickT timestamp.TS // last time we updated the ticks
 	badTime   uint32       // count time going backwards
-	refTS     timestamp.TS // reference time stamp (for refTicks)
-	refTicks  Ticks        // reference ticks value at start-up or re-adj.
+	clkState  uint8        // ticks drift state, see clockDrift()
+	tickWall  time.Time    // real time of the last tick, see tickStart()
+	// time reference, written under wt.lock() (see setRef())
+	refTS    timestamp.TS // reference time stamp (for refTicks)
+	refTicks Ticks        // reference ticks value at start-up or re-adj.
+
+	// Pause() state: the frozen time while paused (zero if not paused) and
+	// the total paused time (atomic access), see timeNow()
+	pausedTS  timestamp.TS
+	pauseOff  int64
+	pauseLock sync.Mutex // serializes Pause() and Resume()
 
 	wg     sync.WaitGroup // wait group for all the go routines started
 	cancel chan struct{}  // used to stop all go routines
+	shared *SharedTicker  // ticks source, if started with StartShared()
+
+	// context cancelled on shutdown (see Context() and ShutdownContext())
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	// closed when all the goroutines abandoned by ShutdownContext()
+	// finished (nil if none), see start()
+	shutWait  chan struct{}
+	stopRun   uint32 // no new handlers are run from the runqs (atomic)
+	runState  uint32 // rsInit, rsRunning or rsStopped (atomic)
+	held      uint32 // handlers dispatch suspended (atomic)
+	goRactive int64  // running FgoR handlers (atomic)
+
+	addSeq  uint64      // last add sequence number (Config.FIFO, atomic)
+	fifoBuf []*TimerLnk // buffer used for sorting the expired list
+
+	// stuck handlers watchdog (Config.StuckThreshold): the running
+	// handlers, protected by stuckLock
+	stuckLock sync.Mutex
+	stuckRuns map[*TimerLnk]*stuckRun
+
+	cfg   Config // optional config parameters
+	log   Logger // logger used, by default &Log
+	clock Clock  // time source, by default the system clock
+	// pseudo-random generator for the simulation mode (Config.SimSeed)
+	simRand *rand.Rand
+	// simulation mode run classes dispatch order and pending run queues
+	// buffer (re-used, to avoid allocations on each tick)
+	simOrder []int
+	simPend  []int
 }
 
 // Init initializes the timer wheel, with td as tick duration.
@@ -174,6 +321,13 @@ type WTimer struct {
 // (e..g 100k active timers mostly with 1s to 32s expire, decreasing tick
 //  numbers only minimally influences the total cpu usage).
 func (wt *WTimer) Init(td time.Duration) error {
+	return wt.InitCfg(td, nil)
+}
+
+// InitCfg is similar to Init(), but allows setting optional configuration
+// parameters (see Config). A nil cfg is equivalent to the default
+// config (and to calling Init()).
+func (wt *WTimer) InitCfg(td time.Duration, cfg *Config) error {
 	if td < (time.Microsecond) {
 		return errors.New("wtimer.Init: tick duration too small")
 	} else if td > (time.Hour * 24) {
@@ -181,6 +335,27 @@ func (wt *WTimer) Init(td time.Duration) error {
 		return errors.New("wtimer.Init: tick duration too high")
 	}
 	wt.tickDuration = td
+	if cfg != nil {
+		wt.cfg = *cfg
+	} else {
+		wt.cfg = Config{}
+	}
+	wt.log = wt.cfg.Log
+	if wt.log == nil {
+		wt.log = &Log
+	}
+	wt.clock = wt.cfg.Clock
+	if wt.clock == nil {
+		wt.clock = sysClock{}
+	}
+	if wt.cfg.TimeScale < 0 {
+		return errors.New("wtimer.Init: invalid time scale")
+	} else if wt.cfg.TimeScale > 0 && wt.cfg.TimeScale != 1 {
+		wt.clock = newScaledClock(wt.clock, wt.cfg.TimeScale)
+	}
+	if wt.cfg.Simulation {
+		wt.initSim()
+	}
 
 	for i, pos := 0, 0; i < len(wt.wheels); i++ {
 		sz := int(wheelEntries[i])
@@ -188,10 +363,28 @@ func (wt *WTimer) Init(td time.Duration) error {
 		pos += sz
 	}
 	wt.expired.init(wheelExp, wheelNoIdx)
-	for i := 0; i < len(wt.rQs); i++ {
-		wt.rQs[i].init(wheelRQ, uint16(i))
+	wt.carry.init(wheelNone, wheelNoIdx)
+	atomic.StorePointer(&wt.addQ.head, nil)
+	atomic.StoreInt64(&wt.active, 0)
+	wt.resetRQStats()
+	wt.resetLagStats()
+	wt.resetSuspendStats()
+	wt.resetClockStats()
+	wt.resetTickStats()
+	wt.resetDeadlineStats()
+	wt.resetAllocStats()
+	wt.resetPause()
+	wt.initSaturation()
+	atomic.StoreUint32(&wt.runState, rsInit)
+	wt.cascaded = [WheelsNo]uint64{}
+	wt.setNextExp(Ticks{}, false)
+	atomic.StoreUint32(&wt.sleeping, 0)
+	wt.wakeCh = make(chan struct{}, 1)
+	if err := wt.initRunQueues(); err != nil {
+		return err
 	}
-	wt.rQch = make(chan struct{}, runQueuesWorkersNo*4)
+	wt.goRch = make(chan *TimerLnk)
+	wt.rQfree = make(chan struct{}, 1)
 	return nil
 }
 
@@ -201,6 +394,14 @@ func (wt *WTimer) Now() Ticks {
 	return NewTicks(crtTicks)
 }
 
+// Len returns the number of pending timers: timers waiting to expire and
+// expired timers waiting to be run. The timers with running handlers are
+// not counted.
+// It can be used for enforcing timer quotas or for statistics.
+func (wt *WTimer) Len() int {
+	return int(atomic.LoadInt64(&wt.active))
+}
+
 // internal crt. ticks++
 func (wt *WTimer) incTime() {
 	atomic.AddUint64(&wt.nowTicks, 1)
@@ -222,6 +423,22 @@ func (wt *WTimer) Duration(t Ticks) time.Duration {
 	return time.Duration(t.Val()) * wt.tickDuration
 }
 
+// MaxDuration returns the maximum interval that fits on the timer wheels,
+// for the configured tick duration (maxLegTicks ticks, minus 1 tick for
+// the partial current tick). Longer intervals
+// are handled by re-adding the timer internally on expire, until the whole
+// interval elapses, unless Config.SingleLeg is set (in which case the
+// Add*() functions return ErrTicksTooHigh, see TicksTooHighError).
+func (wt *WTimer) MaxDuration() time.Duration {
+	if wt.tickDuration == 0 {
+		return 0
+	}
+	if maxLegTicks-1 > uint64(math.MaxInt64/wt.tickDuration) {
+		return math.MaxInt64
+	}
+	return time.Duration(maxLegTicks-1) * wt.tickDuration
+}
+
 // TicksRoundUp converts a duration into ticks number rounding-up
 // if the duration is less then 1 tick or if duration >= 0.5 ticks.
 // This is also the way durations are converted to ticks internally.
@@ -236,11 +453,33 @@ func (wt *WTimer) TicksRoundUp(d time.Duration) Ticks {
 
 // InitTimer() inits a TimerLnk handle before use.
 // For the possible flags values, see Reset().
+// Each call increases the timer generation (see TimerLnk.Gen()).
 // Note: never call it on a running timer, only on new ones.
+// It is safe to call it while a stale handle is used with the *Gen()
+// functions on the same timer (e.g. DelGen()).
 func (wt *WTimer) InitTimer(tl *TimerLnk, flags uint8) error {
-	*tl = TimerLnk{}
-	tl.info.setWheel(wheelNone, wheelNoIdx)
-	return wt.Reset(tl, flags)
+	// the fields are cleared one by one, under the timer lock: tl.lock
+	// itself might be held by a concurrent DelGen() and must not be
+	// overwritten
+	wt.lockTimer(tl)
+	tl.next = nil
+	tl.prev = nil
+	tl.expire = Ticks{}
+	tl.added = Ticks{}
+	tl.info.setAll(0, wheelNone, wheelNoIdx)
+	tl.rctx.setAll(0, 0, 0)
+	atomic.StoreUint32(&tl.ufl, 0)
+	atomic.StoreUint64(&tl.rgid, 0)
+	tl.f = nil
+	tl.arg = nil
+	tl.intvl = 0
+	if x := tl.ext(); x != nil {
+		// keep the optional state allocation, but not its content
+		*x = timerExt{}
+	}
+	atomic.AddUint32(&tl.gen, 1)
+	wt.unlockTimer(tl)
+	return wt.opErr("InitTimer", tl, wt.reset(tl, flags))
 }
 
 // NewTimer() allocates and returns a new  initialised timer handler
@@ -252,6 +491,7 @@ func (wt *WTimer) InitTimer(tl *TimerLnk, flags uint8) error {
 // would involve an additional allocation and more GC work.
 func (wt *WTimer) NewTimer(flags uint8) *TimerLnk {
 	tl := &TimerLnk{}
+	atomic.AddUint64(&wt.allocTimers, 1)
 	if wt.InitTimer(tl, flags) != nil {
 		return nil
 	}
@@ -264,27 +504,90 @@ func (wt *WTimer) NewTimer(flags uint8) *TimerLnk {
 //             the timer context (use with care, delays will impact all
 //             the timers, the handler should execute really fast and
 //             not block under any circumstance).
-//   * FgoR   - run the timer handler in a new go routine (experimental,
+//   * FgoR   - run the timer handler in a separate go routine (experimental,
 //             useful if the handler does lot of work or some potentially
 //             blocking operation). FgoR timers cannot be DelWait()-ed.
 //
 // Do not use on timers that were not deleted, or on timer that finished
 // (returned false from the handler). A finished timer must be re-initialised.
+// The only exception is calling Reset() from the timer own handler, in which
+// case the new flags will be used for the next runs.
+// It is safe to call Reset() in parallel with other operations on the same
+// timer or with its handler finishing: if the timer is still active (e.g.
+// a Del() that returned false has not completed yet) ErrActiveTimer is
+// returned.
 func (wt *WTimer) Reset(tl *TimerLnk, flags uint8) error {
+	return wt.opErr("Reset", tl, wt.reset(tl, flags))
+}
+
+// ResetGen is similar to Reset(), but it changes the timer only if its
+// generation (see TimerLnk.Gen()) is equal to gen. If the timer was
+// re-initialised in the meantime it will return ErrStaleHandle.
+func (wt *WTimer) ResetGen(tl *TimerLnk, flags uint8, gen uint32) error {
+	return wt.opErr("ResetGen", tl, wt.resetGen(tl, flags, true, gen))
+}
+
+// reset is the internal version of Reset(), returning unwrapped errors.
+func (wt *WTimer) reset(tl *TimerLnk, flags uint8) error {
+	return wt.resetGen(tl, flags, false, 0)
+}
+
+// resetGen is the internal version of Reset() and ResetGen(). If chkGen
+// is set, the timer generation is checked against gen.
+// The timer is locked, so that the flags and the list links are not
+// changed in parallel (e.g. by a Del() or a finishing handler).
+func (wt *WTimer) resetGen(tl *TimerLnk, flags uint8,
+	chkGen bool, gen uint32) error {
+	wt.lockTimer(tl)
+	if chkGen && atomic.LoadUint32(&tl.gen) != gen {
+		// timer re-initialised in the meantime => don't touch it
+		wt.unlockTimer(tl)
+		return ErrStaleHandle
+	}
 	f := tl.info.flags()
 	if f&fActive != 0 && f&fRemoved == 0 {
 		// active and not removed
+		var gid uint64
+		if f&fRunning != 0 && wt.selfRunning(tl, &gid) {
+			// called from the timer handler => change only the
+			// non-internal flags
+			flags &= ^uint8(fInternalMask)
+			tl.info.chgFlags(flags, ^uint8(fInternalMask))
+			wt.unlockTimer(tl)
+			return nil
+		}
+		wt.unlockTimer(tl)
 		return ErrActiveTimer
 	}
 	if tl.next != nil || tl.prev != nil {
+		wt.unlockTimer(tl)
 		return ErrInvalidTimer
 	}
 	// make sure the caller does not set our internal flags
 	flags &= ^uint8(fInternalMask)
 	tl.info.chgFlags(flags, fInternalMask)
+	wt.unlockTimer(tl)
+	return nil
+}
+
+// inactiveOrSelf returns nil if the timer is not active or if called from
+// the timer own handler (the cases in which its settings can be changed)
+// and ErrActiveTimer otherwise.
+func (wt *WTimer) inactiveOrSelf(tl *TimerLnk) error {
+	f := tl.info.flags()
+	if f&fActive != 0 && f&fRemoved == 0 {
+		// active and not removed
+		var gid uint64
+		if f&fRunning == 0 || !wt.selfRunning(tl, &gid) {
+			return ErrActiveTimer
+		}
+	}
 	return nil
 }
 
+// lock acquires exclusive access to all the timer lists (except the run
+// queues). It is used when advancing the time and by the debugging
+// functions that walk the wheels.
 func (wt *WTimer) lock() {
 	wt.opLock.Lock()
 }
@@ -293,32 +596,68 @@ func (wt *WTimer) unlock() {
 	wt.opLock.Unlock()
 }
 
+// rlock acquires shared access to the timer lists, used by the timer
+// operations. Operations on different timers can run in parallel, so
+// under rlock() a timer must be changed only with its own lock held
+// (tl.lock) and a list only with the list lock held (lstLock()), in
+// this order. Operations on the same timer are serialized by tl.lock.
+func (wt *WTimer) rlock() {
+	wt.opLock.RLock()
+}
+
+func (wt *WTimer) runlock() {
+	wt.opLock.RUnlock()
+}
+
+// lstLock returns the lock protecting lst when it is changed under
+// rlock() (not needed under wt.lock()). The lists share lstLocksNo locks,
+// instead of having one each: a list lock is never held together with
+// another one, so sharing it can only delay the operations on another
+// list.
+func (wt *WTimer) lstLock(lst *timerLst) *sync.Mutex {
+	i := (uint(lst.wheelNo)<<16 | uint(lst.wheelIdx)) % lstLocksNo
+	return &wt.lstLocks[i]
+}
+
+// lockTimer acquires shared access to the timer lists and locks tl
+// (see rlock()).
+func (wt *WTimer) lockTimer(tl *TimerLnk) {
+	wt.opLock.RLock()
+	tl.lock.Lock()
+}
+
+// unlockTimer releases the locks acquired by lockTimer().
+func (wt *WTimer) unlockTimer(tl *TimerLnk) {
+	tl.lock.Unlock()
+	wt.opLock.RUnlock()
+}
+
 // appendTimer adds an _empty_ timer link to the specified wheel & idx.
 // NOTE: the timer link must be detached (not part of any list).
 // returns nil on success and an error  for bugs or invalid params.
+// It must be called either with wt.lock() held or with wt.rlock() and the
+// timer lock held (the target list lock is taken internally).
 func (wt *WTimer) appendTimer(tl *TimerLnk, wheel uint8, idx uint16) error {
+	var lst *timerLst
 	if wheel < WheelsNo {
-		wt.wheels[wheel].lsts[idx].append(tl)
+		lst = &wt.wheels[wheel].lsts[idx]
 	} else if wheel == wheelExp {
-		wt.expired.append(tl)
-	} else {
-		BUG("invalid wheel no: %d idx %d for %p\n",
-			wheel, idx, tl)
-		return ErrInvalidTimer
+		lst = &wt.expired
 	}
-	return nil
+	if lst != nil {
+		wt.lstLock(lst).Lock()
+		err := lst.append(wt, tl)
+		wt.lstLock(lst).Unlock()
+		return err
+	}
+	wt.bug(tl, "invalid wheel no: %d idx %d for %p\n",
+		wheel, idx, tl)
+	return ErrInvalidTimer
 }
 
 // addUnsafe assumes that the proper locks are held and adds a new timer.
 // returns nil on success, or an error (bad params/expire...)
 func (wt *WTimer) addUnsafe(tl *TimerLnk, now Ticks) error {
-	//	delta := tl.deltaExp0
-	delta, _ := wt.Ticks(tl.intvl)
-	if delta.Val() > MaxTicksDiff {
-		BUG("delta value is too high: %d ticks (%s) > max %d\n",
-			delta.Val(), tl.intvl, MaxTicksDiff)
-		return ErrTicksTooHigh
-	}
 	// adjust expire in ticks since we might be called between ticks
 	// increases and the ticks might increase with more then one.
 	// Small ticks (duration) combined with scheduling latencies might
@@ -331,53 +670,173 @@ func (wt *WTimer) addUnsafe(tl *TimerLnk, now Ticks) error {
 	// time and ticks value, thus latencies would only delay timers that were
 	// supposed to execute during the latency interval, but avoid
 	// executing any timer too early.
-	expIntvl := timestamp.Now().Sub(wt.refTS) + tl.intvl
+	expIntvl := wt.timeNow().Sub(wt.refTS) + tl.intvl
 	// round-up if 0 expire or if expire in-between ticks
 	// (round-up almost always, better to expire 1 tick later then
-	//   1 tick too soon)
+	//   1 tick too soon), unless a different rounding was set
+	//   (SetRounding())
 	// A timer returning 0 expire would never leave the expired list,
 	// being continuously executed (alternative: add another run list
 	// and another mv between expired and run and exec only from run).
-	dticks := wt.TicksRoundUp(expIntvl)
-	if dticks.Val() > (MaxTicksDiff - 1) {
-		BUG("adjusted delta value is too high: %d ticks > max %d\n",
-			dticks.Val(), MaxTicksDiff)
-		return ErrTicksTooHigh
-	}
-	tl.expire = wt.refTicks.Add(dticks)
-	//tl.expire = now.Add(delta)
+	x := tl.extView()
+	dticks := wt.roundTicks(expIntvl, x.round)
+	// ticks from now (0 if already expired)
+	var ahead uint64
+	if elapsed := now.Sub(wt.refTicks).Val(); dticks > elapsed {
+		ahead = dticks - elapsed
+	}
+	if ahead == 0 && x.round == RoundDown {
+		// rounded down to the current tick
+		ahead = 1
+	}
+	precise := wt.isPrecise(tl)
+	if precise {
+		// backstop, normally run before by the runtime timer
+		ahead++
+	} else if x.res == ResCoarse {
+		ahead = wt.coarseAlign(now, ahead)
+	}
+	if err := wt.setExpire(tl, now, ahead); err != nil {
+		return err
+	}
 	w, idx := getWheelPos(tl.expire, now)
-	if w == wheelExp && DBGon() {
-		DBG("timer added with 0 expire: %p delta %d, now %d (ticks)\n",
-			tl, delta, tl.expire)
+	if w == wheelExp && wt.dbgOn() {
+		wt.dbg("timer added with 0 expire: %p intvl %s, now %d (ticks)\n",
+			tl, tl.intvl, tl.expire)
+	}
+
+	if err := wt.appendTimer(tl, w, idx); err != nil {
+		return err
+	}
+	if precise {
+		wt.armPrecise(tl)
+	}
+	return nil
+}
+
+// maxLegTicks is the maximum expire delta for a timer on the wheels. The
+// timers with longer intervals are re-added on expire until the whole
+// interval elapses (see setExpire()).
+const maxLegTicks = wheelsSpan/2 - 1
+
+// setExpire sets the timer expire to ahead ticks after now. If ahead is
+// more then maxLegTicks, the timer will expire after maxLegTicks and the
+// rest is remembered in timerExt.left (see nextLeg()), or, if
+// Config.SingleLeg is set, a TicksTooHighError is returned.
+func (wt *WTimer) setExpire(tl *TimerLnk, now Ticks, ahead uint64) error {
+	x := tl.ext()
+	if x != nil {
+		x.left = 0
+		x.late = 0
+	}
+	if ahead > maxLegTicks {
+		if wt.cfg.SingleLeg {
+			return &TicksTooHighError{
+				Requested: time.Duration(ahead) * wt.tickDuration,
+				Max:       wt.MaxDuration(),
+			}
+		}
+		if x == nil {
+			x = wt.extOf(tl)
+		}
+		x.left = ahead - maxLegTicks
+		ahead = maxLegTicks
 	}
+	tl.expire = now.AddUint64(ahead)
+	return nil
+}
 
+// nextLeg re-adds the expired timer t, whose interval was longer then
+// maxLegTicks, for the rest of its interval.
+// It must be called with wt.lock() held.
+func (wt *WTimer) nextLeg(t *TimerLnk, now Ticks) error {
+	ahead := t.extView().left
+	if t.expire.GT(now) {
+		ahead += t.expire.Sub(now).Val()
+	}
+	wt.setExpire(t, now, ahead)
+	w, idx := getWheelPos(t.expire, now)
+	if err := wt.appendTimer(t, w, idx); err != nil {
+		return err
+	}
+	wt.nextExpAdded(t.expire)
+	return nil
+}
+
+// addAfterUnsafe adds the timer so that it expires t.intvl after base
+// (instead of after the current time, like addUnsafe()), but not before
+// the current time.
+// It must be called with the same locks as addUnsafe().
+func (wt *WTimer) addAfterUnsafe(tl *TimerLnk, base Ticks) error {
+	now := wt.Now()
+	if base.LT(now) {
+		base = now
+	}
+	x := tl.extView()
+	ahead := base.Sub(now).Val() + wt.roundTicks(tl.intvl, x.round)
+	if x.res == ResCoarse {
+		ahead = wt.coarseAlign(now, ahead)
+	}
+	if err := wt.setExpire(tl, now, ahead); err != nil {
+		return err
+	}
+	w, idx := getWheelPos(tl.expire, now)
 	return wt.appendTimer(tl, w, idx)
 }
 
+// rearmSelfUnsafe handles Add*() called from the timer own handler:
+// the timer will be re-added with the new interval, handler and parameter
+// after the handler returns (if it does not return false).
+// It returns true and an error or nil if tl handler is running in the
+// current goroutine and false if not (the Add*() should continue normally).
+// It must be called with the timer locked (wt.lockTimer(tl) or only
+// tl.lock for Config.AddQueue).
+func (wt *WTimer) rearmSelfUnsafe(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}) (bool, error) {
+	var gid uint64
+	flags := tl.info.flags()
+	if flags&(fActive|fRunning|fRemoved) != (fActive|fRunning) ||
+		!wt.selfRunning(tl, &gid) {
+		return false, nil
+	}
+	if flags&fDelete != 0 {
+		// deleted from the handler (or in parallel) => don't re-arm
+		return true, ErrDeletedTimer
+	}
+	if f == nil {
+		wt.err("called with 0 callback\n")
+		return true, ErrInvalidParameters
+	}
+	tl.f = f
+	tl.arg = p
+	tl.intvl = d
+	tl.info.setFlags(fRearm)
+	return true, nil
+}
+
 // addSanityChecks performed sanity checks for parameters of Add*() functions.
 // Can be called with unlocked wt, but then the values might change.
 func (wt *WTimer) addSanityChecks(tl *TimerLnk, delta time.Duration,
 	f TimerHandlerF) error {
 	if tl.info.flags()&fActive != 0 {
-		if DBGon() {
+		if wt.dbgOn() {
 			f, w, idx := tl.info.getAll()
-			DBG("called on active timer %p 0x%0x wheel: %d/%d "+
+			wt.dbg("called on active timer %p 0x%0x wheel: %d/%d "+
 				" n: %p p: %p\n",
 				tl, f, w, idx, tl.next, tl.prev)
 		}
 		return ErrActiveTimer
 	}
 	if tl.info.flags()&fRunning != 0 {
-		if DBGon() {
-			DBG("Add* called on running timer: flags 0x%x \n", tl.info.flags())
+		if wt.dbgOn() {
+			wt.dbg("Add* called on running timer: flags 0x%x \n", tl.info.flags())
 		}
 		return ErrNotResetTimer
 	}
 	if tl.info.flags()&fRemoved != 0 {
-		if DBGon() {
+		if wt.dbgOn() {
 			f, w, idx := tl.info.getAll()
-			DBG("Add* fRemoved set: flags 0x%x   w/idx %d/%d"+
+			wt.dbg("Add* fRemoved set: flags 0x%x   w/idx %d/%d"+
 				" n: %p p: %p\n", f, w, idx, tl.next, tl.prev)
 		}
 		return ErrNotResetTimer
@@ -385,58 +844,125 @@ func (wt *WTimer) addSanityChecks(tl *TimerLnk, delta time.Duration,
 
 	if tl.next != nil || tl.prev != nil {
 		f, w, idx := tl.info.getAll()
-		BUG("called with linked timer: %p flags 0x%x on w/idx %d/%d"+
+		wt.bug(tl, "called with linked timer: %p flags 0x%x on w/idx %d/%d"+
 			" n: %p p: %p\n",
 			tl, f, w, idx, tl.next, tl.prev)
 		return ErrInvalidTimer
 	}
 	w, idx := tl.info.wheelPos()
 	if w != wheelNone || idx != wheelNoIdx {
-		BUG("called non-init or bad timer: %p flags 0x%x on w/idx %d/%d"+
+		wt.bug(tl, "called non-init or bad timer: %p flags 0x%x on w/idx %d/%d"+
 			" n: %p p: %p\n",
 			tl, tl.info.flags(), w, idx, tl.next, tl.prev)
 		return ErrInvalidTimer
 	}
 	if f == nil {
-		ERR("called with 0 callback\n")
+		wt.err("called with 0 callback\n")
 		return ErrInvalidParameters
 	}
+	x := tl.extView()
+	if x.round == RoundExact && delta%wt.tickDuration != 0 {
+		return ErrNotTickMultiple
+	}
+	if wt.cfg.SingleLeg && delta > wt.MaxDuration() {
+		return &TicksTooHighError{Requested: delta, Max: wt.MaxDuration()}
+	}
+	if max := wt.cfg.MaxTimers; max > 0 && wt.Len() >= max {
+		return ErrQuotaExceeded
+	}
+	if x.group != nil {
+		return x.group.allowAdd()
+	}
 	return nil
 }
 
 // Add starts a new timer that will run f(tl, ticks, p) after the specified
 // time.Duration.
-// It returns whether the operation was successful (nil) or an error.
+// It returns whether the operation was successful (nil) or an error
+// (ErrInvalidParameters for a negative duration).
 // tl is a pointer to a TimerLnk structure which should be either provided
 //  or obtained from NewTimer()).
+// If called from the timer own handler, the timer will be re-added with the
+// new parameters after the handler returns (see TimerHandlerF).
 func (wt *WTimer) Add(tl *TimerLnk, d time.Duration,
 	f TimerHandlerF, p interface{}) error {
+	return wt.opErr("Add", tl, wt.add(tl, d, f, p))
+}
+
+// AddGen is similar to Add(), but it adds the timer only if its generation
+// (see TimerLnk.Gen()) is equal to gen. If the timer was re-initialised in
+// the meantime it will return ErrStaleHandle.
+func (wt *WTimer) AddGen(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}, gen uint32) error {
+	return wt.opErr("AddGen", tl, wt.addGen(tl, d, f, p, gen))
+}
+
+// add is the internal version of Add(), returning unwrapped errors.
+func (wt *WTimer) add(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}) error {
+	return wt.addTimer(tl, d, f, p, wt.addSite(), false, 0)
+}
+
+// addGen is the internal version of AddGen(), returning unwrapped errors.
+func (wt *WTimer) addGen(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}, gen uint32) error {
+	return wt.addTimer(tl, d, f, p, wt.addSite(), true, gen)
+}
+
+// addTimer adds tl, recording site as its add site (see addSite()).
+// If chkGen is set, the timer generation is checked against gen.
+func (wt *WTimer) addTimer(tl *TimerLnk, d time.Duration,
+	f TimerHandlerF, p interface{}, site uintptr,
+	chkGen bool, gen uint32) error {
+	if d < 0 {
+		// negative intervals are not supported (use 0 for the next tick)
+		return ErrInvalidParameters
+	}
 	// extra sanity: could be skipped
 	ticks, _ := wt.Ticks(d)
 	if ticks.Val() == 0 {
-		if DBGon() {
-			DBG("Add() called with 0 timeout\n")
+		if wt.dbgOn() {
+			wt.dbg("Add() called with 0 timeout\n")
 		}
 		// return ErrDurationTooSmall
 	}
 
-	wt.lock()
+	if wt.cfg.AddQueue {
+		return wt.queueAdd(tl, d, f, p, site, chkGen, gen)
+	}
+
+	wt.lockTimer(tl)
+	if chkGen && atomic.LoadUint32(&tl.gen) != gen {
+		// timer re-initialised in the meantime => don't touch it
+		wt.unlockTimer(tl)
+		return ErrStaleHandle
+	}
+	if self, err := wt.rearmSelfUnsafe(tl, d, f, p); self {
+		wt.unlockTimer(tl)
+		return err
+	}
 	if err := wt.addSanityChecks(tl, d, f); err != nil {
-		wt.unlock()
+		wt.unlockTimer(tl)
 		return err
 	}
 	tl.f = f
 	tl.arg = p
 	tl.intvl = d
+	tl.added = wt.Now()
+	wt.setSite(tl, site)
+	wt.stampAdd(tl)
 
 	// set fActive and clear the rest of the internal flags
 	tl.info.chgFlags(fActive, fInternalMask)
 	ret := wt.addUnsafe(tl, wt.Now())
 	if ret != nil {
 		tl.info.setFlags(fRemoved)
+	} else {
+		wt.activeInc(tl)
+		wt.nextExpAdded(tl.expire)
 	}
 
-	wt.unlock()
+	wt.unlockTimer(tl)
 
 	return ret
 }
@@ -448,7 +974,7 @@ func (wt *WTimer) Add(tl *TimerLnk, d time.Duration,
 func (wt *WTimer) AddT(tl *TimerLnk, delta Ticks,
 	f TimerHandlerF, p interface{}) error {
 	intvl := wt.Duration(delta)
-	return wt.Add(tl, intvl, f, p)
+	return wt.opErr("AddT", tl, wt.add(tl, intvl, f, p))
 }
 
 // AddExpire starts a new timer that will run f(tl, ticks, p) exactly at the
@@ -460,31 +986,55 @@ func (wt *WTimer) AddT(tl *TimerLnk, delta Ticks,
 //  or obtained from NewTimer().
 func (wt *WTimer) AddExpire(tl *TimerLnk, expire Ticks,
 	f TimerHandlerF, p interface{}) error {
+	return wt.opErr("AddExpire", tl, wt.addExpire(tl, expire, f, p))
+}
+
+// addExpire is the internal version of AddExpire(), returning unwrapped
+// errors.
+func (wt *WTimer) addExpire(tl *TimerLnk, expire Ticks,
+	f TimerHandlerF, p interface{}) error {
 
 	now := wt.Now()
 	intvl := wt.Duration(expire.Sub(now))
+	site := wt.addSite()
 
-	wt.lock()
+	wt.lockTimer(tl)
+	if self, err := wt.rearmSelfUnsafe(tl, intvl, f, p); self {
+		// from the handler the expire cannot be set directly, use
+		// the corresponding interval
+		wt.unlockTimer(tl)
+		return err
+	}
 	if err := wt.addSanityChecks(tl, intvl, f); err != nil {
-		wt.unlock()
+		wt.unlockTimer(tl)
 		return err
 	}
 	tl.f = f
 	tl.arg = p
 	tl.intvl = intvl
 	tl.expire = expire
+	if x := tl.ext(); x != nil {
+		x.left = 0
+	}
+	tl.added = now
+	wt.setSite(tl, site)
+	wt.stampAdd(tl)
 
 	// set fActive and clear the rest of the internal flags
 	tl.info.chgFlags(fActive, fInternalMask)
 
 	w, idx := getWheelPos(tl.expire, now)
-	if w == wheelExp && DBGon() {
-		DBG("timer added with 0 expire: %p delta %d, now %s (ticks)\n",
+	if w == wheelExp && wt.dbgOn() {
+		wt.dbg("timer added with 0 expire: %p delta %d, now %s (ticks)\n",
 			tl, intvl, tl.expire)
 	}
 
 	ret := wt.appendTimer(tl, w, idx)
-	wt.unlock()
+	if ret == nil {
+		wt.activeInc(tl)
+		wt.nextExpAdded(tl.expire)
+	}
+	wt.unlockTimer(tl)
 	return ret
 }
 
@@ -497,6 +1047,7 @@ const (
 	fDelRaceOk
 	fDelForce
 	fDelTry // try only, if running abort (don't mark for delete)
+	fDelGen // check the timer generation
 )
 
 // del will try to remove the corresponding timer.
@@ -505,21 +1056,42 @@ const (
 // will return true or false and the error (true meaning don't retry).
 // To force a delete, waiting for the running timer to terminate (if running)
 // use DelWait().
-func (wt *WTimer) del(tl *TimerLnk, delF delFlags) (bool, error) {
+// If fDelGen is set in delF, the timer generation is checked against gen
+// and if different ErrStaleHandle is returned.
+// If the timer is removed or marked for removal, its children are removed
+// too (see SetParent()).
+func (wt *WTimer) del(tl *TimerLnk, delF delFlags, gen uint32) (bool, error) {
+	ok, err := wt.delTimer(tl, delF, gen)
+	if err == nil && (ok || delF&fDelTry == 0) {
+		wt.delKids(tl)
+	}
+	return ok, err
+}
+
+// delTimer is the internal version of del(), without removing the timer
+// children.
+func (wt *WTimer) delTimer(tl *TimerLnk, delF delFlags,
+	gen uint32) (bool, error) {
 
 retry:
-	wt.lock()
+	wt.lockTimer(tl)
+
+	if delF&fDelGen != 0 && atomic.LoadUint32(&tl.gen) != gen {
+		// timer re-initialised in the meantime => don't touch it
+		wt.unlockTimer(tl)
+		return true, ErrStaleHandle
+	}
 
 	// both flags & wheel should be read in the same time
-	//  (they can change if wt.lock() is held, e.g. from rQ)
+	//  (they can change if wt.lockTimer() is held, e.g. from rQ)
 	flags, wheel, idx := tl.info.getAll()
 	if flags&(fActive|fDelete) != fActive {
 		// if fActive not set or fDelete set
 		if flags&fActive == 0 {
 			// not active anymore => was re-init or never added
-			wt.unlock()
-			if DBGon() {
-				DBG("called on inactive/un-init timer: %p (n: %p, p: %p)"+
+			wt.unlockTimer(tl)
+			if wt.dbgOn() {
+				wt.dbg("called on inactive/un-init timer: %p (n: %p, p: %p)"+
 					" flags 0x%x\n",
 					tl, tl.next, tl.prev, tl.info.flags())
 			}
@@ -529,13 +1101,13 @@ retry:
 		// check if not in Race or Force mode
 		if delF&(fDelRaceOk|fDelForce) == 0 {
 			// not in Race ok or force mode => exit on delete in progress
-			wt.unlock()
+			wt.unlockTimer(tl)
 			if delF&fDelAlreadyOk != 0 {
 				// timer marked for delete -> return current delete strategy
 				return (flags&fRemoved != 0), nil
 			}
-			if DBGon() {
-				DBG("called on timer already delete marked: %p (n: %p, p: %p)"+
+			if wt.dbgOn() {
+				wt.dbg("called on timer already delete marked: %p (n: %p, p: %p)"+
 					" flags 0x%x\n",
 					tl, tl.next, tl.prev, tl.info.flags())
 			}
@@ -545,99 +1117,134 @@ retry:
 	}
 	// a running timer has: fRunning & wheel == wheelNone
 	// a removed timer has: fRemoved & wheel == wheelNone
-	// wheel can change in parallel to  wt.lock() (under wt.rQlock[...])
+	// wheel can change in parallel to  wt.lockTimer()
+	// (under wt.rQs[...].lock)
 	// only from wheelRQ to wheelNone
 	// (if wheelNone there might be parallel runq code updating the flags
 	// in the same time, but always fRunning first, before setting the wheel)
 	//
-	// The wheel must be checked under wt.unlock() otherwise there would be an
+	// The wheel must be checked under wt.unlockTimer(tl) otherwise there would be an
 	//  window between removing from expire lists and adding to a runq
 	// where wheel == wheelNone.
+	if wheel == wheelAddQ {
+		// queued for adding (Config.AddQueue), it cannot be removed
+		// from the queue => mark it, it will be removed on the next tick
+		if delF&fDelTry == 0 {
+			tl.info.setFlags(fDelete)
+		}
+		wt.unlockTimer(tl)
+		return false, nil
+	}
 	if wheel == wheelNone {
 		// check for fRunning, but don't use the cached value
-		// (it might have changed in parallel with wt.lock() see above)
+		// (it might have changed in parallel with wt.lockTimer() see above)
 		if tl.info.flags()&fRunning != 0 {
 			// running cannot be deleted, no error
 			if delF&fDelTry == 0 {
 				tl.info.setFlags(fDelete)
 			}
-			wt.unlock()
+			wt.unlockTimer(tl)
 			return false, nil
 		}
 		// here fRunning is not set and wheel is wheelNone => there
 		// is no parallel runq code using t (it would have set first
 		// fRunning and then transition from wheelRQ to wheelNone)
-		wt.unlock()
+		wt.unlockTimer(tl)
 		// already removed
-		if (delF&(fDelRaceOk|fDelForce) == 0) && WARNon() {
-			WARN("called on already removed timer: %p (n: %p, p: %p),"+
+		if (delF&(fDelRaceOk|fDelForce) == 0) && wt.warnOn() {
+			wt.warn(tl, "called on already removed timer: %p (n: %p, p: %p),"+
 				" flags 0x%x wheel %d/%d\n",
 				tl, tl.next, tl.prev, tl.info.flags(), wheel, idx)
 		}
 		// BUG check also for fRemoved set (even in the rQ case
-		//     fRunning is reset and fRemoved set under wt.lock() so
+		//     fRunning is reset and fRemoved set under wt.lockTimer() so
 		//     wheelNone && !fRunning && !fRemoved is invalid.
 		// TODO: if 2 delete run in parallel and on rQ it would be
 		//       possible: 1st delete set wheel to none holding rQ[i].Lock,
-		//       2nd delete reaches this check with wt.lock() held and
+		//       2nd delete reaches this check with wt.lockTimer() held and
 		//       fails (1st delete did not set yet fRemoved) so it might be
 		//       a valid not BUG case.
 		if flags&fRemoved == 0 {
-			BUG("timer removed but fRemoved not set: %p (n: %p, p: %p),"+
+			wt.bug(tl, "timer removed but fRemoved not set: %p (n: %p, p: %p),"+
 				" flags 0x%x wheel %d/%d\n",
 				tl, tl.next, tl.prev, tl.info.flags(), wheel, idx)
 		}
 		return true, ErrAlreadyRemovedTimer
 	}
 	// BUG check for fRemoved not set?
-	// TODO: change from PANIC to BUG
 	if flags&fRemoved != 0 {
+		// in lenient mode try removing it anyway
 		w, i := tl.info.wheelPos()
-		PANIC("timer fRemoved  SET but on wheel: %p (n: %p, p: %p),"+
-			" crt flags 0x%x wheel %d/%d orig 0x%x wheel %d/%d\n",
+		wt.fault(ErrInvalidTimer, tl,
+			"timer fRemoved  SET but on wheel: %p (n: %p, p: %p),"+
+				" crt flags 0x%x wheel %d/%d orig 0x%x wheel %d/%d\n",
 			tl, tl.next, tl.prev, tl.info.flags(), w, i, flags, wheel, idx)
 	}
 
-	// BUG checks: if wheel != wheelNone then it should not be detached,
-	//  unless wheel was wheelRQ and it did become wheelNone in parallel.
-	if wheel != wheelRQ &&
-		(tl.Detached() || tl.next == nil || tl.prev == nil) {
-		wt.unlock()
-		PANIC("invalid timer link: %p: n: %p p: %p on wheel %d/%d expire %d\n",
-			tl, tl.next, tl.prev, wheel, idx, tl.expire)
-		return true, ErrInvalidTimer
+	var lst *timerLst
+	if wheel < WheelsNo {
+		lst = &wt.wheels[wheel].lsts[idx]
+	} else if wheel == wheelExp {
+		lst = &wt.expired
+	}
+	if lst != nil {
+		// the timer links can be changed by operations on its list
+		// neighbours => lock the list before using them
+		wt.lstLock(lst).Lock()
+		// BUG checks: if wheel != wheelNone then it should not be detached,
+		//  unless wheel was wheelRQ and it did become wheelNone in parallel.
+		if n, p := tl.next, tl.prev; tl.Detached() || n == nil || p == nil {
+			wt.lstLock(lst).Unlock()
+			wt.unlockTimer(tl)
+			err := wt.fault(ErrInvalidTimer, tl,
+				"invalid timer link: %p: n: %p p: %p on wheel %d/%d expire %d\n",
+				tl, n, p, wheel, idx, tl.expire)
+			return true, err
+		}
 	}
 
 	if wheel < WheelsNo {
 		// easy case, not on the expire lists or runq => not running
-		lst := &wt.wheels[wheel].lsts[idx]
-		lst.rm(tl)
+		err := lst.rm(wt, tl)
+		wt.lstLock(lst).Unlock()
 		tl.next = nil // DBG
 		tl.prev = nil // DBG
 		tl.info.setFlags(fRemoved)
-		wt.unlock()
-		return true, nil
+		if flags&fDelete == 0 {
+			// not already un-counted by DelLazy()
+			wt.activeDec(tl)
+		}
+		wt.nextExpRemoved(tl.expire)
+		wt.unlockTimer(tl)
+		return true, err
 	} else if wheel == wheelExp {
 		var ret bool
-		lst := &wt.expired
+		var err error
 		// might be running
 		if tl.info.flags()&fRunning == 0 {
 			// not running => easy remove
-			lst.rm(tl)
+			err = lst.rm(wt, tl)
+			wt.lstLock(lst).Unlock()
 			tl.next = nil // DBG
 			tl.prev = nil // DBG
 			tl.info.setFlags(fRemoved)
+			if flags&fDelete == 0 {
+				wt.activeDec(tl)
+			}
 			ret = true
 		} else {
 			// if wheel == wheelExp, the wheel & flags change are always done
-			// under wt.lock() so flags should never be fRunning here
+			// under wt.lock() or wt.lockTimer() so flags should never be
+			// fRunning here
 			// (since fRunning implies wheel == wheelNone or in the race
 			// case wheel == wheelRQ)
-			// TODO: change to BUG
+			n, p := tl.next, tl.prev
+			wt.lstLock(lst).Unlock()
 			w, i := tl.info.wheelPos()
-			PANIC("timer on wheelExp but fRunning was set: %p (n: %p, p: %p),"+
-				" flags 0x%x (crt 0x%x) wheel %d/%d (crt %d/%d)\n",
-				tl, tl.next, tl.prev, flags, tl.info.flags(),
+			err = wt.fault(ErrInvalidTimer, tl,
+				"timer on wheelExp but fRunning was set: %p (n: %p, p: %p),"+
+					" flags 0x%x (crt 0x%x) wheel %d/%d (crt %d/%d)\n",
+				tl, n, p, flags, tl.info.flags(),
 				wheel, idx, w, i)
 			// running
 			// mark it so it's not re-added (e.g. running periodic)
@@ -646,33 +1253,36 @@ retry:
 			}
 			ret = false
 		}
-		wt.unlock()
-		return ret, nil
+		wt.unlockTimer(tl)
+		return ret, err
 	} else if wheel == wheelRQ {
-		// on the delayed runq => protected by wt.rqLocks[idx]
-		wt.unlock()            // unlock main wheels
-		wt.rQlocks[idx].Lock() // lock target runq
+		// on the delayed runq => protected by wt.rQs[idx].lock
+		wt.unlockTimer(tl)      // unlock main wheels
+		wt.rQs[idx].lock.Lock() // lock target runq
 		// check if anything changed
 		wheel2, idx2 := tl.info.wheelPos()
 		if wheel != wheel2 || idx != idx2 {
 			// changed => retry
-			wt.rQlocks[idx].Unlock()
+			wt.rQs[idx].lock.Unlock()
 			goto retry // main lock already unlocked here
 		} else {
 			var ret bool
+			var err error
 			// not changed, ok try to remove
 			if tl.info.flags()&fRunning == 0 {
 				// not running => remove
-				lst := &wt.rQs[idx]
-				lst.rm(tl)
+				lst := &wt.rQs[idx].lst
+				err = lst.rm(wt, tl)
 				tl.next = nil // DBG
 				tl.prev = nil // DBG
 				tl.info.setFlags(fRemoved)
+				wt.activeDec(tl)
+				wt.rqDequeued(int(idx), 1)
 				ret = true
 			} else { // running
 				// handle race with runq: if the timer is on wheelRQ it
 				// might set wheel to wheelNone and fRunning in parallel
-				// with code running under wt.lock() (so even if we checked
+				// with code running under wt.lockTimer() (so even if we checked
 				// the flags and wheel at the beginning they might have
 				// changed by now).
 
@@ -682,16 +1292,15 @@ retry:
 				}
 				ret = false
 			}
-			wt.rQlocks[idx].Unlock()
-			return ret, nil // main lock already unlocked here
+			wt.rQs[idx].lock.Unlock()
+			return ret, err // main lock already unlocked here
 		}
 	}
-	wt.unlock()
-	// TODO: change to BUG
-	PANIC(" unknown wheel for %p (n: %p, p: %p),"+
+	wt.unlockTimer(tl)
+	err := wt.fault(ErrInvalidTimer, tl, " unknown wheel for %p (n: %p, p: %p),"+
 		" flags 0x%x wheel %d/%d\n",
 		tl, tl.next, tl.prev, tl.info.flags(), wheel, idx)
-	return true, ErrInvalidTimer
+	return true, err
 }
 
 // Del will remove the corresponding timer either immediately or, if
@@ -712,7 +1321,8 @@ retry:
 //
 // Multiple Del*()s can be safely run on the same timer.
 func (wt *WTimer) Del(tl *TimerLnk) (bool, error) {
-	return wt.del(tl, 0)
+	ok, err := wt.del(tl, 0, 0)
+	return ok, wt.opErr("Del", tl, err)
 }
 
 // DelTry will try to remove the corresponding timer, but it will do nothing
@@ -720,7 +1330,8 @@ func (wt *WTimer) Del(tl *TimerLnk) (bool, error) {
 // It returns true on success (timer removed) and false if the timer is
 // running, along with a possible error.
 func (wt *WTimer) DelTry(tl *TimerLnk) (bool, error) {
-	return wt.del(tl, fDelTry)
+	ok, err := wt.del(tl, fDelTry, 0)
+	return ok, wt.opErr("DelTry", tl, err)
 }
 
 // DelWait will remove the corresponding timer, waiting for it if already
@@ -730,11 +1341,85 @@ func (wt *WTimer) DelTry(tl *TimerLnk) (bool, error) {
 // configured to execute in their own temporary goroutine, using the FgoR
 // flag, cannot be safely removed if running). In both cases it
 // might return an error (ErrInvalidTimer or ErrInactiveTimer).
+// If called from the timer own handler it will return false and ErrSelfWait
+// (waiting would deadlock). In this case the timer is marked for removal,
+// like for Del().
 func (wt *WTimer) DelWait(tl *TimerLnk) (bool, error) {
+	ok, err := wt.delWait(tl, 0, 0)
+	return ok, wt.opErr("DelWait", tl, err)
+}
+
+// DelGen is similar to Del(), but it will remove the timer only if its
+// generation (see TimerLnk.Gen()) is equal to gen. If the timer was
+// re-initialised in the meantime it will return true, ErrStaleHandle.
+func (wt *WTimer) DelGen(tl *TimerLnk, gen uint32) (bool, error) {
+	ok, err := wt.del(tl, fDelGen, gen)
+	return ok, wt.opErr("DelGen", tl, err)
+}
+
+// DelTryGen is similar to DelTry(), but it checks first the timer generation
+// (see DelGen()).
+func (wt *WTimer) DelTryGen(tl *TimerLnk, gen uint32) (bool, error) {
+	ok, err := wt.del(tl, fDelTry|fDelGen, gen)
+	return ok, wt.opErr("DelTryGen", tl, err)
+}
+
+// DelWaitGen is similar to DelWait(), but it checks first the timer
+// generation (see DelGen()).
+func (wt *WTimer) DelWaitGen(tl *TimerLnk, gen uint32) (bool, error) {
+	ok, err := wt.delWait(tl, fDelGen, gen)
+	return ok, wt.opErr("DelWaitGen", tl, err)
+}
+
+// DelLazy will mark the corresponding timer for removal, without removing
+// it from the wheel list. The timer handler will not be run anymore and
+// the timer will be removed by the timer goroutine when its list is
+// redistributed or when it expires. It avoids the list locking for
+// workloads where most of the timers are removed before expiring.
+// It returns false, nil if the timer was only marked. Until removed, the
+// timer cannot be re-used (tl.IsActive() will return true) and it keeps
+// the structure containing it in use (it's still referenced from the
+// wheel). It is not counted anymore by Len().
+// For timers that are not waiting on the wheels (expired or running) it
+// is equivalent to Del().
+func (wt *WTimer) DelLazy(tl *TimerLnk) (bool, error) {
+	ok, err := wt.delLazy(tl)
+	return ok, wt.opErr("DelLazy", tl, err)
+}
+
+// delLazy is the internal version of DelLazy().
+func (wt *WTimer) delLazy(tl *TimerLnk) (bool, error) {
+	wt.lockTimer(tl)
+	flags, wheel, _ := tl.info.getAll()
+	if flags&(fActive|fDelete|fRemoved) == fActive && wheel < WheelsNo {
+		tl.info.setFlags(fDelete)
+		wt.activeDec(tl)
+		wt.unlockTimer(tl)
+		wt.delKids(tl)
+		return false, nil
+	}
+	wt.unlockTimer(tl)
+	return wt.del(tl, 0, 0)
+}
+
+// unlinkDeleted removes from lst a timer marked by DelLazy().
+// It must be called with wt.lock() held.
+func (wt *WTimer) unlinkDeleted(lst *timerLst, tl *TimerLnk) {
+	lst.rm(wt, tl) // on error (lenient mode) the timer is dropped anyway
+	tl.next = nil
+	tl.prev = nil
+	tl.info.setFlags(fRemoved)
+}
+
+// delWait is the internal version of DelWait() (see del() for the
+// delF and gen parameters).
+func (wt *WTimer) delWait(tl *TimerLnk, delF delFlags,
+	gen uint32) (bool, error) {
 	var ok bool
 	var err error
+	var gid uint64 // current goroutine id, 0 if not yet known
 	for {
-		ok, err = wt.del(tl, fDelRaceOk)
+		ok, err = wt.del(tl, delF|fDelRaceOk, gen)
 		if !ok && err == nil {
 			// del failed, check if running
 			// if it's still marked as running it might have actually
@@ -750,7 +1435,7 @@ func (wt *WTimer) DelWait(tl *TimerLnk) (bool, error) {
 			if flags&fRunning == fRunning {
 				// get the right lock
 				if wheel == wheelExp {
-					wt.lock()
+					wt.rlock() // wt.running changes only under wt.lock()
 					flags2 := tl.info.flags()
 					wheel2, idx2 := tl.rctx.wheelPos()
 					if wheel == wheel2 && idx == idx2 {
@@ -758,33 +1443,52 @@ func (wt *WTimer) DelWait(tl *TimerLnk) (bool, error) {
 						if wt.running != tl && (flags2&fRunning != 0) {
 							// marked as running, but not really running
 							// => self removed by callback false return
-							wt.unlock()
+							wt.runlock()
 							tl.info.setFlags(fRemoved)
 							return true, nil
 						}
+						if wt.running == tl && wt.selfRunning(tl, &gid) {
+							// called from the handler => would deadlock
+							wt.runlock()
+							return false, ErrSelfWait
+						}
 						// else fallthrough retry
 					}
-					wt.unlock()
+					wt.runlock()
 					// running now or moved to other wheel, retry (fallthrough)
 				} else if wheel == wheelRQ {
-					wt.rQlocks[idx].Lock()
+					wt.rQs[idx].lock.Lock()
 					flags2 := tl.info.flags()
 					wheel2, idx2 := tl.rctx.wheelPos()
 					if wheel == wheel2 && idx == idx2 {
-						if wt.rQrunning[idx] != tl && (flags2&fRunning != 0) {
+						if wt.rQs[idx].running != tl && (flags2&fRunning != 0) {
 							// not running on the advertised rq,
 							// but marked as running
-							wt.rQlocks[idx].Unlock()
+							wt.rQs[idx].lock.Unlock()
 							tl.info.setFlags(fRemoved)
 							return true, nil
 						}
+						if wt.rQs[idx].running == tl &&
+							wt.selfRunning(tl, &gid) {
+							// called from the handler => would deadlock
+							wt.rQs[idx].lock.Unlock()
+							return false, ErrSelfWait
+						}
 						// else fallthrough retry
 					}
-					wt.rQlocks[idx].Unlock()
+					wt.rQs[idx].lock.Unlock()
 					// fallthrough to Gosched()
 				}
 				// spinning...
 				runtime.Gosched()
+			} else if w, _ := tl.info.wheelPos(); w == wheelAddQ {
+				// queued for adding (Config.AddQueue) and marked for
+				// deletion: it cannot be running, so drain the queue now
+				// instead of waiting for the next tick (which might
+				// never come if paused, in simulation or not started)
+				wt.lock()
+				wt.drainAddQ(wt.Now())
+				wt.unlock()
 			}
 		} else {
 			if ok &&
@@ -797,13 +1501,31 @@ func (wt *WTimer) DelWait(tl *TimerLnk) (bool, error) {
 	return ok, err
 }
 
+// selfRunning returns true if tl handler is executed by the current
+// goroutine.
+// gid is used to cache the current goroutine id between calls (if 0 it
+// will be filled).
+// It must be called with the lock protecting tl running "context" held
+// and only on running timers.
+func (wt *WTimer) selfRunning(tl *TimerLnk, gid *uint64) bool {
+	if *gid == 0 {
+		*gid = goID()
+	}
+	return *gid != 0 && atomic.LoadUint64(&tl.rgid) == *gid
+}
+
 // redistTimer will move tl to a new list/wheel according to
 // tl.expire and the current time (specified by now).
 // lst is the list that currently owns tl.
 func (wt *WTimer) redistTimer(lst *timerLst, tl *TimerLnk, now Ticks) {
+	if tl.info.flags()&fDelete != 0 {
+		// marked by DelLazy() => remove it now
+		wt.unlinkDeleted(lst, tl)
+		return
+	}
 	expire := tl.expire
 	if expire.LT(now) {
-		BUG("rtimer %p on wheel/idx: %d/%d: expire less then \"now\":"+
+		wt.bug(tl, "rtimer %p on wheel/idx: %d/%d: expire less then \"now\":"+
 			" expire %d now %d (ticks), lst %p \n",
 			tl, lst.wheelNo, lst.wheelIdx, expire.Val(), now.Val(), lst)
 		// try to fix it to expire immediately
@@ -815,17 +1537,21 @@ func (wt *WTimer) redistTimer(lst *timerLst, tl *TimerLnk, now Ticks) {
 	// (so no BUG checks for wheel >= old wheel), but check for
 	// wheel & lst being the same
 	if w == lst.wheelNo && idx == lst.wheelIdx {
-		BUG("redistributed to the same wheel/idx: %d/%d -> %d/%d"+
+		wt.bug(tl, "redistributed to the same wheel/idx: %d/%d -> %d/%d"+
 			" expire %d now %d (ticks), lst %p tl %p\n",
 			lst.wheelNo, lst.wheelIdx, w, idx, tl.expire.Val(), now.Val(),
 			lst, tl)
 		return // nothing to do
 	}
 
-	lst.rm(tl)
+	if lst.rm(wt, tl) != nil {
+		// lenient mode, invalid timer (already reported)
+		return
+	}
+	wt.cascaded[lst.wheelNo]++
 	if wt.appendTimer(tl, w, idx) != nil {
-		if ERRon() {
-			ERR("append timer failed for tl %p on %d/%d redist to %d/%d"+
+		if wt.errOn() {
+			wt.err("append timer failed for tl %p on %d/%d redist to %d/%d"+
 				" expire %d now %d (tick), lst %p\n",
 				tl, lst.wheelNo, lst.wheelIdx, w, idx,
 				tl.expire.Val(), now.Val(), lst)
@@ -833,23 +1559,59 @@ func (wt *WTimer) redistTimer(lst *timerLst, tl *TimerLnk, now Ticks) {
 		tl.next = nil
 		tl.prev = nil
 		tl.info.setFlags(fRemoved)
+		wt.activeDec(tl)
 	}
 }
 
 // redistLst empties lst and redistributes all its entries according
 // to their expire timeout and "now". now represent the current in ticks.
 func (wt *WTimer) redistLst(lst *timerLst, now Ticks) {
+	if wt.cfg.CascadeBudget > 0 && !lst.isEmpty() {
+		wt.redistLstChunked(lst, now, wt.cfg.CascadeBudget)
+		return
+	}
 	s := lst.head.next
 	// del current element safe iteration
 	for v, nxt := s, s.next; v != &lst.head; v, nxt = nxt, nxt.next {
 		wt.redistTimer(lst, v, now)
 	}
 	if !lst.isEmpty() {
-		BUG("lst on wheel %d idx %d (%p) not empty after redistTimer"+
+		wt.bug(nil, "lst on wheel %d idx %d (%p) not empty after redistTimer"+
 			" @%d ticks\n", lst.wheelNo, lst.wheelIdx, lst, now)
 	}
 }
 
+// redistLstChunked is similar to redistLst(), but it releases wt.lock()
+// after redistributing each budget timers, to avoid holding the lock for
+// too long when cascading big lists (see Config.CascadeBudget).
+// The list content is first moved to wt.carry, so that timers added while
+// the lock is released will not end up in the list being redistributed.
+// The timers keep their wheel position while on wt.carry, so they can be
+// deleted in the meantime (using the lock of the list they were moved from,
+// which also protects wt.carry while it is being redistributed).
+func (wt *WTimer) redistLstChunked(lst *timerLst, now Ticks, budget int) {
+	carry := &wt.carry
+	carry.wheelNo = lst.wheelNo
+	carry.wheelIdx = lst.wheelIdx
+	carry.head.info.setWheel(lst.wheelNo, lst.wheelIdx)
+	lst.mv(wt, carry)
+	n := 0
+	for !carry.isEmpty() {
+		wt.redistTimer(carry, carry.head.next, now)
+		n++
+		if n >= budget && !carry.isEmpty() {
+			// let the waiting operations run
+			wt.unlock()
+			runtime.Gosched()
+			wt.lock()
+			n = 0
+		}
+	}
+	carry.wheelNo = wheelNone
+	carry.wheelIdx = wheelNoIdx
+	carry.head.info.setWheel(wheelNone, wheelNoIdx)
+}
+
 // redistTimers will cause all the timers to be moved to lists according
 // to their expire relative to the current time (passed as the "now" parameter).
 func (wt *WTimer) redistTimers(now Ticks) {
@@ -871,67 +1633,182 @@ func (wt *WTimer) redistTimers(now Ticks) {
 		wt.redistLst(&wt.wheels[1].lsts[idx1], now)
 	}
 	// wheel 0 always runs on each new tick
-	wt.wheels[0].lsts[idx0].mv(&wt.expired)
+	wt.wheels[0].lsts[idx0].mv(wt, &wt.expired)
 }
 
 // handle callback return (re-add if rearm is true, ignore otherwise).
-// WARNING: it should be called with wt.lock() (oplock) held
+// WARNING: it should be called with wt.lock() (oplock) held or with
+// t locked (see afterRun())
 func (wt *WTimer) afterRunUnsafe(t *TimerLnk,
 	rearm bool, delta time.Duration) bool {
 	if rearm && (t.info.flags()&fDelete == 0) {
-		t.info.resetFlags(fRunning)
+		rearmReq := t.info.flags()&fRearm != 0
+		t.info.resetFlags(fRunning | fRearm)
+		x := t.extView()
 		// re-add
-		if delta != Periodic {
+		if rearmReq {
+			// Add*() called from the handler, t.intvl already set
+		} else if delta != Periodic {
 			t.intvl = delta
 			//t.deltaExp0, _ = wt.Ticks(ret)
 			/* should be handled  now (round-up) in addUnsafe()
 			if delta < wt.tickDuration {
 				// re-add too small -> force at least 1 tick to avoid
 				// running continuously on expire
-				// TODO: counter or DBG() msg?
+				// TODO: counter or wt.dbg() msg?
 				t.intvl = wt.tickDuration
 				//t.deltaExp0 = NewTick
 			}
 			*/
+		} else if x.newIv != 0 {
+			t.intvl = x.newIv // changed with SetInterval()
+		}
+		if x.newIv != 0 {
+			x.newIv = 0 // not noExt
 		}
-		if wt.addUnsafe(t, wt.Now()) != nil {
+		wt.stampAdd(t)
+		var err error
+		// only the periodic re-arms are affected by the catch-up and
+		// misses policies, an explicit re-arm is relative to now
+		periodic := !rearmReq && delta == Periodic
+		if periodic && x.miss != MissDefault {
+			err = wt.rearmMissedUnsafe(t)
+		} else if base, ok := wt.skipCatchUp(); periodic && ok {
+			err = wt.addAfterUnsafe(t, base)
+		} else {
+			err = wt.addUnsafe(t, wt.Now())
+		}
+		if err != nil {
 			// add failed (bug?)
-			PANIC("addUnsafe failed\n")
+			wt.fault(err, t, "addUnsafe failed for %p: %s\n", t, err)
 			t.info.setFlags(fRemoved)
 			return false
 		}
+		wt.activeInc(t)
+		wt.nextExpAdded(t.expire)
+		if periodic {
+			wt.countCoalesced(t)
+		}
 		return true
 	} else if rearm {
 		// this means fDelete is set
 		w, i := t.info.wheelPos()
 		if w != wheelNone {
-			PANIC("expected wheel to be none : %d/%d flags 0x%x\n", w, i, t.info.flags())
+			wt.fault(ErrInvalidTimer, t,
+				"expected wheel to be none : %d/%d flags 0x%x\n",
+				w, i, t.info.flags())
 		}
 
-		t.info.chgFlags(fRemoved, fRunning)
+		t.info.chgFlags(fRemoved, fRunning|fRearm)
 	} // else rearm == false => we cannot use t, it might already be destroyed
 	return false
 }
 
+// afterRun is the version of afterRunUnsafe() used outside the timer
+// goroutine (run queues workers and FgoR timers).
+func (wt *WTimer) afterRun(t *TimerLnk, rearm bool, delta time.Duration) {
+	if !rearm {
+		// t cannot be used anymore, nothing to do
+		return
+	}
+	wt.lockTimer(t)
+	wt.afterRunUnsafe(t, rearm, delta)
+	wt.unlockTimer(t)
+}
+
 // processExpired will handle all the entries in the expired list.
+// If Config.RunBudget is set, it will stop after handling RunBudget
+// entries, leaving the rest for the next call (next tick).
 // It must be always called under wt.opLock.
 func (wt *WTimer) processExpired(now Ticks) {
+	if atomic.LoadUint32(&wt.held) != 0 {
+		// SuspendDispatch(): keep the timers on the expired list
+		return
+	}
+	if wt.cfg.FIFO {
+		wt.sortExpired()
+	}
 	lst := &wt.expired
-	rQadded := 0 // elemnts added to the rQs
+	rQadded := 0   // elemnts added to the rQs
+	var gid uint64 // current goroutine id, filled on the first fast timer
+
+	budget := wt.cfg.RunBudget // 0 means unlimited
+	handled := 0
 
 	for !lst.isEmpty() {
+		if budget > 0 && handled >= budget {
+			// budget exhausted, continue on the next tick
+			break
+		}
 		t := lst.head.next
-		lst.rm(t)
+		if wt.cfg.RunQueuePolicy == OverloadBlock && !wt.cfg.Simulation &&
+			t.info.flags()&(Ffast|FgoR|fDelete) == 0 && wt.rqFull() {
+			// wait for the workers to make some room
+			if rQadded != 0 {
+				wt.signalAdded()
+				rQadded = 0
+			}
+			if wt.waitRQFree() {
+				// the lock was released => restart
+				continue
+			}
+			// shutting down => don't block anymore
+		}
+		handled++
+		if lst.rm(wt, t) != nil && lst.head.next == t {
+			// lenient mode: corrupted list, drop its content
+			lst.forceEmpty()
+			break
+		}
 		t.next = nil
 		t.prev = nil
 		flags := t.info.flags()
-		if flags&Ffast != 0 {
-			// fast timer -> execute it now
+		if flags&fDelete != 0 {
+			// marked by DelLazy() (already not counted)
+			t.info.setFlags(fRemoved)
+			continue
+		}
+		if t.extView().left != 0 {
+			// interval longer then the wheels range => next leg
+			if wt.nextLeg(t, now) != nil {
+				t.info.setFlags(fRemoved)
+				wt.activeDec(t)
+			}
+			continue
+		}
+		if wt.lagDrop(t, flags) {
+			wt.dropExpired(t, &wt.lagDropped)
+			// the lock might have been released => restart
+			continue
+		}
+		spill := false // run queues full => run it like a FgoR timer
+		if flags&(Ffast|FgoR) == 0 && wt.rqFull() {
+			switch wt.cfg.RunQueuePolicy {
+			case OverloadDrop:
+				wt.dropExpired(t, &wt.rQdropped)
+				// the lock might have been released => restart
+				continue
+			case OverloadGoR:
+				spill = true
+				atomic.AddUint64(&wt.rQspilled, 1)
+			}
+		}
+		if flags&(Ffast|FgoR) != 0 || spill {
+			// not queued anymore (will run now)
+			wt.activeDec(t)
+		}
+		if flags&Ffast != 0 ||
+			(wt.cfg.Simulation && (flags&FgoR != 0 || spill)) {
+			// fast timer (or simulation mode) -> execute it now
+			if gid == 0 {
+				gid = goID()
+			}
 			wt.running = t
+			atomic.StoreUint64(&t.rgid, gid)
 			t.rctx.setWheel(wheelExp, wheelNoIdx)
 			t.info.setFlags(fRunning)
 			wt.unlock()
-			rearm, delta := t.f(wt, t, t.arg)
+			rearm, delta := wt.runHandler(t, HandlerFast)
 			// a return of rearm == false  means the timer should be removed
 			// immediately: this means the timer handler might not
 			// exist anymore so if rearm == false we cannot use t anymore.
@@ -945,172 +1822,403 @@ func (wt *WTimer) processExpired(now Ticks) {
 			// it might have modified the expired list => restart
 			// (keep the lock)
 			continue
-		} else if flags&FgoR != 0 {
+		} else if flags&FgoR != 0 || spill {
 			// run in separate go routine, experimental
 			// no mark as running possibility..
+			atomic.StoreUint64(&t.rgid, 0) // not known yet
 			t.info.setFlags(fRunning)
 			t.rctx.setWheel(wheelNone, wheelNoIdx)
 			wt.unlock()
-			wt.wg.Add(1)
-			go func() {
-				defer wt.wg.Done()
-				rearm, delta := t.f(wt, t, t.arg)
-				// a return of rearm == false  means the timer should be
-				// removed/ immediately: this means the timer handler
-				// might not exist anymore so if rearm == false we
-				// cannot use t anymore.
-				if !rearm {
-					t = nil // DBG: force nil to catch bugs early
-				}
-				wt.lock()
-				wt.afterRunUnsafe(t, rearm, delta)
-				wt.unlock()
-			}()
+			select {
+			case wt.goRch <- t:
+				// handled by an idle runner
+			default:
+				// all busy => start a new one
+				atomic.AddUint64(&wt.allocGoR, 1)
+				wt.wg.Add(1)
+				go wt.goRunner(t)
+			}
 			wt.lock()
 			// while not locked, someone might have modified the expired
 			// list => restart
 			continue
 		} else {
-			// slow timer -> add to runq
-			rqPos := atomic.LoadUint32(&wt.rQhead)
-			idx := rqPos % runQueuesNo
-			wt.rQlocks[idx].Lock()
-			wt.rQs[idx].append(t)
-			wt.rQlocks[idx].Unlock()
-			atomic.CompareAndSwapUint32(&wt.rQhead, rqPos, rqPos+1)
+			// slow timer -> add to a runq for its class
+			c := int(t.extView().class)
+			if c >= len(wt.rClasses) {
+				// class from another WTimer instance config
+				c = int(PrioNormal)
+			}
+			cls := &wt.rClasses[c]
+			if cls.batchF != nil {
+				// batch delivery at the end (see flushBatches())
+				t.info.setFlags(fRemoved)
+				wt.activeDec(t)
+				cls.batch = append(cls.batch, t)
+				continue
+			}
+			rqPos := atomic.LoadUint32(&cls.rQhead)
+			idx := cls.first + int(rqPos%uint32(cls.n))
+			wt.rQs[idx].lock.Lock()
+			if wt.rQs[idx].lst.append(wt, t) != nil {
+				// lenient mode: bad timer, drop it
+				t.info.setFlags(fRemoved)
+				wt.activeDec(t)
+				wt.rQs[idx].lock.Unlock()
+				continue
+			}
+			wt.rqQueued(idx)
+			wt.rQs[idx].lock.Unlock()
+			atomic.CompareAndSwapUint32(&cls.rQhead, rqPos, rqPos+1)
 			// it should never fail since it's modified only under wt.Lock()
 			// but even if the code changes it would still be ok: if the
 			// swap fails it means rqHead changed under us => don't update it
 			// (some parallel running future code added to the same rQ which
 			// is not problematic, only slightly inefficient)
+			cls.added++
 			rQadded++
 		}
 	}
 	if rQadded != 0 {
 		// something was added to the runqueues => signal the runq workers
-		wt.unlock()
-		sigsNo := rQadded
-		if sigsNo > runQueuesWorkersNo {
-			sigsNo = runQueuesWorkersNo
+		wt.signalAdded()
+	}
+	wt.flushBatches()
+}
+
+// signalAdded signals the workers of all the run classes with newly queued
+// timers (see signalRQ()).
+// It must be called with wt.lock() held, but it will release it while
+// signaling.
+func (wt *WTimer) signalAdded() {
+	for i := range wt.rClasses {
+		cls := &wt.rClasses[i]
+		if n := cls.added; n != 0 {
+			cls.added = 0
+			wt.unlock()
+			wt.signalRQ(cls, n)
+			wt.lock()
 		}
-	runq_signal:
-		// signal the runq workers, but don't send more signals then workers
-		for i := 0; i < sigsNo; i++ {
-			select {
-			case wt.rQch <- struct{}{}:
-			default:
-				/*
-					if DBGon() {
-						DBG("all runq busy after signaling %d /%d "+
-							"(total added %d, pending work %d)\n",
-							i, sigsNo, rQadded,
-							wt.rQhead-wt.rQtail)
-					}
-				*/
-				break runq_signal
+	}
+}
+
+// signalRQ signals the workers serving the run class cls that n timers
+// were queued, but without sending more signals then workers. If the
+// class signal channel is full, the signals are handled according to
+// Config.RunQueueSignal.
+func (wt *WTimer) signalRQ(cls *runClass, n int) {
+	if wt.cfg.Simulation {
+		return // no workers
+	}
+	if n > cls.served {
+		n = cls.served
+	}
+	// direct hand-off: the spinning workers will pick up the new timers
+	// without a signal (see spinForWork())
+	n -= int(atomic.LoadInt32(&cls.spinning))
+	if n > 0 && wt.cfg.RunQueueSignal == SignalToken {
+		atomic.AddInt64(&cls.tokens, int64(n))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case cls.ch <- struct{}{}:
+			continue
+		default:
+		}
+		switch wt.cfg.RunQueueSignal {
+		case SignalBlock:
+			if wt.waitSignal(cls) {
+				continue
 			}
+		case SignalToken:
+			// not lost, the workers will take the tokens
+			return
 		}
-		wt.lock()
+		// all the workers are already signaled (or waited too long)
+		atomic.AddUint64(&wt.rQsigDrops, uint64(n-i))
+		return
 	}
 }
 
-// runqListen listens on ch for a runq number and will run all the
-// timer handlers queued to the respective runq.
-func (wt *WTimer) runqListen(ch <-chan struct{}) {
+// runqListen waits for new work signals for the run class of the worker
+// ws (see signalRQ()) and runs the timer handlers queued for it. For a
+// priority class it runs also the handlers queued with a higher priority,
+// always the higher priorities first. A named class is served alone.
+func (wt *WTimer) runqListen(ws *workerStats) {
+	gid := goID()
+	c := ws.class
+	// served classes and their channels, in dispatch order
+	// (nil channel => blocks forever for the not served ones)
+	var cls [PrioNo]*runClass
+	var chs [PrioNo]chan struct{}
+	if c >= int(PrioNo) {
+		cls[0] = &wt.rClasses[c]
+	} else {
+		for i, p := range prioOrder {
+			cls[i] = &wt.rClasses[p]
+			if int(p) == c {
+				break
+			}
+		}
+	}
+	for i := range cls {
+		if cls[i] != nil {
+			chs[i] = cls[i].ch
+		}
+	}
+	spin := wt.cfg.WorkerSpin // current spin time (adaptive)
+	wait := true
 loop:
 	for {
-		select {
-		case <-wt.cancel:
-			break loop
-		case _, ok := <-ch:
-			if !ok {
-				// EOF
-				break loop
-			}
-		retry:
-			// try getting a runq index to run
-			for {
-				pos := atomic.LoadUint32(&wt.rQtail)
-				if pos == atomic.LoadUint32(&wt.rQhead) {
-					// someone else stole our work, nothing to do, wait for
-					// another signal
-					continue loop
+		var ok bool
+		if wait {
+			// a pending wake token (SignalToken) means new work
+			if !wt.takeToken(&cls) {
+				select {
+				case <-wt.cancel:
+					break loop
+				case _, ok = <-chs[0]:
+				case _, ok = <-chs[1]:
+				case _, ok = <-chs[2]:
 				}
-				if !atomic.CompareAndSwapUint32(&wt.rQtail, pos, pos+1) {
-					// tail changed, someone was faster => try another index
-					continue retry
+				if !ok {
+					// EOF
+					break loop
 				}
-				idx := pos % runQueuesNo
-				wt.rQlocks[idx].Lock()
-				lst := &wt.rQs[idx]
-				for !lst.isEmpty() {
-					t := lst.head.next
-					// flags op needs to be atomic since: we can not wt.lock()
-					// here (deadlock possible since processExpired()
-					// holds wt.lock() and tries to acquire a rQLock
-					// fRunning must be set before setting wheel to wheelNone
-					// (in lst.rm(t) to avoid a del race.
-
-					wt.rQrunning[idx] = t
-					t.rctx.setWheel(wheelRQ, uint16(idx))
-					t.info.setFlags(fRunning)
-
-					lst.rm(t)
-
-					t.next = nil
-					t.prev = nil
-
-					wt.rQlocks[idx].Unlock()
-
-					rearm, delta := t.f(wt, t, t.arg)
-					// a return of rearm == false  means the timer should be
-					// removed/ immediately: this means the timer handler
-					// might not exist anymore so if rearm == false we
-					// cannot use t anymore.
-					if !rearm {
-						t = nil // DBG: force nil to catch bugs early
-					}
+				// the signal consumes its token too
+				wt.takeToken(&cls)
+			}
+			atomic.AddUint64(&ws.wakeups, 1)
+		}
+		start := time.Now()
+		handled := atomic.LoadUint64(&ws.handled)
+		// run queues left non-empty after Config.RunBatch handlers
+		var resume []int
+		for {
+			// run a new pending queue, higher priorities first
+			found := false
+			for i := 0; i < len(cls) && cls[i] != nil && !found; i++ {
+				var idx int
+				if idx, found = wt.runRQ(cls[i], gid, ws); idx >= 0 {
+					resume = append(resume, idx)
+				}
+			}
+			if found {
+				continue
+			}
+			if len(resume) == 0 {
+				break // nothing more to do, wait for a signal
+			}
+			// no new work => continue with the unfinished queues
+			idx := resume[0]
+			resume = resume[1:]
+			if wt.runQ(idx, gid, ws) {
+				resume = append(resume, idx)
+			}
+		}
+		if wait && handled == atomic.LoadUint64(&ws.handled) {
+			// signaled, but the work was taken by other workers
+			atomic.AddUint64(&ws.idle, 1)
+		}
+		ws.addBusy(start)
+		// before blocking, spin for a while waiting for new work
+		wait = !wt.spinForWork(&cls, &spin)
+	} // for main wait on signal loop
+}
 
-					wt.rQlocks[idx].Lock()
-					// if a Del() happened while running it will set the
-					// fDelete flags under the rQ lock => we have to take rQLock
-					// before checking the fDelete flag or otherwise we could
-					// race (fDelete set after we check for it...)
-					if rearm && t.info.flags()&fDelete != 0 {
-						rearm = false // force no re-add
-					}
-					wt.rQlocks[idx].Unlock()
+// pendingWork returns true if any of the run classes cls has queued
+// handlers that are not yet taken by a worker.
+func pendingWork(cls *[PrioNo]*runClass) bool {
+	for i := 0; i < len(cls) && cls[i] != nil; i++ {
+		if atomic.LoadUint32(&cls[i].rQtail) !=
+			atomic.LoadUint32(&cls[i].rQhead) {
+			return true
+		}
+	}
+	return false
+}
+
+// spinForWork spins for up to *spin waiting for new work for the run
+// classes cls (see Config.WorkerSpin). It returns true if new work was
+// found. While spinning the worker is counted as spinning for each class,
+// so that signalRQ() does not signal it. *spin is adapted: doubled (up to
+// Config.WorkerSpin) if work was found and halved otherwise (down to
+// 1/16 of Config.WorkerSpin).
+func (wt *WTimer) spinForWork(cls *[PrioNo]*runClass,
+	spin *time.Duration) bool {
+	max := wt.cfg.WorkerSpin
+	if max <= 0 {
+		return false
+	}
+	for i := 0; i < len(cls) && cls[i] != nil; i++ {
+		atomic.AddInt32(&cls[i].spinning, 1)
+	}
+	found := false
+	deadline := time.Now().Add(*spin)
+spin:
+	for !found && time.Now().Before(deadline) {
+		select {
+		case <-wt.cancel:
+			break spin
+		default:
+		}
+		if found = pendingWork(cls); !found {
+			runtime.Gosched()
+		}
+	}
+	for i := 0; i < len(cls) && cls[i] != nil; i++ {
+		atomic.AddInt32(&cls[i].spinning, -1)
+	}
+	// work queued after the last check might not have been signaled
+	// (spinning still counted) => check again after un-counting
+	found = found || pendingWork(cls)
+	if found {
+		if *spin *= 2; *spin > max {
+			*spin = max
+		}
+	} else if *spin > max/16 {
+		*spin /= 2
+	}
+	return found
+}
 
-					wt.lock()
+// runRQ runs the handlers from the next run queue of cls with pending work
+// (see runQ()).
+// It returns false if there is no pending work for cls. If it stopped
+// before emptying the queue (Config.RunBatch) it returns the queue index,
+// otherwise -1.
+func (wt *WTimer) runRQ(cls *runClass, gid uint64,
+	ws *workerStats) (int, bool) {
+	for {
+		pos := atomic.LoadUint32(&cls.rQtail)
+		if pos == atomic.LoadUint32(&cls.rQhead) {
+			// nothing to do (or someone else stole our work)
+			return -1, false
+		}
+		if !atomic.CompareAndSwapUint32(&cls.rQtail, pos, pos+1) {
+			// tail changed, someone was faster => try another index
+			continue
+		}
+		idx := cls.first + int(pos%uint32(cls.n))
+		if wt.runQ(idx, gid, ws) {
+			return idx, true
+		}
+		return -1, true
+	}
+}
 
-					wt.afterRunUnsafe(t, rearm, delta)
-					wt.unlock()
-					wt.rQlocks[idx].Lock()
-					wt.rQrunning[idx] = nil // always after fRunning reset
-				} // for lst
+// runQ runs the handlers queued on the run queue idx, until the queue is
+// empty or Config.RunBatch handlers were run. It returns true if it
+// stopped before emptying the queue.
+// If another worker is already running handlers from the queue, it does
+// nothing (the other worker will run the rest of the queue too).
+// The handlers run are counted in ws, if not nil (simulation mode).
+func (wt *WTimer) runQ(idx int, gid uint64, ws *workerStats) bool {
+	wt.rQs[idx].lock.Lock()
+	if wt.rQs[idx].running != nil {
+		// another worker is running timers from the same runq
+		// and it will run also the rest of the queue
+		// (wt.rQs[idx].running must always identify the timer
+		// running from the queue, see delWait())
+		wt.rQs[idx].lock.Unlock()
+		return false
+	}
+	lst := &wt.rQs[idx].lst
+	batch := wt.cfg.RunBatch // 0 means unlimited
+	for n := 0; !lst.isEmpty(); n++ {
+		if wt.dispatchStopped() {
+			// ShutdownContext() or SuspendDispatch(): don't run any new
+			// handler
+			break
+		}
+		if batch > 0 && n >= batch {
+			// give the other queues a chance
+			wt.rQs[idx].lock.Unlock()
+			return true
+		}
+		t := lst.head.next
+		// flags op needs to be atomic since: we can not
+		// wt.lockTimer() here (deadlock possible since
+		// processExpired() holds wt.lock() and tries to
+		// acquire a rQLock
+		// fRunning must be set before setting wheel to wheelNone
+		// (in lst.rm(wt, t) to avoid a del race.
+
+		wt.rQs[idx].running = t
+		atomic.StoreUint64(&t.rgid, gid)
+		t.rctx.setWheel(wheelRQ, uint16(idx))
+		t.info.setFlags(fRunning)
+
+		if lst.rm(wt, t) != nil && lst.head.next == t {
+			// lenient mode: corrupted list, drop its content
+			t.info.resetFlags(fRunning)
+			wt.rQs[idx].running = nil
+			lst.forceEmpty()
+			break
+		}
 
-				wt.rQlocks[idx].Unlock()
-			} // for retry a new index
-		} // select
-	} // for main wait on signal loop
+		t.next = nil
+		t.prev = nil
+		wt.activeDec(t)
+		wt.rqDequeued(idx, 1)
+
+		wt.rQs[idx].lock.Unlock()
+
+		rearm, delta := wt.runHandler(t, HandlerRunQ)
+		if ws != nil {
+			atomic.AddUint64(&ws.handled, 1)
+		}
+		// a return of rearm == false  means the timer should be
+		// removed/ immediately: this means the timer handler
+		// might not exist anymore so if rearm == false we
+		// cannot use t anymore.
+		if !rearm {
+			t = nil // DBG: force nil to catch bugs early
+		}
+
+		wt.rQs[idx].lock.Lock()
+		// if a Del() happened while running it will set the
+		// fDelete flags under the rQ lock => we have to take rQLock
+		// before checking the fDelete flag or otherwise we could
+		// race (fDelete set after we check for it...)
+		if rearm && t.info.flags()&fDelete != 0 {
+			rearm = false // force no re-add
+		}
+		wt.rQs[idx].lock.Unlock()
+
+		wt.afterRun(t, rearm, delta)
+		wt.rQs[idx].lock.Lock()
+		wt.rQs[idx].running = nil // always after fRunning reset
+	} // for lst
+
+	wt.rQs[idx].lock.Unlock()
+	return false
 }
 
 // run all the timers that expire at "now"
 func (wt *WTimer) run(now Ticks) {
 	wt.lock()
+	wt.drainAddQ(now)
 	wt.redistTimers(now)
 	wt.processExpired(now)
+	if next, ok := wt.cachedNextExp(); ok && !next.GT(now) {
+		wt.setNextExp(Ticks{}, false) // expired, re-compute on the next use
+	}
+	backlog := wt.expiredBacklog()
 	wt.unlock()
+	if wt.cfg.Saturation.F != nil {
+		wt.checkSaturation(now, backlog)
+	}
 }
 
 // advance the internal time to the passed value, running all the
 // timers that expire.
 // It must never be called in parallel.
-// TODO: public version: RunTicks(diff) for running "by hand", w/o ticker.
+// (see RunTicks() for the public version)
 func (wt *WTimer) advanceTimeTo(t Ticks) {
 	now := wt.Now()
 	if now.GT(t) {
-		BUG("advancing too many ticks: %d ticks (%s)\n",
+		wt.bug(nil, "advancing too many ticks: %d ticks (%s)\n",
 			t.Sub(now).Val(), wt.Duration(t.Sub(now)))
 	}
 	for wt.Now().NE(t) {
@@ -7,64 +7,406 @@
 package wtimer
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/intuitivelabs/timestamp"
 )
 
-// start runq "workers"
+// start runq "workers", for each run class
 func (wt *WTimer) startRQ() {
 	// start run queue "workers"
-	for i := 0; i < runQueuesWorkersNo; i++ {
+	for w := range wt.workers {
 		wt.wg.Add(1)
-		go func() {
+		go func(ws *workerStats) {
 			defer wt.wg.Done()
-			wt.runqListen(wt.rQch)
-		}()
+			if wt.rClasses[ws.class].batchF != nil {
+				wt.batchListen(&wt.rClasses[ws.class], ws)
+				return
+			}
+			wt.runqListen(ws)
+		}(&wt.workers[w])
+	}
+}
+
+// idle time after which a FgoR timers runner exits
+const goRIdleTimeout = 10 * time.Second
+
+// goRunner runs the handler of the FgoR timer t and then it waits for
+// other FgoR timers to run (sent on wt.goRch by processExpired()), so that
+// the goroutines are re-used. It exits after being idle for more then
+// goRIdleTimeout or when Shutdown() is called.
+func (wt *WTimer) goRunner(t *TimerLnk) {
+	defer wt.wg.Done()
+	gid := goID()
+	var idle *time.Timer
+	for {
+		atomic.StoreUint64(&t.rgid, gid)
+		atomic.AddInt64(&wt.goRactive, 1)
+		rearm, delta := wt.runHandler(t, HandlerGoR)
+		atomic.AddInt64(&wt.goRactive, -1)
+		// a return of rearm == false  means the timer should be
+		// removed/ immediately: this means the timer handler
+		// might not exist anymore so if rearm == false we
+		// cannot use t anymore.
+		if !rearm {
+			t = nil // DBG: force nil to catch bugs early
+		}
+		wt.afterRun(t, rearm, delta)
+
+		if idle == nil {
+			idle = time.NewTimer(goRIdleTimeout)
+		} else {
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(goRIdleTimeout)
+		}
+		select {
+		case t = <-wt.goRch:
+		case <-idle.C:
+			return
+		case <-wt.cancel:
+			idle.Stop()
+			return
+		}
 	}
 }
 
+// timer wheel life cycle states (WTimer.runState)
+const (
+	rsInit    = iota // not started since Init()
+	rsRunning        // started
+	rsStopped        // stopped by Shutdown()
+)
+
 // Start will start the timer wheel (timer + workers).
 // No timers will be run if Start() was not called.
 // In most cases it should be used right after Init().
+// The timer wheel can be re-started after Shutdown() (e.g. for
+// re-configuring it), without calling Init() again. The pending timers
+// keep their remaining time (the timer wheel time is stopped while not
+// running). Calling Start() on a running timer wheel has no effect.
 func (wt *WTimer) Start() {
+	if err := wt.start(nil, nil); err != nil && wt.warnOn() {
+		wt.warn(nil, "Start: %s\n", err)
+	}
+}
+
+// StartWithTicker is similar to Start(), but the ticks are driven by the
+// application, which must deliver the current time on ch, ideally at each
+// tick duration (e.g. from its own high-precision timing loop). The
+// elapsed ticks are computed from the delivered timestamps, which must
+// use the same time base as the timer wheel time source (the system clock
+// by default, see Config.Clock). The timer goroutine stops when ch is
+// closed or on Shutdown().
+// It cannot be used in tickless or simulation mode (Config.Tickless and
+// Config.Simulation).
+func (wt *WTimer) StartWithTicker(ch <-chan time.Time) error {
+	if ch == nil || wt.cfg.Tickless || wt.cfg.Simulation {
+		return ErrInvalidParameters
+	}
+	return wt.start(ch, nil)
+}
+
+// start starts the timer wheel, driven by the tickC channel, by the shared
+// ticker st or, if both are nil, by its own ticker.
+// It returns ErrAlreadyStarted if the timer wheel is already running.
+func (wt *WTimer) start(tickC <-chan time.Time, st *SharedTicker) error {
+	if !atomic.CompareAndSwapUint32(&wt.runState, rsInit, rsRunning) &&
+		!atomic.CompareAndSwapUint32(&wt.runState, rsStopped, rsRunning) {
+		return ErrAlreadyStarted
+	}
+	if wt.shutWait != nil {
+		// the goroutines abandoned by ShutdownContext() must finish
+		// before re-using wt.wg
+		<-wt.shutWait
+		wt.shutWait = nil
+	}
+	wt.shared = st
 	wt.cancel = make(chan struct{})
-	wt.lastTickT = timestamp.Now()
-	wt.refTS = wt.lastTickT
-	wt.refTicks = wt.Now()
+	wt.ctx, wt.ctxCancel = context.WithCancel(context.Background())
+	atomic.StoreUint32(&wt.stopRun, 0)
+	wt.register()
+	if wt.cfg.Simulation {
+		// no goroutines, the time is advanced by RunTicks()
+		return nil
+	}
+	wt.clkState = clkInSync
+	wt.tickWall = time.Time{}
+	atomic.StoreUint32(&wt.sleeping, 0)
+	wt.requeueRQs()
 	wt.startRQ()
+	if wt.cfg.VerifyIntvl > 0 {
+		wt.wg.Add(1)
+		go func() {
+			defer wt.wg.Done()
+			wt.verifyLoop()
+		}()
+	}
+	if wt.cfg.LeakScanIntvl > 0 {
+		wt.wg.Add(1)
+		go func() {
+			defer wt.wg.Done()
+			wt.leakScanLoop()
+		}()
+	}
+	if wt.cfg.StuckThreshold > 0 {
+		wt.wg.Add(1)
+		go func() {
+			defer wt.wg.Done()
+			wt.watchdogLoop()
+		}()
+	}
+	// set the time reference just before starting the ticks (the timer
+	// goroutine is the only writer after this point)
+	now := wt.timeNow()
+	wt.lastTickT = now
+	wt.setRef(now, wt.Now())
+	if wt.shared != nil {
+		wt.shared.attach(wt)
+		return nil
+	}
 	wt.wg.Add(1)
+	if wt.cfg.Tickless {
+		go func() {
+			defer wt.wg.Done()
+			defer wt.lockTimerThread()()
+			defer wt.hiResTicks()()
+			wt.ticklessLoop()
+		}()
+		return nil
+	}
 	go func() {
 		defer wt.wg.Done()
-		//		if DBGon() {
-		//			DBG("starting ticker with %s at %s\n",
+		defer wt.lockTimerThread()()
+		//		if wt.dbgOn() {
+		//			wt.dbg("starting ticker with %s at %s\n",
 		//				wt.tickDuration, time.Now())
 		//		}
-		wt.lastTickT = timestamp.Now()
-		wt.refTS = wt.lastTickT
-		ticker := time.NewTicker(wt.tickDuration)
-	loop:
-		for {
-			select {
-			case <-wt.cancel:
-				// DBG("canceled\n")
-				break loop
-			case _, ok := <-ticker.C:
-				if !ok {
-					break loop
+		if tickC != nil {
+			wt.externalTickLoop(tickC)
+			return
+		}
+		if wt.cfg.BusyPoll {
+			wt.busyPollLoop()
+			return
+		}
+		if !wt.cfg.PortableTicker {
+			tfd, err := newTimerFD(wt.realDuration(wt.tickDuration))
+			if err == nil {
+				if err = wt.timerFDLoop(tfd); err == nil {
+					return // shut down
 				}
-				wt.ticker()
+				// read error => fallback to the portable loop, so that
+				// the timers still run
+				wt.bug(nil, "timerfd wait failed, using the portable"+
+					" ticker: %s\n", err)
+			} else if wt.dbgOn() {
+				// not supported => fallback to the portable loop
+				wt.dbg("timerfd not available: %s\n", err)
 			}
 		}
-		ticker.Stop()
+		defer wt.hiResTicks()()
+		wt.absTickLoop()
 	}()
+	return nil
 }
 
 // Shutdown will signal all the go routines to stop and will wait for them
 // to finish.
+// Calling it again, without re-starting the timer wheel, has no effect.
 func (wt *WTimer) Shutdown() {
+	if !wt.stop() {
+		return
+	}
+	wt.wg.Wait()
+	wt.drain()
+	wt.stopped()
+}
+
+// stop signals all the go routines to stop. It returns false if the
+// timer wheel was already stopped.
+func (wt *WTimer) stop() bool {
+	if atomic.SwapUint32(&wt.runState, rsStopped) == rsStopped {
+		return false
+	}
+	if wt.shared != nil {
+		wt.shared.detach(wt)
+		wt.shared = nil
+	}
 	if wt.cancel != nil {
 		close(wt.cancel)
 	}
-	wt.wg.Wait()
+	return true
+}
+
+// requeueRQs moves the timers left in the run queues by a previous
+// ShutdownContext() or SuspendDispatch() back on the expired list, so
+// that they are re-dispatched on the next tick.
+func (wt *WTimer) requeueRQs() {
+	wt.lock()
+	for i := range wt.rQs {
+		wt.rQs[i].lock.Lock()
+		n := int64(0)
+		for lst := &wt.rQs[i].lst; !lst.isEmpty(); n++ {
+			t := lst.head.next
+			if lst.rm(wt, t) != nil || wt.expired.append(wt, t) != nil {
+				lst.forceEmpty()
+				break
+			}
+		}
+		if n != 0 {
+			wt.rqDequeued(i, n)
+		}
+		wt.rQs[i].lock.Unlock()
+	}
+	wt.unlock()
+}
+
+// stopped cleans up after stop().
+func (wt *WTimer) stopped() {
+	wt.unregister()
+	if wt.ctxCancel != nil {
+		wt.ctxCancel()
+	}
+}
+
+// externalTickLoop is the timer goroutine main loop when the ticks are
+// driven by the application (see StartWithTicker()).
+func (wt *WTimer) externalTickLoop(tickC <-chan time.Time) {
+	for {
+		select {
+		case <-wt.cancel:
+			return
+		case t, ok := <-tickC:
+			if !ok {
+				return
+			}
+			wt.tickAt(timestamp.Timestamp(t))
+		}
+	}
+}
+
+// absTickLoop is the portable timer goroutine main loop: instead of a
+// time.Ticker, which drifts relative to the timer wheel time source, it
+// sleeps until the absolute time of the next tick (refTS + n * tick, see
+// nextTickWait()), so the ticks stay in phase with the wheel time even
+// after running for a long time.
+func (wt *WTimer) absTickLoop() {
+	timer := time.NewTimer(wt.realDuration(wt.tickDuration))
+	defer timer.Stop()
+	for {
+		select {
+		case <-wt.cancel:
+			return
+		case <-timer.C:
+			wt.ticker()
+			timer.Reset(wt.nextTickWait())
+		}
+	}
+}
+
+// nextTickWait returns the real time left until the next tick time.
+// The last tick time (lastTickT) is always a whole number of ticks after
+// refTS, so the next tick is due one tick later. If late, it returns 0
+// (the missed ticks are handled by ticker()) and if the time went
+// backwards it waits at most one tick (until ticker() re-syncs).
+// It must be called only from the timer goroutine.
+func (wt *WTimer) nextTickWait() time.Duration {
+	wait := wt.lastTickT.Add(wt.tickDuration).Sub(wt.timeNow())
+	if wait <= 0 {
+		return 0
+	}
+	if wait > wt.tickDuration {
+		wait = wt.tickDuration
+	}
+	return wt.realDuration(wait)
+}
+
+// busyPollLoop is the timer goroutine main loop in busy poll mode: it
+// spins until the next tick time, without sleeping (see Config.BusyPoll).
+func (wt *WTimer) busyPollLoop() {
+	period := wt.realDuration(wt.tickDuration)
+	next := time.Now().Add(period) // monotonic clock
+	for {
+		select {
+		case <-wt.cancel:
+			return
+		default:
+		}
+		now := time.Now()
+		if now.Before(next) {
+			continue
+		}
+		wt.ticker()
+		// keep the ticks phase, skipping the missed ones (ticker()
+		// handles them)
+		for next = next.Add(period); !now.Before(next); {
+			next = next.Add(period)
+		}
+	}
+}
+
+// hiResTicks requests a system timer resolution high enough for the tick
+// duration, if needed by the OS (Windows, see beginHiResTicks()) and not
+// disabled by Config.PortableTicker. It returns a function that must be
+// called when the timer goroutine exits.
+func (wt *WTimer) hiResTicks() func() {
+	if wt.cfg.PortableTicker {
+		return func() {}
+	}
+	end, err := beginHiResTicks(wt.realDuration(wt.tickDuration))
+	if err != nil && wt.warnOn() {
+		wt.warn(nil, "failed to set the timer resolution for %s ticks: %s\n",
+			wt.tickDuration, err)
+	}
+	return end
+}
+
+// maximum sleep time in tickless mode (used if there are no timers)
+const ticklessMaxSleep = time.Minute
+
+// ticklessLoop is the timer goroutine main loop in tickless mode: it sleeps
+// until the nearest timer expire and then advances the time, running the
+// expired timers (see Config.Tickless).
+func (wt *WTimer) ticklessLoop() {
+	t := time.NewTimer(ticklessMaxSleep)
+	for {
+		wt.ticker()
+		wt.lock()
+		exp, d, ok := wt.nextExpireUnsafe()
+		if !ok {
+			d = ticklessMaxSleep
+			exp = wt.Now().Add(wt.TicksRoundUp(d))
+		}
+		if d < wt.tickDuration {
+			// expired timers still waiting to be run (or rounding) => at
+			// least 1 tick, to avoid busy looping
+			d = wt.tickDuration
+		}
+		wt.wakeAt = exp
+		atomic.StoreUint32(&wt.sleeping, 1)
+		wt.unlock()
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(wt.realDuration(d))
+		select {
+		case <-wt.cancel:
+			t.Stop()
+			return
+		case <-t.C:
+		case <-wt.wakeCh:
+		}
+		atomic.StoreUint32(&wt.sleeping, 0)
+	}
 }
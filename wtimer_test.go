@@ -1,12 +1,26 @@
 package wtimer
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/intuitivelabs/timestamp"
 	//"github.com/intuitivelabs/slog"
 )
 
@@ -19,7 +33,7 @@ func TestWTimerConsts(t *testing.T) {
 			WheelsNo)
 		os.Exit(-1)
 	}
-	if TicksBits != tbits {
+	if TicksBits != tbits && TicksBits != 64 /* ticks64 build tag */ {
 		fmt.Printf("wheels total bits size != ticks: %d != %d\n",
 			TicksBits, tbits)
 
@@ -87,7 +101,8 @@ func TestWTimerInit(t *testing.T) {
 		}
 		tsz += sz
 	}
-	if tsz != wTotalEntries || tsz != len(wt.wlists) {
+	// wlists is an array: len(wt.wlists) would be a constant (go vet)
+	if tsz != wTotalEntries || tsz != len(wt.wlists[:]) {
 		t.Errorf("WTimer: wrong total wheel entries: %d\n", tsz)
 	}
 
@@ -131,17 +146,17 @@ func TestWTimerInit(t *testing.T) {
 	}
 
 	for i := 0; i < len(wt.rQs); i++ {
-		if wt.rQs[i].head.next != wt.rQs[i].head.prev ||
-			wt.rQs[i].head.next != &wt.rQs[i].head ||
-			!wt.rQs[i].head.Detached() {
+		if wt.rQs[i].lst.head.next != wt.rQs[i].lst.head.prev ||
+			wt.rQs[i].lst.head.next != &wt.rQs[i].lst.head ||
+			!wt.rQs[i].lst.head.Detached() {
 			t.Errorf("WTimer rQs[%d]  not properly init:"+
 				" %p n: %p p:%p\n",
-				i, &wt.rQs[i].head, wt.rQs[i].head.next,
-				wt.rQs[i].head.prev)
+				i, &wt.rQs[i].lst.head, wt.rQs[i].lst.head.next,
+				wt.rQs[i].lst.head.prev)
 		}
-		wheel := wt.rQs[i].wheelNo
-		idx := wt.rQs[i].wheelIdx
-		flags := wt.rQs[i].head.info.flags()
+		wheel := wt.rQs[i].lst.wheelNo
+		idx := wt.rQs[i].lst.wheelIdx
+		flags := wt.rQs[i].lst.head.info.flags()
 		if flags&fHead == 0 || wheel != wheelRQ || int(idx) != i {
 			t.Errorf("WTimer rQs[%d]  not properly init:"+
 				" flags 0x%x wheel %d idx %d \n",
@@ -202,6 +217,8 @@ func TestWTimerStart(t *testing.T) {
 		t.Fatalf("Add  failed with %q\n", err)
 	}
 	time.Sleep(150 * time.Millisecond)
+	// wait for the handler to finish before checking its results
+	wt.Shutdown()
 	if r != 7 {
 		t.Errorf("Timer executed only %d times\n", r)
 	}
@@ -214,8 +231,6 @@ func TestWTimerStart(t *testing.T) {
 		//t.Errorf("timer delay wrong: %s\n", diff)
 	}
 	t.Logf("timer last run after %s, runs %v\n", diff, exec)
-
-	wt.Shutdown()
 }
 
 func TestWTimerRun(t *testing.T) {
@@ -236,7 +251,7 @@ func TestWTimerRun(t *testing.T) {
 
 	for i := 0; i < iterations; i++ {
 
-		delta := uint64(rand.Int63n(MaxTicksDiff))
+		delta := uint64(rand.Int63n(maxLegTicks + 1))
 		now := wt.Now()
 		expire := now.AddUint64(delta)
 		wt.InitTimer(&tl, Ffast)
@@ -439,7 +454,7 @@ func TestWTDel(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		//delta := uint64(rand.Int63n(maxDiff))
 		expire := 100 * time.Millisecond
-		runs = 0
+		atomic.StoreUint64(&runs, 0)
 		wt.InitTimer(&tl, flags)
 		err := wt.Add(&tl, expire, f, time.Duration(0))
 		if err != nil {
@@ -459,7 +474,7 @@ func TestWTDel(t *testing.T) {
 		if err := wt.Reset(&tl, flags); err != nil {
 			t.Fatalf("Reset failed %q\n", err)
 		}
-		runs = 0
+		atomic.StoreUint64(&runs, 0)
 		expire = 10 * time.Millisecond
 		err = wt.Add(&tl, expire, f, time.Duration(0))
 		if err != nil {
@@ -477,8 +492,8 @@ func TestWTDel(t *testing.T) {
 				wt.InitTimer(&tl, flags)
 			}
 		}
-		runs = 0
-		end = 0
+		atomic.StoreUint64(&runs, 0)
+		atomic.StoreUint64(&end, 0)
 		expire = 20 * time.Millisecond
 		err = wt.Add(&tl, expire, f, time.Duration(20*time.Millisecond))
 		if err != nil {
@@ -498,6 +513,8 @@ func TestWTDel(t *testing.T) {
 			t.Errorf("timer  executed after delete %d times, %d ends\n",
 				runs, end)
 		}
+		// make sure the handler returned before re-initialising the timer
+		wt.DelWait(&tl)
 	}
 	wt.Shutdown()
 }
@@ -609,6 +626,69 @@ func TestWTDelWait(t *testing.T) {
 	wt.Shutdown()
 }
 
+func TestWTDelWaitSharedRunQ(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs uint32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	fblock := func(wt *WTimer, h *TimerLnk,
+		p interface{}) (bool, time.Duration) {
+		close(started)
+		<-release
+		return false, 0
+	}
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.AddUint32(&runs, 1)
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	tls := make([]TimerLnk, 2*len(wt.rQs))
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, time.Millisecond, fblock, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	<-started
+	// the timers expiring on different ticks use the next run queue, so
+	// some of them are queued behind the blocked handler: they must not
+	// be run by another worker, the run queue must always identify its
+	// running timer (for DelWait())
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		d := time.Duration(3*i+3) * time.Millisecond
+		if err := wt.Add(&tls[i], d, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	time.Sleep(time.Duration(3*len(tls)+50) * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		wt.DelWait(&tl)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("DelWait returned while the handler was running\n")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DelWait did not return after the handler ended\n")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadUint32(&runs); n != uint32(len(tls)) {
+		t.Errorf("queued timers run %d times, expected %d\n", n, len(tls))
+	}
+	wt.Shutdown()
+}
+
 func TestWTtimersSameInt(t *testing.T) {
 	var wt WTimer
 	var runs uint64
@@ -710,3 +790,5001 @@ func TestWTtimersSameInt(t *testing.T) {
 	}
 	wt.Shutdown()
 }
+
+func TestWTDelWaitSelf(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs uint64
+	var res [2]error
+	var lock sync.Mutex
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		n := atomic.AddUint64(&runs, 1)
+		ok, err := wt.DelWait(h)
+		lock.Lock()
+		if n <= uint64(len(res)) {
+			res[n-1] = err
+		}
+		lock.Unlock()
+		if ok {
+			t.Errorf("DelWait from handler succeeded\n")
+		}
+		// try re-arming, should be ignored since DelWait marked it for delete
+		return true, Periodic
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	// fast timer, run "by hand"
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(2), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.advanceTimeTo(wt.Now().AddUint64(10))
+	if atomic.LoadUint64(&runs) != 1 || !errors.Is(res[0], ErrSelfWait) {
+		t.Errorf("fast timer: unexpected runs %d or DelWait error %v\n",
+			runs, res[0])
+	}
+	if st := tl.info.flags(); st&fRemoved == 0 {
+		t.Errorf("fast timer not removed after DelWait: flags 0x%x\n", st)
+	}
+
+	// normal timer, run from the runq workers
+	wt.Start()
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, 5*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	if atomic.LoadUint64(&runs) != 2 || !errors.Is(res[1], ErrSelfWait) {
+		t.Errorf("runq timer: unexpected runs %d or DelWait error %v\n",
+			runs, res[1])
+	}
+	lock.Unlock()
+	wt.Shutdown()
+}
+
+func TestWTAddSelf(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs uint64
+	var exp [3]Ticks
+
+	f2 := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		n := atomic.AddUint64(&runs, 1)
+		exp[n-1] = wt.Now()
+		if p.(int) != 2 {
+			t.Errorf("wrong re-armed handler parameter %v\n", p)
+		}
+		return false, 0
+	}
+	f1 := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		n := atomic.AddUint64(&runs, 1)
+		exp[n-1] = wt.Now()
+		if err := wt.Reset(h, Ffast); err != nil {
+			t.Errorf("Reset from handler failed: %s\n", err)
+		}
+		if err := wt.AddT(h, NewTicks(5), f2, 2); err != nil {
+			t.Errorf("Add from handler failed: %s\n", err)
+		}
+		// the returned interval should be ignored
+		return true, Periodic
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// re-adding uses the real time elapsed since refTS => init it like
+	// Start() would do
+	wt.refTS = timestamp.Now()
+	wt.refTicks = start
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, start.AddUint64(2), f1, 1); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// Add on an active timer outside the handler must still fail
+	if err := wt.Add(&tl, time.Millisecond, f1, 1); !errors.Is(err, ErrActiveTimer) {
+		t.Errorf("unexpected Add on active timer result: %v\n", err)
+	}
+	wt.advanceTimeTo(start.AddUint64(100))
+	if atomic.LoadUint64(&runs) != 2 {
+		t.Fatalf("unexpected runs %d\n", runs)
+	}
+	if !exp[0].EQ(start.AddUint64(2)) {
+		t.Errorf("wrong 1st expire: %s instead of %s\n",
+			exp[0].Sub(start), NewTicks(2))
+	}
+	// the re-add interval is computed using the real time elapsed since
+	// refTS (and not the "fake" advanced ticks) => it's relative to start
+	if d := exp[1].Sub(start); d.Val() < 5 || d.Val() > 10 {
+		t.Errorf("wrong re-arm interval: %d ticks\n", d.Val())
+	}
+}
+
+func TestWTState(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var st TimerState
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		st = h.State()
+		return true, Periodic
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if s := tl.State(); s.Active || s.Armed || !s.CanReset() {
+		t.Errorf("unexpected init timer state: %+v\n", s)
+	}
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(3), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if s := tl.State(); !s.Active || !s.Armed || s.Wheel != 0 ||
+		s.Running || s.CanReset() || s.Flags != Ffast || !tl.IsActive() {
+		t.Errorf("unexpected armed timer state: %+v\n", s)
+	}
+	wt.advanceTimeTo(wt.Now().AddUint64(3))
+	if !st.Running || st.Armed || !st.Active {
+		t.Errorf("unexpected running timer state: %+v\n", st)
+	}
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Fatalf("Del failed: %v %v\n", ok, err)
+	}
+	if s := tl.State(); !s.Removed || s.Armed || s.Running ||
+		!s.CanReset() || tl.IsActive() || tl.IsRunning() {
+		t.Errorf("unexpected removed timer state: %+v\n", s)
+	}
+}
+
+func TestWTDelGen(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	gen1 := tl.Gen()
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if ok, err := wt.DelGen(&tl, gen1); !ok || err != nil {
+		t.Fatalf("DelGen failed: %v %v\n", ok, err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	gen2 := tl.Gen()
+	if gen2 == gen1 {
+		t.Fatalf("generation not increased by InitTimer: %d\n", gen2)
+	}
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if ok, err := wt.DelGen(&tl, gen1); !ok || !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("DelGen with stale gen: unexpected %v %v\n", ok, err)
+	}
+	if ok, err := wt.DelWaitGen(&tl, gen1); !ok || !errors.Is(err, ErrStaleHandle) {
+		t.Errorf("DelWaitGen with stale gen: unexpected %v %v\n", ok, err)
+	}
+	if !tl.IsActive() {
+		t.Errorf("timer removed by a stale DelGen\n")
+	}
+	if ok, err := wt.DelTryGen(&tl, gen2); !ok || err != nil {
+		t.Errorf("DelTryGen failed: %v %v\n", ok, err)
+	}
+}
+
+func TestWTDelGenInitRace(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var wg sync.WaitGroup
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, 0)
+	stale := tl.Gen()
+	wt.InitTimer(&tl, 0)
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// a stale handle used while the timer is re-initialised
+			if ok, err := wt.DelGen(&tl, stale); !ok ||
+				!errors.Is(err, ErrStaleHandle) {
+				t.Errorf("DelGen with stale gen: unexpected %v %v\n",
+					ok, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		if err := wt.InitTimer(&tl, 0); err != nil {
+			t.Errorf("InitTimer failed: %s\n", err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if g := tl.Gen(); g != stale+10001 {
+		t.Errorf("unexpected generation %d, expected %d\n", g, stale+10001)
+	}
+}
+
+func TestWTAddResetGen(t *testing.T) {
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	for _, addQ := range []bool{false, true} {
+		var wt WTimer
+		var tl TimerLnk
+
+		cfg := Config{AddQueue: addQ}
+		if err := wt.InitCfg(time.Millisecond*1, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		wt.InitTimer(&tl, 0)
+		gen1 := tl.Gen()
+		if err := wt.AddGen(&tl, time.Second, f, nil, gen1); err != nil {
+			t.Fatalf("AddGen failed with %q (add queue %v)\n", err, addQ)
+		}
+		// a queued timer is removed only on the next tick => wait for it
+		if ok, err := wt.DelWaitGen(&tl, gen1); !ok || err != nil {
+			t.Fatalf("DelWaitGen failed: %v %v\n", ok, err)
+		}
+		if err := wt.ResetGen(&tl, Ffast, gen1); err != nil {
+			t.Errorf("ResetGen failed with %q (add queue %v)\n", err, addQ)
+		}
+		wt.InitTimer(&tl, 0)
+		gen2 := tl.Gen()
+		if err := wt.AddGen(&tl, time.Second, f, nil, gen1); !errors.Is(err,
+			ErrStaleHandle) {
+			t.Errorf("AddGen with stale gen: unexpected %v (add queue %v)\n",
+				err, addQ)
+		}
+		if tl.IsActive() {
+			t.Errorf("timer added by a stale AddGen\n")
+		}
+		if err := wt.ResetGen(&tl, Ffast, gen1); !errors.Is(err,
+			ErrStaleHandle) {
+			t.Errorf("ResetGen with stale gen: unexpected %v\n", err)
+		}
+		if tl.info.flags()&Ffast != 0 {
+			t.Errorf("timer flags changed by a stale ResetGen\n")
+		}
+		if err := wt.AddGen(&tl, time.Second, f, nil, gen2); err != nil {
+			t.Errorf("AddGen failed with %q (add queue %v)\n", err, addQ)
+		}
+		if ok, err := wt.DelWaitGen(&tl, gen2); !ok || err != nil {
+			t.Errorf("DelWaitGen failed: %v %v\n", ok, err)
+		}
+		wt.Shutdown()
+	}
+}
+
+func TestWTTimerError(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	expire := wt.Now().AddUint64(10)
+	if err := wt.AddExpire(&tl, expire, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	err := wt.AddExpire(&tl, expire, f, nil)
+	if !errors.Is(err, ErrActiveTimer) {
+		t.Fatalf("unexpected AddExpire error %v\n", err)
+	}
+	var terr *TimerError
+	if !errors.As(err, &terr) {
+		t.Fatalf("unexpected error type %T\n", err)
+	}
+	flags, w, idx := tl.info.getAll()
+	if terr.Op != "AddExpire" || terr.T != &tl || terr.Flags != flags ||
+		terr.Wheel != w || terr.Idx != idx || terr.Expire != expire {
+		t.Errorf("wrong TimerError state: %+v\n", *terr)
+	}
+	if ok, err := wt.Del(&tl); !ok || err != nil {
+		t.Fatalf("Del failed: %v %v\n", ok, err)
+	}
+	_, err = wt.Del(&tl)
+	if !errors.Is(err, ErrAlreadyRemovedTimer) || !errors.As(err, &terr) ||
+		terr.Op != "Del" {
+		t.Errorf("unexpected Del error %v\n", err)
+	}
+}
+
+func TestWTDump(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var buf bytes.Buffer
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{W0Entries + 3, 20, 10}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if err := wt.Dump(&buf); err != nil {
+		t.Fatalf("Dump failed: %s\n", err)
+	}
+	out := buf.String()
+	for _, s := range []string{"wheel 0: 2 timers in 2 lists\n",
+		"wheel 1: 1 timers in 1 lists\n", "expired: 0 timers\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q not found in dump:\n%s\n", s, out)
+		}
+	}
+	// nearest expirations should be sorted
+	near := out[strings.Index(out, "nearest expirations:"):]
+	p2 := strings.Index(near, fmt.Sprintf("%p", &tls[2]))
+	p1 := strings.Index(near, fmt.Sprintf("%p", &tls[1]))
+	p0 := strings.Index(near, fmt.Sprintf("%p", &tls[0]))
+	if p2 < 0 || p1 < p2 || p0 < p1 {
+		t.Errorf("wrong nearest expirations order:\n%s\n", out)
+	}
+}
+
+func TestWTDebugHandler(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{W0Entries + 3, 20, 10}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	h := wt.DebugHandler()
+	tests := []struct {
+		query string
+		found []int // tls indexes expected in the output
+	}{
+		{"", []int{0, 1, 2}},
+		{"?wheel=1", []int{0}},
+		{"?min=15ms&max=1s", []int{1}},
+		{"?limit=1", []int{2}},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/wtimer"+tc.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: unexpected status %d\n", tc.query, rec.Code)
+			continue
+		}
+		out := rec.Body.String()
+		n := 0
+		for i := range tls {
+			if strings.Contains(out, fmt.Sprintf("%p", &tls[i])) {
+				n++
+			}
+		}
+		if n != len(tc.found) {
+			t.Errorf("%q: unexpected number of timers %d:\n%s\n",
+				tc.query, n, out)
+		}
+		for _, i := range tc.found {
+			if !strings.Contains(out, fmt.Sprintf("%p", &tls[i])) {
+				t.Errorf("%q: timer %d not found:\n%s\n", tc.query, i, out)
+			}
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/wtimer?wheel=9", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid wheel: unexpected status %d\n", rec.Code)
+	}
+}
+
+func TestWTFindLeaks(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return true, Periodic
+	}
+
+	cfg := Config{TrackAddSite: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{10, 100, 100000}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if l := wt.FindLeaks(time.Second, 5); len(l) != 0 {
+		t.Errorf("unexpected leaks found: %v\n", l)
+	}
+	// 250 ticks (ms) => tls[0] re-armed 25 times, tls[1] 2 times
+	wt.advanceTimeTo(wt.Now().AddUint64(250))
+	l := wt.FindLeaks(0, 5)
+	if len(l) != 1 || l[0].T != &tls[0] ||
+		l[0].Age != 250*time.Millisecond {
+		t.Fatalf("unexpected leaks found: %v\n", l)
+	}
+	if !strings.Contains(l[0].Site, "wtimer_test.go") ||
+		!strings.Contains(l[0].Site, "TestWTFindLeaks") {
+		t.Errorf("wrong add site: %q\n", l[0].Site)
+	}
+	if l := wt.FindLeaks(200*time.Millisecond, 0); len(l) != len(tls) {
+		t.Errorf("unexpected leaks found: %v\n", l)
+	}
+}
+
+func TestWTLen(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return p.(bool), Periodic
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		// even timers are periodic
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(10*uint64(i+1)),
+			f, i%2 == 0)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if n := wt.Len(); n != len(tls) {
+		t.Errorf("wrong Len() after add: %d\n", n)
+	}
+	// tls[0] periodic, tls[1] one shot run
+	wt.advanceTimeTo(wt.Now().AddUint64(25))
+	if n := wt.Len(); n != len(tls)-1 {
+		t.Errorf("wrong Len() after run: %d\n", n)
+	}
+	if ok, err := wt.Del(&tls[2]); !ok || err != nil {
+		t.Fatalf("Del failed: %v %v\n", ok, err)
+	}
+	if n := wt.Len(); n != len(tls)-2 {
+		t.Errorf("wrong Len() after Del: %d\n", n)
+	}
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("wrong Len() after re-init: %d\n", n)
+	}
+}
+
+func TestWTOccupancy(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{10, 10, 20, W0Entries + 3}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	s := wt.Occupancy(true)
+	w0, w1 := &s.Wheels[0], &s.Wheels[1]
+	if w0.Timers != 3 || w0.Lists != 2 || w0.MaxList != 2 ||
+		w0.Buckets[10] != 2 || w0.Buckets[20] != 1 ||
+		w1.Timers != 1 || w1.Lists != 1 || w1.Cascaded != 0 {
+		t.Errorf("unexpected stats: %+v %+v\n", *w0, *w1)
+	}
+	wt.advanceTimeTo(wt.Now().AddUint64(W0Entries))
+	s = wt.Occupancy(false)
+	w0, w1 = &s.Wheels[0], &s.Wheels[1]
+	if w0.Timers != 1 || w0.Buckets != nil || w1.Timers != 0 ||
+		w1.Cascaded != 1 {
+		t.Errorf("unexpected stats after run: %+v %+v\n", *w0, *w1)
+	}
+}
+
+func TestWTNextExpire(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if _, _, ok := wt.NextExpire(); ok {
+		t.Errorf("NextExpire succeeded without timers\n")
+	}
+	start := wt.Now()
+	// the timers are added in reverse expire order
+	deltas := [len(tls)]uint64{W0Entries*3 + 5, W0Entries + 3,
+		W0Entries - 10, 100}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], start.AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		exp, d, ok := wt.NextExpire()
+		if !ok || exp != start.AddUint64(deltas[i]) ||
+			d != wt.Duration(NewTicks(deltas[i])) {
+			t.Errorf("wrong next expire after add %d: %v %s %s\n",
+				i, ok, exp, d)
+		}
+	}
+	// remove the nearest timer => re-computed
+	for i := len(tls) - 1; i > 0; i-- {
+		if ok, err := wt.Del(&tls[i]); !ok || err != nil {
+			t.Fatalf("Del failed: %v %v\n", ok, err)
+		}
+		exp, _, ok := wt.NextExpire()
+		if !ok || exp != start.AddUint64(deltas[i-1]) {
+			t.Errorf("wrong next expire after del %d: %v %s\n", i, ok, exp)
+		}
+	}
+	// timer 0 is on wheel 1, force a cascade
+	wt.advanceTimeTo(start.AddUint64(W0Entries * 3))
+	exp, d, ok := wt.NextExpire()
+	if !ok || exp != start.AddUint64(deltas[0]) || d != 5*time.Millisecond {
+		t.Errorf("wrong next expire after advancing time: %v %s %s\n",
+			ok, exp, d)
+	}
+	wt.advanceTimeTo(start.AddUint64(deltas[0]))
+	if _, _, ok := wt.NextExpire(); ok {
+		t.Errorf("NextExpire succeeded after all timers expired\n")
+	}
+}
+
+// the cached nearest expire and the catch-up target must keep all the
+// Ticks bits (including bit 63 with the ticks64 build tag)
+func TestWTNextExpTopBit(t *testing.T) {
+	var wt WTimer
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	for _, v := range []uint64{0, 1, MaxTicksDiff - 1, MaxTicksDiff,
+		MaxTicksDiff + 1, TicksMask - 1, TicksMask} {
+		exp := NewTicks(v)
+		wt.setNextExp(exp, true)
+		next, ok := wt.cachedNextExp()
+		if v == nextExpNone {
+			// cannot be cached (ticks64 only)
+			if ok {
+				t.Errorf("nextExpNone cached as valid\n")
+			}
+		} else if !ok || next != exp {
+			t.Errorf("wrong cached nearest expire for %#x: %s %v\n",
+				v, next, ok)
+		}
+		if v != nextExpNone {
+			wt.nextExpAdded(exp.AddUint64(1))
+			if next, ok = wt.cachedNextExp(); !ok || next != exp {
+				t.Errorf("cached nearest expire %s changed to %s %v\n",
+					exp, next, ok)
+			}
+			wt.nextExpAdded(exp.SubUint64(1))
+			if next, ok = wt.cachedNextExp(); exp.SubUint64(1).Val() !=
+				nextExpNone && (!ok || next != exp.SubUint64(1)) {
+				t.Errorf("cached nearest expire %s not updated: %s %v\n",
+					exp.SubUint64(1), next, ok)
+			}
+		}
+		wt.setNextExp(exp, false)
+		if _, ok = wt.cachedNextExp(); ok {
+			t.Errorf("invalid cached nearest expire for %#x\n", v)
+		}
+		atomic.StoreUint64(&wt.catchUp, v)
+		atomic.StoreUint32(&wt.catchingUp, 1)
+		if target, ok := wt.catchUpTarget(); !ok || target != exp {
+			t.Errorf("wrong catch-up target for %#x: %s %v\n",
+				v, target, ok)
+		}
+		atomic.StoreUint32(&wt.catchingUp, 0)
+		if _, ok := wt.catchUpTarget(); ok {
+			t.Errorf("catching up after the end for %#x\n", v)
+		}
+	}
+}
+
+func TestWTTickless(t *testing.T) {
+	var wt WTimer
+	var far, near TimerLnk
+	var runs uint64
+	var runT atomic.Value
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runT.Store(time.Now())
+		atomic.AddUint64(&runs, 1)
+		return false, 0
+	}
+
+	cfg := Config{Tickless: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&far, 0)
+	if err := wt.Add(&far, time.Hour, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	// the timer goroutine sleeps until far expires => it must be woken up
+	wt.InitTimer(&near, Ffast)
+	start := time.Now()
+	if err := wt.Add(&near, 50*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	for i := 0; i < 100 && atomic.LoadUint64(&runs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&runs) != 1 {
+		t.Fatalf("near timer did not run\n")
+	}
+	d := runT.Load().(time.Time).Sub(start)
+	if d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("near timer run after %s instead of 50ms\n", d)
+	}
+	if ok, err := wt.Del(&far); !ok || err != nil {
+		t.Errorf("Del failed: %v %v\n", ok, err)
+	}
+}
+
+func TestWTCascadeBudget(t *testing.T) {
+	var wt WTimer
+	var tls [10]TimerLnk
+	var runs [len(tls)]Ticks
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs[p.(int)] = wt.Now()
+		return false, 0
+	}
+
+	cfg := Config{CascadeBudget: 3}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		// all on the same wheel 1 list
+		exp := start.AddUint64(W0Entries + uint64(i))
+		if err := wt.AddExpire(&tls[i], exp, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.advanceTimeTo(start.AddUint64(W0Entries + uint64(len(tls))))
+	for i := range tls {
+		if runs[i] != start.AddUint64(W0Entries+uint64(i)) {
+			t.Errorf("timer %d run at %s instead of %d\n",
+				i, runs[i], W0Entries+i)
+		}
+	}
+	if r := wt.CheckConsistency(); !r.OK() {
+		t.Errorf("inconsistent timers: %s\n", r)
+	}
+}
+
+func TestWTRunBudget(t *testing.T) {
+	var wt WTimer
+	var tls [10]TimerLnk
+	var runs [len(tls)]Ticks
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs[p.(int)] = wt.Now()
+		return false, 0
+	}
+
+	cfg := Config{RunBudget: 4}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		// 8 timers expiring at the same time, the last 2 1 tick later
+		exp := start.AddUint64(10)
+		if i >= 8 {
+			exp = exp.AddUint64(1)
+		}
+		if err := wt.AddExpire(&tls[i], exp, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.advanceTimeTo(start.AddUint64(20))
+	// tick 10: 0-3, tick 11: 4-7, tick 12: 8, 9
+	for i := range tls {
+		if exp := start.AddUint64(10 + uint64(i/4)); runs[i] != exp {
+			t.Errorf("timer %d run at %s instead of %s\n", i, runs[i], exp)
+		}
+	}
+}
+
+func TestWTAddQueue(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+	var runs [len(tls)]int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs[p.(int)]++
+		return false, 0
+	}
+
+	cfg := Config{AddQueue: true}
+	if err := wt.InitCfg(time.Millisecond*10, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// adding uses the real time elapsed since refTS => init it like
+	// Start() would do
+	wt.refTS = timestamp.Now()
+	wt.refTicks = start
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		if err := wt.Add(&tls[i], 50*time.Millisecond, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if st := tls[i].State(); !st.Active || !st.Armed {
+			t.Errorf("wrong queued timer %d state: %+v\n", i, st)
+		}
+	}
+	if n := wt.Len(); n != len(tls) {
+		t.Errorf("wrong Len() for queued timers: %d\n", n)
+	}
+	if next, d, ok := wt.NextExpire(); !ok || d != 0 || next != start {
+		t.Errorf("wrong NextExpire() for queued timers: %s %s %v\n",
+			next, d, ok)
+	}
+	// queued timers cannot be removed before the next tick
+	if ok, err := wt.Del(&tls[1]); ok || err != nil {
+		t.Errorf("unexpected Del on queued timer result: %v %v\n", ok, err)
+	}
+	wt.advanceTimeTo(start.AddUint64(1))
+	if st := tls[0].State(); !st.Armed || st.Wheel != 0 {
+		t.Errorf("wrong timer state after the queue drain: %+v\n", st)
+	}
+	if !tls[1].State().Removed {
+		t.Errorf("deleted timer not removed: %+v\n", tls[1].State())
+	}
+	if n := wt.Len(); n != 1 {
+		t.Errorf("wrong Len() after the queue drain: %d\n", n)
+	}
+	if r := wt.CheckConsistency(); !r.OK() {
+		t.Errorf("inconsistent timers after the queue drain: %s\n", r)
+	}
+	wt.advanceTimeTo(start.AddUint64(20))
+	if runs[0] != 1 || runs[1] != 0 {
+		t.Errorf("unexpected runs: %v\n", runs)
+	}
+}
+
+func TestWTDelWaitAddQueue(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		t.Errorf("deleted timer handler called\n")
+		return false, 0
+	}
+
+	// in simulation there is no next tick unless RunTicks() is called
+	cfg := Config{AddQueue: true, Simulation: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 10*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if w, _ := tl.info.wheelPos(); w != wheelAddQ {
+		t.Fatalf("timer not queued: wheel %d\n", w)
+	}
+	done := make(chan struct{})
+	go func() {
+		if ok, err := wt.DelWait(&tl); !ok || err != nil {
+			t.Errorf("unexpected DelWait on queued timer result: %v %v\n",
+				ok, err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DelWait on queued timer timeout\n")
+	}
+	if !tl.State().Removed {
+		t.Errorf("deleted timer not removed: %+v\n", tl.State())
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("wrong Len() after DelWait: %d\n", n)
+	}
+	if r := wt.CheckConsistency(); !r.OK() {
+		t.Errorf("inconsistent timers after DelWait: %s\n", r)
+	}
+	wt.RunTicks(20)
+}
+
+func TestWTDelLazy(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var runs [len(tls)]int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs[p.(int)]++
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// tls[0] on wheel 0, tls[1] & tls[2] on wheel 1
+	exps := [len(tls)]Ticks{start.AddUint64(10),
+		start.AddUint64(W0Entries + 10), start.AddUint64(W0Entries + 20)}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		if err := wt.AddExpire(&tls[i], exps[i], f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if ok, err := wt.DelLazy(&tls[i]); ok || err != nil {
+			t.Errorf("unexpected DelLazy result: %v %v\n", ok, err)
+		}
+		if st := tls[i].State(); !st.DelPending || !st.Armed || !st.Active {
+			t.Errorf("wrong lazily deleted timer %d state: %+v\n", i, st)
+		}
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("wrong Len() after DelLazy: %d\n", n)
+	}
+	if r := wt.CheckConsistency(); !r.OK() || r.Deleted != len(tls) {
+		t.Errorf("wrong consistency report after DelLazy: %s\n", r)
+	}
+	// DelWait() removes immediately
+	if ok, err := wt.DelWait(&tls[2]); !ok || err != nil {
+		t.Errorf("unexpected DelWait result: %v %v\n", ok, err)
+	}
+	// removed on expire
+	wt.advanceTimeTo(start.AddUint64(20))
+	if !tls[0].State().Removed || tls[0].IsActive() {
+		t.Errorf("timer not removed on expire: %+v\n", tls[0].State())
+	}
+	// removed when cascading
+	wt.advanceTimeTo(start.AddUint64(W0Entries))
+	if st := tls[1].State(); !st.Removed || st.Armed {
+		t.Errorf("timer not removed on cascade: %+v\n", st)
+	}
+	wt.advanceTimeTo(start.AddUint64(W0Entries + 30))
+	if runs != [len(tls)]int{} {
+		t.Errorf("lazily deleted timers run: %v\n", runs)
+	}
+	if r := wt.CheckConsistency(); !r.OK() || r.Timers != 0 {
+		t.Errorf("wrong consistency report: %s\n", r)
+	}
+}
+
+// BenchmarkWTRunQueues measures the time needed for dispatching expired
+// timers to the run queues and running them (run queues workers contention).
+func BenchmarkWTRunQueues(b *testing.B) {
+	var wt WTimer
+	var n int64
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.AddInt64(&n, 1)
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		b.Fatalf("WTimer init failure: %s\n", err)
+	}
+	tls := make([]TimerLnk, b.N)
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+	}
+	start := wt.Now()
+	// only the run queues workers, the time is advanced "by hand"
+	wt.cancel = make(chan struct{})
+	wt.startRQ()
+	b.ResetTimer()
+	for i := range tls {
+		// spread the timers over 100 ticks
+		exp := start.AddUint64(uint64(i%100) + 1)
+		if err := wt.AddExpire(&tls[i], exp, f, nil); err != nil {
+			b.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.advanceTimeTo(start.AddUint64(101))
+	for atomic.LoadInt64(&n) != int64(b.N) {
+		runtime.Gosched()
+	}
+	b.StopTimer()
+	wt.Shutdown()
+}
+
+// BenchmarkWTAddDelParallel measures Add() & Del() performance when used
+// in parallel on different timers.
+func BenchmarkWTAddDelParallel(b *testing.B) {
+	var wt WTimer
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		b.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	b.RunParallel(func(pb *testing.PB) {
+		var tl TimerLnk
+		i := 0
+		for pb.Next() {
+			wt.InitTimer(&tl, 0)
+			d := time.Duration(i%1000+1000) * time.Millisecond
+			if err := wt.Add(&tl, d, f, nil); err != nil {
+				b.Errorf("Add  failed with %q\n", err)
+				return
+			}
+			if ok, err := wt.Del(&tl); !ok || err != nil {
+				b.Errorf("Del failed: %v %v\n", ok, err)
+				return
+			}
+			i++
+		}
+	})
+	wt.Shutdown()
+}
+
+func TestWTGoRPool(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs uint64
+	var gids [20]uint64
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		n := atomic.LoadUint64(&runs)
+		gids[n] = goID()
+		atomic.StoreUint64(&runs, n+1)
+		return n+1 < uint64(len(gids)), Periodic
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, FgoR)
+	if err := wt.Add(&tl, 2*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	for i := 0; i < 500 && atomic.LoadUint64(&runs) < uint64(len(gids)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&runs); n != uint64(len(gids)) {
+		t.Fatalf("FgoR timer run %d times instead of %d\n", n, len(gids))
+	}
+	// the goroutines running the handler should be re-used
+	distinct := map[uint64]bool{}
+	for _, g := range gids {
+		distinct[g] = true
+	}
+	if len(distinct) > len(gids)/2 {
+		t.Errorf("FgoR handler run by %d different goroutines in %d runs\n",
+			len(distinct), len(gids))
+	}
+}
+
+func TestWTPriority(t *testing.T) {
+	var wt WTimer
+	var tls [6]TimerLnk
+	prios := [len(tls)]Priority{PrioLow, PrioLow, PrioNormal, PrioNormal,
+		PrioHigh, PrioHigh}
+	order := make(chan Priority, len(tls))
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		order <- p.(Priority)
+		return false, 0
+	}
+
+	// a single worker, running all the priorities
+	cfg := Config{RunQueues: [PrioNo]RunQueueCfg{
+		PrioNormal: {Queues: 1, Workers: 0},
+		PrioHigh:   {Queues: 1, Workers: 0},
+		PrioLow:    {Queues: 1, Workers: 1},
+	}}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if err := wt.SetPriority(&tls[0], PrioNo); err == nil {
+		t.Errorf("SetPriority with invalid priority succeeded\n")
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if err := wt.SetPriority(&tls[i], prios[i]); err != nil {
+			t.Fatalf("SetPriority failed with %q\n", err)
+		}
+		// all expire on the same tick, lowest priorities added first
+		if err := wt.AddExpire(&tls[i], start.AddUint64(1), f,
+			prios[i]); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if err := wt.SetPriority(&tls[0], PrioHigh); err == nil {
+		t.Errorf("SetPriority on active timer succeeded\n")
+	}
+	// only the run queues workers, the time is advanced "by hand"
+	wt.cancel = make(chan struct{})
+	wt.startRQ()
+	defer wt.Shutdown()
+	wt.advanceTimeTo(start.AddUint64(1))
+	rank := map[Priority]int{PrioHigh: 0, PrioNormal: 1, PrioLow: 2}
+	last := PrioHigh
+	for i := range tls {
+		select {
+		case p := <-order:
+			if rank[p] < rank[last] {
+				t.Errorf("timer %d: priority %s run after %s\n", i, p, last)
+			}
+			last = p
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for timer %d\n", i)
+		}
+	}
+}
+
+func TestWTRunClass(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	block := make(chan struct{})
+	blocked := make(chan int, len(tls))
+	done := make(chan int, len(tls))
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		if i := p.(int); i < 2 {
+			blocked <- i
+			<-block
+		}
+		done <- p.(int)
+		return false, 0
+	}
+
+	// 2 workers for all the priorities and a dedicated class
+	cfg := Config{
+		RunQueues: [PrioNo]RunQueueCfg{
+			PrioNormal: {Queues: 1, Workers: 1},
+			PrioHigh:   {Queues: 2, Workers: 0},
+			PrioLow:    {Queues: 1, Workers: 1},
+		},
+		RunClasses: []RunClassCfg{{Name: "isolated", Queues: 1, Workers: 1}},
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if err := wt.SetRunClass(&tls[0], "unknown"); err == nil {
+		t.Errorf("SetRunClass with unknown class succeeded\n")
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if i == 2 {
+			if err := wt.SetRunClass(&tls[i], "isolated"); err != nil {
+				t.Fatalf("SetRunClass failed with %q\n", err)
+			}
+		} else if err := wt.SetPriority(&tls[i], PrioHigh); err != nil {
+			t.Fatalf("SetPriority failed with %q\n", err)
+		}
+		if err := wt.AddExpire(&tls[i], start.AddUint64(1), f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// only the run queues workers, the time is advanced "by hand"
+	wt.cancel = make(chan struct{})
+	wt.startRQ()
+	var unblock sync.Once
+	defer func() {
+		unblock.Do(func() { close(block) })
+		wt.Shutdown()
+	}()
+	wt.advanceTimeTo(start.AddUint64(1))
+	// all the priorities workers are blocked, the isolated class timer
+	// must still run
+	for i := 0; i < 2; i++ {
+		select {
+		case <-blocked:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the blocking timers\n")
+		}
+	}
+	select {
+	case i := <-done:
+		if i != 2 {
+			t.Errorf("unexpected timer %d run\n", i)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("isolated class timer delayed by the other workers\n")
+	}
+	unblock.Do(func() { close(block) })
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the unblocked timers\n")
+		}
+	}
+}
+
+func TestWTRunBatch(t *testing.T) {
+	var wt WTimer
+	var low [3]TimerLnk
+	var high TimerLnk
+	block := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	order := make(chan string, len(low)+1)
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		if p.(string) == "L0" {
+			blocked <- struct{}{}
+			<-block
+		}
+		order <- p.(string)
+		return false, 0
+	}
+
+	// a single worker and queue for each priority
+	cfg := Config{
+		RunQueues: [PrioNo]RunQueueCfg{
+			PrioNormal: {Queues: 1, Workers: 0},
+			PrioHigh:   {Queues: 1, Workers: 0},
+			PrioLow:    {Queues: 1, Workers: 1},
+		},
+		RunBatch: 1,
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	for i := range low {
+		wt.InitTimer(&low[i], 0)
+		wt.SetPriority(&low[i], PrioLow)
+		if err := wt.AddExpire(&low[i], start.AddUint64(1), f,
+			fmt.Sprintf("L%d", i)); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.InitTimer(&high, 0)
+	wt.SetPriority(&high, PrioHigh)
+	if err := wt.AddExpire(&high, start.AddUint64(2), f, "H"); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// only the run queues workers, the time is advanced "by hand"
+	wt.cancel = make(chan struct{})
+	wt.startRQ()
+	var unblock sync.Once
+	defer func() {
+		unblock.Do(func() { close(block) })
+		wt.Shutdown()
+	}()
+	wt.advanceTimeTo(start.AddUint64(1))
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for the first low priority timer\n")
+	}
+	// queue the high priority timer while the low queue is not empty
+	wt.advanceTimeTo(start.AddUint64(2))
+	unblock.Do(func() { close(block) })
+	var res []string
+	for i := 0; i < len(low)+1; i++ {
+		select {
+		case s := <-order:
+			res = append(res, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for timer %d (run %v)\n", i, res)
+		}
+	}
+	// the high priority timer must run after the first batch
+	if strings.Join(res, " ") != "L0 H L1 L2" {
+		t.Errorf("unexpected run order: %v\n", res)
+	}
+}
+
+func TestWTRunQueueMax(t *testing.T) {
+	for _, pol := range []OverloadPolicy{OverloadBlock, OverloadDrop,
+		OverloadGoR} {
+		t.Run(pol.String(), func(t *testing.T) { testRunQueueMax(t, pol) })
+	}
+}
+
+func testRunQueueMax(t *testing.T, pol OverloadPolicy) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	block := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	done := make(chan int, len(tls))
+	dropped := make(chan *TimerLnk, len(tls))
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		if p.(int) == 0 {
+			blocked <- struct{}{}
+			<-block
+		}
+		done <- p.(int)
+		return false, 0
+	}
+
+	// a single worker, with room for only 1 waiting handler
+	cfg := Config{
+		RunQueues: [PrioNo]RunQueueCfg{
+			PrioNormal: {Queues: 1, Workers: 0},
+			PrioHigh:   {Queues: 1, Workers: 0},
+			PrioLow:    {Queues: 1, Workers: 1},
+		},
+		RunQueueMax:    1,
+		RunQueuePolicy: pol,
+		DropF: func(wt *WTimer, tl *TimerLnk) {
+			dropped <- tl
+		},
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		exp := start.AddUint64(2)
+		if i == 0 {
+			exp = start.AddUint64(1)
+		}
+		if err := wt.AddExpire(&tls[i], exp, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// only the run queues workers, the time is advanced "by hand"
+	wt.cancel = make(chan struct{})
+	wt.startRQ()
+	var unblock sync.Once
+	defer func() {
+		unblock.Do(func() { close(block) })
+		wt.Shutdown()
+	}()
+	wt.advanceTimeTo(start.AddUint64(1))
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for the blocking timer\n")
+	}
+	// the worker is busy: timer 1 is queued and timer 2 overflows
+	advanced := make(chan struct{})
+	go func() {
+		wt.advanceTimeTo(start.AddUint64(2))
+		close(advanced)
+	}()
+	switch pol {
+	case OverloadBlock:
+		select {
+		case <-advanced:
+			t.Fatalf("timer goroutine not blocked\n")
+		case <-time.After(50 * time.Millisecond):
+		}
+	case OverloadDrop:
+		select {
+		case tl := <-dropped:
+			if tl != &tls[2] || !tl.State().Removed {
+				t.Errorf("wrong dropped timer %p (%p): %+v\n",
+					tl, &tls[2], tl.State())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the dropped timer\n")
+		}
+	case OverloadGoR:
+		select {
+		case i := <-done:
+			if i != 2 {
+				t.Errorf("unexpected timer %d run\n", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the spilled timer\n")
+		}
+	}
+	unblock.Do(func() { close(block) })
+	select {
+	case <-advanced:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timer goroutine still blocked\n")
+	}
+	// wait for the rest of the timers (the spilled one already run)
+	n := 2
+	if pol == OverloadBlock {
+		n = 3
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the queued timers\n")
+		}
+	}
+	s := wt.RunQueueStats()
+	if s.MaxDepth != 1 || s.Depth != 0 ||
+		(pol == OverloadBlock && s.Blocked == 0) ||
+		(pol == OverloadDrop && s.Dropped != 1) ||
+		(pol == OverloadGoR && s.Spilled != 1) {
+		t.Errorf("unexpected run queue stats: %+v\n", s)
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("unexpected pending timers: %d\n", n)
+	}
+}
+
+func TestWTMaxTimers(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	cfg := Config{MaxTimers: 2}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		err := wt.AddExpire(&tls[i], start.AddUint64(10), f, nil)
+		if i < cfg.MaxTimers && err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		} else if i >= cfg.MaxTimers && !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("unexpected Add over quota result: %v\n", err)
+		}
+	}
+	if tls[2].State().Active {
+		t.Errorf("timer over quota is active: %+v\n", tls[2].State())
+	}
+	if ok, err := wt.Del(&tls[0]); !ok || err != nil {
+		t.Fatalf("Del failed: %v %v\n", ok, err)
+	}
+	if err := wt.AddExpire(&tls[2], start.AddUint64(10), f, nil); err != nil {
+		t.Errorf("Add after Del failed with %q\n", err)
+	}
+}
+
+func TestWTGroup(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	quota := NewGroup("quota", 2, 0)
+	rate := NewGroup("rate", 0, 1)
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		g := quota
+		if i == len(tls)-1 {
+			g = rate
+		}
+		if err := wt.SetGroup(&tls[i], g); err != nil {
+			t.Fatalf("SetGroup failed with %q\n", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err := wt.AddExpire(&tls[i], start.AddUint64(10), f, nil)
+		if i < 2 && err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		} else if i == 2 && !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("unexpected Add over group quota result: %v\n", err)
+		}
+	}
+	if err := wt.SetGroup(&tls[0], rate); !errors.Is(err, ErrActiveTimer) {
+		t.Errorf("unexpected SetGroup on active timer result: %v\n", err)
+	}
+	if err := wt.AddExpire(&tls[3], start.AddUint64(10), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.Del(&tls[3])
+	wt.InitTimer(&tls[3], 0)
+	wt.SetGroup(&tls[3], rate)
+	if err := wt.AddExpire(&tls[3], start.AddUint64(10),
+		f, nil); !errors.Is(err, ErrRateExceeded) {
+		t.Errorf("unexpected Add over group rate result: %v\n", err)
+	}
+	if s := quota.Stats(); s.Timers != 2 || s.Adds != 2 || s.Rejected != 1 {
+		t.Errorf("unexpected group stats: %+v\n", s)
+	}
+	if s := rate.Stats(); s.Timers != 0 || s.Adds != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected group stats: %+v\n", s)
+	}
+	// expire => the group counters are decremented
+	wt.advanceTimeTo(start.AddUint64(10))
+	if n := quota.Len(); n != 0 {
+		t.Errorf("unexpected group timers after expire: %d\n", n)
+	}
+}
+
+func TestWTLag(t *testing.T) {
+	var wt WTimer
+	var periodic, low TimerLnk
+	var runs int
+	var dropped *TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return true, Periodic
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{LagTicks: 10, LagDropLow: true,
+		DropF: func(wt *WTimer, tl *TimerLnk) { dropped = tl }}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// simulate a timer goroutine stalled for 100 ticks: the real time
+	// (used for re-arming) is already 100 ticks ahead
+	wt.refTS = timestamp.Now().Add(-100 * tick)
+	wt.refTicks = start
+	wt.InitTimer(&periodic, Ffast)
+	if err := wt.AddExpire(&periodic, start.AddUint64(1), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.InitTimer(&low, 0)
+	wt.SetPriority(&low, PrioLow)
+	if err := wt.AddExpire(&low, start.AddUint64(5), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.catchUpTo(start.AddUint64(100))
+	if runs != 1 {
+		t.Errorf("periodic timer run %d times while catching up\n", runs)
+	}
+	if dropped != &low || !low.State().Removed {
+		t.Errorf("low priority timer not dropped: %+v\n", low.State())
+	}
+	s := wt.LagStats()
+	if s.Events != 1 || s.LostTicks != 100 || s.Coalesced == 0 ||
+		s.Dropped != 1 {
+		t.Errorf("unexpected lag stats: %+v\n", s)
+	}
+	if _, behind := wt.catchUpTarget(); behind {
+		t.Errorf("still catching up\n")
+	}
+	wt.Del(&periodic)
+}
+
+func TestWTCatchUp(t *testing.T) {
+	for _, pol := range []CatchUpPolicy{CatchUpReplay, CatchUpFastForward,
+		CatchUpSkipPeriodic} {
+		t.Run(pol.String(), func(t *testing.T) { testCatchUp(t, pol) })
+	}
+}
+
+func testCatchUp(t *testing.T, pol CatchUpPolicy) {
+	var wt WTimer
+	var tls [2]TimerLnk
+	var seen [len(tls)][]Ticks
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		i := p.(int)
+		seen[i] = append(seen[i], wt.Now())
+		// timer 1 is periodic
+		return i == 1, Periodic
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{LagTicks: 10, CatchUp: pol}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	wt.refTS = timestamp.Now()
+	if pol != CatchUpSkipPeriodic {
+		// simulate a stalled timer goroutine: the real time (used for
+		// re-arming) is already 100 ticks ahead
+		wt.refTS = wt.refTS.Add(-100 * tick)
+	}
+	wt.refTicks = start
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		exp := start.AddUint64(uint64(5 + 45*i))
+		if err := wt.AddExpire(&tls[i], exp, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// explicitly re-armed timer (not periodic), re-armed relative to the
+	// current tick even with CatchUpSkipPeriodic
+	var rearmed TimerLnk
+	var rearms []Ticks
+	if pol == CatchUpSkipPeriodic {
+		fr := func(wt *WTimer, h *TimerLnk,
+			p interface{}) (bool, time.Duration) {
+			rearms = append(rearms, wt.Now())
+			return len(rearms) == 1, 2 * tick
+		}
+		wt.InitTimer(&rearmed, Ffast)
+		err := wt.AddExpire(&rearmed, start.AddUint64(5), fr, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.catchUpTo(start.AddUint64(100))
+	if pol == CatchUpSkipPeriodic && len(rearms) != 2 {
+		t.Errorf("re-armed timer run %d times during the catch-up\n",
+			len(rearms))
+	}
+	for i := range seen {
+		if len(seen[i]) != 1 {
+			t.Fatalf("timer %d run %d times\n", i, len(seen[i]))
+		}
+		exp := start.AddUint64(uint64(5 + 45*i))
+		if pol == CatchUpFastForward {
+			exp = start.AddUint64(100)
+		}
+		if seen[i][0] != exp {
+			t.Errorf("timer %d run at %s instead of %s\n", i, seen[i][0], exp)
+		}
+	}
+	if pol == CatchUpSkipPeriodic &&
+		!tls[1].Exp().GT(start.AddUint64(100)) {
+		t.Errorf("periodic timer re-armed before the catch-up end: %s\n",
+			tls[1].Exp())
+	}
+	wt.Del(&tls[1])
+}
+
+func TestWTSuspend(t *testing.T) {
+	for _, pol := range []SuspendPolicy{SuspendFire, SuspendShift,
+		SuspendAsk} {
+		t.Run(pol.String(), func(t *testing.T) { testSuspend(t, pol) })
+	}
+}
+
+func testSuspend(t *testing.T, pol SuspendPolicy) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+	var asked time.Duration
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{SuspendThreshold: time.Second, SuspendPolicy: pol,
+		SuspendF: func(wt *WTimer, gap time.Duration) SuspendPolicy {
+			asked = gap
+			return SuspendShift
+		}}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// last tick 10s ago (suspended meanwhile)
+	wt.lastTickT = timestamp.Now().Add(-10 * time.Second)
+	wt.refTS = wt.lastTickT
+	wt.refTicks = start
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.AddExpire(&tl, start.AddUint64(5), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.ticker()
+	s := wt.SuspendStats()
+	if s.Suspends != 1 || s.Gap < 9*time.Second {
+		t.Errorf("unexpected suspend stats: %+v\n", s)
+	}
+	if pol == SuspendFire {
+		if runs != 1 || s.Shifted != 0 {
+			t.Errorf("timer not fired after suspend: %d runs, %+v\n", runs, s)
+		}
+		return
+	}
+	if pol == SuspendAsk && asked < 9*time.Second {
+		t.Errorf("SuspendF called with wrong gap: %s\n", asked)
+	}
+	if runs != 0 || s.Shifted != 1 || wt.Now().GT(start.AddUint64(2)) {
+		t.Errorf("timers not shifted: %d runs, now %s, %+v\n",
+			runs, wt.Now(), s)
+	}
+	wt.Del(&tl)
+}
+
+func TestWTClockStep(t *testing.T) {
+	var wt WTimer
+	var steps []time.Duration
+
+	tick := 10 * time.Millisecond
+	cfg := Config{ClockStepThreshold: time.Second, ClockBackResync: 3,
+		ClockStepF: func(wt *WTimer, step time.Duration) {
+			steps = append(steps, step)
+		}}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	// forward step: last tick 5s ago
+	wt.lastTickT = timestamp.Now().Add(-5 * time.Second)
+	wt.refTS = wt.lastTickT
+	wt.refTicks = start
+	wt.ticker()
+	if len(steps) != 1 || steps[0] < 4*time.Second {
+		t.Fatalf("forward step not reported: %v\n", steps)
+	}
+	// backward step: last tick 5s in the future
+	wt.lastTickT = timestamp.Now().Add(5 * time.Second)
+	now := wt.Now()
+	for i := 0; i < cfg.ClockBackResync; i++ {
+		wt.ticker()
+		if wt.Now() != now {
+			t.Fatalf("time advanced while going backwards: %s -> %s\n",
+				now, wt.Now())
+		}
+	}
+	if len(steps) != 2 || steps[1] > -4*time.Second {
+		t.Fatalf("backward step not reported once: %v\n", steps)
+	}
+	// re-sync after ClockBackResync ticks
+	wt.ticker()
+	if wt.lastTickT.After(timestamp.Now()) {
+		t.Errorf("time reference not re-synchronised (%d)\n", wt.badTime)
+	}
+	// small forward step, under the threshold
+	wt.lastTickT = timestamp.Now().Add(-100 * time.Millisecond)
+	wt.ticker()
+	if len(steps) != 2 {
+		t.Errorf("step under the threshold reported: %v\n", steps)
+	}
+}
+
+// testClock is a manually advanced Clock.
+type testClock struct {
+	ts timestamp.TS
+}
+
+func (c *testClock) Now() timestamp.TS {
+	return timestamp.AtomicLoad(&c.ts)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	timestamp.AtomicStore(&c.ts, c.Now().Add(d))
+}
+
+func TestWTClock(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	clk := &testClock{ts: timestamp.Unix(1000, 0)}
+	if err := wt.InitCfg(tick, &Config{Clock: clk}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	wt.lastTickT = clk.Now()
+	wt.refTS = wt.lastTickT
+	wt.refTicks = start
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 5*tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	for i := 1; i <= 4; i++ {
+		clk.advance(tick)
+		wt.ticker()
+		if runs != 0 || wt.Now() != start.AddUint64(uint64(i)) {
+			t.Fatalf("unexpected state after %d ticks: now %s, %d runs\n",
+				i, wt.Now(), runs)
+		}
+	}
+	// no ticks while the clock is stopped
+	wt.ticker()
+	if wt.Now() != start.AddUint64(4) {
+		t.Fatalf("time advanced with a stopped clock: %s\n", wt.Now())
+	}
+	clk.advance(tick)
+	wt.ticker()
+	if runs != 1 {
+		t.Errorf("timer not run after 5 ticks: %d runs\n", runs)
+	}
+}
+
+func TestWTStartWithTicker(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	done := make(chan Ticks, 1)
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		done <- wt.Now()
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	clk := &testClock{ts: timestamp.Unix(1000, 0)}
+	if err := wt.InitCfg(tick, &Config{Clock: clk}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if err := wt.StartWithTicker(nil); err != ErrInvalidParameters {
+		t.Fatalf("StartWithTicker(nil) returned %v\n", err)
+	}
+	tickC := make(chan time.Time)
+	start := wt.Now()
+	if err := wt.StartWithTicker(tickC); err != nil {
+		t.Fatalf("StartWithTicker failed: %s\n", err)
+	}
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 3*tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// the clock is stopped: only the delivered timestamps count
+	base := clk.Now().Time()
+	for i := 1; i <= 3; i++ {
+		tickC <- base.Add(time.Duration(i) * tick)
+	}
+	select {
+	case now := <-done:
+		if now != start.AddUint64(3) {
+			t.Errorf("timer run at %s instead of %s\n", now, start.AddUint64(3))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timer not run after 3 delivered ticks (now %s)\n", wt.Now())
+	}
+	close(tickC)
+}
+
+func TestWTTimeScale(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{TimeScale: -1}); err == nil {
+		t.Fatalf("WTimer init with negative time scale succeeded\n")
+	}
+	clk := &testClock{ts: timestamp.Unix(1000, 0)}
+	if err := wt.InitCfg(tick, &Config{Clock: clk, TimeScale: 100}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if d := wt.realDuration(time.Second); d != 10*time.Millisecond {
+		t.Errorf("wrong real duration for 1s: %s\n", d)
+	}
+	start := wt.Now()
+	wt.lastTickT = wt.timeNow()
+	wt.refTS = wt.lastTickT
+	wt.refTicks = start
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 500*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// 4ms real time = 400ms scaled time = 40 ticks
+	clk.advance(4 * time.Millisecond)
+	wt.ticker()
+	if runs != 0 || wt.Now() != start.AddUint64(40) {
+		t.Fatalf("unexpected state after 4ms: now %s, %d runs\n",
+			wt.Now(), runs)
+	}
+	clk.advance(time.Millisecond)
+	wt.ticker()
+	if runs != 1 || wt.Now() != start.AddUint64(50) {
+		t.Errorf("timer not run after 5ms: now %s, %d runs\n",
+			wt.Now(), runs)
+	}
+}
+
+func runSimulation(t *testing.T, seed int64) []string {
+	var wt WTimer
+	var fired []string
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		fired = append(fired, fmt.Sprintf("%d:%s", wt.Now().Val(), p))
+		if p.(string) == "periodic" {
+			return true, Periodic
+		}
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{Simulation: true, SimSeed: seed}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	timers := make([]TimerLnk, 20)
+	for i := range timers {
+		flags := uint8(0)
+		if i%5 == 4 {
+			flags = FgoR
+		}
+		wt.InitTimer(&timers[i], flags)
+		name := fmt.Sprintf("t%d", i)
+		if i%7 == 0 {
+			wt.SetPriority(&timers[i], PrioHigh)
+			name = "high" + name
+		}
+		if flags == FgoR {
+			// run directly in simulation mode, before the queued ones
+			name = "go" + name
+		}
+		if err := wt.Add(&timers[i], 5*tick, f, name); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	var per TimerLnk
+	wt.InitTimer(&per, 0)
+	if err := wt.Add(&per, 3*tick, f, "periodic"); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(10)
+	if wt.Len() != 1 {
+		t.Errorf("unexpected pending timers: %d\n", wt.Len())
+	}
+	wt.Del(&per)
+	return fired
+}
+
+func TestWTSimulation(t *testing.T) {
+	ref := runSimulation(t, 1)
+	if len(ref) != 20+3 {
+		t.Fatalf("unexpected fires: %d: %v\n", len(ref), ref)
+	}
+	if got := runSimulation(t, 1); !reflect.DeepEqual(ref, got) {
+		t.Errorf("different fire sequence for the same seed:\n%v\n%v\n",
+			ref, got)
+	}
+	// the high priority timers run first in their tick
+	for i := 1; i < len(ref); i++ {
+		cur := strings.SplitN(ref[i], ":", 2)
+		prev := strings.SplitN(ref[i-1], ":", 2)
+		if cur[0] == prev[0] && strings.HasPrefix(cur[1], "high") &&
+			strings.HasPrefix(prev[1], "t") {
+			t.Errorf("high priority timer run after normal ones: %v\n", ref)
+			break
+		}
+	}
+	differ := false
+	for seed := int64(2); seed < 5 && !differ; seed++ {
+		differ = !reflect.DeepEqual(ref, runSimulation(t, seed))
+	}
+	if !differ {
+		t.Errorf("same fire sequence for different seeds: %v\n", ref)
+	}
+}
+
+func TestWTHandlerRegistry(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+	var buf bytes.Buffer
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	g := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := RegisterHandler("test-reg-f", f); err != nil {
+		t.Fatalf("RegisterHandler failed: %s\n", err)
+	}
+	if err := RegisterHandler("test-reg-f", f); err != nil {
+		t.Errorf("RegisterHandler with the same handler failed: %s\n", err)
+	}
+	if err := RegisterHandler("test-reg-f", g); err != ErrHandlerExists {
+		t.Errorf("RegisterHandler duplicate returned %v\n", err)
+	}
+	if name, ok := HandlerName(f); !ok || name != "test-reg-f" {
+		t.Errorf("HandlerName returned %q, %v\n", name, ok)
+	}
+	if _, ok := HandlerName(g); ok {
+		t.Errorf("HandlerName found unregistered handler\n")
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.InitTimer(&tls[0], Ffast)
+	wt.InitTimer(&tls[1], Ffast)
+	err := wt.AddNamed(&tls[0], time.Second, "test-reg-unknown", nil)
+	if !errors.Is(err, ErrUnknownHandler) {
+		t.Errorf("AddNamed with unknown name returned %v\n", err)
+	}
+	if err := wt.AddNamed(&tls[0], time.Second, "test-reg-f", nil); err != nil {
+		t.Fatalf("AddNamed failed with %q\n", err)
+	}
+	if err := wt.Add(&tls[1], 2*time.Second, g, nil); err != nil {
+		t.Fatalf("Add failed with %q\n", err)
+	}
+	if err := wt.Dump(&buf); err != nil {
+		t.Fatalf("Dump failed: %s\n", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "handler test-reg-f\n") ||
+		!strings.Contains(out, "TestWTHandlerRegistry.func2()\n") {
+		t.Errorf("handler names not found in dump:\n%s\n", out)
+	}
+	wt.Del(&tls[0])
+	wt.Del(&tls[1])
+}
+
+func TestWTMigrate(t *testing.T) {
+	var src, dst WTimer
+	var tls [3]TimerLnk
+	var runs [len(tls)]int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		if wt != &dst {
+			t.Errorf("timer %d run on the old timer wheel\n", p.(int))
+		}
+		runs[p.(int)]++
+		return false, 0
+	}
+
+	if err := src.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if err := dst.Init(10 * time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if _, err := src.Migrate(&src); err != ErrInvalidParameters {
+		t.Errorf("Migrate to itself returned %v\n", err)
+	}
+	ivs := [len(tls)]uint64{50, 200, W0Entries + 1000}
+	for i := range tls {
+		src.InitTimer(&tls[i], Ffast)
+		err := src.AddExpire(&tls[i], src.Now().AddUint64(ivs[i]), f, i)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	src.RunTicks(10)
+	n, err := src.Migrate(&dst)
+	if err != nil || n != len(tls) {
+		t.Fatalf("Migrate returned %d, %v\n", n, err)
+	}
+	if src.Len() != 0 || dst.Len() != len(tls) {
+		t.Fatalf("wrong timers number after Migrate: %d / %d\n",
+			src.Len(), dst.Len())
+	}
+	// remaining time in 10ms ticks
+	exp := [len(tls)]uint64{4, 19, (W0Entries + 1000 - 10 + 5) / 10}
+	for i := range tls {
+		if tls[i].Exp() != dst.Now().AddUint64(exp[i]) {
+			t.Errorf("timer %d: wrong expire after Migrate: %s, now %s\n",
+				i, tls[i].Exp(), dst.Now())
+		}
+	}
+	if r := dst.CheckConsistency(); !r.OK() {
+		t.Errorf("inconsistent timer wheel after Migrate: %s\n", r)
+	}
+	dst.RunTicks(exp[1])
+	if runs != [len(tls)]int{1, 1, 0} || dst.Len() != 1 {
+		t.Errorf("unexpected runs after Migrate: %v\n", runs)
+	}
+	dst.Del(&tls[2])
+}
+
+func TestWTInstances(t *testing.T) {
+	var wts [3]WTimer
+	var tls [3]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	names := [len(wts)]string{"test-b", "test-a", ""}
+	for i := range wts {
+		cfg := Config{Name: names[i], Simulation: true}
+		if err := wts[i].InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wts[i].Start()
+	}
+	for i := range tls {
+		wts[i%2].InitTimer(&tls[i], Ffast)
+		if err := wts[i%2].Add(&tls[i], time.Second, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	lst := Instances()
+	if len(lst) != 2 || lst[0] != &wts[1] || lst[1] != &wts[0] {
+		t.Fatalf("unexpected instances: %v\n", lst)
+	}
+	total, each := AggregatedStats()
+	if total.Instances != 2 || total.Timers != 3 || len(each) != 2 ||
+		each[0].Name != "test-a" || each[0].Timers != 1 ||
+		each[1].Timers != 2 {
+		t.Errorf("unexpected aggregated stats: %+v %+v\n", total, each)
+	}
+	for i := range tls {
+		wts[i%2].Del(&tls[i])
+	}
+	for i := range wts {
+		wts[i].Shutdown()
+	}
+	if lst := Instances(); len(lst) != 0 {
+		t.Errorf("instances still registered after Shutdown: %v\n", lst)
+	}
+}
+
+func TestWTSharedTicker(t *testing.T) {
+	var wts [2]WTimer
+	var tls [len(wts)]TimerLnk
+	var bad WTimer
+
+	done := make(chan int, len(wts))
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		done <- p.(int)
+		return false, 0
+	}
+
+	st, err := NewSharedTicker(5 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewSharedTicker failed: %s\n", err)
+	}
+	st.Start()
+	defer st.Stop()
+	if err := bad.Init(7 * time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if err := bad.StartShared(st); err != ErrInvalidParameters {
+		t.Errorf("StartShared with a bad tick returned %v\n", err)
+	}
+	ticks := [len(wts)]time.Duration{5 * time.Millisecond,
+		50 * time.Millisecond}
+	for i := range wts {
+		if err := wts[i].Init(ticks[i]); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		if err := wts[i].StartShared(st); err != nil {
+			t.Fatalf("StartShared failed: %s\n", err)
+		}
+		defer wts[i].Shutdown()
+		wts[i].InitTimer(&tls[i], Ffast)
+		if err := wts[i].Add(&tls[i], 100*time.Millisecond, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	for range wts {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timers not run: %d / %d pending\n",
+				wts[0].Len(), wts[1].Len())
+		}
+	}
+	if n := len(st.wts); n != len(wts) {
+		t.Errorf("unexpected number of attached instances: %d\n", n)
+	}
+}
+
+func TestWTPause(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+	var runs [len(tls)]int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs[p.(int)]++
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	clk := &testClock{ts: timestamp.Unix(1000, 0)}
+	if err := wt.InitCfg(tick, &Config{Clock: clk}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.Now()
+	wt.lastTickT = wt.timeNow()
+	wt.refTS = wt.lastTickT
+	wt.refTicks = start
+	wt.InitTimer(&tls[0], Ffast)
+	wt.InitTimer(&tls[1], Ffast)
+	if err := wt.Add(&tls[0], 5*tick, f, 0); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	clk.advance(2 * tick)
+	wt.ticker()
+	if !wt.Pause() || wt.Pause() || !wt.Paused() {
+		t.Fatalf("Pause failed\n")
+	}
+	clk.advance(time.Second)
+	wt.ticker()
+	if wt.Now() != start.AddUint64(2) {
+		t.Fatalf("time advanced while paused: %s\n", wt.Now())
+	}
+	// added while paused, relative to the frozen time
+	if err := wt.Add(&tls[1], 4*tick, f, 1); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if d, ok := wt.Resume(); !ok || d != time.Second {
+		t.Fatalf("Resume returned %s, %v\n", d, ok)
+	}
+	if _, ok := wt.Resume(); ok || wt.Paused() {
+		t.Fatalf("Resume succeeded while not paused\n")
+	}
+	clk.advance(3 * tick)
+	wt.ticker()
+	if wt.Now() != start.AddUint64(5) || runs != [len(tls)]int{1, 0} {
+		t.Fatalf("unexpected state after resume: now %s, runs %v\n",
+			wt.Now(), runs)
+	}
+	clk.advance(tick)
+	wt.ticker()
+	if runs != [len(tls)]int{1, 1} {
+		t.Errorf("timer added while paused not run: %v\n", runs)
+	}
+}
+
+func TestWTShutdownContext(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+
+	started := make(chan int, len(tls))
+	aborted := make(chan int, len(tls))
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		started <- p.(int)
+		select {
+		case <-wt.Context().Done():
+			aborted <- p.(int)
+		case <-time.After(10 * time.Second):
+		}
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	wt.InitTimer(&tls[0], 0)
+	wt.InitTimer(&tls[1], FgoR)
+	for i := range tls {
+		if err := wt.Add(&tls[i], 10*time.Millisecond, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	for range tls {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handlers not started\n")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	rep, err := wt.ShutdownContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("ShutdownContext returned %v\n", err)
+	}
+	if len(rep.Running) != 1 || rep.Running[0] != &tls[0] ||
+		rep.RunningGoR != 1 {
+		t.Errorf("unexpected shutdown report: %+v\n", rep)
+	}
+	for range tls {
+		select {
+		case <-aborted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handlers not signaled\n")
+		}
+	}
+	wt.wg.Wait()
+
+	// nothing running => no error
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	if rep, err := wt.ShutdownContext(context.Background()); err != nil ||
+		len(rep.Running) != 0 {
+		t.Errorf("idle ShutdownContext returned %+v, %v\n", rep, err)
+	}
+}
+
+func TestWTDrain(t *testing.T) {
+	for _, pol := range []DrainPolicy{DrainCancel, DrainFireAll,
+		DrainMustRun} {
+		t.Run(pol.String(), func(t *testing.T) { testDrain(t, pol) })
+	}
+}
+
+func testDrain(t *testing.T, pol DrainPolicy) {
+	var wt WTimer
+	var tls [4]TimerLnk
+	var fired []int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		fired = append(fired, p.(int))
+		return true, Periodic // ignored on shutdown
+	}
+
+	if err := wt.InitCfg(time.Millisecond, &Config{Drain: pol}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	flags := [len(tls)]uint8{0, Ffast, FgoR, 0}
+	for i := range tls {
+		wt.InitTimer(&tls[i], flags[i])
+		if i%2 == 1 {
+			wt.SetMustRun(&tls[i], true)
+		}
+		d := time.Duration(len(tls)-i) * time.Hour
+		if err := wt.Add(&tls[i], d, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.Shutdown()
+	var exp []int
+	switch pol {
+	case DrainFireAll:
+		exp = []int{3, 2, 1, 0} // expire order
+	case DrainMustRun:
+		exp = []int{3, 1}
+	}
+	if !reflect.DeepEqual(fired, exp) {
+		t.Errorf("unexpected drained timers: %v instead of %v\n", fired, exp)
+	}
+	if wt.Len() != len(tls)-len(exp) {
+		t.Errorf("unexpected pending timers after drain: %d\n", wt.Len())
+	}
+	for _, i := range exp {
+		if s := tls[i].State(); !s.Removed {
+			t.Errorf("drained timer %d re-armed: %+v\n", i, s)
+		}
+	}
+}
+
+func TestWTRestart(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int32
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.AddInt32(&runs, 1)
+		return true, Periodic
+	}
+	waitRuns := func(n int32) {
+		for i := 0; i < 500 && atomic.LoadInt32(&runs) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if r := atomic.LoadInt32(&runs); r < n {
+			t.Fatalf("timer run only %d times instead of %d\n", r, n)
+		}
+	}
+
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	gs := runtime.NumGoroutine()
+	wt.Start()
+	wt.Start() // ignored
+	running := runtime.NumGoroutine()
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, 5*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	waitRuns(2)
+	wt.Shutdown()
+	wt.Shutdown() // ignored
+	if n := runtime.NumGoroutine(); n > gs {
+		t.Errorf("goroutines left after Shutdown: %d > %d\n", n, gs)
+	}
+	r := atomic.LoadInt32(&runs)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != r {
+		t.Errorf("timer run while stopped\n")
+	}
+	if wt.Len() != 1 {
+		t.Fatalf("pending timer lost on Shutdown: %d\n", wt.Len())
+	}
+	wt.Start()
+	if n := runtime.NumGoroutine(); n > running {
+		t.Errorf("goroutines leaked on restart: %d > %d\n", n, running)
+	}
+	waitRuns(r + 2)
+	wt.Del(&tl)
+	wt.Shutdown()
+}
+
+func TestWTSuspendDispatch(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	start := wt.Now()
+	flags := [len(tls)]uint8{0, Ffast, 0}
+	for i := range tls {
+		wt.InitTimer(&tls[i], flags[i])
+		if err := wt.Add(&tls[i], tick, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if i == 0 {
+			// run before suspending
+			wt.RunTicks(1)
+			wt.SuspendDispatch()
+		}
+	}
+	if runs != 1 || !wt.DispatchSuspended() || wt.SuspendDispatch() {
+		t.Fatalf("unexpected state after SuspendDispatch: %d runs\n", runs)
+	}
+	wt.RunTicks(10)
+	if runs != 1 || wt.Len() != 2 || wt.Now() != start.AddUint64(11) {
+		t.Fatalf("handlers run while suspended: %d runs, %d pending,"+
+			" now %s\n", runs, wt.Len(), wt.Now())
+	}
+	if !wt.ResumeDispatch() || wt.ResumeDispatch() {
+		t.Fatalf("ResumeDispatch failed\n")
+	}
+	wt.RunTicks(1)
+	if runs != len(tls) || wt.Len() != 0 {
+		t.Errorf("handlers not run after ResumeDispatch: %d runs,"+
+			" %d pending\n", runs, wt.Len())
+	}
+}
+
+func TestWTLongIntervals(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	tick := time.Microsecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	// more then MaxTicksDiff ticks
+	long := 10 * 365 * 24 * time.Hour
+	wt.InitTimer(&tls[0], 0)
+	if err := wt.Add(&tls[0], long, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q for %s\n", err, long)
+	}
+	now := wt.Now()
+	total := uint64(long / tick)
+	if tls[0].expire != now.AddUint64(maxLegTicks) ||
+		tls[0].extView().left != total-maxLegTicks {
+		t.Fatalf("wrong long timer legs: expire %s, left %d (now %s)\n",
+			tls[0].expire, tls[0].extView().left, now)
+	}
+	// short timer with a pending leg (the last leg of a long interval)
+	wt.InitTimer(&tls[1], 0)
+	if err := wt.Add(&tls[1], 10*tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.lock()
+	wt.extOf(&tls[1]).left = 5
+	wt.unlock()
+	wt.RunTicks(10)
+	if runs != 0 || wt.Len() != 2 || tls[1].extView().left != 0 ||
+		tls[1].expire != now.AddUint64(15) {
+		t.Fatalf("timer run before its last leg: %d runs, %d pending,"+
+			" expire %s (now %s)\n", runs, wt.Len(), tls[1].expire, now)
+	}
+	wt.RunTicks(5)
+	if runs != 1 || wt.Len() != 1 {
+		t.Errorf("timer not run after its last leg: %d runs, %d pending\n",
+			runs, wt.Len())
+	}
+	if ok, err := wt.Del(&tls[0]); !ok || err != nil || wt.Len() != 0 {
+		t.Errorf("failed to delete the long timer\n")
+	}
+}
+
+func TestWTNegativeIntervals(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+	var addErr error
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		if runs == 1 {
+			addErr = wt.Add(h, -time.Second, h.f, nil)
+			// re-arm with a negative interval => run on the next tick
+			return true, -time.Second
+		}
+		return false, 0
+	}
+
+	tick := time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, -time.Second, f, nil); !errors.Is(err,
+		ErrInvalidParameters) {
+		t.Errorf("Add with negative interval: unexpected %v\n", err)
+	}
+	if tl.IsActive() || wt.Len() != 0 {
+		t.Fatalf("timer added with a negative interval\n")
+	}
+	if err := wt.Add(&tl, tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(4)
+	if !errors.Is(addErr, ErrInvalidParameters) {
+		t.Errorf("handler Add with negative interval: unexpected %v\n",
+			addErr)
+	}
+	if runs != 2 || wt.Len() != 0 {
+		t.Errorf("timer not run after a negative re-arm: %d runs,"+
+			" %d pending\n", runs, wt.Len())
+	}
+}
+
+func TestWTMaxDuration(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	tick := time.Microsecond
+	cfg := Config{Simulation: true, SingleLeg: true}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	max := wt.MaxDuration()
+	if max != time.Duration(maxLegTicks-1)*tick {
+		t.Fatalf("unexpected MaxDuration(): %s\n", max)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, 0)
+	err := wt.Add(&tl, max+tick, f, nil)
+	var tErr *TicksTooHighError
+	if !errors.Is(err, ErrTicksTooHigh) || !errors.As(err, &tErr) {
+		t.Fatalf("unexpected Add() error: %v\n", err)
+	}
+	if tErr.Requested != max+tick || tErr.Max != max || wt.Len() != 0 {
+		t.Errorf("wrong TicksTooHighError: %s (%d pending)\n",
+			tErr, wt.Len())
+	}
+	if err := wt.Add(&tl, max, f, nil); err != nil {
+		t.Fatalf("Add() failed for MaxDuration(): %s\n", err)
+	}
+	if tl.extView().left != 0 || wt.Len() != 1 {
+		t.Errorf("MaxDuration() timer split: left %d\n", tl.extView().left)
+	}
+	wt.Del(&tl)
+}
+
+func TestWTRounding(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	tests := [...]struct {
+		r     Rounding
+		intvl time.Duration
+		ticks uint64
+	}{
+		{RoundNearest, 14 * time.Millisecond, 1},
+		{RoundNearest, 15 * time.Millisecond, 2},
+		{RoundNearest, time.Millisecond, 1},
+		{RoundUp, 11 * time.Millisecond, 2},
+		{RoundUp, 20 * time.Millisecond, 2},
+		{RoundDown, 19 * time.Millisecond, 1},
+		{RoundDown, time.Millisecond, 1},
+		{RoundExact, 30 * time.Millisecond, 3},
+	}
+	for _, tc := range tests {
+		wt.InitTimer(&tl, 0)
+		if err := wt.SetRounding(&tl, tc.r); err != nil {
+			t.Fatalf("SetRounding(%s) failed: %s\n", tc.r, err)
+		}
+		if err := wt.Add(&tl, tc.intvl, f, nil); err != nil {
+			t.Fatalf("Add(%s) failed with %q\n", tc.intvl, err)
+		}
+		if d := tl.expire.Sub(wt.Now()).Val(); d != tc.ticks {
+			t.Errorf("rounding %s for %s: %d ticks instead of %d\n",
+				tc.r, tc.intvl, d, tc.ticks)
+		}
+		wt.Del(&tl)
+	}
+	wt.InitTimer(&tl, 0)
+	wt.SetRounding(&tl, RoundExact)
+	err := wt.Add(&tl, 15*time.Millisecond, f, nil)
+	if !errors.Is(err, ErrNotTickMultiple) || wt.Len() != 0 {
+		t.Errorf("unexpected error for RoundExact: %v\n", err)
+	}
+	if err := wt.SetRounding(&tl, RoundExact+1); err == nil {
+		t.Errorf("SetRounding accepted an invalid rounding\n")
+	}
+}
+
+func TestWTPrecise(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var fired [len(tls)]int64 // ns since start, atomic access
+
+	start := time.Now()
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.StoreInt64(&fired[p.(int)], int64(time.Since(start)))
+		return false, 0
+	}
+
+	tick := 100 * time.Millisecond
+	if err := wt.Init(tick); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	intvl := 30 * time.Millisecond
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if i != 2 {
+			if err := wt.SetPrecise(&tls[i], true); err != nil {
+				t.Fatalf("SetPrecise failed: %s\n", err)
+			}
+		}
+		if err := wt.Add(&tls[i], intvl, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// deleted before expire: must not run
+	if ok, err := wt.Del(&tls[1]); !ok || err != nil {
+		t.Fatalf("Del failed: %v\n", err)
+	}
+	time.Sleep(4 * tick)
+	if d := time.Duration(atomic.LoadInt64(&fired[0])); d < intvl ||
+		d > intvl+tick/2 {
+		t.Errorf("precise timer run after %s (interval %s)\n", d, intvl)
+	}
+	if d := time.Duration(atomic.LoadInt64(&fired[1])); d != 0 {
+		t.Errorf("deleted precise timer run after %s\n", d)
+	}
+	if d := time.Duration(atomic.LoadInt64(&fired[2])); d < tick/2 {
+		t.Errorf("normal timer run after %s (< tick)\n", d)
+	}
+	if wt.Len() != 0 {
+		t.Errorf("%d pending timers left\n", wt.Len())
+	}
+}
+
+func TestWTResolution(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+	var fired []uint64
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		fired = append(fired, wt.Now().Val())
+		return false, 0
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{Simulation: true, CoarseTick: 10 * tick}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	now := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if i != 0 {
+			if err := wt.SetResolution(&tls[i], ResCoarse); err != nil {
+				t.Fatalf("SetResolution failed: %s\n", err)
+			}
+		}
+		intvl := time.Duration(i*7+3) * tick
+		if err := wt.Add(&tls[i], intvl, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		d := tls[i].expire.Sub(now).Val()
+		if i == 0 && d != 3 {
+			t.Errorf("fine timer expire changed: %d ticks\n", d)
+		} else if i != 0 && (tls[i].expire.Val()%10 != 0 ||
+			d < uint64(i*7+3) || d >= uint64(i*7+3+10)) {
+			t.Errorf("coarse timer %d not aligned: expire %s now %s\n",
+				i, tls[i].expire, now)
+		}
+	}
+	wt.RunTicks(40)
+	if len(fired) != len(tls) {
+		t.Fatalf("not all the timers fired: %v\n", fired)
+	}
+	for _, v := range fired[1:] {
+		if v%10 != 0 {
+			t.Errorf("coarse timer fired outside a coarse tick: %v\n",
+				fired)
+		}
+	}
+	if err := wt.SetResolution(&tls[0], ResCoarse+1); err == nil {
+		t.Errorf("SetResolution accepted an invalid resolution\n")
+	}
+}
+
+func testFIFO(t *testing.T, fifo bool, flags uint8) []string {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var fired []string
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		fired = append(fired, p.(string))
+		return false, 0
+	}
+
+	tick := time.Millisecond
+	cfg := Config{Simulation: true, FIFO: fifo}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	// "a" is added first on wheel 1, "b" and "c" are added later, on
+	// wheel 0, but before "a" is cascaded to wheel 0
+	now := wt.Now().Val()
+	exp := now + W0Entries - now%W0Entries + W0Entries + 50
+	names := [len(tls)]string{"a", "b", "c"}
+	for i := range tls {
+		wt.InitTimer(&tls[i], flags)
+		if i == 1 {
+			wt.RunTicks(exp - 16000 - wt.Now().Val())
+		}
+		intvl := time.Duration(exp-wt.Now().Val()) * tick
+		if err := wt.Add(&tls[i], intvl, f, names[i]); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if w, _ := tls[0].info.wheelPos(); w != 1 {
+		t.Fatalf("unexpected wheel for the 1st timer: %d\n", w)
+	}
+	wt.RunTicks(exp - wt.Now().Val())
+	return fired
+}
+
+func TestWTFIFO(t *testing.T) {
+	if got := testFIFO(t, false, Ffast); len(got) != 3 || got[0] == "a" {
+		t.Fatalf("unexpected order without FIFO (test needs update): %v\n",
+			got)
+	}
+	for _, flags := range []uint8{Ffast, 0} {
+		got := testFIFO(t, true, flags)
+		if !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+			t.Errorf("wrong FIFO order (flags 0x%x): %v\n", flags, got)
+		}
+	}
+}
+
+func TestWTSeq(t *testing.T) {
+	var wt WTimer
+	var tls [5]TimerLnk
+	var fired []uint64
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		fired = append(fired, p.(uint64))
+		return false, 0
+	}
+
+	tick := time.Millisecond
+	cfg := Config{Simulation: true, FIFO: true}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	seqs := [len(tls)]uint64{3, 1, 0, 2, 1}
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if err := wt.SetSeq(&tls[i], seqs[i]); err != nil {
+			t.Fatalf("SetSeq failed: %s\n", err)
+		}
+		// parameter: sequence number * 10 + add index
+		arg := seqs[i]*10 + uint64(i)
+		if err := wt.Add(&tls[i], 5*tick, f, arg); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.RunTicks(5)
+	exp := []uint64{2, 11, 14, 23, 30}
+	if !reflect.DeepEqual(fired, exp) {
+		t.Errorf("wrong dispatch order: %v instead of %v\n", fired, exp)
+	}
+}
+
+func TestWTBatch(t *testing.T) {
+	var wt WTimer
+	var tls [12]TimerLnk
+	var batches []int
+	var lock sync.Mutex
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		t.Errorf("timer handler called for a batch class timer\n")
+		return false, 0
+	}
+	bf := func(wt *WTimer, b []*TimerLnk) {
+		lock.Lock()
+		batches = append(batches, len(b))
+		lock.Unlock()
+	}
+
+	for _, sim := range []bool{true, false} {
+		batches = nil
+		tick := 10 * time.Millisecond
+		cfg := Config{Simulation: sim, RunClasses: []RunClassCfg{
+			{Name: "gc", Queues: 1, Workers: 1, BatchF: bf}}}
+		if err := wt.InitCfg(tick, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		for i := range tls {
+			wt.InitTimer(&tls[i], 0)
+			if err := wt.SetRunClass(&tls[i], "gc"); err != nil {
+				t.Fatalf("SetRunClass failed: %s\n", err)
+			}
+			intvl := 5 * tick
+			if i >= 10 {
+				intvl = 10 * tick
+			}
+			if err := wt.Add(&tls[i], intvl, f, nil); err != nil {
+				t.Fatalf("Add  failed with %q\n", err)
+			}
+		}
+		if sim {
+			wt.RunTicks(10)
+		} else {
+			time.Sleep(20 * tick)
+		}
+		wt.Shutdown()
+		lock.Lock()
+		total := 0
+		for _, n := range batches {
+			total += n
+		}
+		if total != len(tls) || (sim && !reflect.DeepEqual(batches,
+			[]int{10, 2})) {
+			t.Errorf("unexpected batches (simulation %v): %v\n",
+				sim, batches)
+		}
+		lock.Unlock()
+		if wt.Len() != 0 {
+			t.Errorf("%d pending timers left\n", wt.Len())
+		}
+	}
+}
+
+func TestWTBatchReuse(t *testing.T) {
+	var wt WTimer
+	var tls [10]TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	bf := func(wt *WTimer, b []*TimerLnk) {
+		runs += len(b)
+	}
+
+	cfg := Config{Simulation: true, RunClasses: []RunClassCfg{
+		{Name: "gc", Queues: 1, Workers: 1, BatchF: bf}}}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	// the batch buffers are re-used => no allocations per tick
+	if n := steadyAllocs(func() {
+		for i := range tls {
+			wt.InitTimer(&tls[i], 0)
+			wt.SetRunClass(&tls[i], "gc")
+			wt.Add(&tls[i], time.Millisecond, f, nil)
+		}
+		wt.RunTicks(2)
+	}); n != 0 {
+		t.Errorf("%v allocations for a batch\n", n)
+	}
+	if runs == 0 || runs%len(tls) != 0 {
+		t.Errorf("unexpected batch delivered timers: %d\n", runs)
+	}
+	wt.Shutdown()
+}
+
+func TestWTBatchOverload(t *testing.T) {
+	for _, pol := range []OverloadPolicy{OverloadBlock, OverloadDrop,
+		OverloadGoR} {
+		t.Run(pol.String(), func(t *testing.T) { testBatchOverload(t, pol) })
+	}
+}
+
+func testBatchOverload(t *testing.T, pol OverloadPolicy) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var delivered, dropped int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		t.Errorf("timer handler called for a batch class timer\n")
+		return false, 0
+	}
+	bf := func(wt *WTimer, b []*TimerLnk) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release // keep the worker busy
+		atomic.AddInt32(&delivered, int32(len(b)))
+	}
+	dropF := func(wt *WTimer, tl *TimerLnk) {
+		atomic.AddInt32(&dropped, 1)
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{RunQueuePolicy: pol, DropF: dropF,
+		RunClasses: []RunClassCfg{
+			{Name: "gc", Queues: 1, Workers: 1, BatchF: bf}}}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if err := wt.SetRunClass(&tls[i], "gc"); err != nil {
+			t.Fatalf("SetRunClass failed: %s\n", err)
+		}
+	}
+	if err := wt.Add(&tls[0], tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	<-started
+	// 1st batch running, the 2nd will be queued and the 3rd will overflow
+	// the class batch queue (1 worker => 1 queued batch)
+	for i := 1; i < len(tls); i++ {
+		if err := wt.Add(&tls[i], time.Duration(2*i-1)*tick, f,
+			nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	time.Sleep(10 * tick)
+	s := wt.RunQueueStats()
+	switch pol {
+	case OverloadBlock:
+		if s.Blocked != 1 {
+			t.Errorf("unexpected blocked batches: %+v\n", s)
+		}
+	case OverloadDrop:
+		if s.Dropped != 1 || atomic.LoadInt32(&dropped) != 1 {
+			t.Errorf("unexpected dropped batch timers: %d, %+v\n",
+				atomic.LoadInt32(&dropped), s)
+		}
+	case OverloadGoR:
+		if s.Spilled != 1 {
+			t.Errorf("unexpected spilled batches: %+v\n", s)
+		}
+	}
+	close(release)
+	exp := int32(len(tls))
+	if pol == OverloadDrop {
+		exp--
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&delivered) != exp; i++ {
+		time.Sleep(tick)
+	}
+	if n := atomic.LoadInt32(&delivered); n != exp {
+		t.Errorf("%d batch timers delivered instead of %d\n", n, exp)
+	}
+	wt.Shutdown()
+	if wt.Len() != 0 {
+		t.Errorf("%d pending timers left\n", wt.Len())
+	}
+}
+
+func TestWTAddChan(t *testing.T) {
+	var wt WTimer
+	var tls [2]TimerLnk
+
+	tick := 10 * time.Millisecond
+	if err := wt.Init(tick); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	ch := make(chan interface{}, len(tls))
+	if err := wt.AddChan(&tls[0], tick, nil, nil); err == nil {
+		t.Fatalf("AddChan accepted a nil channel\n")
+	}
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		var token interface{}
+		if i == 1 {
+			token = "token"
+		}
+		if err := wt.AddChan(&tls[i], time.Duration(i+1)*tick, ch,
+			token); err != nil {
+			t.Fatalf("AddChan failed with %q\n", err)
+		}
+	}
+	for i := range tls {
+		select {
+		case v := <-ch:
+			if (i == 0 && v != &tls[0]) || (i == 1 && v != "token") {
+				t.Errorf("unexpected value received: %v\n", v)
+			}
+		case <-time.After(100 * tick):
+			t.Fatalf("timer %d not delivered\n", i)
+		}
+	}
+	// the timer can be re-added by the reader, after its removal
+	wt.DelWait(&tls[0])
+	wt.Reset(&tls[0], 0)
+	if err := wt.AddChan(&tls[0], tick, ch, nil); err != nil {
+		t.Fatalf("AddChan re-add failed with %q\n", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(100 * tick):
+		t.Fatalf("re-added timer not delivered\n")
+	}
+}
+
+func TestWTProfLabels(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+	if err := RegisterHandler("test-pprof-f", f); err != nil {
+		t.Fatalf("RegisterHandler failed: %s\n", err)
+	}
+
+	tick := 10 * time.Millisecond
+	cfg := Config{Simulation: true, ProfLabels: true, Name: "prof"}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, 0)
+	wt.SetPriority(&tl, PrioHigh)
+	if err := wt.Add(&tl, tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	ctx := pprof.WithLabels(context.Background(), wt.profLabels(&tl))
+	exp := map[string]string{
+		"wtimer": "prof", "handler": "test-pprof-f", "class": "high"}
+	for k, v := range exp {
+		if l, _ := pprof.Label(ctx, k); l != v {
+			t.Errorf("wrong pprof label %s: %q instead of %q\n", k, l, v)
+		}
+	}
+	wt.RunTicks(2)
+	if runs != 1 {
+		t.Errorf("handler not run with pprof labels: %d runs\n", runs)
+	}
+}
+
+func TestWTStuckHandler(t *testing.T) {
+	var wt WTimer
+	var tl, tl2 TimerLnk
+	type report struct {
+		tl      *TimerLnk
+		path    HandlerPath
+		elapsed time.Duration
+	}
+	reports := make(chan report, 10)
+	done := make(chan struct{}, 2)
+
+	block := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		time.Sleep(p.(time.Duration))
+		done <- struct{}{}
+		return false, 0
+	}
+	threshold := 20 * time.Millisecond
+	cfg := Config{
+		StuckThreshold: threshold,
+		StuckF: func(wt *WTimer, tl *TimerLnk, path HandlerPath,
+			elapsed time.Duration) {
+			reports <- report{tl, path, elapsed}
+		},
+	}
+	tick := time.Millisecond
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	wt.InitTimer(&tl2, 0)
+	// tl blocks the timer goroutine, tl2 runs fast enough
+	if err := wt.Add(&tl, tick, block, 10*threshold); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if err := wt.Add(&tl2, tick, block, time.Duration(0)); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handlers not run\n")
+		}
+	}
+	select {
+	case r := <-reports:
+		if r.tl != &tl || r.path != HandlerFast || r.elapsed <= threshold {
+			t.Errorf("wrong stuck report: %p %s %s (expected %p %s)\n",
+				r.tl, r.path, r.elapsed, &tl, HandlerFast)
+		}
+	default:
+		t.Errorf("stuck handler not reported\n")
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("unexpected stuck report: %p %s %s\n",
+			r.tl, r.path, r.elapsed)
+	default:
+	}
+	// the handlers are removed from the watchdog after returning
+	for i := 0; i < 100; i++ {
+		wt.stuckLock.Lock()
+		n := len(wt.stuckRuns)
+		wt.stuckLock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("handlers still watched after returning\n")
+}
+
+func TestWTDeadline(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+	var errs []error
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		ctx := wt.HandlerContext(h)
+		select {
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+		case <-time.After(p.(time.Duration)):
+			errs = append(errs, nil)
+		}
+		return false, 0
+	}
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, 0)
+	if err := wt.SetDeadline(&tl, -1); err == nil {
+		t.Errorf("SetDeadline accepted a negative deadline\n")
+	}
+	if err := wt.SetDeadline(&tl, 20*time.Millisecond); err != nil {
+		t.Fatalf("SetDeadline failed: %s\n", err)
+	}
+	// the handler waits for the context to be cancelled
+	if err := wt.Add(&tl, tick, f, time.Second); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(2)
+	// no deadline: the context is not cancelled
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, tick, f, 50*time.Millisecond); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(2)
+	if runs != 2 {
+		t.Fatalf("handler run %d times instead of 2\n", runs)
+	}
+	if errs[0] != context.DeadlineExceeded || errs[1] != nil {
+		t.Errorf("wrong handler contexts: %v\n", errs)
+	}
+	st := wt.DeadlineStats()
+	if st.Overruns != 1 || st.Overrun <= 0 {
+		t.Errorf("wrong deadline stats: %+v\n", st)
+	}
+	if wt.HandlerContext(&tl) != wt.Context() {
+		t.Errorf("wrong context for a timer without a deadline\n")
+	}
+}
+
+func TestWTNoOverlap(t *testing.T) {
+	var wt WTimer
+	var tls [3]TimerLnk
+	var running, overlaps, runs [len(tls)]int32
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		i := p.(int)
+		if atomic.AddInt32(&running[i], 1) != 1 {
+			atomic.AddInt32(&overlaps[i], 1)
+		}
+		// slower then the interval
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&runs[i], 1)
+		atomic.AddInt32(&running[i], -1)
+		return true, Periodic
+	}
+	tick := time.Millisecond
+	if err := wt.Init(tick); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	flags := [len(tls)]uint8{Ffast, FgoR, 0}
+	for i := range tls {
+		wt.InitTimer(&tls[i], flags[i])
+		if err := wt.Add(&tls[i], tick, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := range tls {
+		// a running timer cannot be re-added from outside
+		if err := wt.Add(&tls[i], tick, f, i); err == nil {
+			t.Errorf("Add succeeded on an active timer %d\n", i)
+		}
+	}
+	for i := range tls {
+		if _, err := wt.DelWait(&tls[i]); err != nil {
+			t.Errorf("DelWait failed for timer %d: %s\n", i, err)
+		}
+	}
+	wt.Shutdown()
+	for i := range tls {
+		if n := atomic.LoadInt32(&runs[i]); n < 2 {
+			t.Errorf("timer %d: only %d runs\n", i, n)
+		}
+		if n := atomic.LoadInt32(&overlaps[i]); n != 0 {
+			t.Errorf("timer %d (flags 0x%x): %d overlapping runs\n",
+				i, flags[i], n)
+		}
+	}
+}
+
+func TestWTMissPolicy(t *testing.T) {
+	var wt WTimer
+	pols := []MissPolicy{MissDefault, MissRealign, MissBurst, MissReport}
+	tls := make([]TimerLnk, len(pols))
+	runs := make([][]Ticks, len(pols))    // run times
+	missed := make([][]uint64, len(pols)) // MissedPeriods() for each run
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		i := p.(int)
+		runs[i] = append(runs[i], wt.Now())
+		missed[i] = append(missed[i], wt.MissedPeriods(h))
+		return true, Periodic
+	}
+	tick := 10 * time.Millisecond
+	cfg := Config{Simulation: true, CatchUp: CatchUpFastForward}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	if err := wt.SetMissPolicy(&tls[0], MissReport+1); err == nil {
+		t.Errorf("SetMissPolicy accepted an invalid policy\n")
+	}
+	start := wt.Now()
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		if err := wt.SetMissPolicy(&tls[i], pols[i]); err != nil {
+			t.Fatalf("SetMissPolicy failed: %s\n", err)
+		}
+		if err := wt.Add(&tls[i], 10*tick, f, i); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// stall: 5 periods (10, 20, 30, 40, 50) are due at once
+	wt.catchUpTo(start.AddUint64(55))
+	wt.RunTicks(10) // up to 65
+	rel := func(i int) []uint64 {
+		r := make([]uint64, len(runs[i]))
+		for j := range runs[i] {
+			r[j] = runs[i][j].Sub(start).Val()
+		}
+		return r
+	}
+	exp := []struct {
+		runs   []uint64
+		missed []uint64
+	}{
+		{[]uint64{55, 65}, []uint64{0, 0}},
+		{[]uint64{55, 65}, []uint64{4, 0}},
+		{[]uint64{55, 56, 57, 58, 59, 60}, []uint64{4, 3, 2, 1, 0, 0}},
+		{[]uint64{55, 60}, []uint64{4, 0}},
+	}
+	for i := range pols {
+		if r := rel(i); !reflect.DeepEqual(r, exp[i].runs) ||
+			!reflect.DeepEqual(missed[i], exp[i].missed) {
+			t.Errorf("policy %s: runs at %v missed %v, expected %v %v\n",
+				pols[i], r, missed[i], exp[i].runs, exp[i].missed)
+		}
+	}
+}
+
+func TestWTChain(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+	var runs []string
+	var at []uint64
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	start := wt.Now()
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs = append(runs, p.(string))
+		at = append(at, wt.Now().Sub(start).Val())
+		return false, 0
+	}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+	}
+	if err := wt.Chain(&tls[0], &tls[0], tick, f, nil); err == nil {
+		t.Errorf("Chain accepted a timer chained to itself\n")
+	}
+	// provisional -> final -> cleanup
+	if err := wt.Chain(&tls[0], &tls[1], 3*tick, f, "final"); err != nil {
+		t.Fatalf("Chain failed: %s\n", err)
+	}
+	if err := wt.Chain(&tls[1], &tls[2], 2*tick, f, "cleanup"); err != nil {
+		t.Fatalf("Chain failed: %s\n", err)
+	}
+	if err := wt.Add(&tls[0], tick, f, "provisional"); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// a deleted timer does not start the next one
+	if err := wt.Chain(&tls[3], &tls[2], tick, f, "deleted"); err != nil {
+		t.Fatalf("Chain failed: %s\n", err)
+	}
+	if err := wt.Add(&tls[3], tick, f, "not run"); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if _, err := wt.Del(&tls[3]); err != nil {
+		t.Fatalf("Del failed: %s\n", err)
+	}
+	wt.RunTicks(10)
+	if !reflect.DeepEqual(runs, []string{"provisional", "final", "cleanup"}) ||
+		!reflect.DeepEqual(at, []uint64{1, 4, 6}) {
+		t.Errorf("wrong chain runs: %v at %v\n", runs, at)
+	}
+}
+
+func TestWTParent(t *testing.T) {
+	var wt WTimer
+	var p, c1, c2, g, free TimerLnk
+	var runs []string
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs = append(runs, p.(string))
+		return false, 0
+	}
+	// p -> c1 -> g, p -> c2, p -> free (detached)
+	setup := func() {
+		for _, tl := range []*TimerLnk{&p, &c1, &c2, &g, &free} {
+			wt.InitTimer(tl, Ffast)
+		}
+		for _, r := range [][2]*TimerLnk{
+			{&c1, &p}, {&c2, &p}, {&g, &c1}, {&free, &p}} {
+			if err := wt.SetParent(r[0], r[1]); err != nil {
+				t.Fatalf("SetParent failed: %s\n", err)
+			}
+		}
+		if err := wt.SetParent(&free, nil); err != nil {
+			t.Fatalf("SetParent failed: %s\n", err)
+		}
+		for _, a := range []struct {
+			tl   *TimerLnk
+			d    time.Duration
+			name string
+		}{{&p, 5 * tick, "p"}, {&c1, 10 * tick, "c1"},
+			{&c2, 10 * tick, "c2"}, {&g, 10 * tick, "g"},
+			{&free, 10 * tick, "free"}} {
+			if err := wt.Add(a.tl, a.d, f, a.name); err != nil {
+				t.Fatalf("Add  failed with %q\n", err)
+			}
+		}
+	}
+	if err := wt.SetParent(&p, &p); err == nil {
+		t.Errorf("SetParent accepted a timer as its own parent\n")
+	}
+
+	// removing the parent removes the whole hierarchy
+	setup()
+	if _, err := wt.Del(&p); err != nil {
+		t.Fatalf("Del failed: %s\n", err)
+	}
+	wt.RunTicks(20)
+	if !reflect.DeepEqual(runs, []string{"free"}) {
+		t.Errorf("wrong runs after removing the parent: %v\n", runs)
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("%d timers left\n", n)
+	}
+
+	// the parent expire removes the hierarchy too
+	runs = nil
+	setup()
+	wt.RunTicks(20)
+	if !reflect.DeepEqual(runs, []string{"p", "free"}) {
+		t.Errorf("wrong runs after the parent expired: %v\n", runs)
+	}
+	if n := wt.Len(); n != 0 {
+		t.Errorf("%d timers left\n", n)
+	}
+}
+
+func TestWTTags(t *testing.T) {
+	var wt WTimer
+	var tls [10]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	if err := wt.SetTag(&tls[0], []int{1}); err == nil {
+		t.Errorf("SetTag accepted a non-comparable tag\n")
+	}
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		var tag interface{} = "reg-refresh"
+		if i%2 == 1 {
+			tag = i % 3
+		}
+		if err := wt.SetTag(&tls[i], tag); err != nil {
+			t.Fatalf("SetTag failed: %s\n", err)
+		}
+		if err := wt.Add(&tls[i], time.Duration(i+1)*time.Second, f,
+			nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	// odd timers: 1, 3, 5, 7, 9 => tags 1, 0, 2, 1, 0
+	if n := wt.CountByTag("reg-refresh"); n != 5 {
+		t.Errorf("CountByTag: %d instead of 5\n", n)
+	}
+	found := wt.FindByTag(1)
+	if len(found) != 2 || found[0].Tag() != 1 || found[1].Tag() != 1 {
+		t.Errorf("FindByTag: wrong timers %v\n", found)
+	}
+	if n := wt.CountByTag(3); n != 0 {
+		t.Errorf("CountByTag for an unused tag: %d\n", n)
+	}
+	if n := wt.CancelByTag(0); n != 2 {
+		t.Errorf("CancelByTag: %d removed instead of 2\n", n)
+	}
+	if n := wt.CountByTag(0); n != 0 {
+		t.Errorf("CountByTag after CancelByTag: %d\n", n)
+	}
+	if n := wt.Len(); n != 8 {
+		t.Errorf("%d timers left instead of 8\n", n)
+	}
+}
+
+func TestWTForEachTimer(t *testing.T) {
+	var wt WTimer
+	tls := make([]TimerLnk, 1000)
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		d := time.Duration(i+1) * time.Duration(i+1) * tick
+		if err := wt.Add(&tls[i], d, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	seen := make(map[*TimerLnk]bool, len(tls))
+	wt.ForEachTimer(func(a *ArmedTimer) bool {
+		if seen[a.T] {
+			t.Errorf("timer %p reported twice\n", a.T)
+		}
+		seen[a.T] = true
+		if a.Left != a.Intvl || a.Gen != a.T.Gen() {
+			t.Errorf("timer %p: wrong state %+v\n", a.T, *a)
+		}
+		// the timer operations can be used from fn
+		if a.Intvl > 100*tick {
+			if ok, err := wt.DelGen(a.T, a.Gen); !ok || err != nil {
+				t.Errorf("DelGen failed for %p: %v %v\n", a.T, ok, err)
+			}
+		}
+		return true
+	})
+	if len(seen) != len(tls) {
+		t.Errorf("%d timers iterated instead of %d\n", len(seen), len(tls))
+	}
+	if n := wt.Len(); n != 10 {
+		t.Errorf("%d timers left instead of 10\n", n)
+	}
+	n := 0
+	wt.ForEachTimer(func(a *ArmedTimer) bool {
+		n++
+		return n < 5
+	})
+	if n != 5 {
+		t.Errorf("iteration not stopped: %d calls\n", n)
+	}
+}
+
+func TestWTHotBuckets(t *testing.T) {
+	var wt WTimer
+	var tls [10]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+
+	if err := wt.Init(time.Millisecond * 1); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	deltas := [len(tls)]uint64{20, 10, 10, 20, 10, 30, 10, 20, 10,
+		W0Entries + 3}
+	for i := range tls {
+		wt.InitTimer(&tls[i], Ffast)
+		err := wt.AddExpire(&tls[i], wt.Now().AddUint64(deltas[i]), f, nil)
+		if err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	if hot := wt.HotBuckets(0); hot[0] != nil {
+		t.Errorf("unexpected buckets for n == 0: %v\n", hot)
+	}
+	hot := wt.HotBuckets(2)
+	now := wt.Now()
+	exp := []HotBucket{
+		{Idx: 10, Timers: 5, Nearest: now.AddUint64(10),
+			In: 10 * time.Millisecond},
+		{Idx: 20, Timers: 3, Nearest: now.AddUint64(20),
+			In: 20 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(hot[0], exp) {
+		t.Errorf("unexpected wheel 0 buckets: %+v\n", hot[0])
+	}
+	if len(hot[1]) != 1 || hot[1][0].Timers != 1 ||
+		hot[1][0].Nearest != now.AddUint64(W0Entries+3) {
+		t.Errorf("unexpected wheel 1 buckets: %+v\n", hot[1])
+	}
+	if len(hot[2]) != 0 || len(hot[3]) != 0 {
+		t.Errorf("unexpected higher wheels buckets: %+v %+v\n",
+			hot[2], hot[3])
+	}
+}
+
+func TestWTUserFlags(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var seen []uint32
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		seen = append(seen, h.UserFlags())
+		h.SetUserFlags(1 << 31)
+		return len(seen) < 2, Periodic
+	}
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	if old := tl.SetUserFlags(0xff); old != 0 {
+		t.Errorf("wrong initial user flags: 0x%x\n", old)
+	}
+	if err := wt.Add(&tl, tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// changed on an active timer
+	if old := tl.ChgUserFlags(0x100, 0x0f); old != 0xff {
+		t.Errorf("wrong user flags: 0x%x\n", old)
+	}
+	wt.RunTicks(3)
+	if !reflect.DeepEqual(seen, []uint32{0x1f0, 0x800001f0}) {
+		t.Errorf("user flags not preserved: %x\n", seen)
+	}
+	if old := tl.ResetUserFlags(0x800000f0); old != 0x800001f0 ||
+		tl.UserFlags() != 0x100 {
+		t.Errorf("wrong user flags: 0x%x 0x%x\n", old, tl.UserFlags())
+	}
+	wt.InitTimer(&tl, 0)
+	if fl := tl.UserFlags(); fl != 0 {
+		t.Errorf("user flags not cleared by InitTimer: 0x%x\n", fl)
+	}
+}
+
+func TestWTSetArg(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var got []interface{}
+	var lock sync.Mutex
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		lock.Lock()
+		got = append(got, p)
+		lock.Unlock()
+		return true, Periodic
+	}
+	tick := time.Millisecond
+	if err := wt.Init(tick); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, FgoR)
+	if err := wt.Add(&tl, tick, f, 0); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	// change the parameter of the armed (and running) timer
+	for i := 1; i <= 20; i++ {
+		tl.SetArg(i)
+		time.Sleep(tick / 2)
+	}
+	if a := tl.Arg(); a != 20 {
+		t.Errorf("wrong Arg(): %v\n", a)
+	}
+	time.Sleep(10 * tick)
+	if _, err := wt.DelWait(&tl); err != nil {
+		t.Errorf("DelWait failed: %s\n", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	prev := -1
+	for _, p := range got {
+		// the handler sees the values in order
+		if v := p.(int); v < prev {
+			t.Fatalf("wrong handler parameters order: %v\n", got)
+		} else {
+			prev = v
+		}
+	}
+	if prev != 20 {
+		t.Errorf("last handler parameter %d instead of 20\n", prev)
+	}
+}
+
+func TestWTSetInterval(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var at []uint64
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	start := wt.Now()
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		at = append(at, wt.Now().Sub(start).Val())
+		return true, Periodic
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.SetInterval(&tl, tick); err == nil {
+		t.Errorf("SetInterval succeeded on an inactive timer\n")
+	}
+	if err := wt.Add(&tl, 2*tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if err := wt.SetInterval(&tl, 0); err == nil {
+		t.Errorf("SetInterval accepted a 0 interval\n")
+	}
+	wt.RunTicks(3)
+	// the current expire (at 4) is not changed
+	if err := wt.SetInterval(&tl, 5*tick); err != nil {
+		t.Fatalf("SetInterval failed: %s\n", err)
+	}
+	wt.RunTicks(12)
+	if !reflect.DeepEqual(at, []uint64{2, 4, 9, 14}) {
+		t.Errorf("wrong runs after SetInterval: %v\n", at)
+	}
+	if iv := tl.Intvl(); iv != 5*tick {
+		t.Errorf("wrong interval: %s\n", iv)
+	}
+}
+
+func TestWTNames(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	if s := tl.String(); !strings.Contains(s, `"-"`) ||
+		!strings.Contains(s, "[fast,inactive]") {
+		t.Errorf("wrong String() for an inactive timer: %s\n", s)
+	}
+	if err := wt.SetName(&tl, "keepalive"); err != nil {
+		t.Fatalf("SetName failed: %s\n", err)
+	}
+	if err := wt.Add(&tl, 5*tick, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	if err := wt.SetName(&tl, "other"); err == nil {
+		t.Errorf("SetName succeeded on an active timer\n")
+	}
+	if s := tl.String(); !strings.Contains(s, `"keepalive"`) ||
+		!strings.Contains(s, "[fast,active,armed]") {
+		t.Errorf("wrong String(): %s\n", s)
+	}
+	if s := fmt.Sprintf("%#v", &tl); !strings.Contains(s,
+		`name: "keepalive"`) {
+		t.Errorf("wrong GoString(): %s\n", s)
+	}
+	var b strings.Builder
+	if err := wt.Dump(&b); err != nil {
+		t.Fatalf("Dump failed: %s\n", err)
+	}
+	if !strings.Contains(b.String(), `name "keepalive"`) {
+		t.Errorf("timer name not in dump:\n%s\n", b.String())
+	}
+	if s := (*TimerLnk)(nil).String(); s != "timer <nil>" {
+		t.Errorf("wrong String() for nil: %s\n", s)
+	}
+}
+
+func TestWTJSON(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	tick := 10 * time.Millisecond
+	cfg := Config{Simulation: true, Name: "json"}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	wt.SetName(&tl, "keepalive")
+	if err := wt.AddExpire(&tl, wt.Now().AddUint64(5), f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+
+	var st map[string]interface{}
+	b, err := json.Marshal(wt.Stats())
+	if err == nil {
+		err = json.Unmarshal(b, &st)
+	}
+	if err != nil {
+		t.Fatalf("stats JSON encoding failed: %s\n", err)
+	}
+	rq, _ := st["run_queues"].(map[string]interface{})
+	if st["name"] != "json" || st["timers"] != 1.0 || rq == nil ||
+		rq["max_depth"] != 0.0 {
+		t.Errorf("wrong stats JSON: %s\n", b)
+	}
+
+	var tj struct {
+		Timer   string `json:"timer"`
+		Name    string `json:"name"`
+		State   string `json:"state"`
+		Expire  Ticks  `json:"expire"`
+		IntvlNs int64  `json:"intvl_ns"`
+	}
+	if b, err = json.Marshal(&tl); err == nil {
+		err = json.Unmarshal(b, &tj)
+	}
+	if err != nil {
+		t.Fatalf("timer JSON encoding failed: %s\n", err)
+	}
+	if tj.Timer != fmt.Sprintf("%p", &tl) || tj.Name != "keepalive" ||
+		tj.State != "fast,active,armed" ||
+		tj.Expire != wt.Now().AddUint64(5) || tj.IntvlNs != int64(5*tick) {
+		t.Errorf("wrong timer JSON: %s\n", b)
+	}
+	if b, err = json.Marshal(snapshotTimer(&tl)); err != nil ||
+		!strings.Contains(string(b), `"intvl_ns":50000000`) {
+		t.Errorf("wrong timer snapshot JSON: %s (%v)\n", b, err)
+	}
+}
+
+func TestWTResetParallel(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return true, Periodic
+	}
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, 0)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	resets := 0
+	go func() {
+		// keep resetting the timer while it is added and removed
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := wt.Reset(&tl, 0)
+			if err != nil && !errors.Is(err, ErrActiveTimer) {
+				t.Errorf("unexpected Reset error: %s\n", err)
+				return
+			}
+			if err == nil {
+				resets++
+			}
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		err := wt.Add(&tl, time.Millisecond, f, nil)
+		if errors.Is(err, ErrActiveTimer) {
+			// removed, but not Reset() yet
+			runtime.Gosched()
+			continue
+		} else if err != nil {
+			t.Errorf("Add failed with %q\n", err)
+			break
+		}
+		time.Sleep(time.Duration(i%3) * time.Millisecond)
+		if _, err := wt.DelWait(&tl); err != nil {
+			t.Errorf("DelWait failed with %q\n", err)
+			break
+		}
+	}
+	close(stop)
+	<-done
+	if resets == 0 {
+		t.Errorf("no successful Reset()\n")
+	}
+}
+
+func TestWTDoubleAddSite(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var terr *TimerError
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	cfg := Config{Simulation: true, TrackAddSite: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	_, _, line, _ := runtime.Caller(0)
+	if err := wt.Add(&tl, time.Second, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	err := wt.Add(&tl, time.Second, f, nil)
+	if !errors.Is(err, ErrActiveTimer) || !errors.As(err, &terr) {
+		t.Fatalf("unexpected second Add result: %v\n", err)
+	}
+	site := fmt.Sprintf("wtimer_test.go:%d ", line+1)
+	if !strings.Contains(terr.AddSite, site) ||
+		!strings.Contains(err.Error(), site) {
+		t.Errorf("wrong add site %q (expected %q): %s\n",
+			terr.AddSite, site, err)
+	}
+	// not reported for other errors
+	wt.Del(&tl)
+	err = wt.SetInterval(&tl, time.Second)
+	if !errors.As(err, &terr) || terr.AddSite != "" {
+		t.Errorf("unexpected SetInterval error: %v\n", err)
+	}
+}
+
+func TestWTAddSites(t *testing.T) {
+	var wt WTimer
+	var tls [4]TimerLnk
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	cfg := Config{Simulation: true, TrackAddSite: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	_, _, line, _ := runtime.Caller(0)
+	for i := 0; i < 3; i++ {
+		wt.InitTimer(&tls[i], Ffast)
+		if err := wt.Add(&tls[i], time.Second, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	wt.InitTimer(&tls[3], Ffast)
+	if err := wt.Add(&tls[3], time.Second, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	site1 := fmt.Sprintf("wtimer_test.go:%d ", line+3)
+	site2 := fmt.Sprintf("wtimer_test.go:%d ", line+8)
+
+	sites := wt.AddSites()
+	if len(sites) != 2 || sites[0].Timers != 3 || sites[1].Timers != 1 ||
+		!strings.Contains(sites[0].Site, site1) ||
+		!strings.Contains(sites[1].Site, site2) {
+		t.Errorf("wrong add sites: %v\n", sites)
+	}
+	var b bytes.Buffer
+	if err := wt.Dump(&b); err != nil {
+		t.Fatalf("Dump failed: %s\n", err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "add sites (2):") ||
+		!strings.Contains(out, "added from ") ||
+		!strings.Contains(out, "    3: "+sites[0].Site) {
+		t.Errorf("add sites missing from the dump:\n%s\n", out)
+	}
+
+	var wt2 WTimer
+	wt2.Init(time.Millisecond)
+	if sites := wt2.AddSites(); sites != nil {
+		t.Errorf("add sites reported without TrackAddSite: %v\n", sites)
+	}
+}
+
+// steadyAllocs returns the average number of heap allocations performed
+// by f, after a warm-up run (see testing.AllocsPerRun()).
+func steadyAllocs(f func()) float64 {
+	return testing.AllocsPerRun(100, f)
+}
+
+func TestWTZeroAllocs(t *testing.T) {
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	fp := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return true, Periodic
+	}
+	fre := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		// re-add from the handler
+		if err := wt.Add(h, 2*time.Millisecond, f, p); err != nil {
+			return false, 0
+		}
+		return true, 0
+	}
+	arg := &struct{ n int }{}
+	for _, flags := range []uint8{Ffast, 0, FgoR} {
+		var wt WTimer
+		var tl, tp, tr TimerLnk
+
+		cfg := Config{Simulation: true}
+		if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		if n := steadyAllocs(func() {
+			wt.InitTimer(&tl, flags)
+			wt.Add(&tl, time.Hour, f, arg)
+			wt.Del(&tl)
+			wt.Reset(&tl, flags)
+			wt.Add(&tl, time.Hour, f, arg)
+			wt.DelWait(&tl)
+		}); n != 0 {
+			t.Errorf("flags 0x%x: %v allocations for add/del\n", flags, n)
+		}
+		if n := steadyAllocs(func() {
+			wt.InitTimer(&tl, flags)
+			wt.Add(&tl, time.Millisecond, f, arg)
+			wt.RunTicks(2)
+		}); n != 0 {
+			t.Errorf("flags 0x%x: %v allocations for add/run\n", flags, n)
+		}
+		wt.InitTimer(&tp, flags)
+		wt.InitTimer(&tr, flags)
+		if err := wt.Add(&tp, time.Millisecond, fp, arg); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if err := wt.Add(&tr, time.Millisecond, fre, arg); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		if n := steadyAllocs(func() { wt.RunTicks(1) }); n != 0 {
+			t.Errorf("flags 0x%x: %v allocations for re-arm\n", flags, n)
+		}
+		if tp.info.flags()&fActive == 0 || tr.info.flags()&fActive == 0 {
+			t.Errorf("flags 0x%x: periodic timers not active anymore\n",
+				flags)
+		}
+		wt.Shutdown()
+	}
+}
+
+// TestWTZeroAllocsStarted checks the steady state allocations on a
+// started (not simulated) timer wheel: the timers are run by the timer
+// goroutine (Ffast), by the run queues workers or by the FgoR runners.
+func TestWTZeroAllocsStarted(t *testing.T) {
+	done := make(chan struct{}, 1)
+	fp := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+		return true, Periodic
+	}
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	arg := &struct{ n int }{}
+	for _, flags := range []uint8{Ffast, 0, FgoR} {
+		var wt WTimer
+		var tp, tl TimerLnk
+
+		if err := wt.Init(time.Millisecond); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		wt.InitTimer(&tp, flags)
+		if err := wt.Add(&tp, time.Millisecond, fp, arg); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		<-done // started (the FgoR runner too)
+		before := wt.AllocStats()
+		if n := steadyAllocs(func() {
+			// wait for the next periodic run, meanwhile add and delete
+			wt.InitTimer(&tl, flags)
+			wt.Add(&tl, time.Hour, f, arg)
+			wt.DelWait(&tl)
+			<-done
+		}); n != 0 {
+			t.Errorf("flags 0x%x: %v allocations for run/re-arm\n", flags, n)
+		}
+		if s := wt.AllocStats(); s != before {
+			t.Errorf("flags 0x%x: allocation counters changed: %+v -> %+v\n",
+				flags, before, s)
+		}
+		wt.DelWait(&tp)
+		wt.Shutdown()
+	}
+}
+
+func TestWTAllocStats(t *testing.T) {
+	var wt WTimer
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	cfg := Config{Simulation: true, ProfLabels: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	if s := wt.AllocStats(); s != (AllocStats{}) {
+		t.Errorf("non-zero initial allocation counters: %+v\n", s)
+	}
+	tl := wt.NewTimer(Ffast)
+	if err := wt.SetDeadline(tl, time.Second); err != nil {
+		t.Fatalf("SetDeadline failed with %q\n", err)
+	}
+	if err := wt.Add(tl, time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(2)
+	exp := AllocStats{Timers: 1, Deadlines: 1, Labels: 1, Options: 1}
+	if s := wt.AllocStats(); runs != 1 || s != exp {
+		t.Errorf("unexpected allocation counters (%d runs): %+v\n", runs, s)
+	}
+	if s := wt.Stats(); s.Allocs != exp {
+		t.Errorf("wrong instance allocation counters: %+v\n", s.Allocs)
+	}
+	wt.Shutdown()
+}
+
+func TestWTLockOSThread(t *testing.T) {
+	var warns int32
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		p.(chan struct{}) <- struct{}{}
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		if f.Level == FaultWarn {
+			atomic.AddInt32(&warns, 1)
+		}
+		return FaultDefault
+	}
+	// lowering the priority (positive nice) does not need privileges
+	for _, cfg := range []Config{
+		{LockOSThread: true, FaultF: faultF},
+		{TickerNice: 1, FaultF: faultF},
+		{TickerNice: 1, Tickless: true, FaultF: faultF},
+	} {
+		var wt WTimer
+		var tl TimerLnk
+
+		if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		ch := make(chan struct{}, 1)
+		wt.InitTimer(&tl, Ffast)
+		if err := wt.Add(&tl, 5*time.Millisecond, f, ch); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Errorf("timer did not fire (%+v)\n", cfg)
+		}
+		wt.Shutdown()
+	}
+	if n := atomic.LoadInt32(&warns); n != 0 && runtime.GOOS == "linux" {
+		t.Errorf("unexpected warnings: %d\n", n)
+	}
+}
+
+func TestWTTimerFD(t *testing.T) {
+	if runtime.GOOS == "linux" {
+		tfd, err := newTimerFD(2 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("newTimerFD failed: %s\n", err)
+		}
+		start := time.Now()
+		var n uint64
+		for n < 10 {
+			e, err := tfd.wait()
+			if err != nil || e == 0 {
+				t.Fatalf("timerfd wait failed: %d, %v\n", e, err)
+			}
+			n += e
+		}
+		if d := time.Since(start); d < 18*time.Millisecond || d > time.Second {
+			t.Errorf("wrong timerfd period: %d ticks in %s\n", n, d)
+		}
+		tfd.close()
+		if _, err := tfd.wait(); err == nil {
+			t.Errorf("wait succeeded on closed timerfd\n")
+		}
+
+		// the timerfd loop returns the read errors (the timer goroutine
+		// then falls back to the portable loop), but not on Shutdown()
+		var wt WTimer
+		if err := wt.Init(time.Millisecond); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.cancel = make(chan struct{})
+		if err := wt.timerFDLoop(tfd); err == nil {
+			t.Errorf("timerfd loop did not fail on a closed timerfd\n")
+		}
+		if tfd, err = newTimerFD(time.Millisecond); err != nil {
+			t.Fatalf("newTimerFD failed: %s\n", err)
+		}
+		close(wt.cancel)
+		if err := wt.timerFDLoop(tfd); err != nil {
+			t.Errorf("timerfd loop failed on shutdown: %s\n", err)
+		}
+		wt.wg.Wait()
+	}
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		p.(chan struct{}) <- struct{}{}
+		return false, 0
+	}
+	for _, portable := range []bool{false, true} {
+		var wt WTimer
+		var tl TimerLnk
+
+		cfg := Config{PortableTicker: portable}
+		if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		wt.Start()
+		ch := make(chan struct{}, 1)
+		wt.InitTimer(&tl, Ffast)
+		start := time.Now()
+		if err := wt.Add(&tl, 20*time.Millisecond, f, ch); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+		select {
+		case <-ch:
+			if d := time.Since(start); d < 18*time.Millisecond {
+				t.Errorf("timer fired too early: %s (portable %v)\n",
+					d, portable)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timer did not fire (portable %v)\n", portable)
+		}
+		wt.Shutdown() // must not block
+	}
+}
+
+func TestWTHiResTicks(t *testing.T) {
+	for _, d := range []time.Duration{time.Millisecond, time.Second} {
+		end, err := beginHiResTicks(d)
+		if err != nil || end == nil {
+			t.Fatalf("beginHiResTicks(%s) failed: %v\n", d, err)
+		}
+		end()
+	}
+	var wt WTimer
+	var tl TimerLnk
+	ch := make(chan time.Duration, 1)
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		ch <- time.Since(p.(time.Time))
+		return false, 0
+	}
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 3*time.Millisecond, f, time.Now()); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	select {
+	case d := <-ch:
+		// with the default windows resolution it would be ~15ms
+		if d < 2*time.Millisecond || d > 100*time.Millisecond {
+			t.Errorf("wrong 3ms timer delay: %s\n", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timer did not fire\n")
+	}
+}
+
+func TestWTBusyPoll(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var warns int32
+
+	ch := make(chan time.Duration, 1)
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		ch <- time.Since(p.(time.Time))
+		return false, 0
+	}
+	faultF := func(wt *WTimer, f *Fault) FaultAction {
+		if f.Level == FaultWarn {
+			atomic.AddInt32(&warns, 1)
+		}
+		return FaultDefault
+	}
+	cfg := Config{BusyPoll: true, FaultF: faultF}
+	if runtime.GOOS == "linux" {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			cfg.CPUAffinity = append(cfg.CPUAffinity, i)
+		}
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, 5*time.Millisecond, f, time.Now()); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	select {
+	case d := <-ch:
+		if d < 4*time.Millisecond || d > 100*time.Millisecond {
+			t.Errorf("wrong 5ms timer delay: %s\n", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("timer did not fire\n")
+	}
+	wt.Shutdown() // must stop spinning
+	if n := atomic.LoadInt32(&warns); n != 0 {
+		t.Errorf("unexpected warnings: %d\n", n)
+	}
+	if err := setThreadAffinity([]int{-1}); err == nil {
+		t.Errorf("invalid CPU affinity accepted\n")
+	}
+}
+
+func TestWTWorkerSpin(t *testing.T) {
+	var wt WTimer
+	var runs int32
+	const n = 200
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.AddInt32(&runs, 1)
+		return false, 0
+	}
+	cfg := Config{WorkerSpin: 200 * time.Microsecond}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	tls := make([]TimerLnk, n)
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		wt.SetPriority(&tls[i], Priority(i%int(PrioNo)))
+		d := time.Duration(1+i%20) * time.Millisecond
+		if err := wt.Add(&tls[i], d, f, nil); err != nil {
+			t.Fatalf("Add  failed with %q\n", err)
+		}
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&runs) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := atomic.LoadInt32(&runs); r != n {
+		t.Errorf("only %d timers from %d were run\n", r, n)
+	}
+	for i := range wt.rClasses {
+		if s := atomic.LoadInt32(&wt.rClasses[i].spinning); s < 0 {
+			t.Errorf("class %d: invalid spinning workers count %d\n", i, s)
+		}
+	}
+
+	// spinning stops after 1/16 WorkerSpin without work
+	var cls [PrioNo]*runClass
+	cls[0] = &wt.rClasses[PrioLow]
+	spin := cfg.WorkerSpin
+	for i := 0; i < 10; i++ {
+		if wt.spinForWork(&cls, &spin) {
+			t.Errorf("work found on idle timer wheel\n")
+		}
+	}
+	if spin != cfg.WorkerSpin/16 {
+		t.Errorf("spin time not adapted: %s\n", spin)
+	}
+}
+
+func TestWTResizeRunQueues(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int32
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		atomic.AddInt32(&runs, 1)
+		return false, 0
+	}
+	procs := runtime.GOMAXPROCS(1)
+	defer runtime.GOMAXPROCS(procs)
+
+	cfg := Config{Simulation: true}
+	cfg.RunQueues[PrioLow] = RunQueueCfg{Queues: 3, Workers: 1}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if n := wt.rClasses[PrioNormal].n; n != minAutoQueues {
+		t.Errorf("wrong normal run queues number for 1 proc: %d\n", n)
+	}
+	runtime.GOMAXPROCS(16)
+	if err := wt.ResizeRunQueues(); err != nil {
+		t.Fatalf("ResizeRunQueues failed: %s\n", err)
+	}
+	if c := &wt.rClasses[PrioNormal]; c.n != 16 || c.workers != 16 {
+		t.Errorf("wrong normal run queues for 16 procs: %d/%d\n",
+			c.n, c.workers)
+	}
+	if n := wt.rClasses[PrioHigh].n; n != 4 {
+		t.Errorf("wrong high run queues number for 16 procs: %d\n", n)
+	}
+	if c := &wt.rClasses[PrioLow]; c.n != 3 || c.workers != 1 {
+		t.Errorf("configured low run queues changed: %d/%d\n",
+			c.n, c.workers)
+	}
+
+	wt.Start()
+	defer wt.Shutdown()
+	if err := wt.ResizeRunQueues(); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("ResizeRunQueues on running timer wheel: %v\n", err)
+	}
+	wt.InitTimer(&tl, 0)
+	if err := wt.Add(&tl, 2*time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(5)
+	if r := atomic.LoadInt32(&runs); r != 1 {
+		t.Errorf("timer run %d times\n", r)
+	}
+}
+
+func TestWTRetrans(t *testing.T) {
+	var wt WTimer
+	var reqs [3]Retrans
+	var sent [len(reqs)][]Ticks
+	var failed [len(reqs)]Ticks
+
+	tick := 10 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{Simulation: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+
+	retr := func(wt *WTimer, r *Retrans, n int, arg interface{}) bool {
+		i := arg.(int)
+		sent[i] = append(sent[i], wt.Now())
+		if n != len(sent[i]) || r.Retransmissions() != n {
+			t.Errorf("req %d: wrong retransmission number %d\n", i, n)
+		}
+		return true
+	}
+	fail := func(wt *WTimer, r *Retrans, arg interface{}) {
+		failed[arg.(int)] = wt.Now()
+	}
+	// SIP like: T1 = 5 ticks, T2 = 20 ticks, Timer B = 64*T1
+	sip := RetransCfg{RTO: 5 * tick, MaxRTO: 20 * tick,
+		Timeout: 64 * 5 * tick, Retransmit: retr, Fail: fail}
+	// DNS like: 2 retries
+	dns := RetransCfg{RTO: 5 * tick, MaxRetrans: 2, Retransmit: retr,
+		Fail: fail}
+	if err := wt.StartRetrans(&reqs[0], &RetransCfg{RTO: tick,
+		Retransmit: retr}, 0); err == nil {
+		t.Fatalf("StartRetrans accepted an unlimited schedule\n")
+	}
+	start := wt.Now()
+	for i, cfg := range [len(reqs)]*RetransCfg{&sip, &dns, &sip} {
+		if err := wt.StartRetrans(&reqs[i], cfg, i); err != nil {
+			t.Fatalf("StartRetrans failed: %s\n", err)
+		}
+	}
+	wt.RunTicks(30)
+	if ok, err := wt.StopRetrans(&reqs[2]); !ok || err != nil {
+		t.Fatalf("StopRetrans failed: %v, %v\n", ok, err)
+	}
+	wt.RunTicks(400)
+
+	exp := [len(reqs)][]uint64{
+		{5, 15, 35, 55, 75, 95, 115, 135, 155, 175, 195, 215, 235, 255,
+			275, 295, 315},
+		{5, 15},
+		{5, 15},
+	}
+	for i := range reqs {
+		if len(sent[i]) != len(exp[i]) {
+			t.Fatalf("req %d: %d retransmissions instead of %d: %v\n",
+				i, len(sent[i]), len(exp[i]), sent[i])
+		}
+		for j, ts := range sent[i] {
+			if ts.Sub(start).Val() != exp[i][j] {
+				t.Errorf("req %d: retransmission %d at %d instead of %d\n",
+					i, j+1, ts.Sub(start).Val(), exp[i][j])
+			}
+		}
+	}
+	if d := failed[0].Sub(start).Val(); d != 320 {
+		t.Errorf("SIP request failed at %d instead of 320\n", d)
+	}
+	if d := failed[1].Sub(start).Val(); d != 35 {
+		t.Errorf("DNS request failed at %d instead of 35\n", d)
+	}
+	if failed[2] != (Ticks{}) {
+		t.Errorf("stopped request failed\n")
+	}
+	if wt.Len() != 0 {
+		t.Errorf("timers left: %d\n", wt.Len())
+	}
+	// re-use
+	sent[1] = nil
+	if err := wt.StartRetrans(&reqs[1], &dns, 1); err != nil {
+		t.Fatalf("StartRetrans on a failed request failed: %s\n", err)
+	}
+	wt.RunTicks(5)
+	if len(sent[1]) != 1 {
+		t.Errorf("re-used request not retransmitted: %v\n", sent[1])
+	}
+}
+
+func TestWTAbsTicks(t *testing.T) {
+	var wt WTimer
+
+	tick := 5 * time.Millisecond
+	if err := wt.InitCfg(tick, &Config{PortableTicker: true}); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	start := wt.timeNow()
+	t0 := wt.Now()
+	wt.Start()
+	time.Sleep(300 * time.Millisecond)
+	wt.Shutdown()
+	exp, _ := wt.Ticks(wt.timeNow().Sub(start))
+	if n := wt.Now().Sub(t0).Val(); n+3 < exp.Val() || n > exp.Val()+1 {
+		t.Errorf("%d ticks run instead of ~%d\n", n, exp.Val())
+	}
+	if off := wt.lastTickT.Sub(wt.refTS) % tick; off != 0 {
+		t.Errorf("ticks out of phase with %s\n", off)
+	}
+
+	now := wt.timeNow()
+	wt.lastTickT = now
+	if w := wt.nextTickWait(); w <= 0 || w > tick {
+		t.Errorf("unexpected wait for the next tick: %s\n", w)
+	}
+	wt.lastTickT = now.Add(-3 * tick)
+	if w := wt.nextTickWait(); w != 0 {
+		t.Errorf("unexpected wait for a late tick: %s\n", w)
+	}
+	wt.lastTickT = now.Add(10 * tick) // time went backwards
+	if w := wt.nextTickWait(); w != tick {
+		t.Errorf("unexpected wait after a backward step: %s\n", w)
+	}
+}
+
+func TestWTClockEvents(t *testing.T) {
+	var wt WTimer
+	var c testClock
+	var evs []ClockEvent
+	var ds []time.Duration
+
+	c.ts = timestamp.Now()
+	tick := 10 * time.Millisecond
+	cfg := Config{Clock: &c, ClockBackResync: 3,
+		ClockEventF: func(wt *WTimer, ev ClockEvent, d time.Duration) {
+			evs = append(evs, ev)
+			ds = append(ds, d)
+		}}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.lastTickT = wt.timeNow()
+	wt.refTS = wt.lastTickT
+	wt.refTicks = wt.Now()
+
+	// ticks lost (e.g. VM pause), reported once
+	c.advance(100 * tick)
+	wt.ticker()
+	c.advance(tick)
+	wt.ticker()
+	c.advance(100 * tick)
+	wt.ticker()
+	// ticks ahead of the time source
+	wt.refTS = wt.refTS.Add(10 * tick)
+	c.advance(tick)
+	wt.ticker()
+	wt.ticker()
+	wt.refTS = wt.refTS.Add(-10 * tick)
+	c.advance(tick)
+	wt.ticker()
+	// time going backwards, until re-synchronised
+	c.advance(-5 * time.Second)
+	for i := 0; i <= cfg.ClockBackResync; i++ {
+		wt.ticker()
+	}
+
+	expEvs := []ClockEvent{ClockSlow, ClockSlow, ClockFast, ClockBackward,
+		ClockResync}
+	if !reflect.DeepEqual(evs, expEvs) {
+		t.Fatalf("unexpected events %v (%v) instead of %v\n",
+			evs, ds, expEvs)
+	}
+	if ds[0] != 100*tick || ds[1] != 100*tick || ds[2] < 9*tick ||
+		ds[3] > -4*time.Second || ds[4] > -4*time.Second {
+		t.Errorf("unexpected events values %v\n", ds)
+	}
+	exp := ClockStats{Backward: 4, Resyncs: 1, Slow: 2, SlowTicks: 200,
+		Fast: 1, FastTicks: uint64(ds[2] / tick)}
+	if s := wt.ClockStats(); s != exp {
+		t.Errorf("unexpected stats %+v instead of %+v\n", s, exp)
+	}
+	if s := wt.Stats(); s.Clock != exp {
+		t.Errorf("unexpected instance stats %+v\n", s.Clock)
+	}
+	for ev := ClockBackward; ev <= ClockFast; ev++ {
+		if ev.String() == "invalid" {
+			t.Errorf("no name for event %d\n", ev)
+		}
+	}
+}
+
+func TestWTTickStats(t *testing.T) {
+	var wt WTimer
+	var h tickHist
+
+	for _, d := range []time.Duration{0, 500 * time.Nanosecond,
+		time.Microsecond, 3 * time.Microsecond, 30 * time.Millisecond,
+		time.Hour} {
+		h.record(d)
+	}
+	s := h.get()
+	exp := [TickHistBuckets]uint64{0: 2, 1: 1, 2: 1, 15: 1,
+		TickHistBuckets - 1: 1}
+	if s.Counts != exp || s.N() != 6 || s.Max != time.Hour {
+		t.Fatalf("unexpected histogram %+v\n", s)
+	}
+	if q := s.Quantile(0.5); q != 2*time.Microsecond {
+		t.Errorf("unexpected median %s\n", q)
+	}
+	if q := s.Quantile(0.8); q != TickHistBound(15) ||
+		TickHistBound(15) < 30*time.Millisecond {
+		t.Errorf("unexpected 0.8 quantile %s\n", q)
+	}
+	if q := s.Quantile(1); q != time.Hour {
+		t.Errorf("unexpected max quantile %s\n", q)
+	}
+	if TickHistBound(TickHistBuckets-1) != 0 {
+		t.Errorf("last bucket bounded\n")
+	}
+
+	tick := time.Millisecond
+	if err := wt.Init(tick); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	t0 := wt.Now()
+	wt.Start()
+	time.Sleep(200 * time.Millisecond)
+	wt.Shutdown()
+	ts := wt.TickStats()
+	n := wt.Now().Sub(t0).Val()
+	if ts.Proc.N() == 0 || ts.Proc.N() > n+1 || ts.Jitter.N() == 0 ||
+		ts.Jitter.N() >= ts.Proc.N() {
+		t.Errorf("unexpected ticks measured: %d proc, %d jitter,"+
+			" %d ticks\n", ts.Proc.N(), ts.Jitter.N(), n)
+	}
+	if ts.Proc.Mean() <= 0 || ts.Proc.Mean() > ts.Proc.Max ||
+		ts.Proc.Quantile(0.99) > ts.Proc.Max {
+		t.Errorf("unexpected processing stats: mean %s, max %s\n",
+			ts.Proc.Mean(), ts.Proc.Max)
+	}
+	if s := wt.Stats(); s.Ticks.Proc.N() != ts.Proc.N() {
+		t.Errorf("unexpected instance stats %+v\n", s.Ticks)
+	}
+	t.Logf("tick proc mean %s p99 %s max %s, jitter mean %s p99 %s\n",
+		ts.Proc.Mean(), ts.Proc.Quantile(0.99), ts.Proc.Max,
+		ts.Jitter.Mean(), ts.Jitter.Quantile(0.99))
+}
+
+func TestWTWorkerStats(t *testing.T) {
+	var wt WTimer
+	var wg sync.WaitGroup
+
+	cfg := Config{
+		RunQueues: [PrioNo]RunQueueCfg{
+			PrioHigh:   {Queues: 1, Workers: 1},
+			PrioNormal: {Queues: 2, Workers: 2},
+			PrioLow:    {Queues: 1, Workers: 1},
+		},
+		RunClasses: []RunClassCfg{{Name: "slow", Queues: 1, Workers: 1}},
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	ws := wt.WorkerStats()
+	if len(ws) != 5 || ws[0].Class != PrioNormal.String() ||
+		ws[4].Class != "slow" {
+		t.Fatalf("unexpected workers %+v\n", ws)
+	}
+	wt.Start()
+	const n = 100
+	const hDuration = 100 * time.Microsecond
+	tls := make([]TimerLnk, n)
+	h := func(wt *WTimer, tl *TimerLnk, p interface{}) (bool, time.Duration) {
+		time.Sleep(hDuration)
+		wg.Done()
+		return false, 0
+	}
+	wg.Add(n)
+	for i := range tls {
+		if err := wt.InitTimer(&tls[i], 0); err != nil {
+			t.Fatalf("InitTimer failed: %s\n", err)
+		}
+		if i%10 == 0 {
+			wt.SetRunClass(&tls[i], "slow")
+		}
+		if err := wt.Add(&tls[i], time.Duration(i%5+1)*time.Millisecond,
+			h, nil); err != nil {
+			t.Fatalf("Add failed: %s\n", err)
+		}
+	}
+	wg.Wait()
+	wt.Shutdown()
+
+	var handled, wakeups, idle uint64
+	var busy time.Duration
+	ws = wt.WorkerStats()
+	for _, w := range ws {
+		handled += w.Handled
+		wakeups += w.Wakeups
+		idle += w.Idle
+		busy += w.Busy
+	}
+	if handled != n || ws[4].Handled != n/10 {
+		t.Errorf("unexpected handled timers %d (%d slow)\n",
+			handled, ws[4].Handled)
+	}
+	if wakeups == 0 || idle > wakeups || busy < n*hDuration {
+		t.Errorf("unexpected utilization: %d wakeups, %d idle, %s busy\n",
+			wakeups, idle, busy)
+	}
+	if s := wt.Stats(); len(s.Workers) != len(ws) {
+		t.Errorf("unexpected instance stats %+v\n", s.Workers)
+	}
+	t.Logf("workers: %+v\n", ws)
+}
+
+func TestWTRunQueueDepths(t *testing.T) {
+	var wt WTimer
+	var first, afterDel []RunQueueDepth
+
+	cfg := Config{
+		RunQueues: [PrioNo]RunQueueCfg{
+			PrioHigh:   {Queues: 1, Workers: 1},
+			PrioNormal: {Queues: 2, Workers: 2},
+			PrioLow:    {Queues: 1, Workers: 1},
+		},
+		RunClasses: []RunClassCfg{{Name: "slow", Queues: 1, Workers: 1}},
+		Simulation: true,
+	}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	const n = 10
+	tls := make([]TimerLnk, n)
+	// the normal priority handlers run first (simulation order), while
+	// the slow class handlers are still queued
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		if first == nil {
+			first = wt.RunQueueDepths()
+			wt.Del(&tls[0])
+			afterDel = wt.RunQueueDepths()
+		}
+		return false, 0
+	}
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if i < 4 {
+			wt.SetRunClass(&tls[i], "slow")
+		}
+		if err := wt.Add(&tls[i], time.Millisecond, f, nil); err != nil {
+			t.Fatalf("Add failed: %s\n", err)
+		}
+	}
+	wt.RunTicks(1)
+	d := first
+	if len(d) != 5 || d[4].Class != "slow" || d[4].Depth != 4 ||
+		d[4].MaxDepth != 4 || d[0].Depth+d[1].Depth != n-4-1 ||
+		d[0].MaxDepth+d[1].MaxDepth != n-4 ||
+		d[0].Class != PrioNormal.String() || d[1].Queue != 1 {
+		t.Fatalf("unexpected run queues depths %+v\n", d)
+	}
+	if d = afterDel; d[4].Depth != 3 || d[4].MaxDepth != 4 {
+		t.Errorf("unexpected depth after Del: %+v\n", d[4])
+	}
+	d = wt.RunQueueDepths()
+	max := 0
+	for _, q := range d {
+		if q.Depth != 0 {
+			t.Errorf("run queue not empty: %+v\n", q)
+		}
+		max += q.MaxDepth
+	}
+	if max != n {
+		t.Errorf("unexpected maximum depths %+v\n", d)
+	}
+	if s := wt.Stats(); len(s.Queues) != len(d) {
+		t.Errorf("unexpected instance stats %+v\n", s.Queues)
+	}
+}
+
+func TestWTSaturation(t *testing.T) {
+	var wt WTimer
+
+	type alert struct {
+		tick uint64
+		a    SaturationAlert
+		on   bool
+		v    int
+	}
+	var alerts []alert
+	tick := 10 * time.Millisecond
+	cfg := Config{
+		Simulation: true,
+		RunBudget:  2,
+		Saturation: SaturationCfg{
+			RunQueueDepth:  2,
+			ExpiredBacklog: 4,
+			LateFire:       tick,
+			LateRate:       4,
+			Interval:       10 * tick,
+			F: func(wt *WTimer, a SaturationAlert, on bool, v int) {
+				alerts = append(alerts, alert{wt.Now().Val(), a, on, v})
+			},
+		},
+	}
+	if err := wt.InitCfg(tick, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	defer wt.Shutdown()
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		return false, 0
+	}
+	// 10 timers expiring on the same tick, dispatched 2 per tick
+	tls := make([]TimerLnk, 10)
+	for i := range tls {
+		wt.InitTimer(&tls[i], 0)
+		if err := wt.Add(&tls[i], tick, f, nil); err != nil {
+			t.Fatalf("Add failed: %s\n", err)
+		}
+	}
+	wt.RunTicks(1)
+	if !wt.Saturated(SatRunQueues) || !wt.Saturated(SatExpired) ||
+		wt.Saturated(SatLateFires) {
+		t.Errorf("unexpected saturation state after the first tick\n")
+	}
+	wt.RunTicks(14)
+	if !wt.Saturated(SatLateFires) || wt.Saturated(SatExpired) {
+		t.Errorf("unexpected saturation state after 15 ticks\n")
+	}
+	wt.RunTicks(10)
+	exp := []alert{
+		{1, SatRunQueues, true, 2},
+		{1, SatExpired, true, 4}, // counted up to the threshold
+		{5, SatExpired, false, 0},
+		{6, SatRunQueues, false, 0},
+		{10, SatLateFires, true, 6}, // run on ticks 3, 4 and 5
+		{20, SatLateFires, false, 0},
+	}
+	if len(alerts) != len(exp) {
+		t.Fatalf("unexpected alerts %+v\n", alerts)
+	}
+	for i := range exp {
+		if alerts[i] != exp[i] {
+			t.Errorf("alert %d: %+v instead of %+v\n", i, alerts[i], exp[i])
+		}
+	}
+	if SatLateFires.String() != "late_fires" {
+		t.Errorf("unexpected alert name %q\n", SatLateFires)
+	}
+}
+
+func TestWTRunQueueSignal(t *testing.T) {
+	bad := []Config{
+		{RunQueueSignalCap: -1},
+		{RunQueueSignal: SignalToken + 1},
+	}
+	for i := range bad {
+		var wt WTimer
+		if err := wt.InitCfg(time.Millisecond, &bad[i]); err == nil {
+			t.Errorf("invalid signal config %d accepted\n", i)
+		}
+	}
+
+	for _, pol := range []SignalPolicy{SignalDrop, SignalBlock, SignalToken} {
+		var wt WTimer
+		var wg sync.WaitGroup
+
+		cfg := Config{
+			RunQueues: [PrioNo]RunQueueCfg{
+				PrioHigh:   {Queues: 1, Workers: 1},
+				PrioNormal: {Queues: 4, Workers: 4},
+				PrioLow:    {Queues: 1, Workers: 1},
+			},
+			RunQueueSignalCap:  1,
+			RunQueueSignal:     pol,
+			RunQueueSignalWait: 100 * time.Millisecond,
+		}
+		if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+			t.Fatalf("WTimer init failure: %s\n", err)
+		}
+		if c := cap(wt.rClasses[PrioNormal].ch); c != 1 {
+			t.Errorf("%s: unexpected signal channel capacity %d\n", pol, c)
+		}
+		wt.Start()
+		const n = 200
+		tls := make([]TimerLnk, n)
+		h := func(wt *WTimer, tl *TimerLnk, p interface{}) (bool, time.Duration) {
+			time.Sleep(100 * time.Microsecond)
+			wg.Done()
+			return false, 0
+		}
+		wg.Add(n)
+		for i := range tls {
+			wt.InitTimer(&tls[i], 0)
+			if err := wt.Add(&tls[i], time.Duration(i%4+1)*time.Millisecond,
+				h, nil); err != nil {
+				t.Fatalf("Add failed: %s\n", err)
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: handlers not run\n", pol)
+		}
+		wt.Shutdown()
+		if s := wt.RunQueueStats(); pol == SignalToken && s.SigDrops != 0 {
+			t.Errorf("%s: %d signals dropped\n", pol, s.SigDrops)
+		}
+		t.Logf("%s: %+v\n", pol, wt.RunQueueStats())
+	}
+
+	var wt WTimer
+	if err := wt.Init(time.Millisecond); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	if c := cap(wt.rClasses[PrioHigh].ch); c !=
+		wt.rClasses[PrioHigh].served*defaultSignalsPerWorker {
+		t.Errorf("unexpected default signal channel capacity %d\n", c)
+	}
+}
+
+func TestWTSizes(t *testing.T) {
+	// the optional features state is kept out of line (timerExt) and
+	// there is a list head for each wheel slot (wTotalEntries), so the
+	// size of TimerLnk and timerLst must not grow back
+	const maxTimerLnk = 104
+	if sz := unsafe.Sizeof(TimerLnk{}); sz > maxTimerLnk {
+		t.Errorf("TimerLnk size %d > %d\n", sz, maxTimerLnk)
+	}
+	if sz := unsafe.Sizeof(timerLst{}); sz > maxTimerLnk+8 {
+		t.Errorf("timerLst size %d > %d\n", sz, maxTimerLnk+8)
+	}
+	if sz := unsafe.Sizeof(WTimer{}.wlists); sz > wTotalEntries*
+		(maxTimerLnk+8) {
+		t.Errorf("wheel lists size %d for %d lists\n", sz, wTotalEntries)
+	}
+}
+
+func TestWTTimerExt(t *testing.T) {
+	var wt WTimer
+	var tl TimerLnk
+	var runs int
+
+	f := func(wt *WTimer, h *TimerLnk, p interface{}) (bool, time.Duration) {
+		runs++
+		return false, 0
+	}
+
+	cfg := Config{Simulation: true}
+	if err := wt.InitCfg(time.Millisecond, &cfg); err != nil {
+		t.Fatalf("WTimer init failure: %s\n", err)
+	}
+	wt.Start()
+	// no optional feature => no optional state
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.Add(&tl, time.Millisecond, f, nil); err != nil {
+		t.Fatalf("Add  failed with %q\n", err)
+	}
+	wt.RunTicks(2)
+	if runs != 1 || tl.ext() != nil || wt.AllocStats().Options != 0 {
+		t.Fatalf("optional state allocated for a plain timer: %d runs,"+
+			" %+v\n", runs, wt.AllocStats())
+	}
+	wt.InitTimer(&tl, Ffast)
+	if err := wt.SetTag(&tl, "tag"); err != nil {
+		t.Fatalf("SetTag failed with %q\n", err)
+	}
+	x := tl.ext()
+	if x == nil || tl.Tag() != "tag" || wt.AllocStats().Options != 1 {
+		t.Fatalf("optional state not allocated by SetTag(): %+v\n",
+			wt.AllocStats())
+	}
+	// kept, but cleared, by InitTimer()
+	wt.InitTimer(&tl, Ffast)
+	if tl.ext() != x || tl.Tag() != nil {
+		t.Errorf("optional state not re-used: %p / %p, tag %v\n",
+			tl.ext(), x, tl.Tag())
+	}
+	if n := steadyAllocs(func() {
+		wt.InitTimer(&tl, Ffast)
+		wt.SetTag(&tl, "tag")
+		wt.SetPriority(&tl, PrioHigh)
+		wt.Add(&tl, time.Millisecond, f, nil)
+		wt.RunTicks(2)
+	}); n != 0 || wt.AllocStats().Options != 1 {
+		t.Errorf("%v allocations for re-initialised timers with options:"+
+			" %+v\n", n, wt.AllocStats())
+	}
+	wt.Shutdown()
+}
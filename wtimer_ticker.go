@@ -7,64 +7,144 @@
 package wtimer
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/intuitivelabs/timestamp"
 )
 
+// default number of consecutive ticks with the time going backwards after
+// which the time reference is re-initialised (see Config.ClockBackResync)
+const defaultClockBackResync = 10
+
+// A ClockStepHandlerF is called for each detected system clock step
+// (see Config.ClockStepF). step is the clock jump: negative for a
+// backward step and, for a forward step, the time since the previous
+// tick, minus the tick duration.
+type ClockStepHandlerF func(wt *WTimer, step time.Duration)
+
+// clockStep reports a detected clock step, if larger then
+// Config.ClockStepThreshold.
+func (wt *WTimer) clockStep(step time.Duration) {
+	if wt.cfg.ClockStepF == nil {
+		return
+	}
+	abs := step
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs >= wt.cfg.ClockStepThreshold {
+		wt.cfg.ClockStepF(wt, step)
+	}
+}
+
+// setRef sets the time reference used for computing the timers expire
+// (see addUnsafe()): the time ts corresponds to the ticks value ticks.
+// refTS and refTicks are read under wt.rlock() by addUnsafe(), so they are
+// written only under wt.lock(). Since the timer goroutine is their only
+// writer once started, it can read them without locking.
+// It must not be called with wt.lock() held.
+func (wt *WTimer) setRef(ts timestamp.TS, ticks Ticks) {
+	wt.lock()
+	wt.refTS = ts
+	wt.refTicks = ticks
+	wt.unlock()
+}
+
 // ticker should be called periodically, ideally at each tick duration
 // _must_ not ever be called in parallel.
 func (wt *WTimer) ticker() uint64 {
-	now := timestamp.Now()
+	return wt.tickAt(wt.timeNow())
+}
+
+// tickAt is similar to ticker(), but uses now as the current time.
+// It has the same restrictions as ticker().
+func (wt *WTimer) tickAt(now timestamp.TS) uint64 {
+	start := time.Now() // real time, see TickStats
+	wt.tickStart(start)
+	n := wt.advanceTicks(now)
+	wt.tickProc.record(time.Since(start))
+	return n
+}
+
+// advanceTicks advances the time to now (see tickAt()), handling the time
+// source anomalies.
+func (wt *WTimer) advanceTicks(now timestamp.TS) uint64 {
 	if now.Before(wt.lastTickT) {
 		// time going backwards!!
 		wt.badTime++
-		if wt.badTime > 10 {
+		atomic.AddUint64(&wt.clkBackward, 1)
+		if wt.badTime == 1 {
+			wt.clockStep(now.Sub(wt.lastTickT))
+			wt.clockEvent(ClockBackward, now.Sub(wt.lastTickT))
+		}
+		resync := wt.cfg.ClockBackResync
+		if resync <= 0 {
+			resync = defaultClockBackResync
+		}
+		if wt.badTime > uint32(resync) {
 			// re-init
-			if ERRon() {
-				ERR("trying to recover after time going backward %d times"+
+			if wt.errOn() {
+				wt.err("trying to recover after time going backward %d times"+
 					" with %s\n",
 					wt.badTime, wt.lastTickT.Sub(now))
 			}
+			atomic.AddUint64(&wt.clkResyncs, 1)
+			wt.clockEvent(ClockResync, now.Sub(wt.lastTickT))
 			wt.lastTickT = now
-			wt.refTS = wt.lastTickT
-			wt.refTicks = wt.Now()
-		} else if DBGon() {
-			DBG("ticker: time going backward with %s (%d times)\n",
+			wt.setRef(now, wt.Now())
+		} else if wt.dbgOn() {
+			wt.dbg("ticker: time going backward with %s (%d times)\n",
 				wt.lastTickT.Sub(now), wt.badTime)
 		}
 		return 0
 	}
 	wt.badTime = 0
+	if wt.cfg.ClockStepThreshold > 0 && !wt.cfg.Tickless {
+		if step := now.Sub(wt.lastTickT) - wt.tickDuration; step > 0 {
+			wt.clockStep(step)
+		}
+	}
+	wt.checkSuspend(now)
 	if now.Sub(wt.refTS)/wt.tickDuration > (MaxTicksDiff - 2) {
-		if DBGon() {
-			DBG("ticker: ticks ref value overflowing after %s"+
+		if wt.dbgOn() {
+			wt.dbg("ticker: ticks ref value overflowing after %s"+
 				" (max ticks %d) -> re-adjusting\n",
-				now.Sub(wt.refTS), MaxTicksDiff)
+				now.Sub(wt.refTS), uint64(MaxTicksDiff))
 		}
+		atomic.AddUint64(&wt.clkReanchors, 1)
+		wt.clockEvent(ClockReanchor, now.Sub(wt.refTS))
 		// re-init, we risk overflowing the ticks
 		// new ref. ts = last tick ts
 		// new ref ticks = current tick - Ticks(now - last tick ts)
 		diff, _ := wt.Ticks(now.Sub(wt.lastTickT))
-		wt.refTS = wt.lastTickT
-		wt.refTicks = wt.Now().Sub(diff)
+		wt.setRef(wt.lastTickT, wt.Now().Sub(diff))
 	}
 
 	runTime := now.Sub(wt.refTS)
 	runTicks := wt.Now().Sub(wt.refTicks)
-	if runTime > wt.Duration(runTicks.AddUint64(1+20)) {
-		if DBGon() {
-			lost, _ := wt.Ticks(runTime - wt.Duration(runTicks))
-			DBG("ticker: lost ticks since start-up: too slow:"+
+	if wt.cfg.Tickless {
+		// in tickless mode the time is advanced only on wake up =>
+		// no lost ticks checks
+	} else if runTime > wt.Duration(runTicks.AddUint64(1+20)) {
+		lost, _ := wt.Ticks(runTime - wt.Duration(runTicks))
+		wt.clockDrift(clkSlow, lost)
+		if wt.dbgOn() {
+			wt.dbg("ticker: lost ticks since start-up: too slow:"+
 				" ticks diff %d = %s, but time diff %s => lost %d ticks\n",
 				runTicks.Val(), wt.Duration(runTicks), runTime, lost.Val())
 		}
 	} else if runTicks.Val() > 1 &&
 		runTime < wt.Duration(runTicks.SubUint64(1)) {
-		if DBGon() {
-			faster, _ := wt.Ticks(wt.Duration(runTicks) - runTime)
-			DBG("ticker: lost ticks since start-up: too fast:"+
+		faster, _ := wt.Ticks(wt.Duration(runTicks) - runTime)
+		wt.clockDrift(clkFast, faster)
+		if wt.dbgOn() {
+			wt.dbg("ticker: lost ticks since start-up: too fast:"+
 				" ticks diff %d = %s time  diff %s => faster with %d ticks\n",
 				runTicks.Val(), wt.Duration(runTicks), runTime, faster.Val())
 		}
+	} else {
+		wt.clockDrift(clkInSync, Ticks{})
 	}
 	diff := now.Sub(wt.lastTickT)
 	if diff < wt.tickDuration {
@@ -74,6 +154,11 @@ func (wt *WTimer) ticker() uint64 {
 	ticks, rest := wt.Ticks(diff)
 
 	wt.lastTickT = now.Add(-rest)
-	wt.advanceTimeTo(wt.Now().Add(ticks))
+	if wt.cfg.Tickless {
+		// lost ticks are normal in tickless mode
+		wt.advanceTimeTo(wt.Now().Add(ticks))
+	} else {
+		wt.catchUpTo(wt.Now().Add(ticks))
+	}
 	return ticks.Val()
 }